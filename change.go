@@ -0,0 +1,38 @@
+package items
+
+import (
+	"fmt"
+	"time"
+)
+
+//ChangeOp is the kind of change made to an item in a store
+type ChangeOp string
+
+//Change operations
+const (
+	ChangeAdd ChangeOp = "add"
+	ChangeUpd ChangeOp = "upd"
+	ChangeDel ChangeOp = "del"
+)
+
+//Change describes one change made to a store
+//Seq is assigned by the store and increases with every change
+type Change struct {
+	Seq  uint64    `json:"seq"`
+	Op   ChangeOp  `json:"op"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+//ErrChangeGap is returned by ChangesSince() when the store cannot
+//provide all changes after the requested sequence, e.g. because the
+//log was trimmed. The consumer must then do a full resync.
+type ErrChangeGap struct {
+	Since uint64 //requested sequence
+	First uint64 //first sequence still in the log (0 if empty)
+	Last  uint64 //last sequence in the log
+}
+
+func (e ErrChangeGap) Error() string {
+	return fmt.Sprintf("changes since seq=%d not available (log has seq %d..%d)", e.Since, e.First, e.Last)
+}
@@ -3,8 +3,10 @@ module github.com/jansemmelink/items2
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/satori/uuid v1.2.0
-	github.com/stewelarend/logger v0.0.3 // indirect
+	github.com/stewelarend/logger v0.0.3
 	golang.org/x/sys v0.0.0-20191020212454-3e7259c5e7c2 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,111 @@
+package items
+
+import (
+	"sync"
+
+	"github.com/stewelarend/logger"
+)
+
+//BeforeAddFunc is a store-level hook that can reject a new item
+type BeforeAddFunc func(item IItem) error
+
+//BeforeUpdFunc is a store-level hook that can reject an update
+type BeforeUpdFunc func(id string, old IItem, new IItem) error
+
+//BeforeDelFunc is a store-level hook that can reject a delete
+type BeforeDelFunc func(id string, item IItem) error
+
+//Hooks are evaluated by a store before it makes a change, first the
+//optional IItemWithBeforeAdd/Upd/Del method on the item, then the
+//registered hooks in the order they were registered.
+//Hooks are called with the store locked and must not use the store.
+type Hooks struct {
+	mutex     sync.Mutex
+	beforeAdd []BeforeAddFunc
+	beforeUpd []BeforeUpdFunc
+	beforeDel []BeforeDelFunc
+}
+
+//NewHooks makes an empty set of hooks
+func NewHooks() *Hooks {
+	return &Hooks{
+		beforeAdd: make([]BeforeAddFunc, 0),
+		beforeUpd: make([]BeforeUpdFunc, 0),
+		beforeDel: make([]BeforeDelFunc, 0),
+	}
+}
+
+//BeforeAdd registers a hook called before an item is added
+func (h *Hooks) BeforeAdd(f BeforeAddFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.beforeAdd = append(h.beforeAdd, f)
+}
+
+//BeforeUpd registers a hook called before an item is updated
+func (h *Hooks) BeforeUpd(f BeforeUpdFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.beforeUpd = append(h.beforeUpd, f)
+}
+
+//BeforeDel registers a hook called before an item is deleted
+func (h *Hooks) BeforeDel(f BeforeDelFunc) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.beforeDel = append(h.beforeDel, f)
+}
+
+//CheckAdd returns the first error from the hooks for a new item
+func (h *Hooks) CheckAdd(item IItem) error {
+	if i, ok := item.(IItemWithBeforeAdd); ok {
+		if err := i.BeforeAdd(); err != nil {
+			return logger.Wrapf(err, "%T.BeforeAdd() rejected", item)
+		}
+	}
+	h.mutex.Lock()
+	hooks := h.beforeAdd
+	h.mutex.Unlock()
+	for _, f := range hooks {
+		if err := f(item); err != nil {
+			return logger.Wrapf(err, "add rejected")
+		}
+	}
+	return nil
+}
+
+//CheckUpd returns the first error from the hooks for an updated item
+func (h *Hooks) CheckUpd(id string, old IItem, new IItem) error {
+	if i, ok := new.(IItemWithBeforeUpd); ok {
+		if err := i.BeforeUpd(old); err != nil {
+			return logger.Wrapf(err, "%T.BeforeUpd(id=%s) rejected", new, id)
+		}
+	}
+	h.mutex.Lock()
+	hooks := h.beforeUpd
+	h.mutex.Unlock()
+	for _, f := range hooks {
+		if err := f(id, old, new); err != nil {
+			return logger.Wrapf(err, "upd(id=%s) rejected", id)
+		}
+	}
+	return nil
+}
+
+//CheckDel returns the first error from the hooks for a deleted item
+func (h *Hooks) CheckDel(id string, item IItem) error {
+	if i, ok := item.(IItemWithBeforeDel); ok {
+		if err := i.BeforeDel(); err != nil {
+			return logger.Wrapf(err, "%T.BeforeDel(id=%s) rejected", item, id)
+		}
+	}
+	h.mutex.Lock()
+	hooks := h.beforeDel
+	h.mutex.Unlock()
+	for _, f := range hooks {
+		if err := f(id, item); err != nil {
+			return logger.Wrapf(err, "del(id=%s) rejected", id)
+		}
+	}
+	return nil
+}
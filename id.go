@@ -0,0 +1,28 @@
+package items
+
+import (
+	"regexp"
+
+	"github.com/stewelarend/logger"
+)
+
+//MaxIDLength is the longest id accepted by ValidateID()
+const MaxIDLength = 128
+
+//validID allows ids to be used in file names and URLs
+var validID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+//ValidateID checks an id supplied by the caller or derived from an item key
+//ids start with a letter or digit followed by letters, digits, '.', '_' or '-'
+func ValidateID(id string) error {
+	if len(id) == 0 {
+		return logger.Wrapf(nil, "missing id")
+	}
+	if len(id) > MaxIDLength {
+		return logger.Wrapf(nil, "id \"%.20s...\" longer than %d", id, MaxIDLength)
+	}
+	if !validID.MatchString(id) {
+		return logger.Wrapf(nil, "id \"%s\" may only have letters, digits, '.', '_' and '-'", id)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package items
 
+import "time"
+
 //IItem is one item
 type IItem interface {
 	Validate() error
@@ -35,3 +37,32 @@ type IItemWithNotifyDel interface {
 	IItem
 	NotifyDel()
 }
+
+//IItemWithBeforeAdd is optional interface to implement to reject new items
+//returning an error aborts the add
+type IItemWithBeforeAdd interface {
+	IItem
+	BeforeAdd() error
+}
+
+//IItemWithBeforeUpd is optional interface to implement to reject updates
+//it is called on the new item, returning an error aborts the update
+type IItemWithBeforeUpd interface {
+	IItem
+	BeforeUpd(old IItem) error
+}
+
+//IItemWithBeforeDel is optional interface to implement to reject deletes
+//returning an error aborts the delete
+type IItemWithBeforeDel interface {
+	IItem
+	BeforeDel() error
+}
+
+//IItemWithTTL is optional interface to implement for items that expire
+//TTL() is the time to live after the item was last added or updated,
+//overriding the store TTL, and 0 means the item does not expire
+type IItemWithTTL interface {
+	IItem
+	TTL() time.Duration
+}
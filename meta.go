@@ -0,0 +1,61 @@
+package items
+
+import "time"
+
+//Meta is item metadata managed by the store, so that items need not
+//maintain it themselves (the same way items do not know their id)
+type Meta struct {
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	Rev       int       `json:"rev"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+
+	//Deleted is set when the item was soft deleted and only a tombstone remains
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+//NewMeta returns metadata for a new item added by actor (may be "")
+func NewMeta(actor string) Meta {
+	now := time.Now()
+	return Meta{
+		Created:   now,
+		Updated:   now,
+		Rev:       1,
+		CreatedBy: actor,
+		UpdatedBy: actor,
+	}
+}
+
+//NextRev returns the metadata after the item was updated by actor (may be "")
+func (m Meta) NextRev(actor string) Meta {
+	m.Updated = time.Now()
+	m.Rev++
+	m.UpdatedBy = actor
+	return m
+}
+
+//Tombstone returns the metadata of the item after it was soft deleted
+func (m Meta) Tombstone() Meta {
+	now := time.Now()
+	m.Deleted = &now
+	return m
+}
+
+//IsDeleted is true for the metadata of a tombstone
+func (m Meta) IsDeleted() bool {
+	return m.Deleted != nil
+}
+
+//Expired is true for a tombstone deleted more than retention ago
+//retention 0 means tombstones never expire
+func (m Meta) Expired(retention time.Duration) bool {
+	return m.Deleted != nil && retention > 0 && time.Since(*m.Deleted) > retention
+}
+
+//Restored returns the metadata of the item after its tombstone was restored
+func (m Meta) Restored(actor string) Meta {
+	m = m.NextRev(actor)
+	m.Deleted = nil
+	return m
+}
@@ -0,0 +1,344 @@
+package items
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+//ErrNotifyHandler is returned by Notifier.SetMode() and Close() when called from a handler
+//in NotifyAsync mode, because they would wait for the worker that is running the handler
+//it is not wrapped so callers can compare with it
+var ErrNotifyHandler = errors.New("cannot wait for notifications in an async notify handler")
+
+//NotifyMode selects how a Notifier delivers notifications
+type NotifyMode int
+
+//Notify modes
+const (
+	//NotifySync delivers in the goroutine that made the change, after the store lock was released
+	NotifySync NotifyMode = iota
+	//NotifyAsync queues notifications and delivers them in the background, in order per item id
+	NotifyAsync
+)
+
+//Notification describes one change to deliver to the item and the handlers
+type Notification struct {
+	Op   ChangeOp
+	ID   string
+	Item IItem //new item for add/upd, the deleted item for del
+	Old  IItem //old item for upd, else nil
+}
+
+//NotifyHandler is a store-level handler called for every notification
+type NotifyHandler func(n Notification) error
+
+//NotifyErrorHandler is called when a handler returned an error or an item notify method panicked
+type NotifyErrorHandler func(n Notification, err error)
+
+//DefaultNotifyWorkers is the number of goroutines used for NotifyAsync
+const DefaultNotifyWorkers = 4
+
+//DefaultNotifyQueueSize is the initial capacity of the queue of each worker
+//queues grow beyond it, so that Notify() never blocks, also not when a handler
+//changes the store and notifies on the queue of its own worker
+var DefaultNotifyQueueSize = 1000
+
+//Notifier delivers item notifications outside the store lock
+//It calls IItemWithNotifyNew/Upd/Del on the items then all registered handlers
+//No lock is held while delivering, so handlers may use the store
+type Notifier struct {
+	mutex   sync.RWMutex //protects mode and queues
+	mode    NotifyMode
+	queues  []*notifyQueue
+	workers *sync.WaitGroup
+	running sync.Map //goroutine ids of the workers
+
+	handlersMutex sync.Mutex
+	handlers      []NotifyHandler
+	onError       NotifyErrorHandler
+
+	pendingMutex sync.Mutex
+	pendingCond  *sync.Cond
+	pending      int
+}
+
+//NewNotifier makes a notifier in the specified mode
+func NewNotifier(mode NotifyMode) *Notifier {
+	n := &Notifier{
+		mode:     NotifySync,
+		handlers: make([]NotifyHandler, 0),
+		onError: func(n Notification, err error) {
+			log.Errorf("Notify %s(%s) failed: %+v", n.Op, n.ID, err)
+		},
+	}
+	n.pendingCond = sync.NewCond(&n.pendingMutex)
+	n.SetMode(mode)
+	return n
+}
+
+//Mode returns the current delivery mode
+func (n *Notifier) Mode() NotifyMode {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.mode
+}
+
+//SetMode changes the delivery mode
+//when leaving NotifyAsync, queued notifications are delivered before it returns
+//It returns ErrNotifyHandler without changing the mode when called from an async handler.
+func (n *Notifier) SetMode(mode NotifyMode) error {
+	if n.inWorker() {
+		return ErrNotifyHandler
+	}
+	n.mutex.Lock()
+	if mode == n.mode && (mode != NotifyAsync || n.queues != nil) {
+		n.mutex.Unlock()
+		return nil
+	}
+	oldQueues, oldWorkers := n.queues, n.workers
+	n.queues, n.workers = nil, nil
+	n.mode = mode
+	if mode == NotifyAsync {
+		n.queues = make([]*notifyQueue, DefaultNotifyWorkers)
+		n.workers = &sync.WaitGroup{}
+		for i := range n.queues {
+			n.queues[i] = newNotifyQueue()
+			n.workers.Add(1)
+			go func(queue *notifyQueue, workers *sync.WaitGroup) {
+				defer workers.Done()
+				id := goroutineID()
+				n.running.Store(id, true)
+				defer n.running.Delete(id)
+				for {
+					notification, ok := queue.pop()
+					if !ok {
+						return
+					}
+					n.deliver(notification)
+					n.done()
+				}
+			}(n.queues[i], n.workers)
+		}
+	}
+	n.mutex.Unlock()
+
+	//stop the old workers without holding the lock,
+	//because their handlers may still make changes that notify
+	for _, queue := range oldQueues {
+		queue.close()
+	}
+	if oldWorkers != nil {
+		oldWorkers.Wait()
+	}
+	return nil
+} //Notifier.SetMode()
+
+//Handle registers a handler called for every notification
+func (n *Notifier) Handle(h NotifyHandler) {
+	n.handlersMutex.Lock()
+	defer n.handlersMutex.Unlock()
+	n.handlers = append(n.handlers, h)
+}
+
+//OnError replaces the error handler, which by default logs the error
+func (n *Notifier) OnError(h NotifyErrorHandler) {
+	n.handlersMutex.Lock()
+	defer n.handlersMutex.Unlock()
+	n.onError = h
+}
+
+//Notify delivers the notifications in the current mode
+//stores must call this only after releasing their lock
+func (n *Notifier) Notify(list ...Notification) {
+	if len(list) == 0 {
+		return
+	}
+	//queue without holding the lock, so that SetMode() does not wait for Notify()
+	n.mutex.RLock()
+	queues := n.queues
+	n.mutex.RUnlock()
+	if queues == nil {
+		for _, notification := range list {
+			n.deliver(notification)
+		}
+		return
+	}
+
+	//queue on the worker selected by id to keep the order per id
+	for i, notification := range list {
+		h := fnv.New32a()
+		h.Write([]byte(notification.ID))
+		n.pendingMutex.Lock()
+		n.pending++
+		n.pendingMutex.Unlock()
+		if !queues[h.Sum32()%uint32(len(queues))].push(notification) {
+			//the mode changed since the queues were copied
+			n.done()
+			n.Notify(list[i:]...)
+			return
+		}
+	}
+} //Notifier.Notify()
+
+//Flush waits until all queued notifications were delivered
+//do not call it from a handler, as it will wait for itself
+func (n *Notifier) Flush() {
+	n.pendingMutex.Lock()
+	defer n.pendingMutex.Unlock()
+	for n.pending > 0 {
+		n.pendingCond.Wait()
+	}
+}
+
+//Close delivers all queued notifications and stops the background workers
+//subsequent notifications are delivered synchronously
+//When called from an async handler, e.g. by closing the store, the workers are stopped
+//without waiting and ErrNotifyHandler is returned, the queued notifications are still delivered.
+func (n *Notifier) Close() error {
+	if !n.inWorker() {
+		return n.SetMode(NotifySync)
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, queue := range n.queues {
+		queue.close()
+	}
+	n.queues, n.workers = nil, nil
+	n.mode = NotifySync
+	return ErrNotifyHandler
+}
+
+//inWorker is true when called from the goroutine of an async worker
+func (n *Notifier) inWorker() bool {
+	_, ok := n.running.Load(goroutineID())
+	return ok
+}
+
+//goroutineID parses the id of the calling goroutine from its stack trace,
+//which starts with "goroutine <id> [running]:"
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	fields := bytes.Fields(buf[:runtime.Stack(buf, false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+func (n *Notifier) done() {
+	n.pendingMutex.Lock()
+	defer n.pendingMutex.Unlock()
+	n.pending--
+	if n.pending == 0 {
+		n.pendingCond.Broadcast()
+	}
+}
+
+//notifyQueue is the queue of one worker
+type notifyQueue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	list   []Notification
+	closed bool
+}
+
+func newNotifyQueue() *notifyQueue {
+	q := &notifyQueue{list: make([]Notification, 0, DefaultNotifyQueueSize)}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+//push adds the notification to the end of the queue, returning false when the queue was closed
+func (q *notifyQueue) push(notification Notification) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return false
+	}
+	q.list = append(q.list, notification)
+	q.cond.Signal()
+	return true
+}
+
+//pop waits for the next notification, returning false when the queue was closed and is empty
+func (q *notifyQueue) pop() (Notification, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.list) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.list) == 0 {
+		return Notification{}, false
+	}
+	notification := q.list[0]
+	q.list[0] = Notification{}
+	q.list = q.list[1:]
+	return notification, true
+}
+
+//close stops the worker after it delivered what is queued
+func (q *notifyQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+//deliver to the item then the handlers, without holding any lock
+func (n *Notifier) deliver(notification Notification) {
+	n.handlersMutex.Lock()
+	handlers := n.handlers
+	onError := n.onError
+	n.handlersMutex.Unlock()
+
+	if err := notifyItem(notification); err != nil {
+		onError(notification, err)
+	}
+	for _, h := range handlers {
+		if err := callHandler(h, notification); err != nil {
+			onError(notification, err)
+		}
+	}
+}
+
+//notifyItem calls the item's optional notify method
+func notifyItem(n Notification) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = logger.Wrapf(nil, "%T notify %s panic: %v", n.Item, n.Op, r)
+		}
+	}()
+	switch n.Op {
+	case ChangeAdd:
+		if item, ok := n.Item.(IItemWithNotifyNew); ok {
+			item.NotifyNew()
+		}
+	case ChangeUpd:
+		if item, ok := n.Item.(IItemWithNotifyUpd); ok {
+			item.NotifyUpd(n.Old)
+		}
+	case ChangeDel:
+		if item, ok := n.Item.(IItemWithNotifyDel); ok {
+			item.NotifyDel()
+		}
+	}
+	return nil
+}
+
+func callHandler(h NotifyHandler, n Notification) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = logger.Wrapf(nil, "notify handler panic: %v", r)
+		}
+	}()
+	return h(n)
+}
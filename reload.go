@@ -0,0 +1,172 @@
+package items
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stewelarend/logger"
+)
+
+//ReloadDiff describes what loading a file would change in a store
+type ReloadDiff struct {
+	Added   []string       `json:"added"`
+	Updated []ReloadUpdate `json:"updated"`
+	Deleted []string       `json:"deleted"`
+	Errors  []ReloadError  `json:"errors"`
+}
+
+//ReloadUpdate is an item that would be updated
+type ReloadUpdate struct {
+	ID     string        `json:"id"`
+	Fields []FieldChange `json:"fields"`
+}
+
+//FieldChange is one changed field of an item
+//nested fields are named with dots, e.g. "address.city"
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+//Reload error kinds
+const (
+	ReloadErrorDecode       = "decode"
+	ReloadErrorMissingID    = "missing_id"
+	ReloadErrorDuplicateID  = "duplicate_id"
+	ReloadErrorMissingItem  = "missing_item"
+	ReloadErrorInvalid      = "invalid"
+	ReloadErrorDuplicateKey = "duplicate_key"
+	ReloadErrorRejected     = "rejected"
+)
+
+//ReloadError is a problem with one item in the file
+type ReloadError struct {
+	Index   int    `json:"index"` //of the item in the file, -1 for an item deleted from the file
+	ID      string `json:"id,omitempty"`
+	Field   string `json:"field,omitempty"` //when known, e.g. "item.name"
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func (e ReloadError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("[%d].id=%s %s %s: %s", e.Index, e.ID, e.Field, e.Kind, e.Message)
+	}
+	return fmt.Sprintf("[%d].id=%s %s: %s", e.Index, e.ID, e.Kind, e.Message)
+}
+
+//NewReloadDiff makes an empty diff
+func NewReloadDiff() ReloadDiff {
+	return ReloadDiff{
+		Added:   make([]string, 0),
+		Updated: make([]ReloadUpdate, 0),
+		Deleted: make([]string, 0),
+		Errors:  make([]ReloadError, 0),
+	}
+}
+
+//Err returns nil when the file can be loaded, else an error listing all the problems
+func (d ReloadDiff) Err() error {
+	if len(d.Errors) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(d.Errors))
+	for _, e := range d.Errors {
+		messages = append(messages, e.Error())
+	}
+	return logger.Wrapf(nil, "%d errors: %s", len(d.Errors), strings.Join(messages, "; "))
+}
+
+//Reload report status
+const (
+	ReloadStatusOK      = "ok"
+	ReloadStatusPartial = "partial" //applied without the items in Errors
+	ReloadStatusFailed  = "failed"
+)
+
+//ReloadReport is the outcome of reloading a file, written for tools to parse
+type ReloadReport struct {
+	File    string        `json:"file"`
+	Time    time.Time     `json:"time"`
+	Status  string        `json:"status"`
+	Added   int           `json:"added"`
+	Updated int           `json:"updated"`
+	Deleted int           `json:"deleted"`
+	Errors  []ReloadError `json:"errors,omitempty"`
+	Message string        `json:"message,omitempty"` //when the file could not be loaded at all
+}
+
+//NewReloadReport reports the counts of an applied diff, or the errors when err != nil
+//an applied diff with errors lists the rejected items
+func NewReloadReport(file string, diff ReloadDiff, err error) ReloadReport {
+	r := ReloadReport{File: file, Time: time.Now(), Status: ReloadStatusOK, Errors: diff.Errors}
+	if err != nil {
+		r.Status = ReloadStatusFailed
+		if len(r.Errors) == 0 {
+			r.Message = err.Error()
+		}
+		return r
+	}
+	if len(r.Errors) > 0 {
+		r.Status = ReloadStatusPartial
+	}
+	r.Added = len(diff.Added)
+	r.Updated = len(diff.Updated)
+	r.Deleted = len(diff.Deleted)
+	return r
+}
+
+//DiffFields compares the JSON encoding of two items and returns the changed fields
+//sorted by name
+func DiffFields(oldItem IItem, newItem IItem) []FieldChange {
+	changes := make([]FieldChange, 0)
+	diffValues(&changes, "", jsonValue(oldItem), jsonValue(newItem))
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+//jsonValue returns the item as decoded from its JSON encoding,
+//i.e. objects as map[string]interface{}
+func jsonValue(item IItem) interface{} {
+	if item == nil {
+		return nil
+	}
+	jsonItem, err := json.Marshal(item)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	json.Unmarshal(jsonItem, &v)
+	return v
+}
+
+func diffValues(changes *[]FieldChange, field string, oldValue interface{}, newValue interface{}) {
+	oldObj, oldIsObj := oldValue.(map[string]interface{})
+	newObj, newIsObj := newValue.(map[string]interface{})
+	if oldIsObj && newIsObj {
+		for name, v := range oldObj {
+			diffValues(changes, joinField(field, name), v, newObj[name])
+		}
+		for name, v := range newObj {
+			if _, ok := oldObj[name]; !ok {
+				diffValues(changes, joinField(field, name), nil, v)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(oldValue, newValue) {
+		*changes = append(*changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+	}
+}
+
+func joinField(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
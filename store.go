@@ -1,9 +1,15 @@
 package items
 
 import (
+	"errors"
 	"reflect"
+	"time"
 )
 
+//ErrClosed is returned by store operations after Close()
+//it is not wrapped so callers can compare with it
+var ErrClosed = errors.New("store is closed")
+
 //IStore of items
 type IStore interface {
 	Name() string
@@ -36,6 +42,133 @@ type IStore interface {
 	//when a store refers to items in another store, indicate the dependency
 	//with this, to prevent deletion of items referred to from this store
 	Uses(fieldName string, itemStore IStore) error
+
+	//Close stops background work, delivers queued notifications and releases
+	//file locks. After Close, operations fail with ErrClosed and Find returns
+	//an empty list. Closing a closed store does nothing.
+	Close() error
+}
+
+//IStoreWithChanges is optional interface implemented by stores
+//that keep a log of changes for consumers to catch up on
+type IStoreWithChanges interface {
+	IStore
+
+	//Seq returns the sequence of the last change, 0 if none yet
+	Seq() uint64
+
+	//ChangesSince returns all changes after seq in the order they were made
+	//if some of those changes are no longer in the log, it returns ErrChangeGap
+	ChangesSince(seq uint64) ([]Change, error)
+}
+
+//IStoreWithNotifier is optional interface implemented by stores
+//that deliver item notifications through a Notifier, which can be
+//used to change the delivery mode and to register handlers
+type IStoreWithNotifier interface {
+	IStore
+	Notifier() *Notifier
+}
+
+//IStoreWithHooks is optional interface implemented by stores
+//that evaluate Hooks before making a change
+type IStoreWithHooks interface {
+	IStore
+	Hooks() *Hooks
+}
+
+//IStoreWithMeta is optional interface implemented by stores
+//that keep Meta for each item
+type IStoreWithMeta interface {
+	IStore
+
+	//AddBy is Add() recording the actor that made the change, e.g. a user name
+	AddBy(actor string, item IItem) (string, error)
+
+	//UpdBy is Upd() recording the actor that made the change
+	UpdBy(actor string, id string, item IItem) error
+
+	//GetWithMeta is Get() also returning the item metadata
+	GetWithMeta(id string) (IItem, Meta, error)
+}
+
+//IStoreWithID is optional interface implemented by stores
+//that accept ids from the caller, e.g. to import items that already have ids
+type IStoreWithID interface {
+	IStore
+
+	//AddWithID is Add() using the id instead of generating one
+	//the id must pass ValidateID() and may not exist, also not as a tombstone
+	AddWithID(id string, item IItem) error
+}
+
+//IStoreWithHistory is optional interface implemented by stores
+//that can keep prior versions of items when they are updated or deleted
+type IStoreWithHistory interface {
+	IStore
+
+	//EnableHistory starts keeping prior versions on every upd and del
+	EnableHistory() error
+
+	//Versions returns all known versions of the item, oldest first,
+	//including the current version if the item was not deleted
+	Versions(id string) ([]Version, error)
+
+	//GetVersion returns the item as it was at the specified revision
+	GetVersion(id string, rev int) (IItem, Meta, error)
+
+	//GetAsOf returns the item as it was at time t
+	GetAsOf(id string, t time.Time) (IItem, Meta, error)
+
+	//FindAsOf is Find() on the items as they were at time t
+	FindAsOf(t time.Time, size int, filter IItem) []IDAndItem
+}
+
+//IStoreWithSoftDelete is optional interface implemented by stores
+//that can keep deleted items as tombstones until they are purged
+type IStoreWithSoftDelete interface {
+	IStore
+
+	//EnableSoftDelete makes Del() keep a tombstone, which is hidden from Get, Find, GetBy
+	//and unique key checks. Tombstones older than retention are purged automatically,
+	//while retention 0 keeps them until Purge() is called.
+	EnableSoftDelete(retention time.Duration) error
+
+	//FindDeleted is Find() on the tombstones
+	FindDeleted(size int, filter IItem) []IDAndItem
+
+	//Restore makes a tombstone a normal item again, with the same id
+	Restore(id string) error
+
+	//Purge permanently removes a tombstone
+	Purge(id string) error
+}
+
+//IStoreWithTTL is optional interface implemented by stores
+//that remove items after their time to live expired
+//Expired items are treated as absent by reads and removed by a background sweeper,
+//which notifies each expired item as deleted
+type IStoreWithTTL interface {
+	IStore
+
+	//EnableTTL sets the time to live of items that do not implement IItemWithTTL,
+	//0 to only expire those that do, and starts the sweeper when sweepInterval > 0
+	EnableTTL(ttl time.Duration, sweepInterval time.Duration) error
+
+	//Sweep removes expired items now and returns the number removed
+	//the sweeper is stopped by Close()
+	Sweep() int
+}
+
+//IStoreWithDryRun is optional interface implemented by stores
+//that reload items from a file, to see what a file will do before it is loaded
+type IStoreWithDryRun interface {
+	IStore
+
+	//DryRun validates the file against the store and returns what loading it would
+	//change, without changing the store. Problems with items are listed in the diff,
+	//while the error is only for a file that cannot be read at all.
+	DryRun(filename string) (ReloadDiff, error)
 }
 
 //IDAndItem ...
@@ -0,0 +1,167 @@
+package bitcask
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//DefaultMergeInterval is how often segments are checked for merging
+var DefaultMergeInterval = time.Minute
+
+//defaultMinDeadRatio merges when at least half of the closed segments are replaced or deleted records
+const defaultMinDeadRatio = 0.5
+
+//MergeOptions control when segments are merged in the background
+//the zero value of each field selects the default behaviour
+type MergeOptions struct {
+	Interval     time.Duration //how often to check, default DefaultMergeInterval
+	MinDeadRatio float64       //of dead bytes in the closed segments before they are merged, default 0.5
+}
+
+func (o MergeOptions) withDefaults() MergeOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultMergeInterval
+	}
+	if o.MinDeadRatio <= 0 {
+		o.MinDeadRatio = defaultMinDeadRatio
+	}
+	return o
+}
+
+func (s *store) mergeInBackground(stop chan struct{}) {
+	defer s.merging.Done()
+	ticker := time.NewTicker(s.merge.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.mergeSegments(s.merge.MinDeadRatio); err != nil && err != items.ErrClosed {
+				s.log.Errorf("Failed to merge %s: %+v", s.dir, err)
+			}
+		}
+	}
+}
+
+//Merge copies the live records of all segments except the active segment
+//into new segments and removes the old segments, regardless of the dead ratio
+func (s *store) Merge() error {
+	return s.mergeSegments(0)
+}
+
+//mergeSegments merges the closed segments when their dead ratio is at least minDeadRatio
+//Records are copied without holding the store lock, so changes continue during a merge.
+//Tombstones are not copied: every older record of the id is in the merged segments
+//or was already merged, because all closed segments are merged together.
+func (s *store) mergeSegments(minDeadRatio float64) error {
+	s.mergeMutex.Lock()
+	defer s.mergeMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return items.ErrClosed
+	}
+	merged := []*segment{}
+	size, dead := int64(0), int64(0)
+	for _, seg := range s.segments {
+		if seg != s.active {
+			merged = append(merged, seg)
+			size += seg.size
+			dead += seg.dead
+		}
+	}
+	s.mutex.Unlock()
+	if len(merged) == 0 || dead == 0 || float64(dead) < minDeadRatio*float64(size) {
+		return nil
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].no < merged[j].no })
+	s.log.Debugf("Merging %d segments with %d of %d bytes dead in %s", len(merged), dead, size, s.dir)
+
+	//copy records that are still the latest of their id
+	type move struct {
+		id       string
+		from, to location
+	}
+	moves := []move{}
+	outputs := []*segment{}
+	var out *segment
+	for _, seg := range merged {
+		err := seg.scan(func(rec record, loc location) error {
+			if rec.op != opPut {
+				return nil
+			}
+			id, err := recordID(rec)
+			if err != nil {
+				return err
+			}
+			s.mutex.Lock()
+			live := s.keydir[id] == loc
+			s.mutex.Unlock()
+			if !live {
+				return nil
+			}
+			if out == nil || out.size >= s.segmentSize {
+				s.mutex.Lock()
+				no := s.nextSegment
+				s.nextSegment++
+				s.mutex.Unlock()
+				if out, err = openSegment(s.dir, no, s.fileMode); err != nil {
+					return err
+				}
+				outputs = append(outputs, out)
+			}
+			to, err := out.append(encodeRecord(rec.seq, rec.op, rec.payload), rec.seq, false)
+			if err != nil {
+				return err
+			}
+			moves = append(moves, move{id: id, from: loc, to: to})
+			return nil
+		})
+		if err == nil {
+			continue
+		}
+		for _, out := range outputs {
+			out.file.Close()
+			os.Remove(out.file.Name())
+		}
+		return logger.Wrapf(err, "cannot merge segment %s", seg.file.Name())
+	}
+	for _, out := range outputs {
+		if err := out.file.Sync(); err != nil {
+			return logger.Wrapf(err, "cannot sync segment %s", out.file.Name())
+		}
+	}
+
+	//use the copies unless the items changed during the merge
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, out := range outputs {
+		s.segments[out.no] = out
+	}
+	for _, m := range moves {
+		if s.keydir[m.id] == m.from {
+			s.keydir[m.id] = m.to
+		} else {
+			s.segments[m.to.segment].dead += int64(m.to.size)
+		}
+	}
+
+	//remove the oldest first, so that a tombstone is never removed while older records of its id remain
+	//the numbers of merge outputs do not show their age, but the sequences of their records do
+	sort.Slice(merged, func(i, j int) bool { return merged[i].maxSeq < merged[j].maxSeq })
+	for _, seg := range merged {
+		delete(s.segments, seg.no)
+		seg.file.Close()
+		if err := os.Remove(seg.file.Name()); err != nil {
+			return logger.Wrapf(err, "cannot remove merged segment %s", seg.file.Name())
+		}
+	}
+	s.log.Debugf("Merged %d segments into %d in %s", len(merged), len(outputs), s.dir)
+	return nil
+} //store.mergeSegments()
@@ -0,0 +1,96 @@
+package bitcask
+
+import (
+	"os"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+//Option configures a store made with NewWithOptions()
+type Option func(s *store) error
+
+//WithIDGenerator sets the generator of ids for new items, instead of idgen.UUIDv4()
+func WithIDGenerator(idGen IIDGenerator) Option {
+	return func(s *store) error {
+		if idGen == nil {
+			return logger.Wrapf(nil, "New(idGen==nil)")
+		}
+		s.idGen = idGen
+		return nil
+	}
+}
+
+//WithFileMode sets the permissions used when segment files are created
+//the default is 0666 (before umask) like os.Create()
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *store) error {
+		if err := common.CheckFileMode(mode); err != nil {
+			return err
+		}
+		s.fileMode = mode
+		return nil
+	}
+}
+
+//WithLogger sets the logger of the store instead of the package logger
+func WithLogger(l logger.ILogger) Option {
+	return func(s *store) error {
+		if l == nil {
+			return logger.Wrapf(nil, "WithLogger(nil)")
+		}
+		s.log = l
+		return nil
+	}
+}
+
+//WithUniqueKey adds a unique index on a value of each item,
+//in addition to the keys of items that implement items.IItemWithUniqueKeys
+func WithUniqueKey(name string, key func(item items.IItem) interface{}) Option {
+	return func(s *store) error {
+		return s.uniqueKeys.Add(name, key)
+	}
+}
+
+//WithHooks uses hooks that were already registered, instead of starting without hooks
+func WithHooks(hooks *items.Hooks) Option {
+	return func(s *store) error {
+		if hooks == nil {
+			return logger.Wrapf(nil, "WithHooks(nil)")
+		}
+		s.hooks = hooks
+		return nil
+	}
+}
+
+//WithSegmentSize sets the size after which a new segment file is started, instead of DefaultSegmentSize
+func WithSegmentSize(size int64) Option {
+	return func(s *store) error {
+		if size < 1024 {
+			return logger.Wrapf(nil, "WithSegmentSize(%d) < 1024", size)
+		}
+		s.segmentSize = size
+		return nil
+	}
+}
+
+//WithSyncWrites syncs the segment file after each change
+//without it, changes written just before the system stops may be lost
+func WithSyncWrites() Option {
+	return func(s *store) error {
+		s.syncWrites = true
+		return nil
+	}
+}
+
+//WithMerge sets when segments are merged in the background, instead of the defaults
+func WithMerge(mergeOptions MergeOptions) Option {
+	return func(s *store) error {
+		if mergeOptions.MinDeadRatio < 0 || mergeOptions.MinDeadRatio > 1 {
+			return logger.Wrapf(nil, "MinDeadRatio=%v not in 0..1", mergeOptions.MinDeadRatio)
+		}
+		s.merge = mergeOptions.withDefaults()
+		return nil
+	}
+}
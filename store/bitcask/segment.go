@@ -0,0 +1,194 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/stewelarend/logger"
+)
+
+//record operations
+const (
+	opPut byte = 1 //item added or updated, payload is the fileItem
+	opDel byte = 2 //tombstone, payload is the id
+)
+
+//record: [crc32 uint32][seq uint64][op byte][len uint32][payload]
+//the checksum covers everything after it
+const recordHeaderSize = 4 + 8 + 1 + 4
+
+//maxPayloadSize limits items, so that a damaged length is not used to allocate memory
+const maxPayloadSize = 64 << 20
+
+var segmentFilenameRegex = regexp.MustCompile(`^([0-9]{9})\.seg$`)
+
+//segment is one append-only file
+//Only the active segment is written, except for the output of a merge.
+type segment struct {
+	no     int
+	file   *os.File
+	size   int64  //bytes written, the end of the last complete record
+	dead   int64  //bytes of records that were replaced or deleted
+	maxSeq uint64 //of the newest record, to remove merged segments from oldest to newest
+}
+
+//location of the latest record of an id
+type location struct {
+	segment int
+	offset  int64
+	size    uint32
+	seq     uint64
+}
+
+//record is a decoded record
+type record struct {
+	seq     uint64
+	op      byte
+	payload []byte
+}
+
+func segmentFilename(dir string, no int) string {
+	return path.Join(dir, fmt.Sprintf("%09d.seg", no))
+}
+
+//segmentNumbers returns the numbers of the segment files in dir in ascending order
+func segmentNumbers(dir string) ([]int, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot open dir %s", dir)
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot read dir %s", dir)
+	}
+	nos := []int{}
+	for _, name := range names {
+		if match := segmentFilenameRegex.FindStringSubmatch(name); match != nil {
+			no, _ := strconv.Atoi(match[1])
+			nos = append(nos, no)
+		}
+	}
+	sort.Ints(nos)
+	return nos, nil
+}
+
+func openSegment(dir string, no int, mode os.FileMode) (*segment, error) {
+	filename := segmentFilename(dir, no)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot open segment %s", filename)
+	}
+	return &segment{no: no, file: file}, nil
+}
+
+func encodeRecord(seq uint64, op byte, payload []byte) []byte {
+	data := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint64(data[4:12], seq)
+	data[12] = op
+	binary.BigEndian.PutUint32(data[13:17], uint32(len(payload)))
+	copy(data[recordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+//decodeRecord checks a complete record read from a location
+func decodeRecord(data []byte) (record, error) {
+	if len(data) < recordHeaderSize {
+		return record{}, logger.Wrapf(nil, "record of %d bytes is too short", len(data))
+	}
+	if binary.BigEndian.Uint32(data[0:4]) != crc32.ChecksumIEEE(data[4:]) {
+		return record{}, logger.Wrapf(nil, "record checksum mismatch")
+	}
+	if int(binary.BigEndian.Uint32(data[13:17])) != len(data)-recordHeaderSize {
+		return record{}, logger.Wrapf(nil, "record length mismatch")
+	}
+	return record{seq: binary.BigEndian.Uint64(data[4:12]), op: data[12], payload: data[recordHeaderSize:]}, nil
+}
+
+//append writes the record at the end of the segment and returns its location
+func (seg *segment) append(data []byte, seq uint64, sync bool) (location, error) {
+	if _, err := seg.file.WriteAt(data, seg.size); err != nil {
+		//the next write replaces what was partly written
+		return location{}, logger.Wrapf(err, "cannot write segment %s", seg.file.Name())
+	}
+	if sync {
+		if err := seg.file.Sync(); err != nil {
+			return location{}, logger.Wrapf(err, "cannot sync segment %s", seg.file.Name())
+		}
+	}
+	loc := location{segment: seg.no, offset: seg.size, size: uint32(len(data)), seq: seq}
+	seg.size += int64(len(data))
+	if seq > seg.maxSeq {
+		seg.maxSeq = seq
+	}
+	return loc, nil
+}
+
+//read the record at the location with a single read
+func (seg *segment) read(loc location) (record, error) {
+	data := make([]byte, loc.size)
+	if _, err := seg.file.ReadAt(data, loc.offset); err != nil {
+		return record{}, logger.Wrapf(err, "cannot read %s at %d", seg.file.Name(), loc.offset)
+	}
+	rec, err := decodeRecord(data)
+	if err != nil {
+		return record{}, logger.Wrapf(err, "invalid record in %s at %d", seg.file.Name(), loc.offset)
+	}
+	return rec, nil
+}
+
+//scan calls fn with each record and its location in the order written,
+//and sets the size of the segment to the end of the last complete record
+//A torn record at the end, left by a crash during a write, is truncated.
+func (seg *segment) scan(fn func(rec record, loc location) error) error {
+	r := bufio.NewReader(io.NewSectionReader(seg.file, 0, 1<<62))
+	offset := int64(0)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				return seg.truncate(offset, err)
+			}
+			seg.size = offset
+			return nil
+		}
+		payloadSize := binary.BigEndian.Uint32(header[13:17])
+		if payloadSize > maxPayloadSize {
+			return seg.truncate(offset, logger.Wrapf(nil, "record length %d > %d", payloadSize, maxPayloadSize))
+		}
+		data := make([]byte, recordHeaderSize+int(payloadSize))
+		copy(data, header)
+		if _, err := io.ReadFull(r, data[recordHeaderSize:]); err != nil {
+			return seg.truncate(offset, err)
+		}
+		rec, err := decodeRecord(data)
+		if err != nil {
+			return seg.truncate(offset, err)
+		}
+		if rec.seq > seg.maxSeq {
+			seg.maxSeq = rec.seq
+		}
+		if err := fn(rec, location{segment: seg.no, offset: offset, size: uint32(len(data)), seq: rec.seq}); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+} //segment.scan()
+
+func (seg *segment) truncate(offset int64, reason error) error {
+	log.Errorf("Truncating segment %s at %d: %v", seg.file.Name(), offset, reason)
+	if err := seg.file.Truncate(offset); err != nil {
+		return logger.Wrapf(err, "cannot truncate segment %s", seg.file.Name())
+	}
+	seg.size = offset
+	return nil
+}
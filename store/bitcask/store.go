@@ -0,0 +1,615 @@
+//Package bitcask implements a IItem store for write-heavy use, in the style of Bitcask
+//Every change is appended to the active segment file in a directory and the location
+//of the latest record of each id is kept in memory, so that Get() needs a single read.
+//Segments with replaced and deleted records are merged in the background.
+package bitcask
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+var (
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-_]*[a-zA-Z0-9]$`)
+)
+
+//DefaultSegmentSize is the size after which a new segment is started, unless WithSegmentSize() is used
+var DefaultSegmentSize int64 = 64 << 20
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids in the segments, also of deleted items
+type IIDGenerator interface {
+	NewID() string
+}
+
+//New makes a new items.IStore using a directory of segment files
+func New(parentDir string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(parentDir, name, tmpl)
+}
+
+//NewWithOptions makes a new items.IStore using a directory of segment files, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(parentDir string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	if len(name) == 0 || !validName.MatchString(name) {
+		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
+	}
+	if tmpl == nil {
+		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
+	}
+	if _, ok := tmpl.(items.IItemWithID); ok {
+		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
+	}
+	s := &store{
+		dir:          parentDir + "/" + name,
+		fileMode:     0666,
+		itemName:     name,
+		itemTmpl:     tmpl,
+		itemType:     reflect.TypeOf(tmpl),
+		fileItemType: fileItemType(reflect.TypeOf(tmpl)),
+		idGen:        idgen.UUIDv4(),
+		segmentSize:  DefaultSegmentSize,
+		merge:        MergeOptions{}.withDefaults(),
+		segments:     make(map[int]*segment),
+		keydir:       make(map[string]location),
+		uniqueKeys:   make(common.KeyFuncs),
+		keyIndex:     common.NewIndex(name),
+		hooks:        items.NewHooks(),
+		notifier:     items.NewNotifier(items.NotifySync),
+		log:          log,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+	if err := os.MkdirAll(s.dir, 0770); err != nil {
+		return nil, logger.Wrapf(err, "Cannot create directory \"%s\" for bitcask", s.dir)
+	}
+
+	//lock before reading so that no other store writes the segments
+	lock, err := filelock.New(s.dir + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock bitcask %s", s.dir)
+	}
+	s.lock = lock
+
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot access items in bitcask %s", s.dir)
+	}
+
+	s.mergeStop = make(chan struct{})
+	s.merging.Add(1)
+	go s.mergeInBackground(s.mergeStop)
+	s.log.Debugf("Created bitcask store of %d %ss in dir %s", len(s.keydir), s.itemName, s.dir)
+	return s, nil
+} //NewWithOptions()
+
+//store implements items.IStore for a directory of segment files
+type store struct {
+	mutex        sync.Mutex
+	dir          string
+	fileMode     os.FileMode
+	itemName     string
+	itemTmpl     items.IItem
+	itemType     reflect.Type
+	fileItemType reflect.Type
+	idGen        IIDGenerator
+	segmentSize  int64
+	syncWrites   bool
+	merge        MergeOptions
+	segments     map[int]*segment
+	active       *segment            //the segment that is appended to
+	nextSegment  int                 //number of the next new segment
+	seq          uint64              //of the last record written
+	keydir       map[string]location //latest record of each item
+	uniqueKeys   common.KeyFuncs     //in addition to IItemWithUniqueKeys
+	keyIndex     *common.Index       //id of each key value
+	hooks        *items.Hooks
+	notifier     *items.Notifier
+	log          logger.ILogger
+	lock         *filelock.Lock
+	closed       bool
+
+	mergeMutex sync.Mutex //one merge at a time
+	mergeStop  chan struct{}
+	merging    sync.WaitGroup
+}
+
+//Name ...
+func (s *store) Name() string {
+	return s.itemName
+}
+
+//Type ...
+func (s *store) Type() reflect.Type {
+	return s.itemType
+}
+
+//StructType ...
+func (s *store) StructType() reflect.Type {
+	if s.itemType.Kind() == reflect.Ptr {
+		return s.itemType.Elem()
+	}
+	return s.itemType
+}
+
+//Tmpl ...
+func (s *store) Tmpl() items.IItem {
+	return s.itemTmpl
+}
+
+//load builds the key directory from all segments
+//Segments are not ordered by age after a merge, so the record with the highest
+//sequence of each id is used, and tombstones are kept until all segments were read.
+func (s *store) load() error {
+	nos, err := segmentNumbers(s.dir)
+	if err != nil {
+		return err
+	}
+	type latestRecord struct {
+		loc     location
+		deleted bool
+	}
+	latest := make(map[string]latestRecord)
+	for _, no := range nos {
+		seg, err := openSegment(s.dir, no, s.fileMode)
+		if err != nil {
+			return err
+		}
+		s.segments[no] = seg
+		s.nextSegment = no + 1
+		if err := seg.scan(func(rec record, loc location) error {
+			id, err := recordID(rec)
+			if err != nil {
+				return logger.Wrapf(err, "invalid record in %s at %d", seg.file.Name(), loc.offset)
+			}
+			if rec.seq > s.seq {
+				s.seq = rec.seq
+			}
+			if prev, ok := latest[id]; ok {
+				if prev.loc.seq > rec.seq {
+					seg.dead += int64(loc.size)
+					return nil
+				}
+				s.segments[prev.loc.segment].dead += int64(prev.loc.size)
+			}
+			latest[id] = latestRecord{loc: loc, deleted: rec.op == opDel}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	ids := make([]string, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		//ids of deleted items must not be generated again
+		idgen.Resume(s.idGen, id)
+		if latest[id].deleted {
+			s.segments[latest[id].loc.segment].dead += int64(latest[id].loc.size)
+			continue
+		}
+		s.keydir[id] = latest[id].loc
+		fileItem, err := s.readItem(latest[id].loc)
+		if err != nil {
+			return err
+		}
+		if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(fileItem.Item)); err != nil {
+			return logger.Wrapf(err, "%s.id=%s", s.itemName, id)
+		}
+		s.keyIndex.Add(id, s.uniqueKeys.Keys(fileItem.Item))
+	}
+
+	//write to a new segment, so that the active segment only has records newer than the others,
+	//which a merge relies on to drop tombstones
+	//the last segment may be the output of a merge, with older records than the segment before it
+	if len(nos) > 0 && s.segments[nos[len(nos)-1]].size == 0 {
+		s.active = s.segments[nos[len(nos)-1]]
+		return nil
+	}
+	return s.newActiveSegment()
+} //store.load()
+
+//newActiveSegment starts a new segment for writing
+func (s *store) newActiveSegment() error {
+	seg, err := openSegment(s.dir, s.nextSegment, s.fileMode)
+	if err != nil {
+		return err
+	}
+	s.nextSegment++
+	s.segments[seg.no] = seg
+	s.active = seg
+	return nil
+}
+
+func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	if item == nil {
+		return "", logger.Wrapf(nil, "cannot add nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return "", logger.Wrapf(err, "cannot add invalid item")
+	}
+	if err := s.keyIndex.Check("", s.uniqueKeys.Keys(item)); err != nil {
+		return "", logger.Wrapf(err, "cannot add duplicate")
+	}
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
+	if _, ok := s.keydir[id]; ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
+	}
+
+	if err := s.put(fileItem{ID: id, Item: item, Meta: items.NewMeta(actor)}); err != nil {
+		return "", logger.Wrapf(err, "failed to add %s", s.itemName)
+	}
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
+	return id, nil
+} //store.add()
+
+func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if item == nil {
+		return logger.Wrapf(nil, "cannot upd nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "cannot upd invalid item")
+	}
+	loc, ok := s.keydir[id]
+	if !ok {
+		return logger.Wrapf(nil, "id=%s does not exist", id)
+	}
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
+		return logger.Wrapf(err, "upd will make a duplicate")
+	}
+	old, err := s.readItem(loc)
+	if err != nil {
+		return logger.Wrapf(err, "failed to upd %s.id=%s", s.itemName, id)
+	}
+	if err := s.hooks.CheckUpd(id, old.Item, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	if err := s.put(fileItem{ID: id, Item: item, Meta: old.Meta.NextRev(actor)}); err != nil {
+		return logger.Wrapf(err, "failed to upd %s.id=%s", s.itemName, id)
+	}
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(old.Item))
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: old.Item})
+	return nil
+} //store.UpdBy()
+
+func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	loc, ok := s.keydir[id]
+	if !ok {
+		return nil //not found also return success
+	}
+	deleted, err := s.readItem(loc)
+	if err != nil {
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	if err := s.hooks.CheckDel(id, deleted.Item); err != nil {
+		return logger.Wrapf(err, "cannot del %s", s.itemName)
+	}
+
+	payload, _ := json.Marshal(fileItem{ID: id})
+	if _, err := s.write(id, opDel, payload); err != nil {
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(deleted.Item))
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deleted.Item})
+	return nil
+} //store.Del()
+
+func (s *store) Get(id string) (items.IItem, error) {
+	item, _, err := s.GetWithMeta(id)
+	return item, err
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+
+	loc, ok := s.keydir[id]
+	if !ok {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	fileItem, err := s.readItem(loc)
+	if err != nil {
+		return nil, items.Meta{}, logger.Wrapf(err, "failed to get %s.id=%s", s.itemName, id)
+	}
+	return fileItem.Item, fileItem.Meta, nil
+}
+
+//Find walks the items in the order of their ids, reading only as many items as needed for size
+func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	for _, id := range s.sortedIDs() {
+		fileItem, err := s.readItem(s.keydir[id])
+		if err != nil {
+			s.log.Errorf("Cannot read %s.id=%s: %+v", s.itemName, id, err)
+			continue
+		}
+		if filter != nil {
+			if err := fileItem.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: id, Item: fileItem.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.Find()
+
+//GetBy uses the in-memory index when the key is a single unique key,
+//else it walks the items to return the first match
+func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
+	s.log.Debugf("%s.GetBy(%+v)", s.Name(), key)
+	if len(key) == 1 {
+		for n, v := range key {
+			if id, ok := s.keyIndex.Get(n, v); ok {
+				if fileItem, err := s.readItem(s.keydir[id]); err == nil && fileItem.Item.MatchKey(key) {
+					return id, fileItem.Item, nil
+				}
+			}
+		}
+	}
+	for _, id := range s.sortedIDs() {
+		fileItem, err := s.readItem(s.keydir[id])
+		if err != nil {
+			return "", nil, logger.Wrapf(err, "failed to get %s{%v}", s.itemName, key)
+		}
+		if fileItem.Item.MatchKey(key) {
+			return id, fileItem.Item, nil
+		}
+	}
+	return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+} //store.GetBy()
+
+func (s *store) sortedIDs() []string {
+	ids := make([]string, 0, len(s.keydir))
+	for id := range s.keydir {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//put appends the item to the active segment
+func (s *store) put(fi fileItem) error {
+	payload, err := json.Marshal(fi)
+	if err != nil {
+		return logger.Wrapf(err, "failed to encode %s.id=%s", s.itemName, fi.ID)
+	}
+	_, err = s.write(fi.ID, opPut, payload)
+	return err
+}
+
+//write appends a record to the active segment and updates the key directory,
+//starting a new segment when the active segment is full
+func (s *store) write(id string, op byte, payload []byte) (location, error) {
+	if len(payload) > maxPayloadSize {
+		return location{}, logger.Wrapf(nil, "%s.id=%s encoded in %d bytes > %d", s.itemName, id, len(payload), maxPayloadSize)
+	}
+	if s.active.size >= s.segmentSize {
+		if err := s.newActiveSegment(); err != nil {
+			return location{}, err
+		}
+	}
+	seq := s.seq + 1
+	loc, err := s.active.append(encodeRecord(seq, op, payload), seq, s.syncWrites)
+	if err != nil {
+		return location{}, err
+	}
+	s.seq = seq
+	if prev, ok := s.keydir[id]; ok {
+		s.segments[prev.segment].dead += int64(prev.size)
+	}
+	if op == opDel {
+		//the tombstone is only needed until the older records were merged
+		delete(s.keydir, id)
+		s.active.dead += int64(loc.size)
+	} else {
+		s.keydir[id] = loc
+	}
+	return loc, nil
+} //store.write()
+
+//readItem reads and decodes the record at the location
+func (s *store) readItem(loc location) (fileItem, error) {
+	seg, ok := s.segments[loc.segment]
+	if !ok {
+		return fileItem{}, logger.Wrapf(nil, "segment %d does not exist", loc.segment)
+	}
+	rec, err := seg.read(loc)
+	if err != nil {
+		return fileItem{}, err
+	}
+	//using the store's fileItemType (including _id)
+	fileItemPtrValue := reflect.New(s.fileItemType)
+	if err := json.Unmarshal(rec.payload, fileItemPtrValue.Interface()); err != nil {
+		return fileItem{}, logger.Wrapf(err, "cannot decode %s", s.itemName)
+	}
+	fileItemValue := fileItemPtrValue.Elem()
+	id := fileItemValue.Field(0).Interface().(string)
+	if itemValue := fileItemValue.Field(1); itemValue.Kind() == reflect.Ptr && itemValue.IsNil() {
+		return fileItem{}, logger.Wrapf(nil, "id=%s has no item data", id)
+	}
+	return fileItem{
+		ID:   id,
+		Item: fileItemValue.Field(1).Interface().(items.IItem),
+		Meta: fileItemValue.Field(2).Interface().(items.Meta),
+	}, nil
+} //store.readItem()
+
+//recordID returns the id of an item or tombstone record
+func recordID(rec record) (string, error) {
+	var idOnly struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(rec.payload, &idOnly); err != nil {
+		return "", logger.Wrapf(err, "cannot decode record")
+	}
+	if idOnly.ID == "" {
+		return "", logger.Wrapf(nil, "missing id")
+	}
+	return idOnly.ID, nil
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+func (s *store) Uses(fieldName string, itemStore items.IStore) error {
+	return logger.Wrapf(nil, "Not yet implemented")
+}
+
+//Close stops merging, delivers queued notifications, closes the segments and releases the directory lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.mergeStop)
+	s.mutex.Unlock()
+
+	//wait without the lock, because a merge may be busy
+	s.merging.Wait()
+	s.mergeMutex.Lock()
+	s.closeSegments()
+	s.mergeMutex.Unlock()
+	s.notifier.Close()
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.dir)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.dir)
+	return nil
+} //store.Close()
+
+func (s *store) closeSegments() {
+	for _, seg := range s.segments {
+		if err := seg.file.Close(); err != nil {
+			s.log.Errorf("Failed to close %s: %v", seg.file.Name(), err)
+		}
+	}
+}
+
+//fileItem is stored in each record
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta
+type fileItem struct {
+	ID   string      `json:"_id"`
+	Item items.IItem `json:"item,omitempty"`
+	Meta items.Meta  `json:"_meta"`
+}
+
+//fileItemType is fileItem with the user item type instead of the IItem interface,
+//so that records can be decoded into the user item type
+func fileItemType(itemType reflect.Type) reflect.Type {
+	structFields := make([]reflect.StructField, 0)
+	t := reflect.TypeOf(fileItem{})
+	for i := 0; i < t.NumField(); i++ {
+		structFields = append(structFields, t.Field(i))
+	}
+	structFields[1].Type = itemType
+	return reflect.StructOf(structFields)
+}
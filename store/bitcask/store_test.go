@@ -0,0 +1,205 @@
+package bitcask_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/bitcask"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/storetest"
+)
+
+func TestMain(m *testing.M) {
+	os.MkdirAll("./share", 0770)
+	os.Exit(m.Run())
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(dir + "/*.seg")
+	if err != nil {
+		t.Fatalf("Cannot list segments: %v", err)
+	}
+	return files
+}
+
+func TestStore(t *testing.T) {
+	os.RemoveAll("./share/users")
+	storetest.Run(t, func() (items.IStore, error) {
+		return bitcask.New("./share", "users", storetest.User{})
+	})
+}
+
+//TestReopen checks that the keydir and index are built again from the segments
+func TestReopen(t *testing.T) {
+	os.RemoveAll("./share/reopened")
+	s, err := bitcask.New("./share", "reopened", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, _ := s.Add(storetest.User{Name: "A", Rev: 1})
+	keepID, _ := s.Add(storetest.User{Name: "keep", Rev: 2})
+	if err := s.(items.IStoreWithMeta).UpdBy("jan", id, storetest.User{Name: "B", Rev: 2}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	aID, _ := s.Add(storetest.User{Name: "A", Rev: 3})
+	if err := s.Del(aID); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	s.Close()
+
+	s, err = bitcask.New("./share", "reopened", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if item, meta, err := s.(items.IStoreWithMeta).GetWithMeta(id); err != nil || item.(storetest.User).Name != "B" || meta.Rev != 2 || meta.UpdatedBy != "jan" {
+		t.Fatalf("GetWithMeta -> %+v %+v %v", item, meta, err)
+	}
+	if _, err := s.Get(aID); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	if list := s.Find(0, storetest.User{Rev: 2}); len(list) != 2 {
+		t.Fatalf("Find -> %+v", list)
+	}
+	if gotID, _, err := s.GetBy(map[string]interface{}{"name": "keep"}); err != nil || gotID != keepID {
+		t.Fatalf("GetBy -> %s %v", gotID, err)
+	}
+	if _, err := s.Add(storetest.User{Name: "B"}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate after reopen: %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir := "./share/merged"
+	os.RemoveAll(dir)
+	seq, _ := idgen.Sequential("")
+	s, err := bitcask.NewWithOptions("./share", "merged", storetest.User{}, bitcask.WithIDGenerator(seq), bitcask.WithSegmentSize(1024))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Add(storetest.User{Name: fmt.Sprintf("user%d", i)})
+	}
+	for rev := 1; rev <= 5; rev++ {
+		for i := 1; i <= 100; i += 2 {
+			if err := s.Upd(fmt.Sprintf("%d", i), storetest.User{Name: fmt.Sprintf("user%d", i-1), Rev: rev}); err != nil {
+				t.Fatalf("Failed to update: %+v", err)
+			}
+		}
+	}
+	for i := 2; i <= 100; i += 2 {
+		s.Del(fmt.Sprintf("%d", i))
+	}
+	before := len(segmentFiles(t, dir))
+	if err := s.(interface{ Merge() error }).Merge(); err != nil {
+		t.Fatalf("Failed to merge: %+v", err)
+	}
+	after := len(segmentFiles(t, dir))
+	if after >= before/2 {
+		t.Fatalf("%d segments after merge of %d", after, before)
+	}
+	if item, err := s.Get("99"); err != nil || item.(storetest.User).Rev != 5 {
+		t.Fatalf("Get after merge -> %+v %v", item, err)
+	}
+	s.Close()
+
+	//deleted items stay deleted although their tombstones were merged away
+	seq, _ = idgen.Sequential("")
+	s, err = bitcask.NewWithOptions("./share", "merged", storetest.User{}, bitcask.WithIDGenerator(seq), bitcask.WithSegmentSize(1024),
+		bitcask.WithMerge(bitcask.MergeOptions{Interval: time.Millisecond * 50}))
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if list := s.Find(0, nil); len(list) != 50 {
+		t.Fatalf("Find -> %d items", len(list))
+	}
+	if _, err := s.Get("2"); err == nil {
+		t.Fatalf("Got deleted item after merge")
+	}
+	if id, err := s.Add(storetest.User{Name: "new"}); err != nil || id != "101" {
+		t.Fatalf("Add -> %s %v", id, err)
+	}
+
+	//merged in the background
+	for i := 1; i <= 100; i += 2 {
+		s.Del(fmt.Sprintf("%d", i))
+	}
+	before = len(segmentFiles(t, dir))
+	time.Sleep(time.Millisecond * 200)
+	if after := len(segmentFiles(t, dir)); after >= before {
+		t.Fatalf("%d segments after background merge of %d", after, before)
+	}
+	if list := s.Find(0, nil); len(list) != 1 || list[0].ID != "101" {
+		t.Fatalf("Find -> %+v", list)
+	}
+}
+
+//TestTornWrite opens a store with an incomplete record at the end of a segment
+func TestTornWrite(t *testing.T) {
+	dir := "./share/torn"
+	os.RemoveAll(dir)
+	s, err := bitcask.New("./share", "torn", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, _ := s.Add(storetest.User{Name: "A"})
+	s.Close()
+	files := segmentFiles(t, dir)
+	data, _ := ioutil.ReadFile(files[0])
+	ioutil.WriteFile(files[0], append(data, data[:len(data)-3]...), 0666)
+
+	s, err = bitcask.New("./share", "torn", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if item, err := s.Get(id); err != nil || item.(storetest.User).Name != "A" {
+		t.Fatalf("Get -> %+v %v", item, err)
+	}
+	if info, _ := os.Stat(files[0]); info.Size() != int64(len(data)) {
+		t.Fatalf("Segment not truncated: %d bytes", info.Size())
+	}
+}
+
+func TestSliceKey(t *testing.T) {
+	os.RemoveAll("./share/tagged")
+	//a key that cannot be compared with == must not panic in the index
+	tags := bitcask.WithUniqueKey("tags", func(item items.IItem) interface{} {
+		return []string{"rev", fmt.Sprintf("%d", item.(storetest.User).Rev)}
+	})
+	s, err := bitcask.NewWithOptions("./share", "tagged", storetest.User{}, tags)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, err := s.Add(storetest.User{Name: "A", Rev: 1})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(storetest.User{Name: "B", Rev: 1}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate slice key: %v", err)
+	}
+	if err := s.Upd(id, storetest.User{Name: "A", Rev: 2}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	s.Close()
+
+	//the index is built again from the segments
+	s, err = bitcask.NewWithOptions("./share", "tagged", storetest.User{}, tags)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %+v", err)
+	}
+	defer s.Close()
+	if _, err := s.Add(storetest.User{Name: "B", Rev: 1}); err != nil {
+		t.Fatalf("Failed to add old key of updated item: %+v", err)
+	}
+	if _, err := s.Add(storetest.User{Name: "C", Rev: 2}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate slice key after reopen: %v", err)
+	}
+}
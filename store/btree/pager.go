@@ -0,0 +1,381 @@
+package btree
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/stewelarend/logger"
+)
+
+//pageSize is the size of every page in the file
+const pageSize = 4096
+
+//page types, in the first byte of each page
+const (
+	pageHeader   byte = 1
+	pageLeaf     byte = 2
+	pageInternal byte = 3
+	pageRecord   byte = 4
+	pageFree     byte = 5
+)
+
+var (
+	fileMagic = []byte("IBT1")
+	walMagic  = []byte("IBW1")
+)
+
+//header is page 0 of the file
+type header struct {
+	pageCount uint32            //pages in the file, including the header
+	freeHead  uint32            //first page in the list of free pages, 0 when none
+	root      uint32            //of the primary tree by id
+	indexRoot map[string]uint32 //of the secondary tree of each unique key
+}
+
+func (h header) clone() header {
+	c := h
+	c.indexRoot = make(map[string]uint32, len(h.indexRoot))
+	for n, root := range h.indexRoot {
+		c.indexRoot[n] = root
+	}
+	return c
+}
+
+//pager reads and writes the pages of the file through a bounded cache
+//Changes are made in a transaction, which is written to the write-ahead log
+//before the pages in the file are changed, so that a crash never leaves
+//a partly written transaction: the log is replayed or discarded on open.
+type pager struct {
+	file        *os.File
+	filename    string
+	wal         *os.File
+	walFilename string
+	cacheSize   int
+	cache       map[uint32]*list.Element
+	lru         *list.List //of cachedPage, most recently used first
+	hdr         header
+	saved       header            //restored on rollback
+	dirty       map[uint32][]byte //pages changed in the transaction, nil when not in a transaction
+	broken      error             //the file may not match memory after a failed commit
+}
+
+type cachedPage struct {
+	no   uint32
+	data []byte
+}
+
+//openPager opens or creates the page file, after recovering from the write-ahead log
+func openPager(filename string, mode os.FileMode, cacheSize int) (*pager, error) {
+	p := &pager{
+		filename:    filename,
+		walFilename: strings.TrimSuffix(filename, path.Ext(filename)) + ".wal",
+		cacheSize:   cacheSize,
+		cache:       make(map[uint32]*list.Element),
+		lru:         list.New(),
+	}
+	var err error
+	if p.file, err = os.OpenFile(filename, os.O_CREATE|os.O_RDWR, mode); err != nil {
+		return nil, logger.Wrapf(err, "cannot open page file %s", filename)
+	}
+	if p.wal, err = os.OpenFile(p.walFilename, os.O_CREATE|os.O_RDWR, mode); err != nil {
+		p.file.Close()
+		return nil, logger.Wrapf(err, "cannot open write-ahead log %s", p.walFilename)
+	}
+	if err := p.open(); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+} //openPager()
+
+func (p *pager) open() error {
+	if err := p.recover(); err != nil {
+		return err
+	}
+	info, err := p.file.Stat()
+	if err != nil {
+		return logger.Wrapf(err, "cannot stat page file %s", p.filename)
+	}
+	if info.Size() == 0 {
+		//new file with the header and an empty primary tree
+		p.hdr = header{pageCount: 1, indexRoot: make(map[string]uint32)}
+		p.begin()
+		root, err := p.newLeaf()
+		if err != nil {
+			p.rollback()
+			return err
+		}
+		p.hdr.root = root
+		return p.commit()
+	}
+	if info.Size()%pageSize != 0 {
+		return logger.Wrapf(nil, "page file %s size %d is not a multiple of %d", p.filename, info.Size(), pageSize)
+	}
+	p.hdr.pageCount = uint32(info.Size() / pageSize)
+	data, err := p.read(0)
+	if err != nil {
+		return err
+	}
+	if p.hdr, err = decodeHeader(data); err != nil {
+		return logger.Wrapf(err, "invalid page file %s", p.filename)
+	}
+	if int64(p.hdr.pageCount)*pageSize != info.Size() {
+		return logger.Wrapf(nil, "page file %s has %d pages instead of %d", p.filename, info.Size()/pageSize, p.hdr.pageCount)
+	}
+	return nil
+} //pager.open()
+
+func (p *pager) close() error {
+	p.wal.Close()
+	return p.file.Close()
+}
+
+//read returns a page, which the caller must not modify
+func (p *pager) read(no uint32) ([]byte, error) {
+	if p.broken != nil {
+		return nil, p.broken
+	}
+	if data, ok := p.dirty[no]; ok {
+		return data, nil
+	}
+	if e, ok := p.cache[no]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(cachedPage).data, nil
+	}
+	if no >= p.hdr.pageCount {
+		return nil, logger.Wrapf(nil, "page %d is beyond the end of %s", no, p.filename)
+	}
+	data := make([]byte, pageSize)
+	if _, err := p.file.ReadAt(data, int64(no)*pageSize); err != nil {
+		return nil, logger.Wrapf(err, "cannot read page %d of %s", no, p.filename)
+	}
+	p.cachePage(no, data)
+	return data, nil
+} //pager.read()
+
+//cachePage keeps the page, removing the least recently used pages to stay within the cache size
+func (p *pager) cachePage(no uint32, data []byte) {
+	if e, ok := p.cache[no]; ok {
+		e.Value = cachedPage{no: no, data: data}
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.cache[no] = p.lru.PushFront(cachedPage{no: no, data: data})
+	for p.lru.Len() > p.cacheSize {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.cache, oldest.Value.(cachedPage).no)
+	}
+}
+
+//write changes a page in the transaction
+func (p *pager) write(no uint32, data []byte) {
+	p.dirty[no] = data
+}
+
+//alloc returns a page for the transaction, reusing free pages first
+func (p *pager) alloc() (uint32, error) {
+	if p.hdr.freeHead == 0 {
+		no := p.hdr.pageCount
+		p.hdr.pageCount++
+		return no, nil
+	}
+	no := p.hdr.freeHead
+	data, err := p.read(no)
+	if err != nil {
+		return 0, err
+	}
+	if data[0] != pageFree {
+		return 0, logger.Wrapf(nil, "free page %d has type %d", no, data[0])
+	}
+	p.hdr.freeHead = binary.BigEndian.Uint32(data[1:5])
+	return no, nil
+}
+
+//free adds the page to the list of free pages in the transaction
+func (p *pager) free(no uint32) {
+	data := make([]byte, pageSize)
+	data[0] = pageFree
+	binary.BigEndian.PutUint32(data[1:5], p.hdr.freeHead)
+	p.write(no, data)
+	p.hdr.freeHead = no
+}
+
+func (p *pager) begin() {
+	p.dirty = make(map[uint32][]byte)
+	p.saved = p.hdr.clone()
+}
+
+func (p *pager) rollback() {
+	p.dirty = nil
+	p.hdr = p.saved
+}
+
+//commit writes the transaction to the write-ahead log, then to the page file
+func (p *pager) commit() error {
+	if p.broken != nil {
+		p.rollback()
+		return p.broken
+	}
+	headerData, err := p.hdr.encode()
+	if err != nil {
+		p.rollback()
+		return err
+	}
+	p.write(0, headerData)
+	pageNos := make([]uint32, 0, len(p.dirty))
+	for no := range p.dirty {
+		pageNos = append(pageNos, no)
+	}
+	sort.Slice(pageNos, func(i, j int) bool { return pageNos[i] < pageNos[j] })
+
+	//the transaction is committed once the log is synced
+	if err := p.writeWAL(p.walData(pageNos)); err != nil {
+		p.rollback()
+		return err
+	}
+
+	//a failure from here is repaired by replaying the log when the file is opened again
+	for _, no := range pageNos {
+		if _, err := p.file.WriteAt(p.dirty[no], int64(no)*pageSize); err != nil {
+			p.broken = logger.Wrapf(err, "cannot write page %d of %s, reopen to recover", no, p.filename)
+			return p.broken
+		}
+	}
+	if err := p.file.Sync(); err != nil {
+		p.broken = logger.Wrapf(err, "cannot sync %s, reopen to recover", p.filename)
+		return p.broken
+	}
+	if err := p.wal.Truncate(0); err != nil {
+		p.broken = logger.Wrapf(err, "cannot clear write-ahead log %s, reopen to recover", p.walFilename)
+		return p.broken
+	}
+	for _, no := range pageNos {
+		p.cachePage(no, p.dirty[no])
+	}
+	p.dirty = nil
+	return nil
+} //pager.commit()
+
+//walData is the log of the transaction: [magic][count uint32], then for each page
+//[page number uint32][page], then [crc32 uint32] of all before it
+func (p *pager) walData(pageNos []uint32) []byte {
+	var buf bytes.Buffer
+	buf.Write(walMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(len(pageNos)))
+	for _, no := range pageNos {
+		binary.Write(&buf, binary.BigEndian, no)
+		buf.Write(p.dirty[no])
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func (p *pager) writeWAL(data []byte) error {
+	if err := p.wal.Truncate(0); err != nil {
+		return logger.Wrapf(err, "cannot clear write-ahead log %s", p.walFilename)
+	}
+	if _, err := p.wal.WriteAt(data, 0); err != nil {
+		return logger.Wrapf(err, "cannot write write-ahead log %s", p.walFilename)
+	}
+	if err := p.wal.Sync(); err != nil {
+		return logger.Wrapf(err, "cannot sync write-ahead log %s", p.walFilename)
+	}
+	return nil
+}
+
+//recover writes the pages of a complete transaction in the log to the page file
+//an incomplete transaction was not committed and is discarded
+func (p *pager) recover() error {
+	info, err := p.wal.Stat()
+	if err != nil {
+		return logger.Wrapf(err, "cannot stat write-ahead log %s", p.walFilename)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	data := make([]byte, info.Size())
+	if _, err := p.wal.ReadAt(data, 0); err != nil {
+		return logger.Wrapf(err, "cannot read write-ahead log %s", p.walFilename)
+	}
+	complete := len(data) >= 12 && bytes.Equal(data[:4], walMagic)
+	if complete {
+		count := int(binary.BigEndian.Uint32(data[4:8]))
+		complete = len(data) == 8+count*(4+pageSize)+4 &&
+			binary.BigEndian.Uint32(data[len(data)-4:]) == crc32.ChecksumIEEE(data[:len(data)-4])
+	}
+	if complete {
+		for offset := 8; offset < len(data)-4; offset += 4 + pageSize {
+			no := binary.BigEndian.Uint32(data[offset : offset+4])
+			if _, err := p.file.WriteAt(data[offset+4:offset+4+pageSize], int64(no)*pageSize); err != nil {
+				return logger.Wrapf(err, "cannot recover page %d of %s", no, p.filename)
+			}
+		}
+		if err := p.file.Sync(); err != nil {
+			return logger.Wrapf(err, "cannot sync %s", p.filename)
+		}
+		log.Infof("Recovered %s from write-ahead log %s", p.filename, p.walFilename)
+	} else {
+		log.Errorf("Discarded incomplete transaction in write-ahead log %s", p.walFilename)
+	}
+	if err := p.wal.Truncate(0); err != nil {
+		return logger.Wrapf(err, "cannot clear write-ahead log %s", p.walFilename)
+	}
+	return nil
+} //pager.recover()
+
+//encode the header into page 0
+func (h header) encode() ([]byte, error) {
+	data := make([]byte, pageSize)
+	data[0] = pageHeader
+	copy(data[1:5], fileMagic)
+	binary.BigEndian.PutUint32(data[5:9], h.pageCount)
+	binary.BigEndian.PutUint32(data[9:13], h.freeHead)
+	binary.BigEndian.PutUint32(data[13:17], h.root)
+	binary.BigEndian.PutUint16(data[17:19], uint16(len(h.indexRoot)))
+	names := make([]string, 0, len(h.indexRoot))
+	for n := range h.indexRoot {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	offset := 19
+	for _, n := range names {
+		if len(n) > 255 || offset+1+len(n)+4 > pageSize {
+			return nil, logger.Wrapf(nil, "too many unique keys to store in the header")
+		}
+		data[offset] = byte(len(n))
+		copy(data[offset+1:], n)
+		binary.BigEndian.PutUint32(data[offset+1+len(n):], h.indexRoot[n])
+		offset += 1 + len(n) + 4
+	}
+	return data, nil
+} //header.encode()
+
+func decodeHeader(data []byte) (header, error) {
+	if data[0] != pageHeader || !bytes.Equal(data[1:5], fileMagic) {
+		return header{}, logger.Wrapf(nil, "not a page file")
+	}
+	h := header{
+		pageCount: binary.BigEndian.Uint32(data[5:9]),
+		freeHead:  binary.BigEndian.Uint32(data[9:13]),
+		root:      binary.BigEndian.Uint32(data[13:17]),
+		indexRoot: make(map[string]uint32),
+	}
+	count := int(binary.BigEndian.Uint16(data[17:19]))
+	offset := 19
+	for i := 0; i < count; i++ {
+		l := int(data[offset])
+		if offset+1+l+4 > pageSize {
+			return header{}, logger.Wrapf(nil, "invalid list of unique keys")
+		}
+		h.indexRoot[string(data[offset+1:offset+1+l])] = binary.BigEndian.Uint32(data[offset+1+l:])
+		offset += 1 + l + 4
+	}
+	return h, nil
+} //decodeHeader()
@@ -0,0 +1,620 @@
+//Package btree implements a IItem store in a single page file for large numbers of items
+//Items are kept in a B+tree by id and each unique key has its own B+tree on disk,
+//so memory use is bounded by the page cache rather than by the number of items.
+//Changes are written to a write-ahead log first, so that the file can be recovered after a crash.
+package btree
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/changelog"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+var (
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-_]*[a-zA-Z0-9]$`)
+)
+
+//DefaultCacheSize is the number of pages kept in memory unless WithCacheSize() is used
+var DefaultCacheSize = 1024
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids in the file
+type IIDGenerator interface {
+	NewID() string
+}
+
+//New makes a new items.IStore using a single page file
+func New(filename string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(filename, name, tmpl)
+}
+
+//NewWithOptions makes a new items.IStore using a single page file, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(filename string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	filename = path.Clean(filename)
+	if len(name) == 0 || !validName.MatchString(name) {
+		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
+	}
+	if tmpl == nil {
+		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
+	}
+	if _, ok := tmpl.(items.IItemWithID); ok {
+		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
+	}
+	s := &store{
+		filename:     filename,
+		fileMode:     0666,
+		itemName:     name,
+		itemTmpl:     tmpl,
+		itemType:     reflect.TypeOf(tmpl),
+		fileItemType: fileItemType(reflect.TypeOf(tmpl)),
+		idGen:        idgen.UUIDv4(),
+		cacheSize:    DefaultCacheSize,
+		uniqueKeys:   make(common.KeyFuncs),
+		hooks:        items.NewHooks(),
+		notifier:     items.NewNotifier(items.NotifySync),
+		log:          log,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+
+	//lock before reading so that no other store writes the file
+	baseFilename := strings.TrimSuffix(filename, path.Ext(filename))
+	lock, err := filelock.New(baseFilename + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock page file %s", filename)
+	}
+	s.lock = lock
+
+	if s.pager, err = openPager(filename, s.fileMode, s.cacheSize); err != nil {
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot access items in page file %s", filename)
+	}
+
+	//ids in the file must not be generated again
+	//only the keys of the tree are read, not the items
+	if _, ok := s.idGen.(idgen.IResumable); ok {
+		if err := s.pager.treeScan(s.pager.hdr.root, nil, func(key, val []byte) (bool, error) {
+			idgen.Resume(s.idGen, string(key))
+			return true, nil
+		}); err != nil {
+			s.pager.close()
+			s.lock.Unlock()
+			return nil, logger.Wrapf(err, "cannot read ids in page file %s", filename)
+		}
+	}
+
+	changes, err := changelog.Open(baseFilename+".changes", changelog.DefaultSize)
+	if err != nil {
+		s.pager.close()
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot open change log for page file %s", filename)
+	}
+	s.changes = changes
+	s.log.Debugf("Created page file store of %ss from file %s", s.itemName, s.filename)
+	return s, nil
+} //NewWithOptions()
+
+//store implements items.IStore for a page file
+type store struct {
+	mutex        sync.Mutex
+	filename     string
+	fileMode     os.FileMode
+	itemName     string
+	itemTmpl     items.IItem
+	itemType     reflect.Type
+	fileItemType reflect.Type
+	idGen        IIDGenerator
+	cacheSize    int //pages
+	pager        *pager
+	uniqueKeys   common.KeyFuncs //in addition to IItemWithUniqueKeys
+	changes      *changelog.Log
+	hooks        *items.Hooks
+	notifier     *items.Notifier
+	log          logger.ILogger
+	lock         *filelock.Lock
+	closed       bool
+}
+
+//Name ...
+func (s *store) Name() string {
+	return s.itemName
+}
+
+//Type ...
+func (s *store) Type() reflect.Type {
+	return s.itemType
+}
+
+//StructType ...
+func (s *store) StructType() reflect.Type {
+	if s.itemType.Kind() == reflect.Ptr {
+		return s.itemType.Elem()
+	}
+	return s.itemType
+}
+
+//Tmpl ...
+func (s *store) Tmpl() items.IItem {
+	return s.itemTmpl
+}
+
+func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	if item == nil {
+		return "", logger.Wrapf(nil, "cannot add nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return "", logger.Wrapf(err, "cannot add invalid item")
+	}
+	if err := s.checkUnique("", item); err != nil {
+		return "", logger.Wrapf(err, "cannot add duplicate")
+	}
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
+	if _, ok, err := s.pager.treeGet(s.pager.hdr.root, []byte(id)); err != nil {
+		return "", logger.Wrapf(err, "failed to add %s", s.itemName)
+	} else if ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
+	}
+
+	newFileItem := fileItem{ID: id, Item: item, Meta: items.NewMeta(actor)}
+	s.pager.begin()
+	if err := s.putItem(newFileItem); err != nil {
+		s.pager.rollback()
+		return "", logger.Wrapf(err, "failed to add %s", s.itemName)
+	}
+	if err := s.addToIndex(id, item); err != nil {
+		s.pager.rollback()
+		return "", logger.Wrapf(err, "failed to add %s", s.itemName)
+	}
+	if err := s.pager.commit(); err != nil {
+		return "", logger.Wrapf(err, "failed to add %s", s.itemName)
+	}
+	s.logChange(items.ChangeAdd, id)
+
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
+	return id, nil
+} //store.add()
+
+func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if item == nil {
+		return logger.Wrapf(nil, "cannot upd nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "cannot upd invalid item")
+	}
+	if err := s.checkUnique(id, item); err != nil {
+		return logger.Wrapf(err, "upd will make a duplicate")
+	}
+	old, recordNo, err := s.getItem(id)
+	if err != nil {
+		return err
+	}
+	if err := s.hooks.CheckUpd(id, old.Item, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	s.pager.begin()
+	err = s.pager.freeRecord(recordNo)
+	if err == nil {
+		err = s.putItem(fileItem{ID: id, Item: item, Meta: old.Meta.NextRev(actor)})
+	}
+	if err == nil {
+		err = s.delFromIndex(id, old.Item)
+	}
+	if err == nil {
+		err = s.addToIndex(id, item)
+	}
+	if err != nil {
+		s.pager.rollback()
+		return logger.Wrapf(err, "failed to upd %s.id=%s", s.itemName, id)
+	}
+	if err := s.pager.commit(); err != nil {
+		return logger.Wrapf(err, "failed to upd %s.id=%s", s.itemName, id)
+	}
+	s.logChange(items.ChangeUpd, id)
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: old.Item})
+	return nil
+} //store.UpdBy()
+
+func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	val, ok, err := s.pager.treeGet(s.pager.hdr.root, []byte(id))
+	if err != nil {
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	if !ok {
+		return nil //not found also return success
+	}
+	deleted, recordNo, err := s.readItem(val)
+	if err != nil {
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	if err := s.hooks.CheckDel(id, deleted.Item); err != nil {
+		return logger.Wrapf(err, "cannot del %s", s.itemName)
+	}
+
+	s.pager.begin()
+	err = s.pager.freeRecord(recordNo)
+	if err == nil {
+		s.pager.hdr.root, _, err = s.pager.treeDel(s.pager.hdr.root, []byte(id))
+	}
+	if err == nil {
+		err = s.delFromIndex(id, deleted.Item)
+	}
+	if err != nil {
+		s.pager.rollback()
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	if err := s.pager.commit(); err != nil {
+		return logger.Wrapf(err, "failed to del %s.id=%s", s.itemName, id)
+	}
+	s.logChange(items.ChangeDel, id)
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deleted.Item})
+	return nil
+} //store.Del()
+
+func (s *store) Get(id string) (items.IItem, error) {
+	item, _, err := s.GetWithMeta(id)
+	return item, err
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+	existing, _, err := s.getItem(id)
+	if err != nil {
+		return nil, items.Meta{}, err
+	}
+	return existing.Item, existing.Meta, nil
+}
+
+//Find walks the items in the order of their ids, reading only as many pages as needed for size
+func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	if err := s.pager.treeScan(s.pager.hdr.root, nil, func(key, val []byte) (bool, error) {
+		fileItem, _, err := s.readItem(val)
+		if err != nil {
+			s.log.Errorf("Cannot read %s.id=%s: %+v", s.itemName, key, err)
+			return true, nil
+		}
+		if filter != nil {
+			if err := fileItem.Item.Match(filter); err != nil {
+				return true, nil
+			}
+		}
+		list = append(list, items.IDAndItem{ID: fileItem.ID, Item: fileItem.Item})
+		return size <= 0 || len(list) < size, nil
+	}); err != nil {
+		s.log.Errorf("Failed to find %ss: %+v", s.itemName, err)
+	}
+	return list
+} //store.Find()
+
+//GetBy looks up the item in the unique index when the key is a single unique key,
+//else it walks the items to return the first match
+//The index has the keys of all items, so a key that is not in it is not found.
+func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
+	s.log.Debugf("%s.GetBy(%+v)", s.Name(), key)
+	if len(key) == 1 {
+		for n, v := range key {
+			if _, ok := s.pager.hdr.indexRoot[n]; !ok {
+				continue
+			}
+			id, ok, err := s.indexGet(n, v)
+			if err != nil {
+				return "", nil, logger.Wrapf(err, "failed to get %s{%v}", s.itemName, key)
+			}
+			if ok {
+				fileItem, _, err := s.getItem(id)
+				if err != nil {
+					return "", nil, logger.Wrapf(err, "failed to get %s{%v}", s.itemName, key)
+				}
+				if fileItem.Item.MatchKey(key) {
+					return id, fileItem.Item, nil
+				}
+			}
+			return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+		}
+	}
+
+	var found *fileItem
+	if err := s.pager.treeScan(s.pager.hdr.root, nil, func(k, val []byte) (bool, error) {
+		fileItem, _, err := s.readItem(val)
+		if err != nil {
+			return false, err
+		}
+		if fileItem.Item.MatchKey(key) {
+			found = &fileItem
+			return false, nil
+		}
+		return true, nil
+	}); err != nil {
+		return "", nil, logger.Wrapf(err, "failed to get %s{%v}", s.itemName, key)
+	}
+	if found == nil {
+		return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+	}
+	return found.ID, found.Item, nil
+} //store.GetBy()
+
+//getItem returns the item with the id and the first page of its record
+func (s *store) getItem(id string) (fileItem, uint32, error) {
+	val, ok, err := s.pager.treeGet(s.pager.hdr.root, []byte(id))
+	if err != nil {
+		return fileItem{}, 0, logger.Wrapf(err, "failed to get %s.id=%s", s.itemName, id)
+	}
+	if !ok {
+		return fileItem{}, 0, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return s.readItem(val)
+}
+
+//readItem decodes the record referred to by the value in the tree of ids
+func (s *store) readItem(val []byte) (fileItem, uint32, error) {
+	if len(val) != 4 {
+		return fileItem{}, 0, logger.Wrapf(nil, "invalid record reference %x", val)
+	}
+	recordNo := binary.BigEndian.Uint32(val)
+	data, err := s.pager.readRecord(recordNo)
+	if err != nil {
+		return fileItem{}, 0, err
+	}
+	//using the store's fileItemType (including _id)
+	fileItemPtrValue := reflect.New(s.fileItemType)
+	if err := json.Unmarshal(data, fileItemPtrValue.Interface()); err != nil {
+		return fileItem{}, 0, logger.Wrapf(err, "cannot decode %s in record %d", s.itemName, recordNo)
+	}
+	fileItemValue := fileItemPtrValue.Elem()
+	return fileItem{
+		ID:   fileItemValue.Field(0).Interface().(string),
+		Item: fileItemValue.Field(1).Interface().(items.IItem),
+		Meta: fileItemValue.Field(2).Interface().(items.Meta),
+	}, recordNo, nil
+} //store.readItem()
+
+//putItem writes the item as a record and refers to it in the tree of ids,
+//in the transaction
+func (s *store) putItem(fi fileItem) error {
+	data, err := json.Marshal(fi)
+	if err != nil {
+		return logger.Wrapf(err, "failed to encode %s.id=%s", s.itemName, fi.ID)
+	}
+	recordNo, err := s.pager.writeRecord(data)
+	if err != nil {
+		return err
+	}
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, recordNo)
+	root, err := s.pager.treePut(s.pager.hdr.root, []byte(fi.ID), val)
+	if err != nil {
+		return logger.Wrapf(err, "cannot store %s.id=%s", s.itemName, fi.ID)
+	}
+	s.pager.hdr.root = root
+	return nil
+}
+
+//indexGet returns the id of the item with the key value
+func (s *store) indexGet(name string, v interface{}) (string, bool, error) {
+	root, ok := s.pager.hdr.indexRoot[name]
+	if !ok {
+		return "", false, nil
+	}
+	id, ok, err := s.pager.treeGet(root, []byte(common.EncodeKey(v)))
+	return string(id), ok, err
+}
+
+//checkUnique fails if another item than id has the same value for one of the item keys
+func (s *store) checkUnique(id string, item items.IItem) error {
+	for n, v := range s.uniqueKeys.Keys(item) {
+		otherID, ok, err := s.indexGet(n, v)
+		if err != nil {
+			return logger.Wrapf(err, "cannot check key %s", n)
+		}
+		if ok && otherID != id {
+			return common.DuplicateKey(s.itemName, id, n, v, otherID)
+		}
+	}
+	return nil
+}
+
+//addToIndex adds the item keys to the index trees in the transaction,
+//creating the tree of a key that was not used before
+func (s *store) addToIndex(id string, item items.IItem) error {
+	for n, v := range s.uniqueKeys.Keys(item) {
+		var err error
+		root, ok := s.pager.hdr.indexRoot[n]
+		if !ok {
+			if root, err = s.pager.newLeaf(); err != nil {
+				return err
+			}
+		}
+		if root, err = s.pager.treePut(root, []byte(common.EncodeKey(v)), []byte(id)); err != nil {
+			return logger.Wrapf(err, "cannot index %s=%v", n, v)
+		}
+		s.pager.hdr.indexRoot[n] = root
+	}
+	return nil
+}
+
+//delFromIndex removes the item keys that refer to id from the index trees in the transaction
+func (s *store) delFromIndex(id string, item items.IItem) error {
+	for n, v := range s.uniqueKeys.Keys(item) {
+		if otherID, ok, err := s.indexGet(n, v); err != nil || !ok || otherID != id {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		root, _, err := s.pager.treeDel(s.pager.hdr.indexRoot[n], []byte(common.EncodeKey(v)))
+		if err != nil {
+			return err
+		}
+		s.pager.hdr.indexRoot[n] = root
+	}
+	return nil
+}
+
+//Seq returns the sequence of the last change
+func (s *store) Seq() uint64 {
+	return s.changes.Seq()
+}
+
+//ChangesSince returns the changes made after seq
+func (s *store) ChangesSince(seq uint64) ([]items.Change, error) {
+	return s.changes.Since(seq)
+}
+
+//logChange records a change that was already applied
+func (s *store) logChange(op items.ChangeOp, id string) {
+	if _, err := s.changes.Append(op, id); err != nil {
+		s.log.Errorf("Failed to log %s.%s(%s): %+v", s.itemName, op, id, err)
+	}
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+func (s *store) Uses(fieldName string, itemStore items.IStore) error {
+	return logger.Wrapf(nil, "Not yet implemented")
+}
+
+//Close delivers queued notifications, then closes the page file and releases the file lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.pager.close()
+	s.mutex.Unlock()
+
+	s.notifier.Close()
+	if err != nil {
+		s.lock.Unlock()
+		return logger.Wrapf(err, "cannot close %s", s.filename)
+	}
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.filename)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.filename)
+	return nil
+} //store.Close()
+
+//fileItem is stored as the JSON record of each item
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta
+type fileItem struct {
+	ID   string      `json:"_id"`
+	Item items.IItem `json:"item"`
+	Meta items.Meta  `json:"_meta"`
+}
+
+//fileItemType is fileItem with the user item type instead of the IItem interface,
+//so that records can be decoded into the user item type
+func fileItemType(itemType reflect.Type) reflect.Type {
+	structFields := make([]reflect.StructField, 0)
+	t := reflect.TypeOf(fileItem{})
+	for i := 0; i < t.NumField(); i++ {
+		structFields = append(structFields, t.Field(i))
+	}
+	structFields[1].Type = itemType
+	return reflect.StructOf(structFields)
+}
@@ -0,0 +1,118 @@
+package btree_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/btree"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/storetest"
+)
+
+func TestStore(t *testing.T) {
+	for _, ext := range []string{".db", ".wal", ".changes"} {
+		os.Remove("./share/users" + ext)
+	}
+	storetest.Run(t, func() (items.IStore, error) {
+		return btree.New("./share/users.db", "user", storetest.User{})
+	})
+}
+
+//TestReopen checks that items and indexes are read from the file
+func TestReopen(t *testing.T) {
+	filename := "./share/reopened.db"
+	for _, ext := range []string{".db", ".wal", ".changes"} {
+		os.Remove("./share/reopened" + ext)
+	}
+	s, err := btree.New(filename, "user", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, _ := s.Add(storetest.User{Name: "A", Rev: 1})
+	s.Add(storetest.User{Name: "keep", Rev: 2})
+	if err := s.Upd(id, storetest.User{Name: "B", Rev: 2}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	aID, _ := s.Add(storetest.User{Name: "A", Rev: 3})
+	if err := s.Del(aID); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	s.Close()
+
+	s, err = btree.New(filename, "user", storetest.User{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if gotID, item, err := s.GetBy(map[string]interface{}{"name": "B"}); err != nil || gotID != id || item.(storetest.User).Rev != 2 {
+		t.Fatalf("GetBy -> %s %+v %v", gotID, item, err)
+	}
+	if _, _, err := s.GetBy(map[string]interface{}{"name": "A"}); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	if _, err := s.Add(storetest.User{Name: "keep"}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate after reopen: %v", err)
+	}
+	if changes, err := s.(items.IStoreWithChanges).ChangesSince(0); err != nil || len(changes) != 5 {
+		t.Fatalf("ChangesSince -> %+v, %v", changes, err)
+	}
+}
+
+//TestManyItems uses a small cache for more items than fit in it
+func TestManyItems(t *testing.T) {
+	filename := "./share/many.db"
+	for _, ext := range []string{".db", ".wal", ".changes"} {
+		os.Remove("./share/many" + ext)
+	}
+	seq, _ := idgen.Sequential("")
+	s, err := btree.NewWithOptions(filename, "user", storetest.User{}, btree.WithIDGenerator(seq), btree.WithCacheSize(32))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	bio := strings.Repeat("long text over more than one page ", 200)
+	for i := 0; i < 1000; i++ {
+		u := storetest.User{Name: fmt.Sprintf("user%d", i), Rev: i % 10}
+		if i%100 == 1 {
+			u.Bio = bio
+		}
+		if _, err := s.Add(u); err != nil {
+			t.Fatalf("Failed to add %d: %+v", i, err)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		if err := s.Del(fmt.Sprintf("%d", i+1)); err != nil {
+			t.Fatalf("Failed to delete %d: %+v", i, err)
+		}
+	}
+	s.Close()
+
+	seq, _ = idgen.Sequential("")
+	s, err = btree.NewWithOptions(filename, "user", storetest.User{}, btree.WithIDGenerator(seq), btree.WithCacheSize(32))
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if id, err := s.Add(storetest.User{Name: "new"}); err != nil || id != "1001" {
+		t.Fatalf("Add after reopen -> %s %v", id, err)
+	}
+	if list := s.Find(0, nil); len(list) != 501 {
+		t.Fatalf("Find -> %d items", len(list))
+	}
+
+	//items are found in the string order of their ids
+	if list := s.Find(3, storetest.User{Rev: 3}); len(list) != 3 || list[0].ID != "104" || list[1].ID != "114" {
+		t.Fatalf("Find(3) -> %+v", list)
+	}
+	if item, err := s.Get("202"); err != nil || item.(storetest.User).Bio != bio {
+		t.Fatalf("Get -> %v", err)
+	}
+	if id, _, err := s.GetBy(map[string]interface{}{"name": "user999"}); err != nil || id != "1000" {
+		t.Fatalf("GetBy -> %s %v", id, err)
+	}
+	if _, _, err := s.GetBy(map[string]interface{}{"name": "user0"}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "not found") {
+		t.Fatalf("GetBy deleted -> %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/stewelarend/logger"
+)
+
+//maxKeySize limits keys so that a split node always fits in a page
+const maxKeySize = 512
+
+//maxValueSize limits values stored in the tree, larger values are stored as records
+const maxValueSize = 512
+
+//node is a decoded tree page
+//leaf pages have a value for each key and link to the next leaf,
+//internal pages have one more child than keys,
+//with keys in children[i] >= keys[i-1] and < keys[i]
+type node struct {
+	leaf     bool
+	keys     [][]byte
+	vals     [][]byte //leaf only
+	children []uint32 //internal only
+	next     uint32   //next leaf, 0 for the last leaf
+}
+
+//node page: [type][count uint16][next uint32], then for each key:
+//leaf:     [len uint16][key][len uint16][value]
+//internal: [child uint32] then for each key [len uint16][key][child uint32]
+const nodeHeaderSize = 1 + 2 + 4
+
+func (n *node) size() int {
+	size := nodeHeaderSize
+	if !n.leaf {
+		size += 4
+	}
+	for i, k := range n.keys {
+		size += entrySize(n, i, k)
+	}
+	return size
+}
+
+func entrySize(n *node, i int, k []byte) int {
+	if n.leaf {
+		return 2 + len(k) + 2 + len(n.vals[i])
+	}
+	return 2 + len(k) + 4
+}
+
+func (n *node) encode() []byte {
+	data := make([]byte, pageSize)
+	data[0] = pageInternal
+	if n.leaf {
+		data[0] = pageLeaf
+	}
+	binary.BigEndian.PutUint16(data[1:3], uint16(len(n.keys)))
+	binary.BigEndian.PutUint32(data[3:7], n.next)
+	offset := nodeHeaderSize
+	if !n.leaf {
+		binary.BigEndian.PutUint32(data[offset:], n.children[0])
+		offset += 4
+	}
+	for i, k := range n.keys {
+		binary.BigEndian.PutUint16(data[offset:], uint16(len(k)))
+		offset += 2 + copy(data[offset+2:], k)
+		if n.leaf {
+			binary.BigEndian.PutUint16(data[offset:], uint16(len(n.vals[i])))
+			offset += 2 + copy(data[offset+2:], n.vals[i])
+		} else {
+			binary.BigEndian.PutUint32(data[offset:], n.children[i+1])
+			offset += 4
+		}
+	}
+	return data
+} //node.encode()
+
+func decodeNode(no uint32, data []byte) (*node, error) {
+	if data[0] != pageLeaf && data[0] != pageInternal {
+		return nil, logger.Wrapf(nil, "page %d has type %d instead of a tree node", no, data[0])
+	}
+	n := &node{leaf: data[0] == pageLeaf}
+	count := int(binary.BigEndian.Uint16(data[1:3]))
+	n.next = binary.BigEndian.Uint32(data[3:7])
+	offset := nodeHeaderSize
+	//read a length-prefixed slice, copied so that the node does not refer to the cached page
+	readBytes := func() ([]byte, bool) {
+		if offset+2 > pageSize {
+			return nil, false
+		}
+		l := int(binary.BigEndian.Uint16(data[offset:]))
+		if offset+2+l > pageSize {
+			return nil, false
+		}
+		b := append([]byte{}, data[offset+2:offset+2+l]...)
+		offset += 2 + l
+		return b, true
+	}
+	if !n.leaf {
+		n.children = append(n.children, binary.BigEndian.Uint32(data[offset:]))
+		offset += 4
+	}
+	for i := 0; i < count; i++ {
+		k, ok := readBytes()
+		if !ok {
+			return nil, logger.Wrapf(nil, "page %d entry %d is beyond the page", no, i)
+		}
+		n.keys = append(n.keys, k)
+		if n.leaf {
+			v, ok := readBytes()
+			if !ok {
+				return nil, logger.Wrapf(nil, "page %d entry %d is beyond the page", no, i)
+			}
+			n.vals = append(n.vals, v)
+		} else {
+			if offset+4 > pageSize {
+				return nil, logger.Wrapf(nil, "page %d entry %d is beyond the page", no, i)
+			}
+			n.children = append(n.children, binary.BigEndian.Uint32(data[offset:]))
+			offset += 4
+		}
+	}
+	return n, nil
+} //decodeNode()
+
+func (p *pager) readNode(no uint32) (*node, error) {
+	data, err := p.read(no)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(no, data)
+}
+
+func (p *pager) writeNode(no uint32, n *node) {
+	p.write(no, n.encode())
+}
+
+//newLeaf allocates an empty leaf, used as the root of a new tree
+func (p *pager) newLeaf() (uint32, error) {
+	no, err := p.alloc()
+	if err != nil {
+		return 0, err
+	}
+	p.writeNode(no, &node{leaf: true})
+	return no, nil
+}
+
+//childIndex is the child of an internal node that holds the key
+func (n *node) childIndex(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) > 0 })
+}
+
+//keyIndex is the position of the key in a leaf, or where it must be inserted
+func (n *node) keyIndex(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool { return bytes.Compare(n.keys[i], key) >= 0 })
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+//findLeaf returns the leaf that holds the key
+func (p *pager) findLeaf(root uint32, key []byte) (uint32, *node, error) {
+	no := root
+	for {
+		n, err := p.readNode(no)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n.leaf {
+			return no, n, nil
+		}
+		no = n.children[n.childIndex(key)]
+	}
+}
+
+//treeGet returns the value of the key
+func (p *pager) treeGet(root uint32, key []byte) ([]byte, bool, error) {
+	_, n, err := p.findLeaf(root, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if i, ok := n.keyIndex(key); ok {
+		return n.vals[i], true, nil
+	}
+	return nil, false, nil
+}
+
+//treePut sets the value of the key in the transaction and returns the root,
+//which changes when the root is split
+func (p *pager) treePut(root uint32, key, val []byte) (uint32, error) {
+	if len(key) == 0 || len(key) > maxKeySize {
+		return 0, logger.Wrapf(nil, "key length %d not in 1..%d", len(key), maxKeySize)
+	}
+	if len(val) > maxValueSize {
+		return 0, logger.Wrapf(nil, "value length %d > %d", len(val), maxValueSize)
+	}
+	split, sepKey, right, err := p.put(root, key, val)
+	if err != nil || !split {
+		return root, err
+	}
+	newRoot, err := p.alloc()
+	if err != nil {
+		return 0, err
+	}
+	p.writeNode(newRoot, &node{keys: [][]byte{sepKey}, children: []uint32{root, right}})
+	return newRoot, nil
+} //pager.treePut()
+
+//put the key in the subtree of page no, returning the new right page
+//and the first key in it when the page had to be split
+func (p *pager) put(no uint32, key, val []byte) (bool, []byte, uint32, error) {
+	n, err := p.readNode(no)
+	if err != nil {
+		return false, nil, 0, err
+	}
+	if n.leaf {
+		i, ok := n.keyIndex(key)
+		if ok {
+			n.vals[i] = val
+		} else {
+			n.keys = append(n.keys[:i], append([][]byte{key}, n.keys[i:]...)...)
+			n.vals = append(n.vals[:i], append([][]byte{val}, n.vals[i:]...)...)
+		}
+	} else {
+		i := n.childIndex(key)
+		split, sepKey, right, err := p.put(n.children[i], key, val)
+		if err != nil || !split {
+			return false, nil, 0, err
+		}
+		n.keys = append(n.keys[:i], append([][]byte{sepKey}, n.keys[i:]...)...)
+		n.children = append(n.children[:i+1], append([]uint32{right}, n.children[i+1:]...)...)
+	}
+	if n.size() <= pageSize {
+		p.writeNode(no, n)
+		return false, nil, 0, nil
+	}
+
+	//split where half of the entries by size are on the left,
+	//so both halves fit even with the largest keys
+	half, total := 0, 0
+	for i, k := range n.keys {
+		total += entrySize(n, i, k)
+	}
+	mid := 0
+	for mid < len(n.keys)-1 && half < total/2 {
+		half += entrySize(n, mid, n.keys[mid])
+		mid++
+	}
+	rightNo, err := p.alloc()
+	if err != nil {
+		return false, nil, 0, err
+	}
+	var right *node
+	var sepKey []byte
+	if n.leaf {
+		right = &node{leaf: true, keys: append([][]byte{}, n.keys[mid:]...), vals: append([][]byte{}, n.vals[mid:]...), next: n.next}
+		n.keys, n.vals, n.next = n.keys[:mid], n.vals[:mid], rightNo
+		sepKey = right.keys[0]
+	} else {
+		//the middle key moves up to the parent
+		right = &node{keys: append([][]byte{}, n.keys[mid+1:]...), children: append([]uint32{}, n.children[mid+1:]...)}
+		sepKey = n.keys[mid]
+		n.keys, n.children = n.keys[:mid], n.children[:mid+1]
+	}
+	p.writeNode(no, n)
+	p.writeNode(rightNo, right)
+	return true, sepKey, rightNo, nil
+} //pager.put()
+
+//treeDel removes the key in the transaction and returns the root,
+//which changes when the tree becomes shorter
+//Leaves that become empty are freed and unlinked from the previous leaf,
+//and internal pages are freed when they have no children left.
+func (p *pager) treeDel(root uint32, key []byte) (uint32, bool, error) {
+	found, empty, err := p.del(root, key, 0)
+	if err != nil || !found {
+		return root, found, err
+	}
+	if empty {
+		root, err := p.newLeaf()
+		return root, true, err
+	}
+	//an internal root with a single child is replaced by the child
+	for {
+		n, err := p.readNode(root)
+		if err != nil {
+			return 0, false, err
+		}
+		if n.leaf || len(n.keys) > 0 {
+			return root, true, nil
+		}
+		p.free(root)
+		root = n.children[0]
+	}
+} //pager.treeDel()
+
+//del removes the key from the subtree of page no, where prev is the subtree
+//with the leaf before it (0 for the first leaf), and returns true when the page
+//became empty and was freed
+func (p *pager) del(no uint32, key []byte, prev uint32) (bool, bool, error) {
+	n, err := p.readNode(no)
+	if err != nil {
+		return false, false, err
+	}
+	if n.leaf {
+		i, ok := n.keyIndex(key)
+		if !ok {
+			return false, false, nil
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.vals = append(n.vals[:i], n.vals[i+1:]...)
+		if len(n.keys) > 0 {
+			p.writeNode(no, n)
+			return true, false, nil
+		}
+		if prev != 0 {
+			prevNo, prevLeaf, err := p.lastLeaf(prev)
+			if err != nil {
+				return false, false, err
+			}
+			prevLeaf.next = n.next
+			p.writeNode(prevNo, prevLeaf)
+		}
+		p.free(no)
+		return true, true, nil
+	}
+
+	i := n.childIndex(key)
+	if i > 0 {
+		prev = n.children[i-1]
+	}
+	found, empty, err := p.del(n.children[i], key, prev)
+	if err != nil || !empty {
+		return found, false, err
+	}
+	//the key before the empty child, or after the first child, is no longer a separator
+	n.children = append(n.children[:i], n.children[i+1:]...)
+	if len(n.keys) > 0 {
+		k := i - 1
+		if k < 0 {
+			k = 0
+		}
+		n.keys = append(n.keys[:k], n.keys[k+1:]...)
+	}
+	if len(n.children) == 0 {
+		p.free(no)
+		return true, true, nil
+	}
+	p.writeNode(no, n)
+	return true, false, nil
+} //pager.del()
+
+//lastLeaf returns the last leaf in the subtree of page no
+func (p *pager) lastLeaf(no uint32) (uint32, *node, error) {
+	for {
+		n, err := p.readNode(no)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n.leaf {
+			return no, n, nil
+		}
+		no = n.children[len(n.children)-1]
+	}
+}
+
+//treeScan calls fn with the keys >= from in order, until fn returns false
+func (p *pager) treeScan(root uint32, from []byte, fn func(key, val []byte) (bool, error)) error {
+	_, n, err := p.findLeaf(root, from)
+	if err != nil {
+		return err
+	}
+	for {
+		i, _ := n.keyIndex(from)
+		for ; i < len(n.keys); i++ {
+			if more, err := fn(n.keys[i], n.vals[i]); err != nil || !more {
+				return err
+			}
+		}
+		if n.next == 0 {
+			return nil
+		}
+		if n, err = p.readNode(n.next); err != nil {
+			return err
+		}
+	}
+} //pager.treeScan()
+
+//record page: [type][next uint32][len uint16][data]
+const recordHeaderSize = 1 + 4 + 2
+
+//writeRecord stores data in a chain of record pages in the transaction
+//and returns the first page
+func (p *pager) writeRecord(data []byte) (uint32, error) {
+	chunk := pageSize - recordHeaderSize
+	pages := make([]uint32, 1+(len(data)-1)/chunk)
+	if len(data) == 0 {
+		pages = pages[:1]
+	}
+	for i := range pages {
+		no, err := p.alloc()
+		if err != nil {
+			return 0, err
+		}
+		pages[i] = no
+	}
+	for i, no := range pages {
+		page := make([]byte, pageSize)
+		page[0] = pageRecord
+		if i+1 < len(pages) {
+			binary.BigEndian.PutUint32(page[1:5], pages[i+1])
+		}
+		end := (i + 1) * chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		l := copy(page[recordHeaderSize:], data[i*chunk:end])
+		binary.BigEndian.PutUint16(page[5:7], uint16(l))
+		p.write(no, page)
+	}
+	return pages[0], nil
+} //pager.writeRecord()
+
+//readRecord returns the data in the chain of record pages
+func (p *pager) readRecord(no uint32) ([]byte, error) {
+	var data []byte
+	for first := no; no != 0; {
+		page, err := p.read(no)
+		if err != nil {
+			return nil, err
+		}
+		l := int(binary.BigEndian.Uint16(page[5:7]))
+		if page[0] != pageRecord || recordHeaderSize+l > pageSize {
+			return nil, logger.Wrapf(nil, "page %d of record %d is not a valid record page", no, first)
+		}
+		data = append(data, page[recordHeaderSize:recordHeaderSize+l]...)
+		no = binary.BigEndian.Uint32(page[1:5])
+	}
+	return data, nil
+}
+
+//freeRecord frees the chain of record pages in the transaction
+func (p *pager) freeRecord(no uint32) error {
+	for no != 0 {
+		page, err := p.read(no)
+		if err != nil {
+			return err
+		}
+		if page[0] != pageRecord {
+			return logger.Wrapf(nil, "page %d has type %d instead of a record", no, page[0])
+		}
+		next := binary.BigEndian.Uint32(page[1:5])
+		p.free(no)
+		no = next
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	os.MkdirAll("./share", 0770)
+	os.Exit(m.Run())
+}
+
+func newTestPager(t *testing.T, filename string) *pager {
+	p, err := openPager(filename, 0666, 16)
+	if err != nil {
+		t.Fatalf("Failed to open pager: %+v", err)
+	}
+	return p
+}
+
+func TestTree(t *testing.T) {
+	filename := "./share/tree.db"
+	os.Remove(filename)
+	p := newTestPager(t, filename)
+
+	//keys of different lengths in random order, some large enough to split after a few entries
+	want := map[string]string{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%08d", r.Intn(100000))
+		if i%100 == 0 {
+			key += strings.Repeat("x", maxKeySize-len(key))
+		}
+		want[key] = fmt.Sprintf("v%d", i)
+		p.begin()
+		root, err := p.treePut(p.hdr.root, []byte(key), []byte(want[key]))
+		if err != nil {
+			t.Fatalf("Failed to put %s: %+v", key, err)
+		}
+		p.hdr.root = root
+		if err := p.commit(); err != nil {
+			t.Fatalf("Failed to commit: %+v", err)
+		}
+	}
+	deleted := 0
+	for key := range want {
+		if deleted++; deleted > 1000 {
+			break
+		}
+		p.begin()
+		root, ok, err := p.treeDel(p.hdr.root, []byte(key))
+		if err != nil || !ok {
+			t.Fatalf("Failed to del %s: %v %+v", key, ok, err)
+		}
+		p.hdr.root = root
+		p.commit()
+		delete(want, key)
+	}
+	p.close()
+
+	p = newTestPager(t, filename)
+	defer p.close()
+	keys := []string{}
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	scanned := []string{}
+	p.treeScan(p.hdr.root, nil, func(key, val []byte) (bool, error) {
+		scanned = append(scanned, string(key))
+		if string(val) != want[string(key)] {
+			t.Fatalf("Scanned %s=%s instead of %s", key, val, want[string(key)])
+		}
+		return true, nil
+	})
+	if strings.Join(scanned, ",") != strings.Join(keys, ",") {
+		t.Fatalf("Scanned %d keys instead of %d in order", len(scanned), len(keys))
+	}
+	for _, key := range keys[:100] {
+		if val, ok, err := p.treeGet(p.hdr.root, []byte(key)); err != nil || !ok || string(val) != want[key] {
+			t.Fatalf("Get %s -> %s %v %+v", key, val, ok, err)
+		}
+	}
+	if len(p.cache) > 16 {
+		t.Fatalf("Cache has %d pages", len(p.cache))
+	}
+}
+
+//TestTreeDelAll checks that the pages of empty leaves are freed and used again
+func TestTreeDelAll(t *testing.T) {
+	filename := "./share/delall.db"
+	os.Remove(filename)
+	p := newTestPager(t, filename)
+	defer p.close()
+	put := func(from, to int) {
+		p.begin()
+		for i := from; i < to; i++ {
+			root, err := p.treePut(p.hdr.root, []byte(fmt.Sprintf("%06d", i)), bytes.Repeat([]byte("v"), 100))
+			if err != nil {
+				t.Fatalf("Failed to put: %+v", err)
+			}
+			p.hdr.root = root
+		}
+		p.commit()
+	}
+	del := func(from, to int) {
+		p.begin()
+		for i := from; i < to; i++ {
+			root, ok, err := p.treeDel(p.hdr.root, []byte(fmt.Sprintf("%06d", i)))
+			if err != nil || !ok {
+				t.Fatalf("Failed to del %d: %v %+v", i, ok, err)
+			}
+			p.hdr.root = root
+		}
+		p.commit()
+	}
+	scan := func() []string {
+		keys := []string{}
+		p.treeScan(p.hdr.root, nil, func(key, val []byte) (bool, error) {
+			keys = append(keys, string(key))
+			return true, nil
+		})
+		return keys
+	}
+	put(0, 2000)
+	pageCount := p.hdr.pageCount
+
+	//the leaves in the middle are unlinked from the leaves before them
+	del(500, 1500)
+	if keys := scan(); len(keys) != 1000 || keys[499] != "000499" || keys[500] != "001500" {
+		t.Fatalf("Scanned %d keys after del", len(keys))
+	}
+	if _, ok, _ := p.treeGet(p.hdr.root, []byte("001000")); ok {
+		t.Fatalf("Got deleted key")
+	}
+	del(0, 500)
+	del(1500, 2000)
+	if keys := scan(); len(keys) != 0 {
+		t.Fatalf("Scanned %d keys in empty tree", len(keys))
+	}
+	if n, err := p.readNode(p.hdr.root); err != nil || !n.leaf {
+		t.Fatalf("Root of empty tree is not a leaf: %+v", err)
+	}
+	put(0, 2000)
+	if p.hdr.pageCount != pageCount {
+		t.Fatalf("Pages %d instead of %d after adding deleted keys again", p.hdr.pageCount, pageCount)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	filename := "./share/record.db"
+	os.Remove(filename)
+	p := newTestPager(t, filename)
+	defer p.close()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	p.begin()
+	no, err := p.writeRecord(data)
+	if err != nil || p.commit() != nil {
+		t.Fatalf("Failed to write record: %+v", err)
+	}
+	if read, err := p.readRecord(no); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("Read %d bytes: %+v", len(read), err)
+	}
+	pageCount := p.hdr.pageCount
+	p.begin()
+	p.freeRecord(no)
+	p.commit()
+
+	//free pages are used again
+	p.begin()
+	p.writeRecord(data[:5000])
+	p.commit()
+	if p.hdr.pageCount != pageCount || p.hdr.freeHead == 0 {
+		t.Fatalf("Pages %d free %d after reuse", p.hdr.pageCount, p.hdr.freeHead)
+	}
+}
+
+//TestRecover writes a transaction to the log only, as if the process stopped before writing the file
+func TestRecover(t *testing.T) {
+	filename := "./share/recover.db"
+	os.Remove(filename)
+	p := newTestPager(t, filename)
+	crash := func(key string) []byte {
+		p.begin()
+		p.hdr.root, _ = p.treePut(p.hdr.root, []byte(key), []byte("value"))
+		headerData, _ := p.hdr.encode()
+		p.write(0, headerData)
+		pageNos := []uint32{}
+		for no := range p.dirty {
+			pageNos = append(pageNos, no)
+		}
+		wal := p.walData(pageNos)
+		if err := p.writeWAL(wal); err != nil {
+			t.Fatalf("Failed to write log: %+v", err)
+		}
+		p.close()
+		return wal
+	}
+
+	//complete log is replayed
+	crash("a")
+	p = newTestPager(t, filename)
+	if _, ok, err := p.treeGet(p.hdr.root, []byte("a")); err != nil || !ok {
+		t.Fatalf("Key not recovered: %v %+v", ok, err)
+	}
+	if info, _ := os.Stat(p.walFilename); info.Size() != 0 {
+		t.Fatalf("Log not cleared after recovery")
+	}
+
+	//incomplete log is discarded
+	wal := crash("b")
+	p.wal, _ = os.OpenFile(p.walFilename, os.O_RDWR, 0666)
+	p.wal.WriteAt(wal[:len(wal)-1], 0)
+	p.wal.Truncate(int64(len(wal) - 1))
+	p.wal.Close()
+	p = newTestPager(t, filename)
+	defer p.close()
+	if _, ok, err := p.treeGet(p.hdr.root, []byte("b")); err != nil || ok {
+		t.Fatalf("Key of incomplete transaction recovered: %v %+v", ok, err)
+	}
+	if _, ok, err := p.treeGet(p.hdr.root, []byte("a")); err != nil || !ok {
+		t.Fatalf("Key lost: %v %+v", ok, err)
+	}
+}
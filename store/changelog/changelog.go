@@ -0,0 +1,198 @@
+//Package changelog keeps a bounded log of store changes in a file next to the store
+//so that consumers can ask for all changes since a known sequence after a restart
+package changelog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+//DefaultSize is the number of changes kept when not specified
+const DefaultSize = 1000
+
+//Log is a bounded list of changes persisted in a file with one JSON change per line
+//the file is appended on each change and rewritten only when it grew to twice the size
+type Log struct {
+	mutex     sync.Mutex
+	filename  string
+	size      int
+	seq       uint64
+	changes   []items.Change
+	fileLines int
+}
+
+//Open loads the existing changes from the file (if it exists) and resumes the sequence
+//size is the number of changes to keep, using DefaultSize if <= 0
+//with filename "" the changes are only kept in memory
+func Open(filename string, size int) (*Log, error) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	l := &Log{
+		filename: filename,
+		size:     size,
+		changes:  make([]items.Change, 0),
+	}
+	if filename == "" {
+		return l, nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, logger.Wrapf(err, "cannot open change log %s", filename)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	lineNr := 0
+	goodSize := int64(0) //up to the newline after the last valid change
+	var lineErr error
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, logger.Wrapf(err, "failed to read change log %s", filename)
+		}
+		lineNr++
+		if lineErr != nil {
+			//a bad line is only tolerated at the end (interrupted write)
+			return nil, lineErr
+		}
+		var c items.Change
+		if err == io.EOF {
+			lineErr = logger.Wrapf(nil, "change log %s line %d is incomplete", filename, lineNr)
+			continue
+		}
+		if err := json.Unmarshal(line, &c); err != nil {
+			lineErr = logger.Wrapf(err, "change log %s line %d is invalid", filename, lineNr)
+			continue
+		}
+		if c.Seq <= l.seq {
+			return nil, logger.Wrapf(nil, "change log %s line %d seq=%d not after %d", filename, lineNr, c.Seq, l.seq)
+		}
+		l.seq = c.Seq
+		l.changes = append(l.changes, c)
+		l.fileLines++
+		goodSize += int64(len(line))
+	}
+	if lineErr != nil {
+		//truncate so that the next change is not appended to the bad line
+		log.Errorf("Removing last line of change log: %v", lineErr)
+		if err := f.Truncate(goodSize); err != nil {
+			return nil, logger.Wrapf(err, "cannot truncate change log %s", filename)
+		}
+	}
+	if len(l.changes) > l.size {
+		l.changes = l.changes[len(l.changes)-l.size:]
+	}
+	log.Debugf("Opened change log %s with %d changes up to seq=%d", filename, len(l.changes), l.seq)
+	return l, nil
+} //Open()
+
+//Seq returns the sequence of the last change
+func (l *Log) Seq() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.seq
+}
+
+//Append records a new change with the next sequence
+//the change is kept in memory even if writing the file failed
+func (l *Log) Append(op items.ChangeOp, id string) (items.Change, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.seq++
+	c := items.Change{
+		Seq:  l.seq,
+		Op:   op,
+		ID:   id,
+		Time: time.Now(),
+	}
+	l.changes = append(l.changes, c)
+	if len(l.changes) > l.size {
+		l.changes = l.changes[len(l.changes)-l.size:]
+	}
+	if l.filename == "" {
+		return c, nil
+	}
+
+	if l.fileLines >= 2*l.size {
+		if err := l.rewrite(); err != nil {
+			return c, logger.Wrapf(err, "failed to trim change log")
+		}
+		return c, nil
+	}
+
+	f, err := os.OpenFile(l.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return c, logger.Wrapf(err, "cannot open change log %s", l.filename)
+	}
+	defer f.Close()
+	jsonChange, _ := json.Marshal(c)
+	if _, err := f.Write(append(jsonChange, '\n')); err != nil {
+		return c, logger.Wrapf(err, "failed to write change log %s", l.filename)
+	}
+	l.fileLines++
+	return c, nil
+} //Log.Append()
+
+//Since returns the changes after seq
+func (l *Log) Since(seq uint64) ([]items.Change, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if seq == l.seq {
+		return []items.Change{}, nil
+	}
+	gap := items.ErrChangeGap{Since: seq, Last: l.seq}
+	if len(l.changes) > 0 {
+		gap.First = l.changes[0].Seq
+	}
+	if seq > l.seq || len(l.changes) == 0 || seq+1 < gap.First {
+		return nil, gap
+	}
+	index := sort.Search(len(l.changes), func(i int) bool { return l.changes[i].Seq > seq })
+	return append([]items.Change{}, l.changes[index:]...), nil
+} //Log.Since()
+
+//rewrite the file with only the changes kept in memory
+func (l *Log) rewrite() error {
+	tmpFilename := l.filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return logger.Wrapf(err, "cannot create %s", tmpFilename)
+	}
+	w := bufio.NewWriter(f)
+	for _, c := range l.changes {
+		jsonChange, _ := json.Marshal(c)
+		w.Write(append(jsonChange, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return logger.Wrapf(err, "failed to write %s", tmpFilename)
+	}
+	if err := f.Close(); err != nil {
+		return logger.Wrapf(err, "failed to close %s", tmpFilename)
+	}
+	if err := os.Rename(tmpFilename, l.filename); err != nil {
+		return logger.Wrapf(err, "failed to replace %s", l.filename)
+	}
+	l.fileLines = len(l.changes)
+	return nil
+} //Log.rewrite()
@@ -0,0 +1,93 @@
+package changelog_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/changelog"
+)
+
+func TestTrim(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/trim.changes"
+	os.Remove(filename)
+	l, err := changelog.Open(filename, 3)
+	if err != nil {
+		t.Fatalf("Failed to open: %+v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := l.Append(items.ChangeAdd, "x"); err != nil {
+			t.Fatalf("Failed to append: %+v", err)
+		}
+	}
+
+	//only the last 3 are kept, also after reopening
+	l, err = changelog.Open(filename, 3)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %+v", err)
+	}
+	if l.Seq() != 10 {
+		t.Fatalf("Seq=%d instead of 10", l.Seq())
+	}
+	if changes, err := l.Since(7); err != nil || len(changes) != 3 || changes[0].Seq != 8 {
+		t.Fatalf("Since(7) -> %+v, %v", changes, err)
+	}
+	if changes, err := l.Since(10); err != nil || len(changes) != 0 {
+		t.Fatalf("Since(10) -> %+v, %v", changes, err)
+	}
+	_, err = l.Since(6)
+	if gap, ok := err.(items.ErrChangeGap); !ok || gap.First != 8 || gap.Last != 10 {
+		t.Fatalf("Since(6) did not give gap error: %v", err)
+	}
+}
+
+//TestTornWrite appends after a change that was only partly written
+func TestTornWrite(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/torn.changes"
+	os.Remove(filename)
+	l, _ := changelog.Open(filename, 10)
+	l.Append(items.ChangeAdd, "a")
+	l.Append(items.ChangeUpd, "a")
+	data, _ := ioutil.ReadFile(filename)
+	ioutil.WriteFile(filename, append(data, data[:len(data)/3]...), 0660)
+
+	l, err := changelog.Open(filename, 10)
+	if err != nil || l.Seq() != 2 {
+		t.Fatalf("Failed to open after torn write: %+v", err)
+	}
+	l.Append(items.ChangeDel, "a")
+	l.Append(items.ChangeAdd, "b")
+	l, err = changelog.Open(filename, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen after append: %+v", err)
+	}
+	if changes, err := l.Since(1); err != nil || len(changes) != 3 || changes[1].Op != items.ChangeDel || changes[2].ID != "b" {
+		t.Fatalf("Since(1) -> %+v, %v", changes, err)
+	}
+}
+
+//TestSeqGap finds changes by their sequence when sequences were skipped
+func TestSeqGap(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/gap.changes"
+	ioutil.WriteFile(filename, []byte(`{"seq":1,"op":"add","id":"a"}
+{"seq":5,"op":"upd","id":"a"}
+{"seq":6,"op":"del","id":"a"}
+`), 0660)
+	l, err := changelog.Open(filename, 10)
+	if err != nil {
+		t.Fatalf("Failed to open: %+v", err)
+	}
+	if changes, err := l.Since(1); err != nil || len(changes) != 2 || changes[0].Seq != 5 {
+		t.Fatalf("Since(1) -> %+v, %v", changes, err)
+	}
+	if changes, err := l.Since(3); err != nil || len(changes) != 2 || changes[0].Seq != 5 {
+		t.Fatalf("Since(3) -> %+v, %v", changes, err)
+	}
+	if changes, err := l.Since(5); err != nil || len(changes) != 1 || changes[0].Seq != 6 {
+		t.Fatalf("Since(5) -> %+v, %v", changes, err)
+	}
+}
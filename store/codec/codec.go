@@ -0,0 +1,101 @@
+//Package codec encodes the items of a store to the bytes written in its files
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+//ICodec encodes and decodes a store file
+//Values are the file items of the store with the item type filled in,
+//so they can be decoded without knowing the interface types.
+type ICodec interface {
+	//Name of the codec, e.g. "json"
+	Name() string
+
+	//Ext is the file name extension, including the '.', e.g. ".json"
+	Ext() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//IListCodec is implemented by codecs that can split an encoded list into its
+//encoded elements, so that a store can report problems with each element
+//rather than failing on the first
+type IListCodec interface {
+	ICodec
+	SplitList(data []byte) ([][]byte, error)
+}
+
+//JSON is indented JSON, which is the default of the stores
+var JSON ICodec = jsonCodec{indent: "  "}
+
+//CompactJSON is JSON without white space, for smaller files
+var CompactJSON ICodec = jsonCodec{}
+
+//Gob is Go's binary encoding, which is faster but not human-readable
+var Gob ICodec = gobCodec{}
+
+type jsonCodec struct {
+	indent string
+}
+
+func (c jsonCodec) Name() string {
+	if c.indent == "" {
+		return "compact-json"
+	}
+	return "json"
+}
+
+func (jsonCodec) Ext() string { return ".json" }
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if c.indent == "" {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", c.indent)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+//SplitList returns the JSON of each element, with an empty file being an empty list
+func (jsonCodec) SplitList(data []byte) ([][]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	var rawElements []json.RawMessage
+	if err := json.Unmarshal(data, &rawElements); err != nil {
+		return nil, err
+	}
+	elements := make([][]byte, 0, len(rawElements))
+	for _, rawElement := range rawElements {
+		elements = append(elements, rawElement)
+	}
+	return elements, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Ext() string { return ".gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Unmarshal of an empty file leaves v unchanged, e.g. an empty list
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,187 @@
+package codec_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/items2/store/codec"
+)
+
+type address struct {
+	Street string   `json:"street"`
+	Lines  []string `json:"lines,omitempty"`
+}
+
+type person struct {
+	ID      string    `json:"_id"`
+	Name    string    `json:"name"`
+	Age     int       `json:"age"`
+	Score   float64   `json:"score"`
+	Active  bool      `json:"active"`
+	Born    time.Time `json:"born"`
+	Note    string    `json:"note"`
+	Address *address  `json:"address"`
+	Tags    []string  `json:"tags"`
+}
+
+func testPeople() []person {
+	born := time.Date(1990, 2, 3, 4, 5, 6, 0, time.UTC)
+	return []person{
+		{ID: "1", Name: "Jan Semmelink", Age: 30, Score: 1.5, Active: true, Born: born, Note: "yes", Address: &address{Street: "Main: 1", Lines: []string{"a", "# not a comment"}}, Tags: []string{"x", "y"}},
+		{ID: "2", Name: "it's \"quoted\"\nline 2", Age: -1, Born: born, Note: "", Tags: []string{}},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []codec.ICodec{codec.JSON, codec.CompactJSON, codec.Gob, codec.YAML, codec.TOML} {
+		people := testPeople()
+		data, err := c.Marshal(people)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %+v", c.Name(), err)
+		}
+		var decoded []person
+		if err := c.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: failed to unmarshal: %+v\n%s", c.Name(), err, data)
+		}
+		if len(decoded) != len(people) {
+			t.Fatalf("%s: decoded %d instead of %d", c.Name(), len(decoded), len(people))
+		}
+		//gob and json differ on empty lists, so compare the rest
+		decoded[1].Tags, people[1].Tags = nil, nil
+		if !reflect.DeepEqual(decoded, people) {
+			t.Fatalf("%s: decoded %+v instead of %+v\n%s", c.Name(), decoded, people, data)
+		}
+
+		//list codecs decode each element on its own
+		listCodec, ok := c.(codec.IListCodec)
+		if !ok {
+			continue
+		}
+		elements, err := listCodec.SplitList(data)
+		if err != nil || len(elements) != len(people) {
+			t.Fatalf("%s: split into %d elements instead of %d: %+v", c.Name(), len(elements), len(people), err)
+		}
+		var p person
+		if err := c.Unmarshal(elements[1], &p); err != nil || p.Name != people[1].Name {
+			t.Fatalf("%s: element decoded as %+v: %+v", c.Name(), p, err)
+		}
+		if elements, err := listCodec.SplitList(nil); err != nil || len(elements) != 0 {
+			t.Fatalf("%s: empty file split into %d elements: %+v", c.Name(), len(elements), err)
+		}
+	}
+}
+
+func TestYAML(t *testing.T) {
+	data, err := codec.YAML.Marshal(testPeople()[:1])
+	if err != nil {
+		t.Fatalf("failed to marshal: %+v", err)
+	}
+	expected := `- _id: "1"
+  name: Jan Semmelink
+  age: 30
+  score: 1.5
+  active: true
+  born: "1990-02-03T04:05:06Z"
+  note: "yes"
+  address:
+    street: 'Main: 1'
+    lines:
+    - a
+    - '# not a comment'
+  tags:
+  - x
+  - "y"
+`
+	if string(data) != expected {
+		t.Fatalf("wrote:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	//hand-edited YAML
+	edited := `# people
+---
+- _id: '3'   # single quoted
+  name: Piet
+  tags:
+  - a
+  - 'b''s'
+  address: {"street": "Long"}
+-
+  _id: "4"
+  name: Koos
+  tags: [x, z]
+  address: {street: Short, lines: [a]}
+  age: 1_000
+  note: |
+    line 1
+    line 2
+- {_id: "5", name: Sarie}
+- _id: "6"
+  name: >
+    folded
+    text
+`
+	var people []person
+	if err := codec.YAML.Unmarshal([]byte(edited), &people); err != nil {
+		t.Fatalf("failed to unmarshal: %+v", err)
+	}
+	if len(people) != 4 || people[0].ID != "3" || people[0].Address == nil || people[0].Address.Street != "Long" ||
+		strings.Join(people[0].Tags, ",") != "a,b's" || people[1].Name != "Koos" ||
+		strings.Join(people[1].Tags, ",") != "x,z" || people[1].Address == nil || people[1].Address.Street != "Short" ||
+		people[1].Age != 1000 || people[1].Note != "line 1\nline 2\n" || people[2].Name != "Sarie" || people[3].Name != "folded text\n" {
+		t.Fatalf("unmarshalled %+v", people)
+	}
+
+	for _, invalid := range []string{
+		"- a\n b: 1",
+		"a: 1\na: 2",
+		"a: [1,\n",
+		"a:\n\t- 1",
+	} {
+		var value interface{}
+		if err := codec.YAML.Unmarshal([]byte(invalid), &value); err == nil {
+			t.Fatalf("unmarshalled invalid YAML %q as %+v", invalid, value)
+		}
+	}
+}
+
+func TestTOML(t *testing.T) {
+	edited := `# people
+[[items]]
+_id = "3"
+name = "Piet"
+age = 1_000
+tags = ["a", 'b']
+
+[items.address]
+street = "Long"
+
+[[items]]
+_id = "4"
+name = """
+Koos
+"""
+`
+	var people []person
+	if err := codec.TOML.Unmarshal([]byte(edited), &people); err != nil {
+		t.Fatalf("failed to unmarshal: %+v", err)
+	}
+	if len(people) != 2 || people[0].ID != "3" || people[0].Age != 1000 || people[0].Address == nil || people[0].Address.Street != "Long" ||
+		strings.Join(people[0].Tags, ",") != "a,b" || people[1].Name != "Koos\n" {
+		t.Fatalf("unmarshalled %+v", people)
+	}
+	var p person
+	if err := codec.TOML.Unmarshal([]byte("_id = \"5\"\nname = \"Sarie\"\n"), &p); err != nil || p.Name != "Sarie" {
+		t.Fatalf("unmarshalled %+v: %+v", p, err)
+	}
+	for _, invalid := range []string{
+		"a = 1\na = 2",
+		"a = [1,\n",
+	} {
+		var value interface{}
+		if err := codec.TOML.Unmarshal([]byte(invalid), &value); err == nil {
+			t.Fatalf("unmarshalled invalid TOML %q as %+v", invalid, value)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stewelarend/logger"
+)
+
+//TOML is human-editable TOML
+//A TOML document is a table, so a list is written as an array of tables named tomlListKey,
+//e.g. [[items]] for each item of a store file. TOML has no null, so null values are left out.
+//Values are converted through JSON, so the `json` field tags apply.
+var TOML ICodec = tomlCodec{}
+
+//tomlListKey is the name of the array of tables with the elements of a list
+const tomlListKey = "items"
+
+type tomlCodec struct{}
+
+func (tomlCodec) Name() string { return "toml" }
+
+func (tomlCodec) Ext() string { return ".toml" }
+
+func (tomlCodec) Marshal(v interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return tomlDocument(withoutNull(value))
+}
+
+func (tomlCodec) Unmarshal(data []byte, v interface{}) error {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return err
+	}
+	var value interface{} = doc
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice {
+		list, ok := doc[tomlListKey]
+		if !ok {
+			return nil //empty list
+		}
+		value = list
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, v)
+}
+
+//SplitList returns the TOML table of each element, with an empty file being an empty list
+func (tomlCodec) SplitList(data []byte) ([][]byte, error) {
+	var doc map[string][]map[string]interface{}
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return nil, logger.Wrapf(err, "TOML document is not a list of [[%s]]", tomlListKey)
+	}
+	elements := make([][]byte, 0, len(doc[tomlListKey]))
+	for _, element := range doc[tomlListKey] {
+		elementData, err := tomlDocument(element)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, elementData)
+	}
+	return elements, nil
+}
+
+//tomlDocument encodes a table as a document, and anything else in the list key
+func tomlDocument(value interface{}) ([]byte, error) {
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		table = map[string]interface{}{tomlListKey: value}
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//withoutNull removes the null values decoded from JSON and converts the numbers
+func withoutNull(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			if element == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = withoutNull(element)
+		}
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if element != nil {
+				list = append(list, withoutNull(element))
+			}
+		}
+		return list
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
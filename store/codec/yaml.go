@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/stewelarend/logger"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//YAML is human-editable YAML, written in block style
+//Values are converted through JSON, so the `json` field tags apply.
+var YAML ICodec = yamlCodec{}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Name() string { return "yaml" }
+
+func (yamlCodec) Ext() string { return ".yaml" }
+
+func (yamlCodec) Marshal(v interface{}) ([]byte, error) {
+	value, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(value)
+}
+
+func (yamlCodec) Unmarshal(data []byte, v interface{}) error {
+	value, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, v)
+}
+
+//SplitList returns the YAML of each element, with an empty file being an empty list
+func (c yamlCodec) SplitList(data []byte) ([][]byte, error) {
+	value, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, logger.Wrapf(nil, "YAML document is not a list")
+	}
+	elements := make([][]byte, 0, len(list))
+	for _, element := range list {
+		elementData, err := yaml.Marshal(element)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, elementData)
+	}
+	return elements, nil
+}
+
+//parseYAML decodes a YAML document into values that can be encoded as JSON,
+//failing on duplicate keys
+func parseYAML(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := yaml.UnmarshalStrict(data, &value); err != nil {
+		return nil, err
+	}
+	return jsonCompatible(value), nil
+}
+
+//jsonCompatible replaces the maps decoded by yaml with maps that have string keys
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(element)
+		}
+		return m
+	case []interface{}:
+		for i, element := range v {
+			v[i] = jsonCompatible(element)
+		}
+	}
+	return value
+}
+
+//jsonValue is v as it is encoded in JSON, with the fields of objects in order
+func jsonValue(v interface{}) (interface{}, error) {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	return decodeOrdered(decoder)
+}
+
+//decodeOrdered decodes the next JSON value from tokens rather than into a map
+//to keep the order of the fields
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '[' {
+			list := []interface{}{}
+			for decoder.More() {
+				element, err := decodeOrdered(decoder)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, element)
+			}
+			_, err := decoder.Token()
+			return list, err
+		}
+		fields := yaml.MapSlice{}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, yaml.MapItem{Key: keyToken, Value: value})
+		}
+		_, err := decoder.Token()
+		return fields, err
+	case json.Number:
+		if i, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return u, nil
+		}
+		return t.Float64()
+	}
+	return token, nil
+} //decodeOrdered()
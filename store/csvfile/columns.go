@@ -0,0 +1,160 @@
+package csvfile
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stewelarend/logger"
+)
+
+//idColumn is the header of the column with the item ids
+const idColumn = "_id"
+
+//column maps a CSV column to a field of the item struct
+type column struct {
+	name  string //header, from the json tag or the field name
+	index []int  //of the struct field
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+//structColumns returns a column for each exported field of a flat struct
+//fields must be strings, bools, numbers, time.Time or implement encoding.TextMarshaler
+//and encoding.TextUnmarshaler, because each value must fit in a single cell
+func structColumns(structType reflect.Type) ([]column, error) {
+	if structType.Kind() != reflect.Struct {
+		return nil, logger.Wrapf(nil, "%v is not a struct", structType)
+	}
+	columns := make([]column, 0, structType.NumField())
+	names := map[string]bool{idColumn: true}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue //unexported
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		if !flatType(field.Type) {
+			return nil, logger.Wrapf(nil, "%v.%s of type %v cannot be stored in a CSV column", structType, field.Name, field.Type)
+		}
+		if names[name] {
+			return nil, logger.Wrapf(nil, "%v has more than one column named \"%s\"", structType, name)
+		}
+		names[name] = true
+		columns = append(columns, column{name: name, index: field.Index})
+	}
+	return columns, nil
+} //structColumns()
+
+//flatType is true for types that can be written to a single cell
+func flatType(t reflect.Type) bool {
+	if t == timeType || (t.Implements(textMarshalerType) && reflect.PtrTo(t).Implements(textUnmarshalerType)) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+//formatCell returns the text of a field value
+func formatCell(v reflect.Value) (string, error) {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if t.IsZero() {
+			return "", nil
+		}
+		return t.Format(time.RFC3339Nano), nil
+	}
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	}
+	return "", logger.Wrapf(nil, "cannot format %v", v.Type())
+} //formatCell()
+
+//parseCell sets the field value from its text, with an empty cell being the zero value
+func parseCell(v reflect.Value, text string) error {
+	if v.Type() == timeType {
+		t := time.Time{}
+		if text != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339Nano, text); err != nil {
+				return logger.Wrapf(err, "invalid time \"%s\", expecting RFC3339", text)
+			}
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(text)
+		return nil
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return logger.Wrapf(nil, "invalid bool \"%s\"", text)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return logger.Wrapf(nil, "invalid %v \"%s\"", v.Type(), text)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return logger.Wrapf(nil, "invalid %v \"%s\"", v.Type(), text)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, v.Type().Bits())
+		if err != nil {
+			return logger.Wrapf(nil, "invalid %v \"%s\"", v.Type(), text)
+		}
+		v.SetFloat(f)
+	default:
+		return logger.Wrapf(nil, "cannot parse %v", v.Type())
+	}
+	return nil
+} //parseCell()
@@ -0,0 +1,86 @@
+package csvfile
+
+import (
+	"os"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+//Option configures a store made with NewWithOptions()
+type Option func(s *store) error
+
+//WithIDGenerator sets the generator of ids for new items, instead of idgen.UUIDv4()
+func WithIDGenerator(idGen IIDGenerator) Option {
+	return func(s *store) error {
+		if idGen == nil {
+			return logger.Wrapf(nil, "New(idGen==nil)")
+		}
+		s.idGen = idGen
+		return nil
+	}
+}
+
+//WithFileMode sets the permissions used when the store file is created
+//the default is 0666 (before umask) like os.Create()
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *store) error {
+		if err := common.CheckFileMode(mode); err != nil {
+			return err
+		}
+		s.fileMode = mode
+		return nil
+	}
+}
+
+//WithLogger sets the logger of the store instead of the package logger
+func WithLogger(l logger.ILogger) Option {
+	return func(s *store) error {
+		if l == nil {
+			return logger.Wrapf(nil, "WithLogger(nil)")
+		}
+		s.log = l
+		return nil
+	}
+}
+
+//WithUniqueKey adds a unique index on a value of each item,
+//in addition to the keys of items that implement items.IItemWithUniqueKeys
+func WithUniqueKey(name string, key func(item items.IItem) interface{}) Option {
+	return func(s *store) error {
+		return s.uniqueKeys.Add(name, key)
+	}
+}
+
+//WithHooks uses hooks that were already registered, instead of starting without hooks
+func WithHooks(hooks *items.Hooks) Option {
+	return func(s *store) error {
+		if hooks == nil {
+			return logger.Wrapf(nil, "WithHooks(nil)")
+		}
+		s.hooks = hooks
+		return nil
+	}
+}
+
+//WithReload reloads the store from reloadfilename after it was changed, see NewWithReload()
+func WithReload(reloadfilename string, opts ReloadOptions) Option {
+	return func(s *store) error {
+		if reloadfilename == "" {
+			return logger.Wrapf(nil, "WithReload(reloadfilename==\"\")")
+		}
+		if opts.Debounce < 0 || opts.PollInterval < 0 {
+			return logger.Wrapf(nil, "WithReload(debounce=%v,pollInterval=%v) negative duration", opts.Debounce, opts.PollInterval)
+		}
+		if opts.Debounce == 0 {
+			opts.Debounce = DefaultReloadDebounce
+		}
+		if opts.PollInterval == 0 {
+			opts.PollInterval = defaultPollInterval
+		}
+		s.reloadFilename = reloadfilename
+		s.reload = opts
+		return nil
+	}
+}
@@ -0,0 +1,578 @@
+//Package csvfile implements a IItem store using a CSV file with one row per item
+//The item type must be a flat struct, with a column for each field named by its json tag,
+//so that the file can be maintained in a spreadsheet.
+package csvfile
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+var (
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-_]*[a-zA-Z0-9]$`)
+)
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids loaded from the file
+type IIDGenerator interface {
+	NewID() string
+}
+
+//New makes a new items.IStore using a CSV file
+func New(filename string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(filename, name, tmpl)
+}
+
+//NewWithReload is same as New() then watching reloadfilename, e.g. exported from a spreadsheet
+//When it changed, all its rows are validated and must pass the hooks, then the store file
+//is replaced and the changes are notified. When it fails, the store is not changed and
+//the reason is written to <reload file without extension>.err
+func NewWithReload(filename string, reloadfilename string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(filename, name, tmpl, WithReload(reloadfilename, ReloadOptions{}))
+}
+
+//NewWithOptions makes a new items.IStore using a CSV file, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(filename string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	filename = path.Clean(filename)
+	if len(name) == 0 || !validName.MatchString(name) {
+		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
+	}
+	if tmpl == nil {
+		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
+	}
+	if _, ok := tmpl.(items.IItemWithID); ok {
+		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
+	}
+	s := &store{
+		filename:   filename,
+		fileMode:   0666,
+		itemName:   name,
+		itemTmpl:   tmpl,
+		itemType:   reflect.TypeOf(tmpl),
+		idGen:      idgen.UUIDv4(),
+		indexOfID:  make(map[string]int),
+		uniqueKeys: make(common.KeyFuncs),
+		keyIndex:   common.NewIndex(name),
+		hooks:      items.NewHooks(),
+		notifier:   items.NewNotifier(items.NotifySync),
+		log:        log,
+	}
+	columns, err := structColumns(s.StructType())
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot store %s in CSV", name)
+	}
+	s.columns = columns
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+
+	//lock before reading so that no other store writes the file
+	lock, err := filelock.New(strings.TrimSuffix(filename, path.Ext(filename)) + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock CSV file %s", filename)
+	}
+	s.lock = lock
+
+	if err := s.readFile(); err != nil {
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot access items in CSV file %s", filename)
+	}
+	if s.reloadFilename != "" {
+		if err := s.watchFile(s.reloadFilename); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.log.Debugf("Created CSV file store of %d %ss from file %s", len(s.fileItems), s.itemName, s.filename)
+	return s, nil
+} //NewWithOptions()
+
+//store implements items.IStore for a CSV file
+type store struct {
+	mutex      sync.Mutex
+	filename   string
+	fileMode   os.FileMode
+	itemName   string
+	itemTmpl   items.IItem
+	itemType   reflect.Type
+	columns    []column //after the _id column
+	idGen      IIDGenerator
+	fileItems  []fileItem      //in the order of the rows in the file
+	indexOfID  map[string]int  //in fileItems
+	uniqueKeys common.KeyFuncs //in addition to IItemWithUniqueKeys
+	keyIndex   *common.Index
+	hooks      *items.Hooks
+	notifier   *items.Notifier
+	log        logger.ILogger
+	lock       *filelock.Lock
+	closed     bool
+
+	reload         ReloadOptions
+	reloadFilename string //to watch after the store was created
+	watcherStop    chan struct{}
+	watching       sync.WaitGroup
+}
+
+//Name ...
+func (s *store) Name() string {
+	return s.itemName
+}
+
+//Type ...
+func (s *store) Type() reflect.Type {
+	return s.itemType
+}
+
+//StructType ...
+func (s *store) StructType() reflect.Type {
+	if s.itemType.Kind() == reflect.Ptr {
+		return s.itemType.Elem()
+	}
+	return s.itemType
+}
+
+//Tmpl ...
+func (s *store) Tmpl() items.IItem {
+	return s.itemTmpl
+}
+
+func (s *store) Add(item items.IItem) (string, error) {
+	return s.add("", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add(id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	if err := s.checkType(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if err := item.Validate(); err != nil {
+		return "", logger.Wrapf(err, "cannot add invalid item")
+	}
+	if err := s.keyIndex.Check("", s.uniqueKeys.Keys(item)); err != nil {
+		return "", logger.Wrapf(err, "cannot add duplicate")
+	}
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
+	if _, ok := s.indexOfID[id]; ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
+	}
+
+	updatedFileItems := append(append([]fileItem{}, s.fileItems...), fileItem{ID: id, Item: item})
+	if err := s.writeFile(updatedFileItems); err != nil {
+		return "", logger.Wrapf(err, "failed to update CSV file")
+	}
+	s.setFileItems(updatedFileItems)
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
+	return id, nil
+} //store.add()
+
+func (s *store) Upd(id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if err := s.checkType(item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "cannot upd invalid item")
+	}
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return logger.Wrapf(nil, "id=%s does not exist", id)
+	}
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
+		return logger.Wrapf(err, "upd will make a duplicate")
+	}
+	oldItem := s.fileItems[index].Item
+	if err := s.hooks.CheckUpd(id, oldItem, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	updatedFileItems := append([]fileItem{}, s.fileItems...)
+	updatedFileItems[index].Item = item
+	if err := s.writeFile(updatedFileItems); err != nil {
+		return logger.Wrapf(err, "failed to update CSV file")
+	}
+	s.setFileItems(updatedFileItems)
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: oldItem})
+	return nil
+} //store.Upd()
+
+func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return nil //not found also return success
+	}
+	deletedItem := s.fileItems[index].Item
+	if err := s.hooks.CheckDel(id, deletedItem); err != nil {
+		return logger.Wrapf(err, "cannot del %s", s.itemName)
+	}
+
+	updatedFileItems := append(append([]fileItem{}, s.fileItems[:index]...), s.fileItems[index+1:]...)
+	if err := s.writeFile(updatedFileItems); err != nil {
+		return logger.Wrapf(err, "failed to update CSV file")
+	}
+	s.setFileItems(updatedFileItems)
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deletedItem})
+	return nil
+} //store.Del()
+
+func (s *store) Get(id string) (items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.ErrClosed
+	}
+
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return nil, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return s.fileItems[index].Item, nil
+}
+
+func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	//walk the items to return in the order of the file
+	for _, fileItem := range s.fileItems {
+		if filter != nil {
+			if err := fileItem.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: fileItem.ID, Item: fileItem.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.Find()
+
+func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
+	for _, fileItem := range s.fileItems {
+		if fileItem.Item.MatchKey(key) {
+			return fileItem.ID, fileItem.Item, nil
+		}
+	}
+	return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+} //store.GetBy()
+
+func (s *store) Uses(fieldName string, itemStore items.IStore) error {
+	return logger.Wrapf(nil, "Not yet implemented")
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+//Close stops the reload watcher, delivers queued notifications and releases the file lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.watcherStop != nil {
+		close(s.watcherStop)
+	}
+	s.mutex.Unlock()
+
+	//wait without the lock, because a reload may be busy
+	s.watching.Wait()
+	s.notifier.Close()
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.filename)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.filename)
+	return nil
+} //store.Close()
+
+//checkType fails for items that cannot be written to the columns of the store
+func (s *store) checkType(item items.IItem) error {
+	if item == nil {
+		return logger.Wrapf(nil, "nil item")
+	}
+	if reflect.TypeOf(item) != s.itemType {
+		return logger.Wrapf(nil, "%T is not %v", item, s.itemType)
+	}
+	return nil
+}
+
+//readFile loads the store file, or creates it with only the header when it does not exist
+func (s *store) readFile() error {
+	if _, err := os.Stat(s.filename); os.IsNotExist(err) {
+		return s.writeFile(nil)
+	}
+	fileItems, err := s.loadFile(s.filename)
+	if err != nil {
+		return err
+	}
+	s.setFileItems(fileItems)
+
+	//ids loaded from the file must not be generated again
+	for _, fileItem := range fileItems {
+		idgen.Resume(s.idGen, fileItem.ID)
+	}
+	return nil
+}
+
+//loadFile decodes and validates all rows of the file without changing the store
+//all invalid rows are reported with their row numbers, the header being row 1
+func (s *store) loadFile(filename string) ([]fileItem, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot open file %s", filename)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReader(f))
+	reader.FieldsPerRecord = -1 //checked below to report the row
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil //empty file
+	}
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot read header of %s", filename)
+	}
+
+	//map the columns in the order of the header
+	idPos := -1
+	columnAt := make([]*column, len(header))
+	for pos, name := range header {
+		name = strings.TrimSpace(name)
+		if name == idColumn {
+			idPos = pos
+			continue
+		}
+		for i := range s.columns {
+			if s.columns[i].name == name {
+				columnAt[pos] = &s.columns[i]
+			}
+		}
+		if columnAt[pos] == nil {
+			return nil, logger.Wrapf(nil, "%s: unknown column \"%s\" in header", filename, name)
+		}
+	}
+	if idPos < 0 {
+		return nil, logger.Wrapf(nil, "%s: missing column \"%s\" in header", filename, idColumn)
+	}
+
+	fileItems := make([]fileItem, 0)
+	indexOfID := make(map[string]int)
+	index := common.NewIndex(s.itemName)
+	problems := []string{}
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: row %d: %v", filename, row, err))
+			break //the rest of the file cannot be read reliably
+		}
+		fi, err := s.decodeRow(header, columnAt, idPos, record)
+		if err == nil && fi.ID == "" {
+			continue //empty row
+		}
+		if err == nil {
+			if other, ok := indexOfID[fi.ID]; ok {
+				err = logger.Wrapf(nil, "duplicate id=%s, same as row %d", fi.ID, other)
+			}
+		}
+		if err == nil {
+			err = index.Check(fi.ID, s.uniqueKeys.Keys(fi.Item))
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: row %d: %v", filename, row, err))
+			continue
+		}
+		indexOfID[fi.ID] = row
+		index.Add(fi.ID, s.uniqueKeys.Keys(fi.Item))
+		fileItems = append(fileItems, fi)
+	}
+	if len(problems) > 0 {
+		return nil, logger.Wrapf(nil, "%d invalid rows:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+	return fileItems, nil
+} //store.loadFile()
+
+//decodeRow makes a valid item from a row, or returns an empty id for an empty row
+func (s *store) decodeRow(header []string, columnAt []*column, idPos int, record []string) (fileItem, error) {
+	if strings.TrimSpace(strings.Join(record, "")) == "" {
+		return fileItem{}, nil
+	}
+	if len(record) != len(header) {
+		return fileItem{}, logger.Wrapf(nil, "%d columns instead of %d", len(record), len(header))
+	}
+	id := strings.TrimSpace(record[idPos])
+	if id == "" {
+		return fileItem{}, logger.Wrapf(nil, "missing %s", idColumn)
+	}
+	itemPtrValue := reflect.New(s.StructType())
+	for pos, cell := range record {
+		if col := columnAt[pos]; col != nil {
+			if err := parseCell(itemPtrValue.Elem().FieldByIndex(col.index), cell); err != nil {
+				return fileItem{}, logger.Wrapf(err, "column %s", col.name)
+			}
+		}
+	}
+	itemValue := itemPtrValue
+	if s.itemType.Kind() != reflect.Ptr {
+		itemValue = itemPtrValue.Elem()
+	}
+	item, ok := itemValue.Interface().(items.IItem)
+	if !ok {
+		return fileItem{}, logger.Wrapf(nil, "%v is not an items.IItem", itemValue.Type())
+	}
+	if err := item.Validate(); err != nil {
+		return fileItem{}, logger.Wrapf(err, "invalid %s.id=%s", s.itemName, id)
+	}
+	return fileItem{ID: id, Item: item}, nil
+} //store.decodeRow()
+
+//writeFile replaces the store file with the header and one row per item
+//the rows are written to a temporary file that is then renamed, so that
+//readers never see a partly written file
+func (s *store) writeFile(fileItems []fileItem) error {
+	tmpFilename := s.filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode)
+	if err != nil {
+		return logger.Wrapf(err, "failed to create file %s", tmpFilename)
+	}
+	writer := csv.NewWriter(f)
+	record := make([]string, 0, len(s.columns)+1)
+	record = append(record, idColumn)
+	for _, col := range s.columns {
+		record = append(record, col.name)
+	}
+	err = writer.Write(record)
+	for _, fi := range fileItems {
+		if err != nil {
+			break
+		}
+		itemValue := reflect.Indirect(reflect.ValueOf(fi.Item))
+		record = append(record[:0], fi.ID)
+		for _, col := range s.columns {
+			var cell string
+			if cell, err = formatCell(itemValue.FieldByIndex(col.index)); err != nil {
+				err = logger.Wrapf(err, "cannot write %s.id=%s column %s", s.itemName, fi.ID, col.name)
+				break
+			}
+			record = append(record, cell)
+		}
+		if err == nil {
+			err = writer.Write(record)
+		}
+	}
+	if err == nil {
+		writer.Flush()
+		err = writer.Error()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return logger.Wrapf(err, "failed to write file %s", tmpFilename)
+	}
+	if err := os.Rename(tmpFilename, s.filename); err != nil {
+		os.Remove(tmpFilename)
+		return logger.Wrapf(err, "failed to replace file %s", s.filename)
+	}
+	return nil
+} //store.writeFile()
+
+//setFileItems replaces the items of the store after they were written
+func (s *store) setFileItems(fileItems []fileItem) {
+	s.fileItems = fileItems
+	s.indexOfID = make(map[string]int)
+	s.keyIndex = common.NewIndex(s.itemName)
+	for i, fi := range fileItems {
+		s.indexOfID[fi.ID] = i
+		s.keyIndex.Add(fi.ID, s.uniqueKeys.Keys(fi.Item))
+	}
+}
+
+//fileItem is one row in the file
+type fileItem struct {
+	ID   string
+	Item items.IItem
+}
@@ -0,0 +1,205 @@
+package csvfile_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/csvfile"
+	"github.com/stewelarend/logger"
+)
+
+func TestMain(m *testing.M) {
+	os.MkdirAll("./share", 0770)
+	os.Exit(m.Run())
+}
+
+type country struct {
+	Code       string    `json:"code"`
+	Name       string    `json:"name"`
+	Population int64     `json:"population,omitempty"`
+	Area       float64   `json:"area"`
+	Active     bool      `json:"active"`
+	Since      time.Time `json:"since"`
+	internal   string
+	Ignored    string `json:"-"`
+}
+
+func (c country) Validate() error {
+	if len(c.Code) != 2 {
+		return logger.Wrapf(nil, "code must be 2 letters")
+	}
+	return nil
+}
+
+func (c country) Match(filter items.IItem) error {
+	return nil
+}
+
+func (c country) MatchKey(key map[string]interface{}) bool {
+	code, ok := key["code"]
+	return ok && code == c.Code
+}
+
+func (c country) Keys() map[string]interface{} {
+	return map[string]interface{}{"code": c.Code}
+}
+
+type nested struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+func (n nested) Validate() error {
+	return nil
+}
+
+func (n nested) Match(filter items.IItem) error {
+	return nil
+}
+
+func (n nested) MatchKey(key map[string]interface{}) bool {
+	return false
+}
+
+func TestStore(t *testing.T) {
+	filename := "./share/countries.csv"
+	os.Remove(filename)
+	if _, err := csvfile.New("./share/nested.csv", "nested", nested{}); err == nil {
+		t.Fatalf("Created store for a struct that is not flat")
+	}
+
+	s, err := csvfile.New(filename, "country", country{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	since := time.Date(1994, 4, 27, 0, 0, 0, 0, time.UTC)
+	id, err := s.Add(country{Code: "ZA", Name: "South Africa, Republic of", Population: 60000000, Area: 1221037.5, Active: true, Since: since, internal: "x", Ignored: "y"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(country{Code: "ZA", Name: "Duplicate"}); err == nil {
+		t.Fatalf("Added duplicate code")
+	}
+	if _, err := s.Add(country{Code: "ZAF"}); err == nil {
+		t.Fatalf("Added invalid item")
+	}
+	nlID, err := s.Add(country{Code: "NL", Name: "Netherlands"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s.Upd(nlID, country{Code: "NL", Name: "The \"Netherlands\""}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	s.Close()
+
+	//header from json tags, cells quoted where needed
+	data, _ := ioutil.ReadFile(filename)
+	fileLines := strings.Split(string(data), "\n")
+	if fileLines[0] != "_id,code,name,population,area,active,since" ||
+		fileLines[1] != id+`,ZA,"South Africa, Republic of",60000000,1221037.5,true,1994-04-27T00:00:00Z` ||
+		fileLines[2] != nlID+`,NL,"The ""Netherlands""",0,0,false,` {
+		t.Fatalf("Wrote:\n%s", data)
+	}
+
+	s, err = csvfile.New(filename, "country", country{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	item, err := s.Get(id)
+	if err != nil || item.(country) != (country{Code: "ZA", Name: "South Africa, Republic of", Population: 60000000, Area: 1221037.5, Active: true, Since: since}) {
+		t.Fatalf("Get -> %+v, %v", item, err)
+	}
+	if list := s.Find(0, nil); len(list) != 2 || list[1].ID != nlID {
+		t.Fatalf("Find -> %+v", list)
+	}
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	if _, _, err := s.GetBy(map[string]interface{}{"code": "ZA"}); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+}
+
+func TestInvalidRows(t *testing.T) {
+	filename := "./share/invalid.csv"
+	ioutil.WriteFile(filename, []byte(`_id,code,name,population
+1,ZA,South Africa,60
+2,ZAF,Too long,1
+3,NL,Netherlands,many
+1,BE,Belgium,1
+4,ZA,Again,1
+5,FR
+,,,
+,DE,Germany,1
+6,US,"United States",1
+`), 0666)
+	_, err := csvfile.New(filename, "country", country{})
+	if err == nil {
+		t.Fatalf("Opened file with invalid rows")
+	}
+	msg := fmt.Sprintf("%v", err)
+	for _, expected := range []string{"row 3:", "row 4: column population", "row 5: duplicate id=1", "row 6: duplicate key", "row 7:", "row 9: missing _id"} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("Error does not contain \"%s\": %s", expected, msg)
+		}
+	}
+	for _, unexpected := range []string{"row 2:", "row 8:", "row 10:"} {
+		if strings.Contains(msg, unexpected) {
+			t.Fatalf("Error reports a valid row \"%s\": %s", unexpected, msg)
+		}
+	}
+
+	ioutil.WriteFile(filename, []byte("_id,code,nam\n"), 0666)
+	if _, err := csvfile.New(filename, "country", country{}); err == nil {
+		t.Fatalf("Opened file with unknown column")
+	}
+}
+
+func TestReload(t *testing.T) {
+	filename := "./share/reload.csv"
+	reloadFilename := "./share/reload-edit.csv"
+	errorFilename := "./share/reload-edit.err"
+	for _, fn := range []string{filename, reloadFilename, errorFilename} {
+		os.Remove(fn)
+	}
+	s, err := csvfile.NewWithOptions(filename, "country", country{}, csvfile.WithReload(reloadFilename, csvfile.ReloadOptions{Debounce: time.Millisecond * 200}))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	id, _ := s.Add(country{Code: "ZA", Name: "South Africa"})
+	notified := make(chan items.Notification, 10)
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		notified <- n
+		return nil
+	})
+
+	//columns in another order, some missing
+	ioutil.WriteFile(reloadFilename, []byte("name,code,_id\nSouth Africa,ZA,"+id+"\nNetherlands,NL,nl\n"), 0666)
+	time.Sleep(time.Millisecond * 600)
+	if n := <-notified; n.Op != items.ChangeAdd || n.ID != "nl" {
+		t.Fatalf("Notified %+v", n)
+	}
+	if item, err := s.Get("nl"); err != nil || item.(country).Name != "Netherlands" {
+		t.Fatalf("Get -> %+v, %v", item, err)
+	}
+	if _, err := os.Stat(errorFilename); err == nil {
+		t.Fatalf("Error file after successful reload")
+	}
+
+	//invalid file does not change the store
+	ioutil.WriteFile(reloadFilename, []byte("_id,code\nnl,NLD\n"), 0666)
+	time.Sleep(time.Millisecond * 600)
+	if data, err := ioutil.ReadFile(errorFilename); err != nil || !strings.Contains(string(data), "row 2:") {
+		t.Fatalf("Error file has %s: %v", data, err)
+	}
+	if list := s.Find(0, nil); len(list) != 2 {
+		t.Fatalf("Find -> %+v", list)
+	}
+}
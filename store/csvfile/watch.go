@@ -0,0 +1,132 @@
+package csvfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/filewatch"
+	"github.com/stewelarend/logger"
+)
+
+//DefaultReloadDebounce is how long the reload file must be unchanged
+//before it is reloaded, so that a file is not loaded while being written
+var DefaultReloadDebounce = time.Second * 3
+
+//defaultPollInterval is used to check the reload file when fsnotify is not available
+const defaultPollInterval = time.Second
+
+//ReloadOptions control how the store is reloaded from a file
+//the zero value of each field selects the default behaviour
+type ReloadOptions struct {
+	Debounce     time.Duration //how long the file must be unchanged before it is loaded, default DefaultReloadDebounce
+	PollInterval time.Duration //to check the file when fsnotify is not available, default 1s
+}
+
+//watchFile reloads the store from filename after it was changed
+func (s *store) watchFile(filename string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.watcherStop != nil {
+		return logger.Wrapf(nil, "cannot watch %s", filename)
+	}
+	s.watcherStop = make(chan struct{})
+	s.watching.Add(1)
+	filewatch.Watch(s.log, filename, s.reload.Debounce, s.reload.PollInterval, s.watcherStop, s.watching.Done, s.reloadFile)
+	return nil
+} //store.watchFile()
+
+//reloadFile replaces the store with the items in the changed file,
+//then reports the outcome in the error file
+func (s *store) reloadFile(filename string) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.log.Infof("Processing: %s", filename)
+	pending, err := s.applyFile(filename)
+	notifications = pending
+	s.reportReload(filename, err)
+} //store.reloadFile()
+
+//applyFile loads the file and replaces the store items when all rows are valid
+//and all changes pass the hooks, returning the changes to notify
+func (s *store) applyFile(filename string) ([]items.Notification, error) {
+	fileItems, err := s.loadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	//added and updated items in the order of the file, then the deleted items
+	pending := []items.Notification{}
+	inFile := make(map[string]bool)
+	for _, fi := range fileItems {
+		inFile[fi.ID] = true
+		index, ok := s.indexOfID[fi.ID]
+		if !ok {
+			pending = append(pending, items.Notification{Op: items.ChangeAdd, ID: fi.ID, Item: fi.Item})
+			continue
+		}
+		if old := s.fileItems[index].Item; !reflect.DeepEqual(old, fi.Item) {
+			pending = append(pending, items.Notification{Op: items.ChangeUpd, ID: fi.ID, Item: fi.Item, Old: old})
+		}
+	}
+	for _, fi := range s.fileItems {
+		if !inFile[fi.ID] {
+			pending = append(pending, items.Notification{Op: items.ChangeDel, ID: fi.ID, Item: fi.Item})
+		}
+	}
+
+	//external edits must pass the same hooks as changes made through the store
+	for _, n := range pending {
+		var err error
+		switch n.Op {
+		case items.ChangeAdd:
+			err = s.hooks.CheckAdd(n.Item)
+		case items.ChangeUpd:
+			err = s.hooks.CheckUpd(n.ID, n.Old, n.Item)
+		case items.ChangeDel:
+			err = s.hooks.CheckDel(n.ID, n.Item)
+		}
+		if err != nil {
+			return nil, logger.Wrapf(err, "cannot %s %s.id=%s", n.Op, s.itemName, n.ID)
+		}
+	}
+
+	if err := s.writeFile(fileItems); err != nil {
+		return nil, err
+	}
+	s.setFileItems(fileItems)
+
+	//ids loaded from the file must not be generated again
+	for _, fi := range fileItems {
+		idgen.Resume(s.idGen, fi.ID)
+	}
+	return pending, nil
+} //store.applyFile()
+
+//reportReload writes the error to <reload file without extension>.err
+//or removes the error file of a previous reload on success
+func (s *store) reportReload(filename string, err error) {
+	errorFilename := strings.TrimSuffix(filename, path.Ext(filename)) + ".err"
+	if err == nil {
+		s.log.Infof("Reloaded %s", filename)
+		os.Remove(errorFilename)
+		return
+	}
+	s.log.Errorf("Reload %s failed: %v", filename, err)
+	if werr := ioutil.WriteFile(errorFilename, []byte(fmt.Sprintf("Reload failed: %+v", err)), 0660); werr != nil {
+		s.log.Errorf("Failed to create %s: %+v", errorFilename, werr)
+	}
+} //store.reportReload()
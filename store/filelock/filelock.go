@@ -0,0 +1,46 @@
+//Package filelock takes an exclusive advisory lock on a file, so that two stores,
+//in the same or in different processes, do not write the same files
+package filelock
+
+import (
+	"os"
+
+	"github.com/stewelarend/logger"
+)
+
+//Lock is held on a file until Unlock() is called
+type Lock struct {
+	filename string
+	f        *os.File
+}
+
+//New locks the file, creating it if it does not exist
+//it fails immediately if the file is already locked
+func New(filename string) (*Lock, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot open lock file %s", filename)
+	}
+	if err := lock(f); err != nil {
+		f.Close()
+		return nil, logger.Wrapf(err, "%s is locked by another store", filename)
+	}
+	return &Lock{filename: filename, f: f}, nil
+}
+
+//Unlock releases the lock
+//the file is not removed, because another store may already be waiting to lock it
+func (l *Lock) Unlock() error {
+	if l.f == nil {
+		return nil
+	}
+	defer func() { l.f = nil }()
+	if err := unlock(l.f); err != nil {
+		l.f.Close()
+		return logger.Wrapf(err, "cannot unlock %s", l.filename)
+	}
+	if err := l.f.Close(); err != nil {
+		return logger.Wrapf(err, "cannot close lock file %s", l.filename)
+	}
+	return nil
+}
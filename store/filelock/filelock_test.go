@@ -0,0 +1,28 @@
+package filelock_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jansemmelink/items2/store/filelock"
+)
+
+func TestLock(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/test.lock"
+	l1, err := filelock.New(filename)
+	if err != nil {
+		t.Fatalf("Failed to lock: %+v", err)
+	}
+	if _, err := filelock.New(filename); err == nil {
+		t.Fatalf("Locked twice")
+	}
+	if err := l1.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock: %+v", err)
+	}
+	l2, err := filelock.New(filename)
+	if err != nil {
+		t.Fatalf("Failed to lock after unlock: %+v", err)
+	}
+	l2.Unlock()
+}
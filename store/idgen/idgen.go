@@ -0,0 +1,65 @@
+//Package idgen provides id generators for the stores
+package idgen
+
+import (
+	"strings"
+
+	"github.com/satori/uuid"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+//IIDGenerator generates unique ids
+//(same as the IIDGenerator of the stores)
+type IIDGenerator interface {
+	NewID() string
+}
+
+//IResumable is implemented by generators that must know the existing ids
+//so that they do not generate them again
+//stores call Resume() with each id they loaded before calling NewID()
+type IResumable interface {
+	Resume(existingID string)
+}
+
+//Resume passes the existing ids to gen when it is resumable
+func Resume(gen IIDGenerator, existingIDs ...string) {
+	if resumable, ok := gen.(IResumable); ok {
+		for _, id := range existingIDs {
+			resumable.Resume(id)
+		}
+	}
+}
+
+//UUIDv4 generates random UUIDs, e.g. "0f8fad5b-d9cb-469f-a165-70867728950e"
+func UUIDv4() IIDGenerator {
+	return uuidV4{}
+}
+
+type uuidV4 struct{}
+
+func (uuidV4) NewID() string {
+	return uuid.NewV4().String()
+}
+
+//Prefixed generates ids with a prefix, e.g. Prefixed("usr_", ULID()) -> "usr_01ARZ3NDEKTSV4RRFFQ69G5FAV"
+func Prefixed(prefix string, gen IIDGenerator) IIDGenerator {
+	return prefixed{prefix: prefix, gen: gen}
+}
+
+type prefixed struct {
+	prefix string
+	gen    IIDGenerator
+}
+
+func (p prefixed) NewID() string {
+	return p.prefix + p.gen.NewID()
+}
+
+//Resume ignores ids without the prefix
+func (p prefixed) Resume(existingID string) {
+	if strings.HasPrefix(existingID, p.prefix) {
+		Resume(p.gen, strings.TrimPrefix(existingID, p.prefix))
+	}
+}
@@ -0,0 +1,75 @@
+package idgen_test
+
+import (
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/jansemmelink/items2/store/idgen"
+)
+
+func TestULID(t *testing.T) {
+	gen := idgen.ULID()
+	valid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id := gen.NewID()
+		if !valid.MatchString(id) {
+			t.Fatalf("Invalid ULID %s", id)
+		}
+		if id <= last {
+			t.Fatalf("ULID %s not after %s", id, last)
+		}
+		last = id
+	}
+}
+
+func TestUUIDs(t *testing.T) {
+	v4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	v7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if id := idgen.UUIDv4().NewID(); !v4.MatchString(id) {
+		t.Fatalf("Invalid UUIDv4 %s", id)
+	}
+	gen := idgen.UUIDv7()
+	ids := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := gen.NewID()
+		if !v7.MatchString(id) || ids[id] {
+			t.Fatalf("Invalid or duplicate UUIDv7 %s", id)
+		}
+		ids[id] = true
+	}
+}
+
+func TestSequential(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/seq.last"
+	os.Remove(filename)
+	gen, err := idgen.Sequential(filename)
+	if err != nil {
+		t.Fatalf("Failed to create: %+v", err)
+	}
+	idgen.Resume(gen, "3", "abc", "12", "7")
+	if id := gen.NewID(); id != "13" {
+		t.Fatalf("Got %s instead of 13", id)
+	}
+
+	//the last id is kept, even if the store no longer has it
+	gen, err = idgen.Sequential(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %+v", err)
+	}
+	idgen.Resume(gen, "3")
+	if id := gen.NewID(); id != "14" {
+		t.Fatalf("Got %s instead of 14", id)
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	seq, _ := idgen.Sequential("")
+	gen := idgen.Prefixed("usr_", seq)
+	idgen.Resume(gen, "usr_5", "grp_9")
+	if id := gen.NewID(); id != "usr_6" {
+		t.Fatalf("Got %s instead of usr_6", id)
+	}
+}
@@ -0,0 +1,65 @@
+package idgen
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stewelarend/logger"
+)
+
+//Sequential generates ids "1", "2", "3", ... continuing after the highest existing id
+//When filename is not "", the last id is kept in that file so that the ids of
+//deleted items are not used again. Use a separate file for each store.
+func Sequential(filename string) (IIDGenerator, error) {
+	s := &sequential{filename: filename}
+	if filename == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, logger.Wrapf(err, "cannot read last id from %s", filename)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, logger.Wrapf(err, "invalid last id in %s", filename)
+	}
+	s.last = last
+	return s, nil
+}
+
+type sequential struct {
+	mutex    sync.Mutex
+	filename string
+	last     uint64
+}
+
+func (s *sequential) NewID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.last++
+	id := strconv.FormatUint(s.last, 10)
+	if s.filename != "" {
+		//the store still checks that the id does not exist, so failing here is not fatal
+		if err := ioutil.WriteFile(s.filename, []byte(id), 0660); err != nil {
+			log.Errorf("Failed to keep last id in %s: %+v", s.filename, err)
+		}
+	}
+	return id
+}
+
+//Resume continues after existingID if it is a higher number
+func (s *sequential) Resume(existingID string) {
+	if n, err := strconv.ParseUint(existingID, 10, 64); err == nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if n > s.last {
+			s.last = n
+		}
+	}
+}
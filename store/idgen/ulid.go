@@ -0,0 +1,59 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+//crockford is the base32 alphabet of ULIDs, without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//ULID generates 26 character ids that sort by creation time, e.g. "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+//(48 bits of milliseconds since 1970 then 80 random bits, see https://github.com/ulid/spec)
+//ids made in the same millisecond increment the random part so that they still sort in order
+func ULID() IIDGenerator {
+	return &ulid{}
+}
+
+type ulid struct {
+	mutex  sync.Mutex
+	lastMs uint64
+	hi     uint16 //top 16 of the 80 random bits
+	lo     uint64 //low 64 of the 80 random bits
+}
+
+func (u *ulid) NewID() string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= u.lastMs {
+		//same millisecond (or clock went back): increment to stay monotonic
+		ms = u.lastMs
+		u.lo++
+		if u.lo == 0 {
+			u.hi++
+		}
+	} else {
+		var random [10]byte
+		rand.Read(random[:])
+		u.hi = binary.BigEndian.Uint16(random[0:2])
+		u.lo = binary.BigEndian.Uint64(random[2:10])
+	}
+	u.lastMs = ms
+
+	//128 bits encoded as 26 characters of 5 bits (the first has only 3)
+	var id [26]byte
+	for i := 9; i >= 0; i-- {
+		id[i] = crockford[ms&0x1f]
+		ms >>= 5
+	}
+	hi, lo := u.hi, u.lo
+	for i := 25; i >= 10; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | uint64(hi&0x1f)<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
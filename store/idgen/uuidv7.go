@@ -0,0 +1,28 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+//UUIDv7 generates UUIDs that sort by creation time to the millisecond,
+//e.g. "017f22e2-79b0-7cc3-98c4-dc0c0c07398f" (see RFC 9562)
+func UUIDv7() IIDGenerator {
+	return uuidV7{}
+}
+
+type uuidV7 struct{}
+
+func (uuidV7) NewID() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	var msBytes [8]byte
+	binary.BigEndian.PutUint64(msBytes[:], ms)
+	copy(u[0:6], msBytes[2:8])
+	u[6] = u[6]&0x0f | 0x70 //version 7
+	u[8] = u[8]&0x3f | 0x80 //variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/stewelarend/logger"
+)
+
+//Index has the id of each value of each unique key
+//values are stored by EncodeKey(), so any key value can be indexed
+type Index struct {
+	name   string                       //item name used in errors
+	values map[string]map[string]string //[key name][encoded value] = id
+	byID   map[string]map[string]string //[id][key name] = encoded value
+}
+
+//NewIndex makes an empty index for items called name
+func NewIndex(name string) *Index {
+	return &Index{
+		name:   name,
+		values: make(map[string]map[string]string),
+		byID:   make(map[string]map[string]string),
+	}
+}
+
+//Has returns true if any item was indexed on key name
+func (index *Index) Has(name string) bool {
+	_, ok := index.values[name]
+	return ok
+}
+
+//Get returns the id of the item with value v for key name
+func (index *Index) Get(name string, v interface{}) (string, bool) {
+	id, ok := index.values[name][EncodeKey(v)]
+	return id, ok
+}
+
+//Check fails if another item than id has the same value for one of the keys
+//id is "" for a new item
+func (index *Index) Check(id string, keys map[string]interface{}) error {
+	for n, v := range keys {
+		if otherID, ok := index.Get(n, v); ok && otherID != id {
+			return DuplicateKey(index.name, id, n, v, otherID)
+		}
+	}
+	return nil
+}
+
+//Add indexes the keys of item id
+//it fails with a DuplicateKeyError without changing the index
+//when another item already has one of the values
+func (index *Index) Add(id string, keys map[string]interface{}) error {
+	for n, v := range keys {
+		if existingID, ok := index.Get(n, v); ok && existingID != id {
+			return DuplicateKeyError{Name: index.name, ID: id, Key: n, Value: v, ExistingID: existingID}
+		}
+	}
+	index.Put(id, keys)
+	return nil
+}
+
+//Put replaces the keys of item id without checking them,
+//a value that was indexed for another item is taken over by id
+func (index *Index) Put(id string, keys map[string]interface{}) {
+	index.Remove(id)
+	if len(keys) == 0 {
+		return
+	}
+	itemValues := make(map[string]string, len(keys))
+	for n, v := range keys {
+		values, ok := index.values[n]
+		if !ok {
+			values = make(map[string]string)
+			index.values[n] = values
+		}
+		value := EncodeKey(v)
+		values[value] = id
+		itemValues[n] = value
+	}
+	index.byID[id] = itemValues
+}
+
+//Del removes the keys that refer to item id
+func (index *Index) Del(id string, keys map[string]interface{}) {
+	for n, v := range keys {
+		value := EncodeKey(v)
+		if index.values[n][value] == id {
+			delete(index.values[n], value)
+		}
+		if index.byID[id][n] == value {
+			delete(index.byID[id], n)
+		}
+	}
+}
+
+//Remove removes all the keys that refer to item id
+func (index *Index) Remove(id string) {
+	for n, value := range index.byID[id] {
+		if index.values[n][value] == id {
+			delete(index.values[n], value)
+		}
+	}
+	delete(index.byID, id)
+}
+
+//DuplicateKey is the error when item id has the same value v for key n as item otherID
+//id is "" for a new item
+func DuplicateKey(name string, id string, n string, v interface{}, otherID string) error {
+	if len(id) == 0 {
+		return logger.Wrapf(nil, "duplicate key: %s:{%s:%v}", name, n, v)
+	}
+	return logger.Wrapf(nil, "duplicate key: %s:{%s:%v} same as %s:{id:%s}", name, n, v, name, otherID)
+}
+
+//DuplicateKeyError is returned by Index.Add so that reload can report the key
+type DuplicateKeyError struct {
+	Name       string
+	ID         string
+	Key        string
+	Value      interface{}
+	ExistingID string
+}
+
+func (e DuplicateKeyError) Error() string {
+	return fmt.Sprintf("%s.id=%s duplicate on %s=%v", e.Name, e.ID, e.Key, e.Value)
+}
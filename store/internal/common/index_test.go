@@ -0,0 +1,62 @@
+package common_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/items2/store/internal/common"
+)
+
+func TestIndex(t *testing.T) {
+	index := common.NewIndex("user")
+	//slices and maps cannot be map keys, so values are indexed by their encoding
+	if err := index.Add("1", map[string]interface{}{"tags": []string{"a", "b"}, "attr": map[string]int{"x": 1}}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if id, ok := index.Get("tags", []string{"a", "b"}); !ok || id != "1" {
+		t.Fatalf("Get(tags) -> %s,%v", id, ok)
+	}
+	if err := index.Check("", map[string]interface{}{"attr": map[string]int{"x": 1}}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Check new duplicate -> %v", err)
+	}
+	if err := index.Check("1", map[string]interface{}{"tags": []string{"a", "b"}}); err != nil {
+		t.Fatalf("Check same item -> %v", err)
+	}
+	err := index.Add("2", map[string]interface{}{"tags": []string{"b"}, "attr": map[string]int{"x": 1}})
+	if keyErr, ok := err.(common.DuplicateKeyError); !ok || keyErr.Key != "attr" || keyErr.ExistingID != "1" {
+		t.Fatalf("Add duplicate -> %v", err)
+	}
+	if _, ok := index.Get("tags", []string{"b"}); ok {
+		t.Fatalf("failed Add() changed the index")
+	}
+
+	//only keys that still refer to the item are removed
+	index.Del("2", map[string]interface{}{"tags": []string{"a", "b"}})
+	if _, ok := index.Get("tags", []string{"a", "b"}); !ok {
+		t.Fatalf("Del(2) removed key of 1")
+	}
+	index.Del("1", map[string]interface{}{"tags": []string{"a", "b"}})
+	if _, ok := index.Get("tags", []string{"a", "b"}); ok {
+		t.Fatalf("Del(1) did not remove the key")
+	}
+}
+
+func TestIndexPut(t *testing.T) {
+	index := common.NewIndex("user")
+	index.Put("1", map[string]interface{}{"name": "a"})
+	index.Put("1", map[string]interface{}{"name": "b"})
+	if _, ok := index.Get("name", "a"); ok {
+		t.Fatalf("Put() kept the old key")
+	}
+	//a value can be taken over, e.g. from an item that expired
+	index.Put("2", map[string]interface{}{"name": "b"})
+	index.Remove("1")
+	if id, ok := index.Get("name", "b"); !ok || id != "2" {
+		t.Fatalf("Remove(1) removed the key of 2: %s,%v", id, ok)
+	}
+	index.Remove("2")
+	if _, ok := index.Get("name", "b"); ok {
+		t.Fatalf("Remove(2) kept the key")
+	}
+}
@@ -0,0 +1,73 @@
+//Package common has the code that every store uses for unique keys and options
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//KeyFuncs are the unique keys added with WithUniqueKey(),
+//in addition to the keys of items that implement items.IItemWithUniqueKeys
+type KeyFuncs map[string]func(items.IItem) interface{}
+
+//Add adds a named key for WithUniqueKey()
+func (f KeyFuncs) Add(name string, key func(item items.IItem) interface{}) error {
+	if name == "" || key == nil {
+		return logger.Wrapf(nil, "WithUniqueKey(%s) without name or key", name)
+	}
+	if _, ok := f[name]; ok {
+		return logger.Wrapf(nil, "WithUniqueKey(%s) already defined", name)
+	}
+	f[name] = key
+	return nil
+}
+
+//Keys returns the unique keys of the item, from items.IItemWithUniqueKeys and the key funcs
+func (f KeyFuncs) Keys(item items.IItem) map[string]interface{} {
+	keys := make(map[string]interface{})
+	if itemWithUniqueKeys, ok := item.(items.IItemWithUniqueKeys); ok {
+		for n, v := range itemWithUniqueKeys.Keys() {
+			keys[n] = v
+		}
+	}
+	for n, key := range f {
+		keys[n] = key(item)
+	}
+	return keys
+}
+
+//EncodeKey encodes a key value so that values can be compared and used as map keys,
+//also slices and maps that cannot be compared with ==
+//values are compared by their JSON encoding
+func EncodeKey(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%T:%#v", v, v)
+	}
+	return string(data)
+}
+
+//KeyID returns the value of key idKey as an item id, for WithIDFromKey()
+func KeyID(itemName string, keys map[string]interface{}, idKey string) (string, error) {
+	v, ok := keys[idKey]
+	if !ok {
+		return "", logger.Wrapf(nil, "%s has no key %s", itemName, idKey)
+	}
+	id := fmt.Sprint(v)
+	if err := items.ValidateID(id); err != nil {
+		return "", logger.Wrapf(err, "%s=%v cannot be used as id", idKey, v)
+	}
+	return id, nil
+}
+
+//CheckFileMode fails if the mode set with WithFileMode() does not allow the store to read and write
+func CheckFileMode(mode os.FileMode) error {
+	if mode&0600 != 0600 {
+		return logger.Wrapf(nil, "file mode %v does not allow the store to read and write", mode)
+	}
+	return nil
+}
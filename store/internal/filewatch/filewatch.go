@@ -0,0 +1,108 @@
+//Package filewatch reloads a file after it was changed, for the stores that reload from a file
+package filewatch
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stewelarend/logger"
+)
+
+//Watch calls reload with filename after the file changed and then did not change
+//for the debounce time, so that a file is not loaded while being written,
+//until stop is closed, then it calls done
+//The directory is watched rather than the file, so that editors that
+//write a new file then rename it over the old one are also noticed.
+//When fsnotify cannot be used, the file is polled at the interval instead.
+func Watch(log logger.ILogger, filename string, debounce, interval time.Duration, stop <-chan struct{}, done func(), reload func(filename string)) {
+	filename = path.Clean(filename)
+	//start from the current file time (not time.Now()) because file
+	//times are coarser than the clock and a quick write may look older
+	lastModTime := time.Time{}
+	if info, err := os.Stat(filename); err == nil {
+		lastModTime = info.ModTime()
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(path.Dir(filename)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Errorf("Cannot watch %s with fsnotify, polling instead: %v", filename, err)
+		go poll(log, filename, lastModTime, debounce, interval, stop, done, reload)
+		return
+	}
+	go watchEvents(log, filename, watcher, debounce, stop, done, reload)
+	log.Debugf("Watching %s...", filename)
+} //Watch()
+
+//watchEvents reloads the file after no events were received for the debounce time
+func watchEvents(log logger.ILogger, filename string, watcher *fsnotify.Watcher, debounce time.Duration, stop <-chan struct{}, done func(), reload func(filename string)) {
+	defer done()
+	defer watcher.Close()
+
+	//timer runs only while the file is changing
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Debugf("Stopped watching %s", filename)
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if path.Clean(event.Name) != filename || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			log.Debugf("CHANGING  %s (%s)...", filename, event.Op)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Error watching %s: %v", filename, err)
+		case <-timer.C:
+			log.Debugf("RELOADING %s ...", filename)
+			reload(filename)
+		}
+	}
+} //watchEvents()
+
+//poll reloads the file after its modification time did not change for the debounce time
+func poll(log logger.ILogger, filename string, lastModTime time.Time, debounce, interval time.Duration, stop <-chan struct{}, done func(), reload func(filename string)) {
+	defer done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	changing := false
+	for {
+		if info, err := os.Stat(filename); err == nil && info.ModTime().After(lastModTime) {
+			changing = true
+			lastModTime = info.ModTime()
+		}
+		if changing && time.Now().After(lastModTime.Add(debounce)) {
+			log.Debugf("RELOADING %s ...", filename)
+			reload(filename)
+			changing = false
+		} else if changing {
+			log.Debugf("CHANGING  %s ...", filename)
+		}
+		select {
+		case <-stop:
+			log.Debugf("Stopped watching %s", filename)
+			return
+		case <-ticker.C:
+		}
+	}
+} //poll()
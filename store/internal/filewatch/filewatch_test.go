@@ -0,0 +1,52 @@
+package filewatch
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stewelarend/logger"
+)
+
+func TestWatch(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/watched.json"
+	os.Remove(filename)
+	for _, polling := range []bool{false, true} {
+		var reloadsMutex sync.Mutex
+		reloads := 0
+		reload := func(string) {
+			reloadsMutex.Lock()
+			defer reloadsMutex.Unlock()
+			reloads++
+		}
+		stop := make(chan struct{})
+		var watching sync.WaitGroup
+		watching.Add(1)
+		if polling {
+			go poll(logger.New(), filename, time.Time{}, time.Millisecond*200, time.Millisecond*20, stop, watching.Done, reload)
+		} else {
+			Watch(logger.New(), filename, time.Millisecond*200, time.Millisecond*20, stop, watching.Done, reload)
+		}
+
+		//reloaded once after the file stopped changing
+		for i := 0; i < 3; i++ {
+			ioutil.WriteFile(filename, []byte("[]"), 0660)
+			time.Sleep(time.Millisecond * 100)
+		}
+		reloadsMutex.Lock()
+		if reloads != 0 {
+			t.Fatalf("Reloaded while changing (polling=%v)", polling)
+		}
+		reloadsMutex.Unlock()
+		time.Sleep(time.Millisecond * 300)
+		close(stop)
+		watching.Wait()
+		if reloads != 1 {
+			t.Fatalf("Reloaded %d times (polling=%v)", reloads, polling)
+		}
+		os.Remove(filename)
+	}
+}
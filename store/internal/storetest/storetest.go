@@ -0,0 +1,139 @@
+//Package storetest has the tests that every store must pass, for use in the tests of each store
+package storetest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//User is the item used in the tests, with a unique name
+type User struct {
+	Name string `json:"name"`
+	Rev  int    `json:"rev"`
+	Bio  string `json:"bio,omitempty"`
+}
+
+//Validate requires a name
+func (u User) Validate() error {
+	if len(u.Name) == 0 {
+		return logger.Wrapf(nil, "user.name not specified")
+	}
+	return nil
+}
+
+//Match filters on rev when the filter has it
+func (u User) Match(filter items.IItem) error {
+	if f, ok := filter.(User); ok && f.Rev != 0 && f.Rev != u.Rev {
+		return logger.Wrapf(nil, "rev does not match")
+	}
+	return nil
+}
+
+//MatchKey matches the name
+func (u User) MatchKey(key map[string]interface{}) bool {
+	name, ok := key["name"]
+	return ok && name == u.Name
+}
+
+//Keys makes the name unique
+func (u User) Keys() map[string]interface{} {
+	return map[string]interface{}{"name": u.Name}
+}
+
+//Run tests the store made by newStore, which must be empty and store User items
+//The store must implement items.IStoreWithNotifier, IStoreWithHooks and IStoreWithMeta,
+//the change log is also checked when it implements items.IStoreWithChanges.
+//It is closed when the test is done.
+func Run(t *testing.T, newStore func() (items.IStore, error)) {
+	s, err := newStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	notified := []items.Notification{}
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		notified = append(notified, n)
+		return nil
+	})
+	s.(items.IStoreWithHooks).Hooks().BeforeDel(func(id string, item items.IItem) error {
+		if item.(User).Name == "keep" {
+			return logger.Wrapf(nil, "cannot delete keep")
+		}
+		return nil
+	})
+
+	id, err := s.Add(User{Name: "A", Rev: 1})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(User{Name: "A", Rev: 2}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate name: %v", err)
+	}
+	if _, err := s.Add(User{}); err == nil {
+		t.Fatalf("Added invalid item")
+	}
+	keepID, _ := s.Add(User{Name: "keep", Rev: 2})
+	if err := s.Del(keepID); err == nil {
+		t.Fatalf("Deleted item rejected by hook")
+	}
+	if err := s.(items.IStoreWithMeta).UpdBy("jan", id, User{Name: "keep"}); err == nil {
+		t.Fatalf("Updated to duplicate name")
+	}
+	if err := s.(items.IStoreWithMeta).UpdBy("jan", id, User{Name: "B", Rev: 2}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	if item, meta, err := s.(items.IStoreWithMeta).GetWithMeta(id); err != nil || item.(User).Name != "B" || meta.Rev != 2 || meta.UpdatedBy != "jan" {
+		t.Fatalf("GetWithMeta -> %+v %+v %v", item, meta, err)
+	}
+	aID, err := s.Add(User{Name: "A", Rev: 3})
+	if err != nil {
+		t.Fatalf("Failed to add name that was freed by update: %+v", err)
+	}
+	//stores list the items in their own order
+	list := s.Find(0, User{Rev: 2})
+	found := map[string]bool{}
+	for _, idAndItem := range list {
+		found[idAndItem.ID] = true
+	}
+	if len(list) != 2 || !found[id] || !found[keepID] {
+		t.Fatalf("Find -> %+v", list)
+	}
+	if list := s.Find(1, nil); len(list) != 1 {
+		t.Fatalf("Find(1) -> %+v", list)
+	}
+	if gotID, item, err := s.GetBy(map[string]interface{}{"name": "keep"}); err != nil || gotID != keepID || item.(User).Rev != 2 {
+		t.Fatalf("GetBy -> %s %+v %v", gotID, item, err)
+	}
+	if err := s.Del(aID); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	if _, err := s.Get(aID); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	if _, _, err := s.GetBy(map[string]interface{}{"name": "A"}); err == nil {
+		t.Fatalf("GetBy got deleted item")
+	}
+	if _, err := s.Add(User{Name: "A", Rev: 4}); err != nil {
+		t.Fatalf("Failed to add name that was freed by delete: %+v", err)
+	}
+	if withChanges, ok := s.(items.IStoreWithChanges); ok {
+		if changes, err := withChanges.ChangesSince(0); err != nil || len(changes) != 6 || changes[3].Op != items.ChangeAdd || changes[4].Op != items.ChangeDel {
+			t.Fatalf("ChangesSince -> %+v, %v", changes, err)
+		}
+	}
+	if len(notified) != 6 || notified[2].Op != items.ChangeUpd || notified[2].Old.(User).Name != "A" || notified[4].ID != aID {
+		t.Fatalf("Notified %+v", notified)
+	}
+
+	s.Close()
+	if _, err := s.Get(id); err != items.ErrClosed {
+		t.Fatalf("Get after Close -> %v", err)
+	}
+	if _, err := s.Add(User{Name: "C"}); err != items.ErrClosed {
+		t.Fatalf("Add after Close -> %v", err)
+	}
+}
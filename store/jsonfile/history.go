@@ -0,0 +1,239 @@
+package jsonfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//historyItem is one prior version of an item as stored in the history file
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta, 3=Replaced, 4=Deleted
+type historyItem struct {
+	ID       string      `json:"_id"`
+	Item     items.IItem `json:"item"`
+	Meta     items.Meta  `json:"_meta"`
+	Replaced time.Time   `json:"_replaced"`
+	Deleted  bool        `json:"_deleted,omitempty"`
+}
+
+//history keeps prior versions in a sidecar file with one JSON version per line
+type history struct {
+	filename        string
+	historyItemType reflect.Type
+}
+
+//EnableHistory starts keeping prior versions in <file>.history next to the store file
+func (s *store) EnableHistory() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	if s.history == nil {
+		s.history = &history{
+			filename:        strings.TrimSuffix(s.filename, path.Ext(s.filename)) + ".history",
+			historyItemType: withItemType(reflect.TypeOf(historyItem{}), s.itemType),
+		}
+		s.log.Debugf("Keeping %s history in %s", s.itemName, s.history.filename)
+	}
+	return nil
+}
+
+//Versions returns the prior versions and the current version of the item
+func (s *store) Versions(id string) ([]items.Version, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.versions(id)
+}
+
+//GetVersion returns the item at the specified revision
+func (s *store) GetVersion(id string, rev int) (items.IItem, items.Meta, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, items.Meta{}, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Meta.Rev == rev {
+			return versions[i].Item, versions[i].Meta, nil
+		}
+	}
+	return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s rev=%d not found", s.itemName, id, rev)
+}
+
+//GetAsOf returns the item as it was at time t
+func (s *store) GetAsOf(id string, t time.Time) (items.IItem, items.Meta, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, items.Meta{}, err
+	}
+	v, ok := items.VersionAt(versions, t)
+	if !ok {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s did not exist at %s", s.itemName, id, t)
+	}
+	return v.Item, v.Meta, nil
+}
+
+//FindAsOf is Find() on the items as they were at time t
+//current items are listed in file order, followed by deleted items
+func (s *store) FindAsOf(t time.Time, size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+	if s.history == nil {
+		s.log.Errorf("%s.FindAsOf() without history", s.itemName)
+		return list
+	}
+	historyItems, err := s.history.read("")
+	if err != nil {
+		s.log.Errorf("%s.FindAsOf() cannot read history: %+v", s.itemName, err)
+		return list
+	}
+
+	//make list of ids: current items first, then the deleted items
+	ids := make([]string, 0, len(s.itemsFromFile))
+	versionsByID := make(map[string][]items.Version)
+	for _, fileItem := range s.itemsFromFile {
+		ids = append(ids, fileItem.ID)
+		versionsByID[fileItem.ID] = make([]items.Version, 0)
+	}
+	for _, hi := range historyItems {
+		if _, ok := versionsByID[hi.ID]; !ok {
+			ids = append(ids, hi.ID)
+		}
+		versionsByID[hi.ID] = append(versionsByID[hi.ID], hi.version())
+	}
+	for _, id := range ids {
+		versions := versionsByID[id]
+		if current, ok := s.itemByID[id]; ok {
+			versions = append(versions, items.Version{Item: current.Item, Meta: current.Meta})
+		}
+		v, ok := items.VersionAt(versions, t)
+		if !ok {
+			continue
+		}
+		if filter != nil {
+			if err := v.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: id, Item: v.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.FindAsOf()
+
+//versions must be called with the store locked
+func (s *store) versions(id string) ([]items.Version, error) {
+	if s.closed {
+		return nil, items.ErrClosed
+	}
+	if s.history == nil {
+		return nil, logger.Wrapf(nil, "%s history is not enabled", s.itemName)
+	}
+	historyItems, err := s.history.read(id)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot read %s.id=%s history", s.itemName, id)
+	}
+	versions := make([]items.Version, 0, len(historyItems)+1)
+	for _, hi := range historyItems {
+		versions = append(versions, hi.version())
+	}
+	if current, ok := s.itemByID[id]; ok {
+		versions = append(versions, items.Version{Item: current.Item, Meta: current.Meta})
+	}
+	if len(versions) == 0 {
+		return nil, logger.Wrapf(nil, "%s.id=%s does not exist", s.itemName, id)
+	}
+	return versions, nil
+} //store.versions()
+
+//keepVersions writes replaced versions to the history, if enabled
+//must be called with the store locked, before the change is applied
+func (s *store) keepVersions(list ...historyItem) error {
+	if s.history == nil || len(list) == 0 {
+		return nil
+	}
+	return s.history.append(list...)
+}
+
+func (h *history) append(list ...historyItem) error {
+	f, err := os.OpenFile(h.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return logger.Wrapf(err, "cannot open history file %s", h.filename)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, hi := range list {
+		jsonVersion, err := json.Marshal(hi)
+		if err != nil {
+			return logger.Wrapf(err, "failed to encode history of id=%s", hi.ID)
+		}
+		w.Write(append(jsonVersion, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		return logger.Wrapf(err, "failed to write history file %s", h.filename)
+	}
+	return nil
+} //history.append()
+
+//read the history of one item, or of all items when id is ""
+func (h *history) read(id string) ([]historyItem, error) {
+	list := make([]historyItem, 0)
+	f, err := os.Open(h.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, logger.Wrapf(err, "cannot open history file %s", h.filename)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		historyItemPtrValue := reflect.New(h.historyItemType)
+		if err := json.Unmarshal(scanner.Bytes(), historyItemPtrValue.Interface()); err != nil {
+			return nil, logger.Wrapf(err, "history file %s line %d is invalid", h.filename, lineNr)
+		}
+		v := historyItemPtrValue.Elem()
+		hi := historyItem{
+			ID:       v.Field(0).Interface().(string),
+			Meta:     v.Field(2).Interface().(items.Meta),
+			Replaced: v.Field(3).Interface().(time.Time),
+			Deleted:  v.Field(4).Interface().(bool),
+		}
+		if id != "" && hi.ID != id {
+			continue
+		}
+		hi.Item = v.Field(1).Interface().(items.IItem)
+		list = append(list, hi)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, logger.Wrapf(err, "failed to read history file %s", h.filename)
+	}
+	return list, nil
+} //history.read()
+
+func (hi historyItem) version() items.Version {
+	return items.Version{
+		Item:     hi.Item,
+		Meta:     hi.Meta,
+		Replaced: hi.Replaced,
+		Deleted:  hi.Deleted,
+	}
+}
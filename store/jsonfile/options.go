@@ -0,0 +1,106 @@
+package jsonfile
+
+import (
+	"os"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+//Option configures a store made with NewWithOptions()
+type Option func(s *store) error
+
+//WithIDGenerator sets the generator of ids for new items, instead of idgen.UUIDv4()
+func WithIDGenerator(idGen IIDGenerator) Option {
+	return func(s *store) error {
+		if idGen == nil {
+			return logger.Wrapf(nil, "New(idGen==nil)")
+		}
+		s.idGen = idGen
+		return nil
+	}
+}
+
+//WithFileMode sets the permissions used when the store file is created
+//the default is 0666 (before umask) like os.Create()
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *store) error {
+		if err := common.CheckFileMode(mode); err != nil {
+			return err
+		}
+		s.fileMode = mode
+		return nil
+	}
+}
+
+//WithReload reloads the store from reloadfilename after it was changed, see NewWithReload()
+func WithReload(reloadfilename string, opts ReloadOptions) Option {
+	return func(s *store) error {
+		if reloadfilename == "" {
+			return logger.Wrapf(nil, "WithReload(reloadfilename==\"\")")
+		}
+		if err := opts.withDefaults(reloadfilename).validate(); err != nil {
+			return err
+		}
+		s.reloadFilename = reloadfilename
+		s.reload = opts
+		return nil
+	}
+}
+
+//WithLogger sets the logger of the store instead of the package logger
+func WithLogger(l logger.ILogger) Option {
+	return func(s *store) error {
+		if l == nil {
+			return logger.Wrapf(nil, "WithLogger(nil)")
+		}
+		s.log = l
+		return nil
+	}
+}
+
+//WithUniqueKey adds a unique index on a value of each item,
+//in addition to the keys of items that implement items.IItemWithUniqueKeys
+func WithUniqueKey(name string, key func(item items.IItem) interface{}) Option {
+	return func(s *store) error {
+		return s.uniqueKeys.Add(name, key)
+	}
+}
+
+//WithIDFromKey uses the value of a unique key as the id of each item instead of generating ids,
+//e.g. a country code, so the key cannot be changed by Upd()
+//the key is from items.IItemWithUniqueKeys or WithUniqueKey() and must pass items.ValidateID()
+func WithIDFromKey(name string) Option {
+	return func(s *store) error {
+		if name == "" {
+			return logger.Wrapf(nil, "WithIDFromKey(\"\")")
+		}
+		s.idKey = name
+		return nil
+	}
+}
+
+//WithHooks uses hooks that were already registered, instead of starting without hooks
+func WithHooks(hooks *items.Hooks) Option {
+	return func(s *store) error {
+		if hooks == nil {
+			return logger.Wrapf(nil, "WithHooks(nil)")
+		}
+		s.hooks = hooks
+		return nil
+	}
+}
+
+//WithCodec sets the encoding of the store file instead of codec.JSON
+//reload files must use the same encoding
+func WithCodec(c codec.ICodec) Option {
+	return func(s *store) error {
+		if c == nil {
+			return logger.Wrapf(nil, "WithCodec(nil)")
+		}
+		s.codec = c
+		return nil
+	}
+}
@@ -0,0 +1,341 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+//loadedFile is a file decoded and compared with the store, before it is applied
+type loadedFile struct {
+	itemsFromFile []fileItem
+	itemByID      map[string]fileItem
+	deletedByID   map[string]fileItem
+	keyIndex      *common.Index
+	pending       []items.Notification //changes in the order they will be notified
+	diff          items.ReloadDiff
+	lenient       bool //diff.Errors are rejected items, the rest can be applied
+}
+
+//loadEntry is an item from the file, or the old version kept in its place
+type loadEntry struct {
+	fileItem
+	index int  //in the file, -1 when not in the file
+	kept  bool //old version kept because the new one was rejected
+}
+
+//decodedItem is an item from the file, or the error decoding it
+type decodedItem struct {
+	value reflect.Value //pointer to the store's fileItemType (including _id)
+	id    string        //when known after an error, to identify the item
+	err   error
+}
+
+//decodeFile decodes the list of items in the file data
+//when the codec can split the list, each item is decoded separately,
+//so that all problems in the file are reported, else the list must decode as a whole
+func (s *store) decodeFile(data []byte) ([]decodedItem, error) {
+	listCodec, ok := s.codec.(codec.IListCodec)
+	if !ok {
+		listPtrValue := reflect.New(reflect.SliceOf(s.fileItemType))
+		if err := s.codec.Unmarshal(data, listPtrValue.Interface()); err != nil {
+			return nil, err
+		}
+		listValue := listPtrValue.Elem()
+		decodedItems := make([]decodedItem, 0, listValue.Len())
+		for i := 0; i < listValue.Len(); i++ {
+			decodedItems = append(decodedItems, decodedItem{value: listValue.Index(i).Addr()})
+		}
+		return decodedItems, nil
+	}
+
+	rawItems, err := listCodec.SplitList(data)
+	if err != nil {
+		return nil, err
+	}
+	decodedItems := make([]decodedItem, 0, len(rawItems))
+	for _, rawItem := range rawItems {
+		fileItemPtrValue := reflect.New(s.fileItemType)
+		if err := s.codec.Unmarshal(rawItem, fileItemPtrValue.Interface()); err != nil {
+			//get the id if possible to identify the item
+			var idOnly struct {
+				ID string `json:"_id"`
+			}
+			s.codec.Unmarshal(rawItem, &idOnly)
+			decodedItems = append(decodedItems, decodedItem{id: idOnly.ID, err: err})
+			continue
+		}
+		decodedItems = append(decodedItems, decodedItem{value: fileItemPtrValue})
+	}
+	return decodedItems, nil
+} //store.decodeFile()
+
+//DryRun loads the file and compares it with the store without applying it
+func (s *store) DryRun(filename string) (items.ReloadDiff, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ReloadDiff{}, items.ErrClosed
+	}
+	loaded, err := s.loadFile(filename, true)
+	if err != nil {
+		return items.ReloadDiff{}, err
+	}
+	return loaded.diff, nil
+}
+
+//loadFile decodes and validates all items in the file and compares them with the store
+//problems with items are listed in the diff, while an error means the file could not be read
+//when reload is true, the changes must also pass the hooks, and with the lenient
+//reload policy the old version is kept for each item that failed
+//must be called with the store locked, and it does not change the store
+func (s *store) loadFile(filename string, reload bool) (*loadedFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot access file %s", filename)
+	}
+	decodedItems, err := s.decodeFile(data)
+	if err != nil {
+		return nil, logger.Wrapf(err, "failed to read file %s as a %s list", filename, s.codec.Name())
+	}
+
+	//collect the items (still not updating the store)
+	loaded := &loadedFile{
+		diff:    items.NewReloadDiff(),
+		lenient: reload && s.reload.Policy == ReloadLenient,
+	}
+	entries := make([]loadEntry, 0, len(decodedItems))
+	indexOfID := make(map[string]int)
+	failed := make(map[string]bool) //items with errors are neither added nor deleted
+	addError := func(index int, id string, field string, kind string, format string, args ...interface{}) {
+		failed[id] = true
+		loaded.diff.Errors = append(loaded.diff.Errors, items.ReloadError{Index: index, ID: id, Field: field, Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+	keepOld := func(index int, id string) {
+		if old, ok := s.oldFileItem(id); ok && loaded.lenient {
+			entries = append(entries, loadEntry{fileItem: old, index: index, kept: true})
+		}
+	}
+	for i, decodedItem := range decodedItems {
+		if err := decodedItem.err; err != nil {
+			field := ""
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				field = typeErr.Field
+			}
+			addError(i, decodedItem.id, field, items.ReloadErrorDecode, "%v", err)
+			if _, ok := indexOfID[decodedItem.id]; !ok && len(decodedItem.id) > 0 {
+				indexOfID[decodedItem.id] = i
+				keepOld(i, decodedItem.id)
+			}
+			continue
+		}
+		fileItemValue := decodedItem.value.Elem()
+		id := fileItemValue.Field(0).Interface().(string)
+		s.log.Debugf("add [%d] id=%s  (has %d)", i, id, len(entries))
+		if len(id) == 0 {
+			addError(i, id, "_id", items.ReloadErrorMissingID, "missing id")
+			continue
+		}
+		if other, ok := indexOfID[id]; ok {
+			addError(i, id, "_id", items.ReloadErrorDuplicateID, "duplicate id, same as [%d]", other)
+			continue
+		}
+		indexOfID[id] = i
+
+		if itemValue := fileItemValue.Field(1); itemValue.Kind() == reflect.Ptr && itemValue.IsNil() {
+			addError(i, id, "item", items.ReloadErrorMissingItem, "no item data")
+			keepOld(i, id)
+			continue
+		}
+		item := fileItemValue.Field(1).Interface().(items.IItem)
+		if err := item.Validate(); err != nil {
+			addError(i, id, "", items.ReloadErrorInvalid, "%v", err)
+			keepOld(i, id)
+			continue
+		}
+		if keyID, err := s.keyID(item); err != nil || (keyID != "" && keyID != id) {
+			if err == nil {
+				err = logger.Wrapf(nil, "id does not match %s=%s", s.idKey, keyID)
+			}
+			addError(i, id, "_id", items.ReloadErrorInvalid, "%v", err)
+			keepOld(i, id)
+			continue
+		}
+		//metadata in a reload file is ignored, including tombstones, because it is managed by the store
+		meta := items.Meta{}
+		if !reload {
+			meta = fileItemValue.Field(2).Interface().(items.Meta)
+		}
+		entries = append(entries, loadEntry{fileItem: fileItem{ID: id, Item: item, Meta: meta}, index: i})
+		s.log.Debugf("LOADED %s[%d]: id=%s: %+v", filename, i, id, item)
+	}
+
+	//external edits must pass the same hooks as changes made through the store
+	if reload {
+		for _, n := range s.pendingChanges(entries, failed) {
+			if err := s.checkHooks(n); err != nil {
+				index, ok := indexOfID[n.ID]
+				if !ok {
+					index = -1 //deleted from the file
+				}
+				addError(index, n.ID, "", items.ReloadErrorRejected, "%v", err)
+				if loaded.lenient {
+					entries = s.revertEntry(entries, n.ID, index)
+				}
+			}
+		}
+	}
+
+	//build new set of indexes to ensure keys are unique
+	//when lenient, a rejected item may make another one fail, so repeat until all pass
+	for {
+		loaded.keyIndex = common.NewIndex(s.itemName)
+		rejected := make(map[string]loadEntry)
+		for _, entry := range entries {
+			//tombstones are kept in the list but not indexed
+			if entry.Meta.IsDeleted() {
+				continue
+			}
+			err := loaded.keyIndex.Add(entry.ID, s.uniqueKeys.Keys(entry.Item))
+			if err == nil {
+				continue
+			}
+			field := ""
+			keyErr, isKeyErr := err.(common.DuplicateKeyError)
+			if isKeyErr {
+				field = "item." + keyErr.Key
+				//reject the item that changed, rather than the one it clashes with
+				if s.unchanged(entry) {
+					for _, other := range entries {
+						if other.ID == keyErr.ExistingID {
+							entry = other
+							break
+						}
+					}
+				}
+			}
+			addError(entry.index, entry.ID, field, items.ReloadErrorDuplicateKey, "%v", err)
+			rejected[entry.ID] = entry
+			if loaded.lenient {
+				break
+			}
+		}
+		if len(rejected) == 0 {
+			break
+		}
+		for id, entry := range rejected {
+			if loaded.lenient && !entry.kept {
+				entries = s.revertEntry(entries, id, entry.index)
+			} else {
+				entries = withoutEntry(entries, id)
+			}
+		}
+		if !loaded.lenient {
+			break
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].index < entries[j].index })
+	sort.SliceStable(loaded.diff.Errors, func(i, j int) bool { return loaded.diff.Errors[i].Index < loaded.diff.Errors[j].Index })
+
+	//copy into array and id-maps
+	loaded.itemsFromFile = make([]fileItem, 0, len(entries))
+	loaded.itemByID = make(map[string]fileItem)
+	loaded.deletedByID = make(map[string]fileItem)
+	for _, entry := range entries {
+		loaded.itemsFromFile = append(loaded.itemsFromFile, entry.fileItem)
+		if entry.Meta.IsDeleted() {
+			loaded.deletedByID[entry.ID] = entry.fileItem
+		} else {
+			loaded.itemByID[entry.ID] = entry.fileItem
+		}
+	}
+
+	loaded.pending = s.pendingChanges(entries, failed)
+	for _, n := range loaded.pending {
+		switch {
+		case n.Op == items.ChangeAdd:
+			loaded.diff.Added = append(loaded.diff.Added, n.ID)
+		case n.Op == items.ChangeDel:
+			loaded.diff.Deleted = append(loaded.diff.Deleted, n.ID)
+		case changed(n):
+			loaded.diff.Updated = append(loaded.diff.Updated, items.ReloadUpdate{ID: n.ID, Fields: items.DiffFields(n.Old, n.Item)})
+		}
+	}
+	return loaded, nil
+} //store.loadFile()
+
+//pendingChanges compares the entries with the store
+//upd/del in the order of the store, then add in the order of the entries
+func (s *store) pendingChanges(entries []loadEntry, failed map[string]bool) []items.Notification {
+	entryByID := make(map[string]loadEntry)
+	for _, entry := range entries {
+		if !entry.Meta.IsDeleted() {
+			entryByID[entry.ID] = entry
+		}
+	}
+	pending := make([]items.Notification, 0)
+	for _, oldFileItem := range s.itemsFromFile {
+		if oldFileItem.Meta.IsDeleted() {
+			continue
+		}
+		id, oldItem := oldFileItem.ID, oldFileItem.Item
+		//see if exists in new file
+		if entry, ok := entryByID[id]; ok {
+			pending = append(pending, items.Notification{Op: items.ChangeUpd, ID: id, Item: entry.Item, Old: oldItem})
+		} else if !failed[id] {
+			pending = append(pending, items.Notification{Op: items.ChangeDel, ID: id, Item: oldItem})
+		}
+	}
+	for _, entry := range entries {
+		if _, ok := entryByID[entry.ID]; !ok {
+			continue //tombstone
+		}
+		if _, ok := s.itemByID[entry.ID]; !ok {
+			pending = append(pending, items.Notification{Op: items.ChangeAdd, ID: entry.ID, Item: entry.Item})
+		}
+	}
+	return pending
+} //store.pendingChanges()
+
+//oldFileItem is the item or tombstone in the store before the reload
+func (s *store) oldFileItem(id string) (fileItem, bool) {
+	if old, ok := s.itemByID[id]; ok {
+		return old, true
+	}
+	old, ok := s.deletedByID[id]
+	return old, ok
+}
+
+//revertEntry replaces the entry with the old version from the store,
+//or removes it when it is new
+func (s *store) revertEntry(entries []loadEntry, id string, index int) []loadEntry {
+	entries = withoutEntry(entries, id)
+	if old, ok := s.oldFileItem(id); ok {
+		entries = append(entries, loadEntry{fileItem: old, index: index, kept: true})
+	}
+	return entries
+}
+
+//unchanged is true when the entry is the same as the item in the store
+//the old items have unique keys, so only changed items can clash
+func (s *store) unchanged(entry loadEntry) bool {
+	old, ok := s.oldFileItem(entry.ID)
+	return entry.kept || (ok && reflect.DeepEqual(old.Item, entry.Item))
+}
+
+func withoutEntry(entries []loadEntry, id string) []loadEntry {
+	kept := make([]loadEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ID != id {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,142 @@
+package jsonfile
+
+import (
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//EnableSoftDelete makes Del() keep tombstones in the file
+//tombstones older than retention are purged with the next write, 0 keeps them
+func (s *store) EnableSoftDelete(retention time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	s.softDelete = true
+	s.retention = retention
+	if _, purged := s.withoutExpired(s.itemsFromFile); len(purged) > 0 {
+		if err := s.updateFile(s.itemsFromFile); err != nil {
+			return logger.Wrapf(err, "failed to purge expired %s tombstones", s.itemName)
+		}
+	}
+	return nil
+}
+
+//FindDeleted is Find() on the tombstones, in file order
+func (s *store) FindDeleted(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+	for _, fileItem := range s.itemsFromFile {
+		if !fileItem.Meta.IsDeleted() || fileItem.Meta.Expired(s.retention) {
+			continue
+		}
+		if filter != nil {
+			if err := fileItem.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: fileItem.ID, Item: fileItem.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.FindDeleted()
+
+//Restore replaces the tombstone with the item as it was before it was deleted
+func (s *store) Restore(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	tombstone, ok := s.deletedByID[id]
+	if !ok || tombstone.Meta.Expired(s.retention) {
+		return logger.Wrapf(nil, "deleted %s.id=%s does not exist", s.itemName, id)
+	}
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(tombstone.Item)); err != nil {
+		return logger.Wrapf(err, "restore will make a duplicate")
+	}
+	if err := s.hooks.CheckAdd(tombstone.Item); err != nil {
+		return logger.Wrapf(err, "cannot restore %s", s.itemName)
+	}
+
+	restored := fileItem{ID: id, Item: tombstone.Item, Meta: tombstone.Meta.Restored("")}
+	updatedItemsFromFile := make([]fileItem, 0, len(s.itemsFromFile))
+	for _, fileItem := range s.itemsFromFile {
+		if fileItem.ID == id {
+			fileItem = restored
+		}
+		updatedItemsFromFile = append(updatedItemsFromFile, fileItem)
+	}
+	if err := s.updateFile(updatedItemsFromFile); err != nil {
+		return logger.Wrapf(err, "failed to update JSON file")
+	}
+	delete(s.deletedByID, id)
+	s.itemByID[id] = restored
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(restored.Item))
+	s.logChange(items.ChangeAdd, id)
+	s.log.Debugf("RESTORE(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: restored.Item})
+	return nil
+} //store.Restore()
+
+//Purge removes the tombstone from the file
+//purging an id that does not exist also succeeds
+func (s *store) Purge(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if _, ok := s.itemByID[id]; ok {
+		return logger.Wrapf(nil, "cannot purge %s.id=%s that is not deleted", s.itemName, id)
+	}
+	if _, ok := s.deletedByID[id]; !ok {
+		return nil
+	}
+	updatedItemsFromFile := make([]fileItem, 0, len(s.itemsFromFile))
+	for _, fileItem := range s.itemsFromFile {
+		if fileItem.ID != id {
+			updatedItemsFromFile = append(updatedItemsFromFile, fileItem)
+		}
+	}
+	if err := s.updateFile(updatedItemsFromFile); err != nil {
+		return logger.Wrapf(err, "failed to update JSON file")
+	}
+	delete(s.deletedByID, id)
+	s.log.Debugf("PURGED(%s)", id)
+	return nil
+} //store.Purge()
+
+//withoutExpired returns the list without expired tombstones and the ids that were removed
+func (s *store) withoutExpired(list []fileItem) ([]fileItem, []string) {
+	var kept []fileItem
+	var purged []string
+	for index, fi := range list {
+		if fi.Meta.Expired(s.retention) {
+			if kept == nil {
+				kept = append(make([]fileItem, 0, len(list)), list[:index]...)
+			}
+			purged = append(purged, fi.ID)
+		} else if kept != nil {
+			kept = append(kept, fi)
+		}
+	}
+	if kept == nil {
+		return list, nil
+	}
+	return kept, purged
+}
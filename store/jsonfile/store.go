@@ -2,9 +2,6 @@
 package jsonfile
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
 	"os"
 	"path"
 	"reflect"
@@ -13,8 +10,12 @@ import (
 	"sync"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/changelog"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
 	"github.com/stewelarend/logger"
 )
 
@@ -36,20 +37,36 @@ var (
 
 //NewWithReload is same as New() then WatchFile()
 func NewWithReload(filename string, reloadfilename string, name string, tmpl items.IItem, idGen IIDGenerator) (items.IStore, error) {
-	s, err := newStore(filename, name, tmpl, idGen)
-	if err != nil {
-		return nil, err
-	}
-	s.watchFile(reloadfilename)
-	return s, nil
+	return NewWithReloadOptions(filename, reloadfilename, name, tmpl, idGen, ReloadOptions{})
+}
+
+//NewWithReloadOptions is same as NewWithReload() with control over the reload
+func NewWithReloadOptions(filename string, reloadfilename string, name string, tmpl items.IItem, idGen IIDGenerator, opts ReloadOptions) (items.IStore, error) {
+	return NewWithOptions(filename, name, tmpl, WithIDGenerator(idGen), WithReload(reloadfilename, opts))
 }
 
 //New makes a new items.IStore using a single JSON file
 func New(filename string, name string, tmpl items.IItem, idGen IIDGenerator) (items.IStore, error) {
-	return newStore(filename, name, tmpl, idGen)
+	return NewWithOptions(filename, name, tmpl, WithIDGenerator(idGen))
+}
+
+//NewWithOptions makes a new items.IStore using a single JSON file, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(filename string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	s, err := newStore(filename, name, tmpl, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.reloadFilename != "" {
+		if err := s.watchFile(s.reloadFilename, s.reload); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-func newStore(filename string, name string, tmpl items.IItem, idGen IIDGenerator) (*store, error) {
+func newStore(filename string, name string, tmpl items.IItem, opts ...Option) (*store, error) {
 	filename = path.Clean(filename)
 	if len(name) == 0 || !validName.MatchString(name) {
 		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
@@ -57,29 +74,59 @@ func newStore(filename string, name string, tmpl items.IItem, idGen IIDGenerator
 	if tmpl == nil {
 		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
 	}
-	if idGen == nil {
-		return nil, logger.Wrapf(nil, "New(idGen==nil)")
-	}
 	if _, ok := tmpl.(items.IItemWithID); ok {
 		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
 	}
 	s := &store{
 		filename:      filename,
+		fileMode:      0666,
+		codec:         codec.JSON,
 		itemName:      name,
 		itemTmpl:      tmpl,
 		itemType:      reflect.TypeOf(tmpl),
 		fileItemType:  fileItemType(reflect.TypeOf(tmpl)),
-		idGen:         idGen,
 		itemsFromFile: make([]fileItem, 0),
-		itemByID:      make(map[string]items.IItem),
-		indexSet:      newIndexSet(name),
+		itemByID:      make(map[string]fileItem),
+		deletedByID:   make(map[string]fileItem),
+		uniqueKeys:    make(common.KeyFuncs),
+		hooks:         items.NewHooks(),
+		notifier:      items.NewNotifier(items.NotifySync),
+		log:           log,
+		reload:        ReloadOptions{}.withDefaults(filename),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+	if s.idGen == nil {
+		s.idGen = idgen.UUIDv4()
 	}
+	s.keyIndex = common.NewIndex(s.itemName)
 
-	if err := s.readFile(filename); err != nil {
+	//lock before reading so that no other store writes the file
+	baseFilename := strings.TrimSuffix(filename, path.Ext(filename))
+	lock, err := filelock.New(baseFilename + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock JSON file %s", filename)
+	}
+	s.lock = lock
+
+	if _, err := s.readFile(filename, false); err != nil {
+		s.lock.Unlock()
 		return nil, logger.Wrapf(err, "cannot access items in JSON file %s", filename)
 	}
 
-	log.Debugf("Created JSON file store of %d %ss from file %s", len(s.itemByID), s.itemName, s.filename)
+	//open the change log only after the initial load
+	//so that loading existing items is not logged as changes
+	changes, err := changelog.Open(baseFilename+".changes", changelog.DefaultSize)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot open change log for JSON file %s", filename)
+	}
+	s.changes = changes
+
+	s.log.Debugf("Created JSON file store of %d %ss from file %s", len(s.itemByID), s.itemName, s.filename)
 	return s, nil
 } //New()
 
@@ -87,16 +134,36 @@ func newStore(filename string, name string, tmpl items.IItem, idGen IIDGenerator
 type store struct {
 	mutex         sync.Mutex
 	filename      string
+	fileMode      os.FileMode
+	codec         codec.ICodec
 	itemName      string
 	itemTmpl      items.IItem
 	itemType      reflect.Type
 	fileItemType  reflect.Type
 	idGen         IIDGenerator
 	itemsFromFile []fileItem
-	itemByID      map[string]items.IItem
-	indexSet      indexSet
-
-	watcher *fsnotify.Watcher
+	itemByID      map[string]fileItem //excludes tombstones
+	deletedByID   map[string]fileItem //only tombstones
+	keyIndex      *common.Index
+	uniqueKeys    common.KeyFuncs //in addition to IItemWithUniqueKeys
+	idKey         string          //unique key used as id, "" to generate ids
+	changes       *changelog.Log
+	hooks         *items.Hooks
+	notifier      *items.Notifier
+	log           logger.ILogger
+	history       *history
+	softDelete    bool
+	retention     time.Duration //of tombstones, 0 to keep them
+	ttl           time.Duration //of items, 0 when items do not expire
+	sweeperStop   chan struct{}
+	sweeper       sync.WaitGroup
+	lock          *filelock.Lock
+	closed        bool
+
+	watcherStop    chan struct{}
+	watching       sync.WaitGroup
+	reload         ReloadOptions //policy also applies to DryRun()
+	reloadFilename string        //to watch after the store was created
 }
 
 //Name ...
@@ -123,8 +190,36 @@ func (s *store) Tmpl() items.IItem {
 }
 
 func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	//remove expired items first, so they do not conflict with this change
+	notifications = s.expireItems()
 
 	if item == nil {
 		return "", logger.Wrapf(nil, "cannot add nil item")
@@ -133,35 +228,67 @@ func (s *store) Add(item items.IItem) (string, error) {
 		return "", logger.Wrapf(err, "cannot add invalid item")
 	}
 
-	if err := s.indexSet.CheckUniqueness("", item); err != nil {
+	if err := s.keyIndex.Check("", s.uniqueKeys.Keys(item)); err != nil {
 		return "", logger.Wrapf(err, "cannot add duplicate")
 	}
 
-	//assign a new unique id
-	id := s.idGen.NewID()
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+
+	//use the id from the item key, or assign a new unique id
+	keyID, err := s.keyID(item)
+	if err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if keyID != "" {
+		if id != "" && id != keyID {
+			return "", logger.Wrapf(nil, "cannot add %s.id=%s with %s=%s", s.itemName, id, s.idKey, keyID)
+		}
+		id = keyID
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
 	if _, ok := s.itemByID[id]; ok {
 		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
 	}
+	if _, ok := s.deletedByID[id]; ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists as deleted", s.Name(), id)
+	}
 
 	//append and update file
-	updatedItemsFromFile := append(s.itemsFromFile, fileItem{ID: id, Item: item})
+	newFileItem := fileItem{ID: id, Item: item, Meta: items.NewMeta(actor)}
+	updatedItemsFromFile := append(s.itemsFromFile, newFileItem)
 	if err := s.updateFile(updatedItemsFromFile); err != nil {
 		return "", logger.Wrapf(err, "failed to update JSON file")
 	}
-	s.itemByID[id] = item
-	s.indexSet.AddToIndex(id, item)
-
-	log.Debugf("ADD(%s)", id)
+	s.itemByID[id] = newFileItem
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.logChange(items.ChangeAdd, id)
 
-	if addedItem, ok := item.(items.IItemWithNotifyNew); ok {
-		addedItem.NotifyNew()
-	}
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
 	return id, nil
-} //store.Add()
+} //store.add()
 
 func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	//remove expired items first, so they do not conflict with this change
+	notifications = s.expireItems()
 
 	if item == nil {
 		return logger.Wrapf(nil, "cannot upd nil item")
@@ -170,18 +297,22 @@ func (s *store) Upd(id string, item items.IItem) error {
 		return logger.Wrapf(err, "cannot upd invalid item")
 	}
 
-	if err := s.indexSet.CheckUniqueness(id, item); err != nil {
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
 		return logger.Wrapf(err, "upd will make a duplicate")
 	}
+	if keyID, err := s.keyID(item); err != nil || (keyID != "" && keyID != id) {
+		return logger.Wrapf(err, "cannot upd %s.id=%s to %s=%s", s.itemName, id, s.idKey, keyID)
+	}
 
 	//replace and update file
 	var oldItem items.IItem
 	updatedItemsFromFile := append([]fileItem{}, s.itemsFromFile...)
 	updIndex := -1
 	for index, fileItem := range updatedItemsFromFile {
-		if fileItem.ID == id {
-			oldItem = updatedItemsFromFile[index].Item
+		if fileItem.ID == id && !fileItem.Meta.IsDeleted() {
+			oldItem = fileItem.Item
 			updatedItemsFromFile[index].Item = item
+			updatedItemsFromFile[index].Meta = fileItem.Meta.NextRev(actor)
 			updIndex = index
 			break
 		}
@@ -190,56 +321,85 @@ func (s *store) Upd(id string, item items.IItem) error {
 		return logger.Wrapf(nil, "id=%s does not exist", id)
 	}
 
+	if err := s.hooks.CheckUpd(id, oldItem, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	old := s.itemByID[id]
+	if err := s.keepVersions(historyItem{ID: id, Item: old.Item, Meta: old.Meta, Replaced: time.Now()}); err != nil {
+		return logger.Wrapf(err, "cannot keep history of %s.id=%s", s.itemName, id)
+	}
+
 	if err := s.updateFile(updatedItemsFromFile); err != nil {
 		return logger.Wrapf(err, "failed to update JSON file")
 	}
-	s.indexSet.DelFromIndex(id, oldItem)
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(oldItem))
 
 	s.itemsFromFile = updatedItemsFromFile
-	s.itemByID[id] = item
-	s.indexSet.AddToIndex(id, item)
-	log.Debugf("UPD(%s) -> %+v", id, item)
-	if updatedItem, ok := item.(items.IItemWithNotifyUpd); ok {
-		updatedItem.NotifyUpd(oldItem)
-	} else {
-		log.Debugf("%s(%s).notifyUpd() not implemented by %T", s.itemName, id, item)
-	}
+	s.itemByID[id] = updatedItemsFromFile[updIndex]
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.logChange(items.ChangeUpd, id)
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: oldItem})
 	return nil
-} //store.Upd()
+} //store.UpdBy()
 
 func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	notifications = s.expireItems()
 
 	var deletedItem items.IItem
+	var deletedMeta items.Meta
+	var tombstone fileItem
 
-	//make list of items without this one
+	//make list of items without this one, or with its tombstone
 	updatedItemsFromFile := make([]fileItem, 0)
 	for _, fileItem := range s.itemsFromFile {
-		if fileItem.ID != id {
+		if fileItem.ID != id || fileItem.Meta.IsDeleted() {
 			updatedItemsFromFile = append(updatedItemsFromFile, fileItem)
 		} else {
 			deletedItem = fileItem.Item
+			deletedMeta = fileItem.Meta
+			if s.softDelete {
+				tombstone = fileItem
+				tombstone.Meta = fileItem.Meta.Tombstone()
+				updatedItemsFromFile = append(updatedItemsFromFile, tombstone)
+			}
 		}
 	}
 
 	if deletedItem != nil {
+		if err := s.hooks.CheckDel(id, deletedItem); err != nil {
+			return logger.Wrapf(err, "cannot del %s", s.itemName)
+		}
+
+		if err := s.keepVersions(historyItem{ID: id, Item: deletedItem, Meta: deletedMeta, Replaced: time.Now(), Deleted: true}); err != nil {
+			return logger.Wrapf(err, "cannot keep history of %s.id=%s", s.itemName, id)
+		}
+
 		//update the file contents
 		if err := s.updateFile(updatedItemsFromFile); err != nil {
 			return logger.Wrapf(err, "failed to update JSON file")
 		}
-		s.indexSet.DelFromIndex(id, deletedItem)
-		if deletedItemWithNotify, ok := deletedItem.(items.IItemWithNotifyDel); ok {
-			log.Debugf("NotifyDel(%s)", id)
-			deletedItemWithNotify.NotifyDel()
-		} else {
-			log.Debugf("Not calling NotifyDel(%s)", id)
-		}
+		s.keyIndex.Del(id, s.uniqueKeys.Keys(deletedItem))
+		notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deletedItem})
 		//deleted: update store
 		s.itemsFromFile = updatedItemsFromFile
 		delete(s.itemByID, id)
+		if s.softDelete {
+			s.deletedByID[id] = tombstone
+		}
+		s.logChange(items.ChangeDel, id)
 		//not found also return success
-		log.Debugf("DEL(%s)", id)
+		s.log.Debugf("DEL(%s)", id)
 	}
 	return nil
 } //store.Del()
@@ -247,20 +407,47 @@ func (s *store) Del(id string) error {
 func (s *store) Get(id string) (items.IItem, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.ErrClosed
+	}
 
 	existing, ok := s.itemByID[id]
-	if !ok {
+	if !ok || s.expired(existing, time.Now()) {
 		return nil, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
 	}
-	return existing, nil
+	return existing.Item, nil
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+
+	existing, ok := s.itemByID[id]
+	if !ok || s.expired(existing, time.Now()) {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return existing.Item, existing.Meta, nil
 }
 
 func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
-	//do not lock, because we use Get() inside this func...
-	//walk the items array to return in the order of the file
-	log.Debugf("Find among %d %s items...", len(s.itemsFromFile), s.Name())
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	//walk the items array to return in the order of the file
+	s.log.Debugf("Find among %d %s items...", len(s.itemsFromFile), s.Name())
+	now := time.Now()
 	for _, fileItem := range s.itemsFromFile {
+		if fileItem.Meta.IsDeleted() || s.expired(fileItem, now) {
+			continue
+		}
 		if filter != nil {
 			if err := fileItem.Item.Match(filter); err != nil {
 				//log.Errorf("Filter out file %s: %+v", info.Name(), err)
@@ -276,11 +463,18 @@ func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
 } //store.Find()
 
 func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
 	//walk the items array to return first match
-	log.Debugf("%s.GetBy(%+v)", s.Name(), key)
+	s.log.Debugf("%s.GetBy(%+v)", s.Name(), key)
+	now := time.Now()
 	for _, fileItem := range s.itemsFromFile {
 		item := fileItem.Item
-		if item.MatchKey(key) {
+		if !fileItem.Meta.IsDeleted() && !s.expired(fileItem, now) && item.MatchKey(key) {
 			return fileItem.ID, item, nil
 		}
 	} //for each item from file
@@ -302,240 +496,243 @@ func (s *store) noItem() items.IItem {
 	return ni.(items.IItem)
 }
 
-//IIDGenerator generates unique ids
+//keyID returns the id derived from the item key, or "" when ids are not derived from keys
+func (s *store) keyID(item items.IItem) (string, error) {
+	if s.idKey == "" {
+		return "", nil
+	}
+	return common.KeyID(s.itemName, s.uniqueKeys.Keys(item), s.idKey)
+}
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids loaded from the file
 type IIDGenerator interface {
 	NewID() string
 }
 
 //read the file into the store, replacing old contents on success only
-func (s *store) readFile(filename string) error {
+//when reload is true, the hooks can reject the changes
+//the diff lists what changed, or the problems found in the file
+func (s *store) readFile(filename string, reload bool) (items.ReloadDiff, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return items.NewReloadDiff(), items.ErrClosed
+	}
 
 	//if file does not exist, we can create the file later, but we need to ensure
 	//we can access and create the file, so read/create it now...
 	if _, err := os.Stat(filename); err != nil {
-		f, err := os.Create(filename)
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode)
 		if err != nil {
-			return logger.Wrapf(err, "cannot create file %s", filename)
+			return items.NewReloadDiff(), logger.Wrapf(err, "cannot create file %s", filename)
 		}
 
 		//created empty file
 		//store now has empty list
 		f.Close()
 		//s.itemsFromFile = make([]*IItemWithID, 0)
-		s.itemByID = make(map[string]items.IItem)
-		return nil
+		s.itemByID = make(map[string]fileItem)
+		s.deletedByID = make(map[string]fileItem)
+		return items.NewReloadDiff(), nil
 	}
 
-	//filename exists
-	f, err := os.Open(filename)
+	loaded, err := s.loadFile(filename, reload)
 	if err != nil {
-		return logger.Wrapf(err, "cannot access file %s", filename)
+		return items.NewReloadDiff(), err
 	}
-	defer f.Close()
-
-	//make an array []IItem using the store's fileItemType (including _id)
-	sliceType := reflect.SliceOf(s.fileItemType)
-	itemSlicePtrValue := reflect.New(sliceType)
-	itemSlicePtr := itemSlicePtrValue.Interface()
-
-	//decode the file into the new slice:
-	if err := json.NewDecoder(f).Decode(itemSlicePtr); err != nil {
-		if err != io.EOF {
-			return logger.Wrapf(err, "failed to read file %s into %T", filename, itemSlicePtr)
-		}
-		//EOF: empty JSON file
-		//store now has empty list
-		//s.itemsFromFile = make([]*IItemWithID, 0)
-		s.itemByID = make(map[string]items.IItem)
-		return nil
+	if err := loaded.diff.Err(); err != nil && !loaded.lenient {
+		return loaded.diff, logger.Wrapf(err, "file %s has invalid %ss", filename, s.Name())
 	}
+	itemsFromFile, itemByID, deletedByID := loaded.itemsFromFile, loaded.itemByID, loaded.deletedByID
+	pending := loaded.pending
 
-	//copy into array and id-map and build new set of indexes to ensure ids are unique
-	//(still not updating the store)
-	itemsFromFile := make([]fileItem, 0)
-	itemByID := make(map[string]items.IItem)
-	indexSet := newIndexSet(s.itemName)
-	needUpdate := false
-	for i := 0; i < itemSlicePtrValue.Elem().Len(); i++ {
-		fileItemValue := itemSlicePtrValue.Elem().Index(i)
-		id := fileItemValue.Field(0).Interface().(string)
-		log.Debugf("add [%d] id=%s  (has %d)", i, id, len(itemByID))
-		if len(id) == 0 {
-			return logger.Wrapf(nil, "Missing id in file %s %s[%d]", filename, s.Name(), i)
-		}
-		if _, ok := itemByID[id]; ok {
-			return logger.Wrapf(nil, "Duplicate id in file %s %s[%d].id=\"%s\"", filename, s.Name(), i, id)
-		}
-
-		if fileItemValue.Field(1).IsNil() {
-			return logger.Wrapf(nil, "item[%d].id=%s has no item data", i, id)
-		}
-		itemData := fileItemValue.Field(1).Interface()
-		item := itemData.(items.IItem)
-		if err := item.Validate(); err != nil {
-			return logger.Wrapf(err, "file %s %s[%d].id=%s is invalid", filename, s.Name(), i, id)
+	//keep history of items replaced or deleted by the file
+	now := time.Now()
+	replaced := make([]historyItem, 0)
+	for _, n := range pending {
+		if n.Op != items.ChangeAdd && changed(n) {
+			old := s.itemByID[n.ID]
+			replaced = append(replaced, historyItem{ID: n.ID, Item: old.Item, Meta: old.Meta, Replaced: now, Deleted: n.Op == items.ChangeDel})
 		}
+	}
+	if err := s.keepVersions(replaced...); err != nil {
+		return loaded.diff, logger.Wrapf(err, "cannot keep history of %s", s.itemName)
+	}
 
-		//add to new index, list and map:
-		if err := indexSet.AddToIndex(id, item); err != nil {
-			return logger.Wrapf(err, "file %s %s.id=%s has duplicate key", filename, s.Name(), id)
-		}
-		itemsFromFile = append(itemsFromFile, fileItem{ID: id, Item: item})
-		itemByID[id] = item
-		log.Debugf("LOADED %s[%d]: id=%s: %+v", filename, i, id, item)
-	}
-
-	//notify the application about upd/del changes first
-	for id, oldItem := range s.itemByID {
-		//see if exists in new file
-		if newItem, ok := itemByID[id]; ok {
-			if updatedItemWithNotify, ok := newItem.(items.IItemWithNotifyUpd); ok {
-				log.Debugf("NotifyUpd(%s)", id)
-				updatedItemWithNotify.NotifyUpd(oldItem)
-			} else {
-				log.Debugf("Not calling NotifyUpd(%s)", id)
+	//metadata is managed by the store and not taken from a reloaded file
+	if reload {
+		for index := range itemsFromFile {
+			newFileItem := &itemsFromFile[index]
+			if newFileItem.Meta.IsDeleted() {
+				continue //old tombstone kept in place of a rejected item
 			}
-		} else {
-			if deletedItemWithNotify, ok := oldItem.(items.IItemWithNotifyDel); ok {
-				log.Debugf("NotifyDel(%s)", id)
-				deletedItemWithNotify.NotifyDel()
+			if oldFileItem, ok := s.itemByID[newFileItem.ID]; !ok {
+				newFileItem.Meta = items.NewMeta("")
+			} else if reflect.DeepEqual(oldFileItem.Item, newFileItem.Item) {
+				newFileItem.Meta = oldFileItem.Meta
 			} else {
-				log.Debugf("Not calling NotifyDel(%s)", id)
+				newFileItem.Meta = oldFileItem.Meta.NextRev("")
 			}
+			itemByID[newFileItem.ID] = *newFileItem
 		}
-	}
 
-	//notify the application about new items next
-	for id, newItem := range itemByID {
-		if _, ok := s.itemByID[id]; !ok {
-			if addedItemWithNotify, ok := newItem.(items.IItemWithNotifyNew); ok {
-				log.Debugf("NotifyNew(%s)", id)
-				addedItemWithNotify.NotifyNew()
-			} else {
-				log.Debugf("Not calling NotifyNew(%s)", id)
+		//tombstones are not in the reload file, so keep them unless the item is in the file again
+		for _, oldFileItem := range s.itemsFromFile {
+			if !oldFileItem.Meta.IsDeleted() {
+				continue
+			}
+			_, isItem := itemByID[oldFileItem.ID]
+			_, isDeleted := deletedByID[oldFileItem.ID]
+			if !isItem && !isDeleted {
+				itemsFromFile = append(itemsFromFile, oldFileItem)
+				deletedByID[oldFileItem.ID] = oldFileItem
 			}
 		}
 	}
 
-	if needUpdate {
-		if err := s.updateFile(itemsFromFile); err != nil {
-			return logger.Wrapf(err, "Failed to update file %s with new ids", filename)
+	for _, n := range pending {
+		if changed(n) {
+			s.logChange(n.Op, n.ID)
 		}
 	}
 
-	//replace the old list, map and indexSet
+	//replace the old list, map and key index
 	s.itemsFromFile = itemsFromFile
 	s.itemByID = itemByID
-	s.indexSet = indexSet
-	return nil
-} //store.readFile()
-
-func (s *store) watchFile(filename string) error {
-	//not using fsnotify.NewWatcher() anymore, because we only watch one file,
-	//and want to trigger after the file changes stopped, not when it starts
-	//so doing io.Stat() instead at regular intervals
+	s.deletedByID = deletedByID
+	s.keyIndex = loaded.keyIndex
+	notifications = pending
 
-	processModifiedFile := func(filename string) {
-		log.Infof("Processing: %s", filename)
-		errorFilename := strings.Replace(filename, ".json", ".err", 1)
-		err := s.readFile(filename)
-		if err != nil {
-			log.Errorf("Reload failed: %v", err)
+	//ids loaded from the file must not be generated again
+	for _, fileItem := range itemsFromFile {
+		idgen.Resume(s.idGen, fileItem.ID)
+	}
 
-			//write error file
-			if f, ferr := os.Create(errorFilename); ferr == nil {
-				defer f.Close()
-				f.Write([]byte(fmt.Sprintf("Reload failed: %+v", err)))
-				log.Debugf("Wrote %s", errorFilename)
-			} else {
-				log.Errorf("Failed to create %s: %+v", errorFilename, ferr)
-			}
-		} else {
-			log.Errorf("Reloaded %s", filename)
-			os.Remove(errorFilename)
-
-			//copy file to replace store file
-			err := func(to, from string) error {
-				f1, err := os.Open(from)
-				if err != nil {
-					return logger.Wrapf(err, "Failed to open %s", from)
-				}
-				defer f1.Close()
-				f2, err := os.Create(to)
-				if err != nil {
-					return logger.Wrapf(err, "Failed to create %s", to)
-				}
-				defer f2.Close()
-				if _, err := io.Copy(f2, f1); err != nil {
-					return logger.Wrapf(err, "Failed to copy %s to %s", from, to)
-				}
-				log.Debugf("Copied %s to %s", from, to)
-				return nil
-			}(s.filename, filename)
-			if err != nil {
-				log.Errorf("Failed to copy loaded file %s into store file %s: %v", filename, s.filename, err)
-			}
+	//write what was applied, with the metadata kept by the store, before the lock is released
+	//so that changes made through the store after the reload are not overwritten
+	if len(loaded.diff.Errors) > 0 || reload {
+		if err := s.updateFile(itemsFromFile); err != nil {
+			return loaded.diff, logger.Wrapf(err, "cannot write %s after partial reload", s.filename)
 		}
-	} //processModifiedFile()
-
-	go func(filename string) {
-		lastModTime := time.Now()
-		changing := false
-		for {
-			if info, err := os.Stat(filename); err == nil {
-				if info.ModTime().After(lastModTime) {
-					//detect a change
-					changing = true
-					lastModTime = info.ModTime()
-				}
-			} //if got file info
-
-			//detect changes stopped for 3 seconds
-			if changing && time.Now().After(lastModTime.Add(time.Second*3)) {
-				log.Debugf("RELOADING %s ...", filename)
-				processModifiedFile(filename)
-				changing = false
-			} else {
-				if changing {
-					log.Debugf("CHANGING  %s ...", filename)
-				} else {
-					log.Debugf("NO CHANGE %s ...", filename)
-				}
-			}
-
-			//wait before checking again...
-			time.Sleep(time.Second)
-		} //forever...
-	}(path.Clean(filename))
-
-	log.Debugf("Watching %s...", filename)
-	return nil
-} //store.watchFile()
+	}
+	return loaded.diff, nil
+} //store.readFile()
 
 func (s *store) updateFile(updatedItems []fileItem) error {
-	f, err := os.Create(s.filename)
+	//expired tombstones are purged with every write
+	updatedItems, purged := s.withoutExpired(updatedItems)
+
+	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode)
 	if err != nil {
 		return logger.Wrapf(err, "Failed to create new file %s", s.filename)
 	}
 	defer f.Close()
 
-	jsonFileData, _ := json.MarshalIndent(updatedItems, "", "  ")
-	_, err = f.Write(jsonFileData)
+	fileData, err := s.codec.Marshal(s.fileItemList(updatedItems))
+	if err != nil {
+		return logger.Wrapf(err, "Failed to encode items for file %s", s.filename)
+	}
+	_, err = f.Write(fileData)
 	if err != nil {
 		return logger.Wrapf(err, "Failed to write updated items to file %s", s.filename)
 	}
 
 	//written: update store now
 	s.itemsFromFile = updatedItems
+	for _, id := range purged {
+		delete(s.deletedByID, id)
+		s.log.Debugf("PURGED(%s)", id)
+	}
 	return nil
 } //store.updateFile()
 
+//Seq returns the sequence of the last change
+func (s *store) Seq() uint64 {
+	return s.changes.Seq()
+}
+
+//ChangesSince returns the changes made after seq
+func (s *store) ChangesSince(seq uint64) ([]items.Change, error) {
+	return s.changes.Since(seq)
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+//checkHooks evaluates the hooks for a change read from file
+func (s *store) checkHooks(n items.Notification) error {
+	switch n.Op {
+	case items.ChangeAdd:
+		return s.hooks.CheckAdd(n.Item)
+	case items.ChangeUpd:
+		if changed(n) {
+			return s.hooks.CheckUpd(n.ID, n.Old, n.Item)
+		}
+	case items.ChangeDel:
+		return s.hooks.CheckDel(n.ID, n.Item)
+	}
+	return nil
+}
+
+//changed is false for an update that did not change the item
+func changed(n items.Notification) bool {
+	return n.Op != items.ChangeUpd || !reflect.DeepEqual(n.Old, n.Item)
+}
+
+//logChange records a change that was already applied
+//failing to log does not undo the change, consumers will see a gap after restart
+func (s *store) logChange(op items.ChangeOp, id string) {
+	if s.changes == nil {
+		return //still loading
+	}
+	if _, err := s.changes.Append(op, id); err != nil {
+		s.log.Errorf("Failed to log %s.%s(%s): %+v", s.itemName, op, id, err)
+	}
+}
+
 func (s *store) Uses(fieldName string, itemStore items.IStore) error {
 	return logger.Wrapf(nil, "Not yet implemented")
 }
 
+//Close stops the reload watcher and TTL sweeper, delivers queued
+//notifications and releases the file lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.watcherStop != nil {
+		close(s.watcherStop)
+	}
+	if s.sweeperStop != nil {
+		close(s.sweeperStop)
+	}
+	s.mutex.Unlock()
+
+	//wait without the lock, because a reload or sweep may be busy
+	s.watching.Wait()
+	s.sweeper.Wait()
+	s.notifier.Close()
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.filename)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.filename)
+	return nil
+} //store.Close()
+
 //mockItem implements IItem but is not used in this module
 type mockItem struct {
 	Name string
@@ -549,18 +746,22 @@ func (mockItem) Match(items.IItem) error {
 //fileItem is a struct similar to what we store in files
 //we use this to copy and modify its relfect description
 //to store other IItem structs
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta
 type fileItem struct {
 	ID   string      `json:"_id"`
 	Item items.IItem `json:"item"`
+	Meta items.Meta  `json:"_meta"`
 }
 
 //add _id to existing IItem struct type to store in file and list output
 func fileItemType(itemType reflect.Type) reflect.Type {
 	//return reflect.TypeOf(fileItem{})
+	return withItemType(reflect.TypeOf(fileItem{}), itemType)
+}
 
-	//make struct same as fileItem but using user item type instead of generic IItem
-	//becuase user type is a struct while IItem is just an interface
-	t := reflect.TypeOf(fileItem{})
+//withItemType makes a struct same as t but with field[1] using the user item type
+//instead of generic IItem becuase user type is a struct while IItem is just an interface
+func withItemType(t reflect.Type, itemType reflect.Type) reflect.Type {
 	structFields := make([]reflect.StructField, 0)
 	for i := 0; i < t.NumField(); i++ {
 		structFields = append(structFields, t.Field(i))
@@ -570,101 +771,17 @@ func fileItemType(itemType reflect.Type) reflect.Type {
 	return reflect.StructOf(structFields)
 }
 
-func newIndexSet(name string) indexSet {
-	return indexSet{
-		name:  name,
-		index: make(map[string]itemIndex),
-	}
-}
-
-type indexSet struct {
-	name  string
-	index map[string]itemIndex
-}
-
-func (s *indexSet) CheckUniqueness(id string, i items.IItem) error {
-	//if i.id is defined, do not compare with self (e.g. during item update)
-	//if i.id is not defined, its a new item that must be checked against all items
-	if itemWithUniqueKeys, ok := i.(items.IItemWithUniqueKeys); ok {
-		//need to check each unique key agains all other items
-		log.Debugf("Checking unique keys on %T", i)
-		keys := itemWithUniqueKeys.Keys()
-		for n, v := range keys {
-			//only need to check if this index exist
-			//if not - it will be created when this item is added,
-			//but then since its empty now, no need to check it if
-			//it does not exist :-)
-			if index, ok := s.index[n]; ok {
-				if otherItemID, ok := index[v]; ok {
-					//the index entry already exists:
-					//if this item has no id, this is a new item and it will
-					//be duplicate key
-					if len(id) == 0 {
-						return logger.Wrapf(nil, "duplicate key: %s:{%s:%v}", s.name, n, v)
-					}
-
-					//item has an id, so we're busy updating an existing item:
-					//this is only duplicate if the indexed item is not this item
-					if otherItemID != id {
-						return logger.Wrapf(nil, "duplicate key: %s:{%s:%v} same as %s:{id:%s}", s.name, n, v, s.name, otherItemID)
-					}
-				}
-			}
+//fileItemList makes a slice of fileItemType from the items, so that codecs
+//that need concrete types (e.g. gob) can encode the item field
+func (s *store) fileItemList(list []fileItem) interface{} {
+	listValue := reflect.MakeSlice(reflect.SliceOf(s.fileItemType), len(list), len(list))
+	for i, fileItem := range list {
+		fileItemValue := listValue.Index(i)
+		fileItemValue.Field(0).Set(reflect.ValueOf(fileItem.ID))
+		if fileItem.Item != nil {
+			fileItemValue.Field(1).Set(reflect.ValueOf(fileItem.Item))
 		}
-	} else {
-		log.Debugf("No unique keys on %T", i)
+		fileItemValue.Field(2).Set(reflect.ValueOf(fileItem.Meta))
 	}
-	return nil
-}
-
-func (s *indexSet) AddToIndex(id string, i items.IItem) error {
-	if itemWithUniqueKeys, ok := i.(items.IItemWithUniqueKeys); ok {
-		keys := itemWithUniqueKeys.Keys()
-
-		//check before adding
-		for n, v := range keys {
-			//create index if not exist
-			index, ok := s.index[n]
-			if !ok {
-				index = newIndex()
-				s.index[n] = index
-			}
-			if existingID, ok := index[v]; ok {
-				if existingID != id {
-					return logger.Wrapf(nil, "%s.id=%s duplicate on %s=%v",
-						s.name, id, n, v)
-				}
-			}
-		} //for each item.key
-
-		//no duplicates: add all keys
-		for n, v := range keys {
-			index, _ := s.index[n]
-			index[v] = id
-			log.Debugf("Added index(%s)[%v]=item", n, v)
-		} //for each item.key
-	}
-	return nil
-} //store.AddToIndex()
-
-func (s *indexSet) DelFromIndex(id string, i items.IItem) {
-	if itemWithUniqueKeys, ok := i.(items.IItemWithUniqueKeys); ok {
-		keys := itemWithUniqueKeys.Keys()
-		for n, v := range keys {
-			//delete only if index exists
-			index, ok := s.index[n]
-			if ok {
-				delete(index, v)
-				log.Debugf("Removed index(%s)[%v]=item.id=%s", n, v, id)
-			}
-		}
-	}
-} //store.DelFromIndex()
-
-//index stores the id
-//use that to get the item in the store from itemByID[<id>]
-type itemIndex map[interface{}]string
-
-func newIndex() itemIndex {
-	return make(map[interface{}]string)
+	return listValue.Interface()
 }
@@ -3,14 +3,19 @@ package jsonfile_test
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/idgen"
 	"github.com/jansemmelink/items2/store/jsonfile"
 	"github.com/satori/uuid"
 	"github.com/stewelarend/logger"
@@ -18,6 +23,12 @@ import (
 
 var log = logger.New()
 
+func TestMain(m *testing.M) {
+	//all tests write their files under ./share
+	os.MkdirAll("./share/load", 0770)
+	os.Exit(m.Run())
+}
+
 func Test1(t *testing.T) {
 	filename := "./share/users.json"
 	os.Remove(filename)
@@ -25,6 +36,7 @@ func Test1(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create s1: %+v", err)
 	}
+	defer s1.Close()
 	log.Debugf("Created s1: %s", s1.Name())
 
 	//add a single item (no duplicate detection)
@@ -53,6 +65,7 @@ func Test2(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store file %s: %+v", storeFileName, err)
 	}
+	defer store.Close()
 	log.Debugf("Created store file %s: %s", storeFileName, store.Name())
 
 	//add 10 items
@@ -145,6 +158,7 @@ func TestUniqueKeys(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %+v", err)
 	}
+	defer store.Close()
 	log.Debugf("Created store: %s", store.Name())
 
 	//add a single item
@@ -225,10 +239,11 @@ func TestFileUpdate(t *testing.T) {
 
 	os.Mkdir("./share/load", 0770)
 	os.Remove(filename)
-	s1, err := jsonfile.NewWithReload(filename, loadfilename, "user", user{}, idGen{})
+	s1, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{Debounce: time.Millisecond * 200})
 	if err != nil {
 		t.Fatalf("Failed to create s1: %+v", err)
 	}
+	defer s1.Close()
 	log.Debugf("Created s1: %s", s1.Name())
 
 	if list := s1.Find(100, nil); len(list) != 0 {
@@ -243,17 +258,17 @@ func TestFileUpdate(t *testing.T) {
 
 	//update the load file - with one item
 	updateFile(t, loadfilename, `[{"_id":"f8f47a3e-3601-11ea-8045-f45c89a88a57","item": {"name": "A", "rev":1}}]`)
-	time.Sleep(time.Second)
+	time.Sleep(time.Millisecond * 600)
 	if list := s1.Find(100, nil); len(list) != 1 {
 		t.Fatalf("Got %d instead of 1", len(list))
 	}
-	if !sameFileContents(t, filename, loadfilename) {
-		t.Fatalf("Different contents in file %s and %s", filename, loadfilename)
+	if fis := storeFileItems(t, filename); len(fis) != 1 || fis[0].Item.Name != "A" || fis[0].Meta.Rev != 1 {
+		t.Fatalf("Store file %s not written from reload: %+v", filename, fis)
 	}
 
 	//update the load file - with invalid item
 	updateFile(t, loadfilename, `[{"_id":"f8f47a3e-3601-11ea-8045-f45c89a88a57","item": {"name": "", "rev":2}}]`)
-	time.Sleep(time.Second)
+	time.Sleep(time.Millisecond * 600)
 	if list := s1.Find(100, nil); len(list) != 1 { //still expect old item to exist
 		t.Fatalf("Got %d instead of 1", len(list))
 	} else {
@@ -262,15 +277,15 @@ func TestFileUpdate(t *testing.T) {
 			t.Fatalf("Invalid update broke u1:%+v", u1)
 		}
 	}
-	if sameFileContents(t, filename, loadfilename) { //should now be different
-		t.Fatalf("Same contents in file %s and %s after invalid update", filename, loadfilename)
+	if fis := storeFileItems(t, filename); len(fis) != 1 || fis[0].Item.Name != "A" { //should still have the old item
+		t.Fatalf("Store file %s changed after invalid update: %+v", filename, fis)
 	}
 	//check error file - should indicate invalid name ""
 	checkErrorfile(t, errorFilename, "user.name not specified")
 
 	//corrent the mistake, updating the item with a new name and rev
 	updateFile(t, loadfilename, `[{"_id":"f8f47a3e-3601-11ea-8045-f45c89a88a57","item": {"name": "B", "rev":3}}]`)
-	time.Sleep(time.Second)
+	time.Sleep(time.Millisecond * 600)
 	if list := s1.Find(100, nil); len(list) != 1 { //still expect old item to exist
 		t.Fatalf("Got %d instead of 1", len(list))
 	} else {
@@ -279,8 +294,8 @@ func TestFileUpdate(t *testing.T) {
 			t.Fatalf("Update not applied to u1:%+v", u1)
 		}
 	}
-	if !sameFileContents(t, filename, loadfilename) { //should now be same
-		t.Fatalf("Different contents in file %s and %s after update", filename, loadfilename)
+	if fis := storeFileItems(t, filename); len(fis) != 1 || fis[0].Item.Name != "B" || fis[0].Meta.Rev != 2 { //metadata kept by the store
+		t.Fatalf("Store file %s not updated with metadata: %+v", filename, fis)
 	}
 	//check error file must be deleted
 	if _, err := os.Stat(errorFilename); err == nil {
@@ -301,6 +316,25 @@ func updateFile(t *testing.T, filename string, json string) {
 	t.Logf("Updated %s", filename)
 }
 
+//storeFileItem is an item as written in the store file
+type storeFileItem struct {
+	ID   string     `json:"_id"`
+	Item user       `json:"item"`
+	Meta items.Meta `json:"_meta"`
+}
+
+func storeFileItems(t *testing.T, filename string) []storeFileItem {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %v", filename, err)
+	}
+	var fis []storeFileItem
+	if err := json.Unmarshal(data, &fis); err != nil {
+		t.Fatalf("Failed to decode file %s: %v", filename, err)
+	}
+	return fis
+}
+
 func sameFileContents(t *testing.T, f1, f2 string) bool {
 	md5_1 := fileMD5(t, f1)
 	md5_2 := fileMD5(t, f2)
@@ -351,3 +385,1010 @@ func checkErrorfile(t *testing.T, filename string, textToFind string) {
 
 	t.Logf("Error file %s indicates \"%s\"", filename, textToFind)
 }
+
+func TestChanges(t *testing.T) {
+	filename := "./share/changes.json"
+	os.Remove(filename)
+	os.Remove("./share/changes.changes")
+	s1, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s1.Close()
+	id1, err := s1.Add(user{Rev: 1, Name: "A"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	id2, err := s1.Add(user{Rev: 1, Name: "B"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s1.Upd(id1, user{Rev: 2, Name: "A"}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	if err := s1.Del(id2); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	//loading existing items after a restart must not log changes
+	s1.Close()
+	s2, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s2.Close()
+	cs := s2.(items.IStoreWithChanges)
+	if cs.Seq() != 4 {
+		t.Fatalf("Seq=%d instead of 4", cs.Seq())
+	}
+	changes, err := cs.ChangesSince(2)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+	if len(changes) != 2 ||
+		changes[0].Seq != 3 || changes[0].Op != items.ChangeUpd || changes[0].ID != id1 ||
+		changes[1].Seq != 4 || changes[1].Op != items.ChangeDel || changes[1].ID != id2 {
+		t.Fatalf("Wrong changes: %+v", changes)
+	}
+}
+
+//counter is an item that is updated from a notification handler
+type counter struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (c counter) Validate() error                          { return nil }
+func (c counter) Match(filter items.IItem) error           { return nil }
+func (c counter) MatchKey(key map[string]interface{}) bool { return key["name"] == c.Name }
+
+func TestNotify(t *testing.T) {
+	filename := "./share/counters.json"
+	os.Remove(filename)
+	s, err := jsonfile.New(filename, "counter", counter{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	totalID, err := s.Add(counter{Name: "total"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+
+	//handler updates the total in the same store, which deadlocked
+	//when notifications were delivered with the store locked
+	notifier := s.(items.IStoreWithNotifier).Notifier()
+	var totalMutex sync.Mutex //async handlers run in parallel for different ids
+	notifier.Handle(func(n items.Notification) error {
+		if n.ID == totalID {
+			return nil
+		}
+		totalMutex.Lock()
+		defer totalMutex.Unlock()
+		total, err := s.Get(totalID)
+		if err != nil {
+			return err
+		}
+		c := total.(counter)
+		c.Count++
+		return s.Upd(totalID, c)
+	})
+	var errorsMutex sync.Mutex
+	handlerErrors := 0
+	notifier.OnError(func(n items.Notification, err error) {
+		errorsMutex.Lock()
+		defer errorsMutex.Unlock()
+		handlerErrors++
+	})
+
+	if _, err := s.Add(counter{Name: "a"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if total, _ := s.Get(totalID); total.(counter).Count != 1 {
+		t.Fatalf("Total not updated synchronously: %+v", total)
+	}
+
+	//async delivery
+	notifier.SetMode(items.NotifyAsync)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Add(counter{Name: fmt.Sprintf("b%d", i)}); err != nil {
+			t.Fatalf("Failed to add: %+v", err)
+		}
+	}
+	notifier.Flush()
+	if total, _ := s.Get(totalID); total.(counter).Count != 11 {
+		t.Fatalf("Total=%+v instead of 11", total)
+	}
+
+	//errors from handlers are reported
+	notifier.Handle(func(n items.Notification) error {
+		return logger.Wrapf(nil, "handler failed")
+	})
+	if _, err := s.Add(counter{Name: "c"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	notifier.Close()
+	errorsMutex.Lock()
+	defer errorsMutex.Unlock()
+	if handlerErrors == 0 {
+		t.Fatalf("Handler error not reported")
+	}
+}
+
+//TestNotifyFromHandler has async handlers that change the mode and close the store
+func TestNotifyFromHandler(t *testing.T) {
+	filename := "./share/notify-handler.json"
+	os.Remove(filename)
+	s, err := jsonfile.New(filename, "counter", counter{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	notifier := s.(items.IStoreWithNotifier).Notifier()
+	notifier.SetMode(items.NotifyAsync)
+	errs := make(chan error, 2)
+	notifier.Handle(func(n items.Notification) error {
+		errs <- notifier.SetMode(items.NotifySync)
+		errs <- notifier.Close()
+		return nil
+	})
+	if _, err := s.Add(counter{Name: "a"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != items.ErrNotifyHandler {
+				t.Fatalf("Called from handler -> %v", err)
+			}
+		case <-time.After(time.Second * 10):
+			t.Fatalf("Deadlocked in handler")
+		}
+	}
+	if notifier.Mode() != items.NotifySync {
+		t.Fatalf("Close from handler did not stop async delivery")
+	}
+	if err := notifier.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+}
+
+//TestNotifyQueueFull has async handlers that add items while the queues are full
+func TestNotifyQueueFull(t *testing.T) {
+	filename := "./share/notify-full.json"
+	os.Remove(filename)
+	defer func(size int) { items.DefaultNotifyQueueSize = size }(items.DefaultNotifyQueueSize)
+	items.DefaultNotifyQueueSize = 1
+	s, err := jsonfile.New(filename, "counter", counter{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	notifier := s.(items.IStoreWithNotifier).Notifier()
+	notifier.SetMode(items.NotifyAsync)
+	notifier.Handle(func(n items.Notification) error {
+		if n.Op != items.ChangeAdd || strings.HasSuffix(n.Item.(counter).Name, ".copy") {
+			return nil
+		}
+		_, err := s.Add(counter{Name: n.Item.(counter).Name + ".copy"})
+		return err
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			s.Add(counter{Name: fmt.Sprintf("c%d", i)})
+			if i == 25 {
+				notifier.SetMode(items.NotifySync)
+				notifier.SetMode(items.NotifyAsync)
+			}
+		}
+		notifier.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatalf("Deadlocked while handlers add items")
+	}
+	if list := s.Find(0, nil); len(list) != 100 {
+		t.Fatalf("Found %d instead of 100 items", len(list))
+	}
+}
+
+//lockedUser cannot be deleted while locked
+type lockedUser struct {
+	user
+	Locked bool `json:"locked"`
+}
+
+func (u lockedUser) BeforeDel() error {
+	if u.Locked {
+		return logger.Wrapf(nil, "user %s is locked", u.Name)
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	filename := "./share/hooks.json"
+	loadfilename := "./share/load/hooks.json"
+	os.Remove(filename)
+	os.Remove(loadfilename)
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", lockedUser{}, idGen{}, jsonfile.ReloadOptions{Debounce: time.Millisecond * 200})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	s.(items.IStoreWithHooks).Hooks().BeforeUpd(func(id string, old items.IItem, new items.IItem) error {
+		if new.(lockedUser).Rev < old.(lockedUser).Rev {
+			return logger.Wrapf(nil, "rev may not decrease")
+		}
+		return nil
+	})
+
+	id, err := s.Add(lockedUser{user: user{Rev: 2, Name: "A"}, Locked: true})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s.Del(id); err == nil {
+		t.Fatalf("Deleted locked user")
+	}
+	if err := s.Upd(id, lockedUser{user: user{Rev: 1, Name: "A"}, Locked: true}); err == nil {
+		t.Fatalf("Updated to lower rev")
+	}
+
+	//reload is rejected by the same hook
+	updateFile(t, loadfilename, fmt.Sprintf(`[{"_id":"%s","item":{"name":"A","rev":1,"locked":true}}]`, id))
+	time.Sleep(time.Millisecond * 600)
+	if item, _ := s.Get(id); item.(lockedUser).Rev != 2 {
+		t.Fatalf("Reload applied lower rev: %+v", item)
+	}
+	checkErrorfile(t, strings.Replace(loadfilename, ".json", ".err", 1), "rev may not decrease")
+
+	//unlock then delete
+	if err := s.Upd(id, lockedUser{user: user{Rev: 3, Name: "A"}}); err != nil {
+		t.Fatalf("Failed to unlock: %+v", err)
+	}
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to delete unlocked user: %+v", err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	filename := "./share/meta.json"
+	os.Remove(filename)
+	s1, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s1.Close()
+	ms := s1.(items.IStoreWithMeta)
+	id, err := ms.AddBy("alice", user{Rev: 1, Name: "A"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := ms.UpdBy("bob", id, user{Rev: 2, Name: "A"}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+
+	//metadata must be persisted
+	s1.Close()
+	s2, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s2.Close()
+	_, meta, err := s2.(items.IStoreWithMeta).GetWithMeta(id)
+	if err != nil {
+		t.Fatalf("Failed to get: %+v", err)
+	}
+	if meta.Rev != 2 || meta.CreatedBy != "alice" || meta.UpdatedBy != "bob" || meta.Updated.Before(meta.Created) {
+		t.Fatalf("Wrong meta: %+v", meta)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	filename := "./share/history.json"
+	os.Remove(filename)
+	os.Remove("./share/history.history")
+	os.Remove("./share/history.changes")
+	s, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	hs := s.(items.IStoreWithHistory)
+	if err := hs.EnableHistory(); err != nil {
+		t.Fatalf("Failed to enable history: %+v", err)
+	}
+	id, err := s.Add(user{Rev: 1, Name: "A"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	t1 := time.Now()
+	if err := s.Upd(id, user{Rev: 2, Name: "B"}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	t2 := time.Now()
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	versions, err := hs.Versions(id)
+	if err != nil || len(versions) != 2 || !versions[1].Deleted {
+		t.Fatalf("Wrong versions: %+v, %v", versions, err)
+	}
+	if item, _, err := hs.GetVersion(id, 1); err != nil || item.(user).Name != "A" {
+		t.Fatalf("GetVersion(1) -> %+v, %v", item, err)
+	}
+	if item, _, err := hs.GetAsOf(id, t1); err != nil || item.(user).Name != "A" {
+		t.Fatalf("GetAsOf(t1) -> %+v, %v", item, err)
+	}
+	if item, _, err := hs.GetAsOf(id, t2); err != nil || item.(user).Name != "B" {
+		t.Fatalf("GetAsOf(t2) -> %+v, %v", item, err)
+	}
+	if list := hs.FindAsOf(t2, 0, nil); len(list) != 1 || list[0].ID != id {
+		t.Fatalf("FindAsOf(t2) -> %+v", list)
+	}
+	if list := hs.FindAsOf(time.Now(), 0, nil); len(list) != 0 {
+		t.Fatalf("FindAsOf(now) -> %+v", list)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	filename := "./share/softdelete.json"
+	os.Remove(filename)
+	s1, err := jsonfile.New(filename, "userUniq", userUniq{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s1.Close()
+	sd := s1.(items.IStoreWithSoftDelete)
+	if err := sd.EnableSoftDelete(0); err != nil {
+		t.Fatalf("Failed to enable soft delete: %+v", err)
+	}
+	id, err := s1.Add(userUniq{user{Name: "A"}})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s1.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	//tombstone is hidden, also from unique keys and after reopening the file
+	for reopen := 0; reopen < 2; reopen++ {
+		if reopen > 0 {
+			s1.Close()
+			s1, err = jsonfile.New(filename, "userUniq", userUniq{}, idGen{})
+			if err != nil {
+				t.Fatalf("Failed to reopen store: %+v", err)
+			}
+			defer s1.Close()
+			sd = s1.(items.IStoreWithSoftDelete)
+		}
+		if _, err := s1.Get(id); err == nil {
+			t.Fatalf("Got deleted item")
+		}
+		if list := s1.Find(0, nil); len(list) != 0 {
+			t.Fatalf("Found deleted item: %+v", list)
+		}
+		if _, _, err := s1.GetBy(map[string]interface{}{"name": "A"}); err == nil {
+			t.Fatalf("GetBy found deleted item")
+		}
+		if list := sd.FindDeleted(0, nil); len(list) != 1 || list[0].ID != id {
+			t.Fatalf("FindDeleted -> %+v", list)
+		}
+	}
+	otherID, err := s1.Add(userUniq{user{Name: "A"}})
+	if err != nil {
+		t.Fatalf("Failed to add same name as deleted item: %+v", err)
+	}
+
+	//restore fails while the name is in use
+	if err := sd.Restore(id); err == nil {
+		t.Fatalf("Restored duplicate")
+	}
+	if err := s1.Del(otherID); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if err := sd.Restore(id); err != nil {
+		t.Fatalf("Failed to restore: %+v", err)
+	}
+	if _, meta, err := s1.(items.IStoreWithMeta).GetWithMeta(id); err != nil || meta.Rev != 2 || meta.IsDeleted() {
+		t.Fatalf("Restored -> %+v, %v", meta, err)
+	}
+	if err := sd.Purge(id); err == nil {
+		t.Fatalf("Purged item that is not deleted")
+	}
+	if err := sd.Purge(otherID); err != nil {
+		t.Fatalf("Failed to purge: %+v", err)
+	}
+	if list := sd.FindDeleted(0, nil); len(list) != 0 {
+		t.Fatalf("FindDeleted after purge -> %+v", list)
+	}
+
+	//expired tombstones are purged with the next write
+	if err := sd.EnableSoftDelete(time.Millisecond * 10); err != nil {
+		t.Fatalf("Failed to set retention: %+v", err)
+	}
+	if err := s1.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if list := sd.FindDeleted(0, nil); len(list) != 0 {
+		t.Fatalf("FindDeleted after retention -> %+v", list)
+	}
+	if _, err := s1.Add(userUniq{user{Name: "B"}}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	s1.Close()
+	s3, err := jsonfile.New(filename, "userUniq", userUniq{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s3.Close()
+	if list := s3.(items.IStoreWithSoftDelete).FindDeleted(0, nil); len(list) != 0 {
+		t.Fatalf("Expired tombstone was not purged: %+v", list)
+	}
+}
+
+//TestReloadTombstones reloads a file without the tombstones of the store
+func TestReloadTombstones(t *testing.T) {
+	filename := "./share/reload-tombstones.json"
+	loadfilename := "./share/load/reload-tombstones.json"
+	os.Remove(filename)
+	os.Remove(loadfilename)
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{Debounce: time.Millisecond * 200})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	sd := s.(items.IStoreWithSoftDelete)
+	if err := sd.EnableSoftDelete(0); err != nil {
+		t.Fatalf("Failed to enable soft delete: %+v", err)
+	}
+	deletedID, _ := s.Add(user{Rev: 1, Name: "A"})
+	keptID, _ := s.Add(user{Rev: 1, Name: "B"})
+	if err := s.Del(deletedID); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	//a tombstone in the reload file is an item, because metadata is managed by the store
+	updateFile(t, loadfilename, `[{"_id":"`+keptID+`","item":{"rev":1,"name":"B"}},`+
+		`{"_id":"x","item":{"rev":1,"name":"C"},"_meta":{"rev":5,"deleted":"2020-01-01T00:00:00Z"}}]`)
+	time.Sleep(time.Millisecond * 600)
+	if _, meta, err := s.(items.IStoreWithMeta).GetWithMeta("x"); err != nil || meta.IsDeleted() || meta.Rev != 1 {
+		t.Fatalf("GetWithMeta(x) -> %+v, %v", meta, err)
+	}
+	if list := sd.FindDeleted(0, nil); len(list) != 1 || list[0].ID != deletedID {
+		t.Fatalf("FindDeleted after reload -> %+v", list)
+	}
+	if err := sd.Restore(deletedID); err != nil {
+		t.Fatalf("Failed to restore after reload: %+v", err)
+	}
+	if item, err := s.Get(deletedID); err != nil || item.(user).Name != "A" {
+		t.Fatalf("Get restored -> %+v, %v", item, err)
+	}
+}
+
+type session struct {
+	user
+	Lifetime time.Duration `json:"lifetime"`
+}
+
+func (s session) TTL() time.Duration {
+	return s.Lifetime
+}
+
+func TestTTL(t *testing.T) {
+	filename := "./share/ttl.json"
+	os.Remove(filename)
+	s, err := jsonfile.New(filename, "session", session{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	var expiredMutex sync.Mutex
+	expired := map[string]bool{}
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		if n.Op == items.ChangeDel {
+			expiredMutex.Lock()
+			expired[n.ID] = true
+			expiredMutex.Unlock()
+		}
+		return nil
+	})
+	short, _ := s.Add(session{user: user{Name: "short"}, Lifetime: time.Millisecond * 50})
+	forever, _ := s.Add(session{user: user{Name: "forever"}})
+	if _, err := s.Get(short); err != nil {
+		t.Fatalf("Session expired too soon: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	//expired item is absent before it is removed
+	if _, err := s.Get(short); err == nil {
+		t.Fatalf("Got expired session")
+	}
+	if list := s.Find(0, nil); len(list) != 1 || list[0].ID != forever {
+		t.Fatalf("Find -> %+v", list)
+	}
+
+	//sweeper removes it from the file
+	ts := s.(items.IStoreWithTTL)
+	if err := ts.EnableTTL(0, time.Millisecond*10); err != nil {
+		t.Fatalf("Failed to enable TTL: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := ts.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+	expiredMutex.Lock()
+	if !expired[short] || expired[forever] {
+		t.Fatalf("Wrong expiry notifications: %+v", expired)
+	}
+	expiredMutex.Unlock()
+	fileData, _ := ioutil.ReadFile(filename)
+	if strings.Contains(string(fileData), short) {
+		t.Fatalf("Expired session still in file")
+	}
+}
+
+func TestClose(t *testing.T) {
+	filename := "./share/close.json"
+	loadfilename := "./share/load/close.json"
+	os.Remove(filename)
+	s1, err := jsonfile.NewWithReload(filename, loadfilename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, err := s1.Add(user{Rev: 1, Name: "A"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+
+	//the file is locked while the store is open
+	if _, err := jsonfile.New(filename, "user", user{}, idGen{}); err == nil {
+		t.Fatalf("Opened store twice")
+	}
+
+	//close stops the watcher and all operations fail
+	if err := s1.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatalf("Failed to close twice: %+v", err)
+	}
+	if _, err := s1.Add(user{Rev: 1, Name: "B"}); err != items.ErrClosed {
+		t.Fatalf("Add after close -> %v", err)
+	}
+	if _, err := s1.Get(id); err != items.ErrClosed {
+		t.Fatalf("Get after close -> %v", err)
+	}
+	if err := s1.Del(id); err != items.ErrClosed {
+		t.Fatalf("Del after close -> %v", err)
+	}
+	if list := s1.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Find after close -> %+v", list)
+	}
+
+	//the lock was released
+	s2, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s2.Close()
+	if _, err := s2.Get(id); err != nil {
+		t.Fatalf("Failed to get after reopen: %+v", err)
+	}
+}
+
+func TestReloadRename(t *testing.T) {
+	filename := "./share/rename.json"
+	loadfilename := "./share/load/rename.json"
+	os.Remove(filename)
+	os.Remove(loadfilename)
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{Debounce: time.Millisecond * 200})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	//editors write a new file then rename it over the old one
+	tmpFilename := loadfilename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, []byte(`[{"_id":"1","item":{"rev":1,"name":"A"}}]`), 0660); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	if err := os.Rename(tmpFilename, loadfilename); err != nil {
+		t.Fatalf("Failed to rename: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if _, err := s.Get("1"); err == nil {
+		t.Fatalf("Reloaded before debounce")
+	}
+	time.Sleep(time.Millisecond * 500)
+	if _, err := s.Get("1"); err != nil {
+		t.Fatalf("Not reloaded: %+v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	filename := "./share/dryrun.json"
+	loadfilename := "./share/load/dryrun.json"
+	os.Remove(filename)
+	s, err := jsonfile.New(filename, "userUniq", userUniq{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	id1, _ := s.Add(userUniq{user{Rev: 1, Name: "A"}})
+	id2, _ := s.Add(userUniq{user{Rev: 1, Name: "B"}})
+
+	updateFile(t, loadfilename, fmt.Sprintf(`[
+		{"_id":"%s","item":{"rev":2,"name":"A"}},
+		{"_id":"new","item":{"rev":1,"name":"C"}},
+		{"_id":"bad","item":{"rev":1,"name":""}},
+		{"_id":"dup","item":{"rev":1,"name":"A"}}
+	]`, id1))
+	diff, err := s.(items.IStoreWithDryRun).DryRun(loadfilename)
+	if err != nil {
+		t.Fatalf("Failed dry run: %+v", err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0] != "new" {
+		t.Fatalf("Added: %+v", diff.Added)
+	}
+	if len(diff.Deleted) != 1 || diff.Deleted[0] != id2 {
+		t.Fatalf("Deleted: %+v", diff.Deleted)
+	}
+	if len(diff.Updated) != 1 || diff.Updated[0].ID != id1 || len(diff.Updated[0].Fields) != 1 || diff.Updated[0].Fields[0].Field != "rev" {
+		t.Fatalf("Updated: %+v", diff.Updated)
+	}
+	if len(diff.Errors) != 2 ||
+		diff.Errors[0].Index != 2 || diff.Errors[0].Kind != items.ReloadErrorInvalid ||
+		diff.Errors[1].Index != 3 || diff.Errors[1].Kind != items.ReloadErrorDuplicateKey {
+		t.Fatalf("Errors: %+v", diff.Errors)
+	}
+
+	//store is not changed
+	if list := s.Find(0, nil); len(list) != 2 {
+		t.Fatalf("Dry run changed the store: %+v", list)
+	}
+}
+
+func TestReloadReport(t *testing.T) {
+	filename := "./share/report.json"
+	loadfilename := "./share/load/report.json"
+	errorFilename := "./share/load/report.err"
+	okFilename := "./share/load/report.ok"
+	for _, fn := range []string{filename, loadfilename, errorFilename, okFilename} {
+		os.Remove(fn)
+	}
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{
+		Debounce: time.Millisecond * 200,
+		Report:   jsonfile.ReloadReportJSON,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	//all errors are reported, not only the first
+	updateFile(t, loadfilename, `[
+		{"_id":"1","item":{"rev":"x","name":"A"}},
+		{"_id":"2","item":{"rev":1,"name":""}},
+		{"_id":"3","item":{"rev":1,"name":"C"}}
+	]`)
+	time.Sleep(time.Millisecond * 600)
+	var report items.ReloadReport
+	readReport(t, errorFilename, &report)
+	if report.Status != items.ReloadStatusFailed || len(report.Errors) != 2 {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+	if e := report.Errors[0]; e.Index != 0 || e.ID != "1" || e.Field != "item.rev" || e.Kind != items.ReloadErrorDecode {
+		t.Fatalf("Wrong decode error: %+v", e)
+	}
+	if e := report.Errors[1]; e.Index != 1 || e.ID != "2" || e.Kind != items.ReloadErrorInvalid {
+		t.Fatalf("Wrong invalid error: %+v", e)
+	}
+	if list := s.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Applied file with errors: %+v", list)
+	}
+
+	//success replaces the error report
+	updateFile(t, loadfilename, `[
+		{"_id":"1","item":{"rev":1,"name":"A"}},
+		{"_id":"2","item":{"rev":1,"name":"B"}}
+	]`)
+	time.Sleep(time.Millisecond * 600)
+	report = items.ReloadReport{}
+	readReport(t, okFilename, &report)
+	if report.Status != items.ReloadStatusOK || report.Added != 2 || report.Updated != 0 || report.Deleted != 0 {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+	if _, err := os.Stat(errorFilename); err == nil {
+		t.Fatalf("Error report not removed")
+	}
+}
+
+func readReport(t *testing.T, filename string, report *items.ReloadReport) {
+	jsonReport, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Cannot read report: %+v", err)
+	}
+	if err := json.Unmarshal(jsonReport, report); err != nil {
+		t.Fatalf("Cannot decode report %s: %+v", string(jsonReport), err)
+	}
+}
+
+func TestReloadLenient(t *testing.T) {
+	filename := "./share/lenient.json"
+	loadfilename := "./share/load/lenient.json"
+	errorFilename := "./share/load/lenient.err"
+	for _, fn := range []string{filename, loadfilename, errorFilename, "./share/load/lenient.ok"} {
+		os.Remove(fn)
+	}
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "userUniq", userUniq{}, idGen{}, jsonfile.ReloadOptions{
+		Debounce: time.Millisecond * 200,
+		Policy:   jsonfile.ReloadLenient,
+		Report:   jsonfile.ReloadReportJSON,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	updateFile(t, loadfilename, `[
+		{"_id":"1","item":{"rev":1,"name":"A"}},
+		{"_id":"2","item":{"rev":1,"name":"B"}},
+		{"_id":"3","item":{"rev":1,"name":"C"}}
+	]`)
+	time.Sleep(time.Millisecond * 600)
+	if list := s.Find(0, nil); len(list) != 3 {
+		t.Fatalf("Got %d instead of 3", len(list))
+	}
+
+	//invalid, duplicate and rejected items keep their old version
+	s.(items.IStoreWithHooks).Hooks().BeforeDel(func(id string, item items.IItem) error {
+		if id == "3" {
+			return logger.Wrapf(nil, "3 may not be deleted")
+		}
+		return nil
+	})
+	updateFile(t, loadfilename, `[
+		{"_id":"1","item":{"rev":2,"name":""}},
+		{"_id":"2","item":{"rev":2,"name":"C"}},
+		{"_id":"4","item":{"rev":1,"name":"D"}},
+		{"_id":"5","item":{"rev":1,"name":""}}
+	]`)
+	time.Sleep(time.Millisecond * 600)
+
+	expected := map[string]string{"1": "A", "2": "B", "3": "C", "4": "D"}
+	list := s.Find(0, nil)
+	if len(list) != len(expected) {
+		t.Fatalf("Got %d instead of %d: %+v", len(list), len(expected), list)
+	}
+	for _, idAndItem := range list {
+		if u := idAndItem.Item.(userUniq); expected[idAndItem.ID] != u.Name || u.Rev != 1 {
+			t.Fatalf("Wrong %s: %+v", idAndItem.ID, u)
+		}
+	}
+
+	var report items.ReloadReport
+	readReport(t, errorFilename, &report)
+	if report.Status != items.ReloadStatusPartial || report.Added != 1 || report.Updated != 0 || report.Deleted != 0 {
+		t.Fatalf("Wrong report: %+v", report)
+	}
+	kinds := make([]string, 0)
+	for _, e := range report.Errors {
+		kinds = append(kinds, fmt.Sprintf("%d:%s:%s", e.Index, e.ID, e.Kind))
+	}
+	if strings.Join(kinds, ",") != "-1:3:rejected,0:1:invalid,1:2:duplicate_key,3:5:invalid" {
+		t.Fatalf("Wrong errors: %v", kinds)
+	}
+
+	//the store file has what was applied, not the reload file
+	s.Close()
+	s, err = jsonfile.New(filename, "userUniq", userUniq{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s.Close()
+	if list := s.Find(0, nil); len(list) != len(expected) {
+		t.Fatalf("Got %d instead of %d after reopen", len(list), len(expected))
+	}
+}
+
+func TestReloadOptions(t *testing.T) {
+	filename := "./share/options.json"
+	loadfilename := "./share/load/options.json"
+	errorFilename := "./share/options-reload.err"
+	os.Remove(filename)
+	os.Remove(loadfilename)
+	os.Remove(errorFilename)
+	if _, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{Policy: "loose"}); err == nil {
+		t.Fatalf("Created store with unknown policy")
+	}
+	s, err := jsonfile.NewWithReloadOptions(filename, loadfilename, "user", user{}, idGen{}, jsonfile.ReloadOptions{
+		Debounce:      time.Millisecond * 200,
+		ErrorFilename: errorFilename,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	updateFile(t, loadfilename, `[{"_id":"1","item":{"rev":1,"name":""}}]`)
+	time.Sleep(time.Millisecond * 600)
+	checkErrorfile(t, errorFilename, "user.name not specified")
+
+	//the store writes its own file, with metadata
+	updateFile(t, loadfilename, `[{"_id":"1","item":{"rev":1,"name":"A"}}]`)
+	time.Sleep(time.Millisecond * 600)
+	if _, err := s.Get("1"); err != nil {
+		t.Fatalf("Not reloaded: %+v", err)
+	}
+	if _, err := os.Stat(errorFilename); err == nil {
+		t.Fatalf("Error file %s still exists", errorFilename)
+	}
+	fileData, _ := ioutil.ReadFile(filename)
+	if sameFileContents(t, filename, loadfilename) || !strings.Contains(string(fileData), `"_meta"`) {
+		t.Fatalf("Store file copied from reload file: %s", string(fileData))
+	}
+}
+
+func TestOptions(t *testing.T) {
+	filename := "./share/options-new.json"
+	os.Remove(filename)
+	if _, err := jsonfile.NewWithOptions(filename, "user", user{}, jsonfile.WithIDGenerator(nil)); err == nil {
+		t.Fatalf("Created store with nil id generator")
+	}
+
+	hooks := items.NewHooks()
+	hooks.BeforeAdd(func(item items.IItem) error {
+		if item.(user).Rev < 1 {
+			return logger.Wrapf(nil, "rev must be positive")
+		}
+		return nil
+	})
+	s, err := jsonfile.NewWithOptions(filename, "user", user{},
+		jsonfile.WithIDGenerator(idGen{}),
+		jsonfile.WithFileMode(0600),
+		jsonfile.WithLogger(log),
+		jsonfile.WithHooks(hooks),
+		jsonfile.WithUniqueKey("name", func(item items.IItem) interface{} { return item.(user).Name }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.Add(user{Rev: 1, Name: "A"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(user{Rev: 2, Name: "A"}); err == nil {
+		t.Fatalf("Added duplicate name")
+	}
+	if _, err := s.Add(user{Rev: 0, Name: "B"}); err == nil {
+		t.Fatalf("Added item rejected by hook")
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Wrong file mode: %+v %v", info, err)
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	filename := "./share/sequential.json"
+	os.Remove(filename)
+	for i, expected := range []string{"1", "2"} {
+		seq, _ := idgen.Sequential("")
+		s, err := jsonfile.NewWithOptions(filename, "user", user{}, jsonfile.WithIDGenerator(seq))
+		if err != nil {
+			t.Fatalf("Failed to create store: %+v", err)
+		}
+		//resumes after the ids in the file
+		id, err := s.Add(user{Rev: 1, Name: fmt.Sprintf("U%d", i)})
+		s.Close()
+		if err != nil || id != expected {
+			t.Fatalf("Added id=%s instead of %s: %v", id, expected, err)
+		}
+	}
+}
+
+func TestAddWithID(t *testing.T) {
+	filename := "./share/addwithid.json"
+	os.Remove(filename)
+	s, err := jsonfile.New(filename, "user", user{}, idGen{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	ws := s.(items.IStoreWithID)
+	if err := ws.AddWithID("u-1", user{Rev: 1, Name: "A"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	for _, id := range []string{"u-1", "", "a/b", "-a", strings.Repeat("a", items.MaxIDLength+1)} {
+		if err := ws.AddWithID(id, user{Rev: 1, Name: "B"}); err == nil {
+			t.Fatalf("Added with id \"%s\"", id)
+		}
+	}
+	if item, err := s.Get("u-1"); err != nil || item.(user).Name != "A" {
+		t.Fatalf("Get -> %+v, %v", item, err)
+	}
+}
+
+func TestIDFromKey(t *testing.T) {
+	filename := "./share/idfromkey.json"
+	os.Remove(filename)
+	s, err := jsonfile.NewWithOptions(filename, "userUniq", userUniq{}, jsonfile.WithIDFromKey("name"))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	if id, err := s.Add(userUniq{user{Rev: 1, Name: "ZA"}}); err != nil || id != "ZA" {
+		t.Fatalf("Added id=%s instead of ZA: %v", id, err)
+	}
+	if _, err := s.Add(userUniq{user{Rev: 2, Name: "ZA"}}); err == nil {
+		t.Fatalf("Added same key twice")
+	}
+	if err := s.(items.IStoreWithID).AddWithID("US", userUniq{user{Rev: 1, Name: "UK"}}); err == nil {
+		t.Fatalf("Added with id different from key")
+	}
+	if err := s.Upd("ZA", userUniq{user{Rev: 2, Name: "ZW"}}); err == nil {
+		t.Fatalf("Updated key used as id")
+	}
+	if err := s.Upd("ZA", userUniq{user{Rev: 2, Name: "ZA"}}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	if _, err := s.Add(userUniq{user{Rev: 1, Name: "not valid"}}); err == nil {
+		t.Fatalf("Added with key that is not a valid id")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []codec.ICodec{codec.CompactJSON, codec.Gob, codec.YAML, codec.TOML} {
+		filename := "./share/codec" + c.Ext()
+		os.Remove(filename)
+		s, err := jsonfile.NewWithOptions(filename, "user", user{}, jsonfile.WithCodec(c))
+		if err != nil {
+			t.Fatalf("%s: failed to create store: %+v", c.Name(), err)
+		}
+		id, err := s.Add(user{Rev: 1, Name: "A"})
+		s.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to add: %+v", c.Name(), err)
+		}
+
+		//the file is encoded with the codec and loaded again
+		data, _ := ioutil.ReadFile(filename)
+		var list []map[string]interface{}
+		if c != codec.Gob {
+			if err := c.Unmarshal(data, &list); err != nil || len(list) != 1 || list[0]["_id"] != id {
+				t.Fatalf("%s: file has %+v: %v\n%s", c.Name(), list, err, data)
+			}
+		}
+		s, err = jsonfile.NewWithOptions(filename, "user", user{}, jsonfile.WithCodec(c))
+		if err != nil {
+			t.Fatalf("%s: failed to open store: %+v", c.Name(), err)
+		}
+		item, err := s.Get(id)
+		s.Close()
+		if err != nil || item.(user).Name != "A" {
+			t.Fatalf("%s: Get -> %+v, %v", c.Name(), item, err)
+		}
+	}
+
+	//YAML reports problems with each item
+	filename := "./share/codec-errors.yaml"
+	ioutil.WriteFile(filename, []byte("- _id: a\n  item:\n    name: A\n- _id: b\n  item:\n    rev: x\n"), 0666)
+	if _, err := jsonfile.NewWithOptions(filename, "user", user{}, jsonfile.WithCodec(codec.YAML)); err == nil {
+		t.Fatalf("Opened file with invalid item")
+	}
+	s, err := jsonfile.NewWithOptions("./share/codec-dryrun.yaml", "user", user{}, jsonfile.WithCodec(codec.YAML))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	diff, err := s.(items.IStoreWithDryRun).DryRun(filename)
+	if err != nil || len(diff.Errors) != 1 || diff.Errors[0].ID != "b" || diff.Errors[0].Kind != items.ReloadErrorDecode {
+		t.Fatalf("DryRun -> %+v, %v", diff, err)
+	}
+}
@@ -0,0 +1,102 @@
+package jsonfile
+
+import (
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//EnableTTL sets the store TTL and starts the sweeper when sweepInterval > 0
+func (s *store) EnableTTL(ttl time.Duration, sweepInterval time.Duration) error {
+	if ttl < 0 || sweepInterval < 0 {
+		return logger.Wrapf(nil, "EnableTTL(%v,%v) negative duration", ttl, sweepInterval)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	s.ttl = ttl
+	if sweepInterval > 0 && s.sweeperStop == nil {
+		s.sweeperStop = make(chan struct{})
+		s.sweeper.Add(1)
+		go s.sweep(sweepInterval, s.sweeperStop)
+	}
+	return nil
+}
+
+func (s *store) sweep(interval time.Duration, stop chan struct{}) {
+	defer s.sweeper.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+//Sweep removes expired items now, returning the number of items removed
+func (s *store) Sweep() int {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0
+	}
+	notifications = s.expireItems()
+	return len(notifications)
+}
+
+//expired is true when the item's TTL passed
+func (s *store) expired(fi fileItem, now time.Time) bool {
+	return items.IsExpired(fi.Item, fi.Meta, s.ttl, now)
+}
+
+//expireItems removes expired items from the file and returns their notifications
+//must be called with the store locked
+//expiry cannot be vetoed by hooks and does not leave tombstones
+func (s *store) expireItems() []items.Notification {
+	now := time.Now()
+	var expired []fileItem
+	kept := make([]fileItem, 0, len(s.itemsFromFile))
+	for _, fileItem := range s.itemsFromFile {
+		if !fileItem.Meta.IsDeleted() && s.expired(fileItem, now) {
+			expired = append(expired, fileItem)
+		} else {
+			kept = append(kept, fileItem)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	replaced := make([]historyItem, 0, len(expired))
+	for _, fileItem := range expired {
+		replaced = append(replaced, historyItem{ID: fileItem.ID, Item: fileItem.Item, Meta: fileItem.Meta, Replaced: now, Deleted: true})
+	}
+	if err := s.keepVersions(replaced...); err != nil {
+		s.log.Errorf("Cannot keep history of expired %s: %+v", s.itemName, err)
+		return nil
+	}
+	if err := s.updateFile(kept); err != nil {
+		s.log.Errorf("Failed to remove expired %s: %+v", s.itemName, err)
+		return nil
+	}
+
+	notifications := make([]items.Notification, 0, len(expired))
+	for _, fileItem := range expired {
+		delete(s.itemByID, fileItem.ID)
+		s.keyIndex.Del(fileItem.ID, s.uniqueKeys.Keys(fileItem.Item))
+		s.logChange(items.ChangeDel, fileItem.ID)
+		s.log.Debugf("EXPIRED(%s)", fileItem.ID)
+		notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: fileItem.ID, Item: fileItem.Item})
+	}
+	return notifications
+} //store.expireItems()
@@ -0,0 +1,158 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/internal/filewatch"
+	"github.com/stewelarend/logger"
+)
+
+//DefaultReloadDebounce is how long the reload file must be unchanged
+//before it is reloaded, so that a file is not loaded while being written
+var DefaultReloadDebounce = time.Second * 3
+
+//Reload report formats
+const (
+	ReloadReportText = "text" //only <name>.err with the error message
+	ReloadReportJSON = "json" //<name>.err or <name>.ok with an items.ReloadReport
+)
+
+//Reload policies
+const (
+	ReloadStrict  = "strict"  //apply the file only when all items are valid
+	ReloadLenient = "lenient" //apply the valid items and keep the old version of the others
+)
+
+//defaultPollInterval is used to check the reload file when fsnotify is not available
+const defaultPollInterval = time.Second
+
+//ReloadOptions control how the store is reloaded from a file
+//the zero value of each field selects the default behaviour
+//The reload file is no longer copied over the store file: after each reload the store
+//file is written from the loaded items with the metadata kept by the store, so the
+//WriteStoreFile option was removed.
+type ReloadOptions struct {
+	Debounce      time.Duration //how long the file must be unchanged before it is loaded, default DefaultReloadDebounce
+	PollInterval  time.Duration //to check the file when fsnotify is not available, default 1s
+	Policy        string        //ReloadStrict (default) or ReloadLenient
+	Report        string        //ReloadReportText (default) or ReloadReportJSON
+	ErrorFilename string        //default <reload file without extension>.err
+	OKFilename    string        //for the JSON report, default <reload file without extension>.ok
+}
+
+//withDefaults fills in the fields that were not set
+func (o ReloadOptions) withDefaults(filename string) ReloadOptions {
+	if o.Debounce <= 0 {
+		o.Debounce = DefaultReloadDebounce
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.Policy == "" {
+		o.Policy = ReloadStrict
+	}
+	if o.Report == "" {
+		o.Report = ReloadReportText
+	}
+	baseFilename := strings.TrimSuffix(filename, path.Ext(filename))
+	if o.ErrorFilename == "" {
+		o.ErrorFilename = baseFilename + ".err"
+	}
+	if o.OKFilename == "" {
+		o.OKFilename = baseFilename + ".ok"
+	}
+	return o
+}
+
+//validate checks the options after defaults were applied
+func (o ReloadOptions) validate() error {
+	if o.Policy != ReloadStrict && o.Policy != ReloadLenient {
+		return logger.Wrapf(nil, "unknown reload policy \"%s\"", o.Policy)
+	}
+	if o.Report != ReloadReportText && o.Report != ReloadReportJSON {
+		return logger.Wrapf(nil, "unknown reload report \"%s\"", o.Report)
+	}
+	return nil
+}
+
+//watchFile reloads the store from filename after it was changed
+func (s *store) watchFile(filename string, opts ReloadOptions) error {
+	filename = path.Clean(filename)
+	opts = opts.withDefaults(filename)
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.watcherStop != nil {
+		return logger.Wrapf(nil, "cannot watch %s", filename)
+	}
+	s.reload = opts
+	s.watcherStop = make(chan struct{})
+	s.watching.Add(1)
+	filewatch.Watch(s.log, filename, opts.Debounce, opts.PollInterval, s.watcherStop, s.watching.Done, s.reloadFile)
+	return nil
+} //store.watchFile()
+
+//reloadFile loads the changed file into the store, which then writes the store file
+//from the loaded items, or writes the error to a .err file next to it
+func (s *store) reloadFile(filename string) {
+	s.log.Infof("Processing: %s", filename)
+	diff, err := s.readFile(filename, true)
+	if err == items.ErrClosed {
+		return
+	}
+	s.reportReload(filename, diff, err)
+} //store.reloadFile()
+
+//reportReload writes the outcome of a reload to the error file when it failed
+//or items were rejected, and in JSON format also to the ok file when it succeeded
+func (s *store) reportReload(filename string, diff items.ReloadDiff, err error) {
+	errorFilename, okFilename := s.reload.ErrorFilename, s.reload.OKFilename
+	rejected := err == nil && len(diff.Errors) > 0
+	if err != nil {
+		s.log.Errorf("Reload failed: %v", err)
+	} else if rejected {
+		s.log.Errorf("Reloaded %s with %d %ss rejected", filename, len(diff.Errors), s.itemName)
+	} else {
+		s.log.Infof("Reloaded %s: %d added, %d updated, %d deleted", filename, len(diff.Added), len(diff.Updated), len(diff.Deleted))
+	}
+
+	var reportFilename string
+	var reportData []byte
+	switch {
+	case s.reload.Report == ReloadReportJSON:
+		reportFilename = okFilename
+		if err != nil || rejected {
+			reportFilename = errorFilename
+		}
+		reportData, _ = json.MarshalIndent(items.NewReloadReport(filename, diff, err), "", "  ")
+	case err != nil:
+		reportFilename, reportData = errorFilename, []byte(fmt.Sprintf("Reload failed: %+v", err))
+	case rejected:
+		reportFilename, reportData = errorFilename, []byte(fmt.Sprintf("Reload rejected %+v", diff.Err()))
+	}
+
+	//remove the report of the previous reload
+	for _, fn := range []string{errorFilename, okFilename} {
+		if fn != reportFilename {
+			os.Remove(fn)
+		}
+	}
+	if reportFilename == "" {
+		return
+	}
+	if werr := ioutil.WriteFile(reportFilename, reportData, 0660); werr != nil {
+		s.log.Errorf("Failed to create %s: %+v", reportFilename, werr)
+		return
+	}
+	s.log.Debugf("Wrote %s", reportFilename)
+} //store.reportReload()
@@ -0,0 +1,113 @@
+package jsonfiles
+
+import (
+	"container/list"
+	"sort"
+)
+
+//catalogue is the set of ids of the item files, kept in memory
+//so that the directory and its shards are only read when the store is opened
+//The ids are sorted when they are listed after a change, so that adding is O(1).
+type catalogue struct {
+	ids    map[string]bool
+	sorted []string //nil when ids changed since the last list()
+}
+
+func newCatalogue(ids []string) *catalogue {
+	c := &catalogue{ids: make(map[string]bool, len(ids))}
+	for _, id := range ids {
+		c.ids[id] = true
+	}
+	return c
+}
+
+func (c *catalogue) has(id string) bool {
+	return c.ids[id]
+}
+
+func (c *catalogue) add(id string) {
+	if !c.ids[id] {
+		c.ids[id] = true
+		c.sorted = nil
+	}
+}
+
+func (c *catalogue) remove(id string) {
+	if c.ids[id] {
+		delete(c.ids, id)
+		c.sorted = nil
+	}
+}
+
+//list returns a sorted copy of the ids, which stays valid while items are added and removed
+func (c *catalogue) list() []string {
+	if c.sorted == nil {
+		c.sorted = make([]string, 0, len(c.ids))
+		for id := range c.ids {
+			c.sorted = append(c.sorted, id)
+		}
+		sort.Strings(c.sorted)
+	}
+	return append([]string{}, c.sorted...)
+}
+
+//itemCache is an LRU cache of the encoded item files
+//items are decoded again from the cached data, so each Get() returns a new item
+//a nil cache or size 0 caches nothing
+type itemCache struct {
+	size    int
+	order   *list.List //of cachedFile, most recently used in front
+	entries map[string]*list.Element
+}
+
+type cachedFile struct {
+	id   string
+	data []byte
+}
+
+func newItemCache(size int) *itemCache {
+	return &itemCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *itemCache) get(id string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(cachedFile).data, true
+}
+
+func (c *itemCache) put(id string, data []byte) {
+	if c == nil || c.size == 0 {
+		return
+	}
+	if e, ok := c.entries[id]; ok {
+		e.Value = cachedFile{id: id, data: data}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[id] = c.order.PushFront(cachedFile{id: id, data: data})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		delete(c.entries, oldest.Value.(cachedFile).id)
+		c.order.Remove(oldest)
+	}
+}
+
+func (c *itemCache) remove(id string) {
+	if c == nil {
+		return
+	}
+	if e, ok := c.entries[id]; ok {
+		delete(c.entries, id)
+		c.order.Remove(e)
+	}
+}
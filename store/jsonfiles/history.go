@@ -0,0 +1,232 @@
+package jsonfiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//historyDir is the sub directory of the store with one directory per item id,
+//in the same shards as the item files,
+//each holding one file per prior version, named by the time it was replaced
+const historyDir = ".history"
+
+//versionFilename matches the files in the history directory of an item
+var versionFilename = regexp.MustCompile(`^[0-9]{20}\.json$`)
+
+//historyItem is one prior version of an item as stored in the history file
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta, 3=Replaced, 4=Deleted
+type historyItem struct {
+	ID       string      `json:"_id"`
+	Item     items.IItem `json:"item"`
+	Meta     items.Meta  `json:"_meta"`
+	Replaced time.Time   `json:"_replaced"`
+	Deleted  bool        `json:"_deleted,omitempty"`
+}
+
+//EnableHistory starts keeping prior versions in <dir>/.history/<id>/,
+//or in <dir>/.history/<shard>/<id>/ with WithShards()
+func (s *store) EnableHistory() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	if err := mkdir(s.path + "/" + historyDir); err != nil {
+		return logger.Wrapf(err, "cannot create %s history directory", s.itemName)
+	}
+	s.historyItemType = withItemType(reflect.TypeOf(historyItem{}), reflect.PtrTo(s.itemType))
+	return nil
+}
+
+//Versions returns the prior versions and the current version of the item
+func (s *store) Versions(id string) ([]items.Version, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.versions(id)
+}
+
+//GetVersion returns the item at the specified revision
+func (s *store) GetVersion(id string, rev int) (items.IItem, items.Meta, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, items.Meta{}, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Meta.Rev == rev {
+			return versions[i].Item, versions[i].Meta, nil
+		}
+	}
+	return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s rev=%d not found", s.itemName, id, rev)
+}
+
+//GetAsOf returns the item as it was at time t
+func (s *store) GetAsOf(id string, t time.Time) (items.IItem, items.Meta, error) {
+	versions, err := s.Versions(id)
+	if err != nil {
+		return nil, items.Meta{}, err
+	}
+	v, ok := items.VersionAt(versions, t)
+	if !ok {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s did not exist at %s", s.itemName, id, t)
+	}
+	return v.Item, v.Meta, nil
+}
+
+//FindAsOf is Find() on the items as they were at time t
+//current items are listed first, followed by deleted items
+func (s *store) FindAsOf(t time.Time, size int, filter items.IItem) []items.IDAndItem {
+	list := make([]items.IDAndItem, 0)
+	s.mutex.Lock()
+	enabled, closed := s.historyItemType != nil, s.closed
+	s.mutex.Unlock()
+	if closed {
+		return list
+	}
+	if !enabled {
+		s.log.Errorf("%s.FindAsOf() without history", s.itemName)
+		return list
+	}
+
+	//current items, then ids that only have history
+	ids := make([]string, 0)
+	known := make(map[string]bool)
+	for _, current := range s.Find(0, nil) {
+		ids = append(ids, current.ID)
+		known[current.ID] = true
+	}
+	s.walkHistory(s.path+"/"+historyDir, 0, func(id string) {
+		if !known[id] {
+			ids = append(ids, id)
+		}
+	})
+
+	for _, id := range ids {
+		item, _, err := s.GetAsOf(id, t)
+		if err != nil {
+			continue
+		}
+		if filter != nil {
+			if err := item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: id, Item: item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.FindAsOf()
+
+//versions must be called with the store locked
+func (s *store) versions(id string) ([]items.Version, error) {
+	if s.closed {
+		return nil, items.ErrClosed
+	}
+	if s.historyItemType == nil {
+		return nil, logger.Wrapf(nil, "%s history is not enabled", s.itemName)
+	}
+	versions := make([]items.Version, 0)
+	dir := s.itemHistoryDir(id)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, logger.Wrapf(err, "cannot read %s.id=%s history", s.itemName, id)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		fn := dir + "/" + info.Name()
+		jsonData, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, logger.Wrapf(err, "cannot read history file %s", fn)
+		}
+		historyItemPtrValue := reflect.New(s.historyItemType)
+		if err := json.Unmarshal(jsonData, historyItemPtrValue.Interface()); err != nil {
+			return nil, logger.Wrapf(err, "failed to decode history file %s", fn)
+		}
+		v := historyItemPtrValue.Elem()
+		versions = append(versions, items.Version{
+			Item:     v.Field(1).Interface().(items.IItem),
+			Meta:     v.Field(2).Interface().(items.Meta),
+			Replaced: v.Field(3).Interface().(time.Time),
+			Deleted:  v.Field(4).Interface().(bool),
+		})
+	}
+	if current, err := s.readItemFile(id); err == nil {
+		versions = append(versions, items.Version{Item: current.Item, Meta: current.Meta})
+	}
+	if len(versions) == 0 {
+		return nil, logger.Wrapf(nil, "%s.id=%s does not exist", s.itemName, id)
+	}
+	return versions, nil
+} //store.versions()
+
+//keepVersion writes a replaced version to the history, if enabled
+//must be called with the store locked, before the change is applied
+func (s *store) keepVersion(hi historyItem) error {
+	if s.historyItemType == nil {
+		return nil
+	}
+	dir := s.itemHistoryDir(hi.ID)
+	if err := mkdir(dir); err != nil {
+		return logger.Wrapf(err, "cannot create history directory")
+	}
+	jsonVersion, err := json.MarshalIndent(hi, "", "  ")
+	if err != nil {
+		return logger.Wrapf(err, "failed to encode history of id=%s", hi.ID)
+	}
+	fn := fmt.Sprintf("%s/%020d.json", dir, hi.Replaced.UnixNano())
+	if err := ioutil.WriteFile(fn, jsonVersion, 0660); err != nil {
+		return logger.Wrapf(err, "failed to write history file %s", fn)
+	}
+	return nil
+} //store.keepVersion()
+
+//itemHistoryDir is the history directory of the item, in the same shard as the item file
+func (s *store) itemHistoryDir(id string) string {
+	if s.shards.levels > 0 {
+		return s.path + "/" + historyDir + "/" + s.shardDir(id) + "/" + id
+	}
+	return s.path + "/" + historyDir + "/" + id
+}
+
+//walkHistory calls fn with the id of each item history directory in the shards of dir
+func (s *store) walkHistory(dir string, level int, fn func(id string)) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		switch {
+		case !info.IsDir():
+		case level < s.shards.levels:
+			if s.shards.isShard(info.Name()) {
+				s.walkHistory(dir+"/"+info.Name(), level+1, fn)
+			}
+		case dir+"/"+info.Name() == s.itemHistoryDir(info.Name()):
+			fn(info.Name())
+		}
+	}
+}
+
+//isHistoryDir returns true if dir has the version files of an item, rather than shards
+func isHistoryDir(dir string) bool {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && versionFilename.MatchString(info.Name()) {
+			return true
+		}
+	}
+	return false
+}
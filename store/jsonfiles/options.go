@@ -0,0 +1,132 @@
+package jsonfiles
+
+import (
+	"os"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+//Option configures a store made with NewWithOptions()
+type Option func(s *store) error
+
+//ReloadOptions control how the store reloads item files changed by other programs
+//the zero value of each field selects the default behaviour
+type ReloadOptions struct {
+	Debounce     time.Duration //how long a file must be unchanged before it is loaded, default DefaultReloadDebounce
+	PollInterval time.Duration //to scan the files when fsnotify is not available, default 1s
+}
+
+//WithIDGenerator sets the generator of ids for new items, instead of idgen.UUIDv4()
+func WithIDGenerator(idGen IIDGenerator) Option {
+	return func(s *store) error {
+		if idGen == nil {
+			return logger.Wrapf(nil, "New(idGen==nil)")
+		}
+		s.idGen = idGen
+		return nil
+	}
+}
+
+//WithFileMode sets the permissions used when item files are created
+//the default is 0666 (before umask) like os.Create()
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *store) error {
+		if err := common.CheckFileMode(mode); err != nil {
+			return err
+		}
+		s.fileMode = mode
+		return nil
+	}
+}
+
+//WithReload watches the directory for item files changed by other programs, see NewWithReload()
+func WithReload(opts ReloadOptions) Option {
+	return func(s *store) error {
+		if opts.Debounce < 0 || opts.PollInterval < 0 {
+			return logger.Wrapf(nil, "WithReload(debounce=%v,pollInterval=%v) negative duration", opts.Debounce, opts.PollInterval)
+		}
+		if opts.Debounce == 0 {
+			opts.Debounce = DefaultReloadDebounce
+		}
+		if opts.PollInterval == 0 {
+			opts.PollInterval = defaultPollInterval
+		}
+		s.reload = &opts
+		return nil
+	}
+}
+
+//WithLogger sets the logger of the store instead of the package logger
+func WithLogger(l logger.ILogger) Option {
+	return func(s *store) error {
+		if l == nil {
+			return logger.Wrapf(nil, "WithLogger(nil)")
+		}
+		s.log = l
+		return nil
+	}
+}
+
+//WithUniqueKey adds a unique index on a value of each item,
+//in addition to the keys of items that implement items.IItemWithUniqueKeys
+//The index is kept in memory, so all items are read once when the store is opened.
+//key is called with a pointer to the item, like the items returned by Get()
+func WithUniqueKey(name string, key func(item items.IItem) interface{}) Option {
+	return func(s *store) error {
+		return s.uniqueKeys.Add(name, key)
+	}
+}
+
+//WithIDFromKey uses the value of a unique key as the id of each item instead of generating ids,
+//e.g. a country code, so the files are named like country_ZA.json and the key cannot be changed by Upd()
+//the key is from items.IItemWithUniqueKeys or WithUniqueKey() and must pass items.ValidateID()
+func WithIDFromKey(name string) Option {
+	return func(s *store) error {
+		if name == "" {
+			return logger.Wrapf(nil, "WithIDFromKey(\"\")")
+		}
+		s.idKey = name
+		return nil
+	}
+}
+
+//WithHooks uses hooks that were already registered, instead of starting without hooks
+func WithHooks(hooks *items.Hooks) Option {
+	return func(s *store) error {
+		if hooks == nil {
+			return logger.Wrapf(nil, "WithHooks(nil)")
+		}
+		s.hooks = hooks
+		return nil
+	}
+}
+
+//WithCodec sets the encoding of the item files instead of codec.JSON
+//the file names end with the extension of the codec, e.g. <name>_<id>.yaml
+func WithCodec(c codec.ICodec) Option {
+	return func(s *store) error {
+		if c == nil {
+			return logger.Wrapf(nil, "WithCodec(nil)")
+		}
+		s.codec = c
+		return nil
+	}
+}
+
+//WithCacheSize keeps up to size encoded item files in memory, so that repeated Get() and Find()
+//do not read their files again, the least recently used items are dropped first
+//The encoded files are cached and decoded on each use, so changing a returned item does not change the cache.
+//Files changed by other programs are only seen with WithReload(). The default size is 0 (no cache).
+func WithCacheSize(size int) Option {
+	return func(s *store) error {
+		if size < 0 {
+			return logger.Wrapf(nil, "WithCacheSize(%d) negative size", size)
+		}
+		s.cache = newItemCache(size)
+		return nil
+	}
+}
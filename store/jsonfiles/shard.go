@@ -0,0 +1,278 @@
+package jsonfiles
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//maxShardLevels and maxShardWidth limit WithShards() to layouts that are useful
+//e.g. 2 levels of 2 characters make up to 64^4 directories
+const (
+	maxShardLevels = 4
+	maxShardWidth  = 4
+)
+
+//reshardDir is where Reshard() moves history directories aside
+const reshardDir = ".reshard"
+
+//shardName matches the names of shard directories, made of id characters and '_' padding
+var shardName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+//shards is the layout of the item files in subdirectories, 0 levels for a flat directory
+type shards struct {
+	levels int
+	width  int
+}
+
+//dir is the shard directory of id relative to the store, "" when not sharded
+func (l shards) dir(id string) string {
+	names := make([]string, l.levels)
+	for i := range names {
+		name := []byte(strings.Repeat("_", l.width))
+		for j := range name {
+			if c := i*l.width + j; c < len(id) && id[c] != '.' {
+				name[j] = id[c]
+			}
+		}
+		names[i] = string(name)
+	}
+	return strings.Join(names, "/")
+}
+
+//isShard returns true if name can be the name of a shard directory in this layout
+func (l shards) isShard(name string) bool {
+	return len(name) == l.width && shardName.MatchString(name)
+}
+
+//layoutOf returns the layout in which dir, relative to the store, is the shard directory of id
+func layoutOf(dir string, id string) (shards, bool) {
+	if dir == "." || dir == "" {
+		return shards{}, true
+	}
+	names := strings.Split(filepath.ToSlash(dir), "/")
+	l := shards{levels: len(names), width: len(names[0])}
+	if l.levels > maxShardLevels || l.width > maxShardWidth || l.dir(id) != strings.Join(names, "/") {
+		return shards{}, false
+	}
+	return l, true
+}
+
+//WithShards puts each item file in nested subdirectories named after the start of its id,
+//e.g. with 2 levels of width 2 the item abcdef is in ab/cd/<name>_abcdef.json,
+//so that directories stay small with millions of items
+//Ids shorter than the shard names are padded with '_' and '.' is replaced with '_'.
+//Use Reshard() to move the files of an existing store when the layout is changed.
+//Reload watches each shard directory with fsnotify.
+func WithShards(levels, width int) Option {
+	return func(s *store) error {
+		if levels < 0 || levels > maxShardLevels || (levels > 0 && (width < 1 || width > maxShardWidth)) {
+			return logger.Wrapf(nil, "WithShards(%d,%d) not in 0..%d levels of 1..%d characters", levels, width, maxShardLevels, maxShardWidth)
+		}
+		s.shards = shards{levels: levels, width: width}
+		return nil
+	}
+}
+
+//shardDir is the directory of the item file relative to the store, "" when not sharded
+func (s *store) shardDir(id string) string {
+	return s.shards.dir(id)
+}
+
+//walkItemFiles calls fn with the id and file name of each item file in sorted order until fn returns false
+//only files in the directory of their own shard are item files
+func (s *store) walkItemFiles(fn func(id string, filename string) bool) error {
+	_, err := s.walkShard(s.path, 0, s.itemFilename, fn)
+	return err
+}
+
+//walkShard calls fn for the files under the shard dir at level that are named filenameOf(id)
+func (s *store) walkShard(dir string, level int, filenameOf func(id string) string, fn func(id string, filename string) bool) (bool, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, logger.Wrapf(err, "cannot read %s", dir)
+	}
+	for _, info := range infos {
+		filename := dir + "/" + info.Name()
+		if level < s.shards.levels {
+			if !info.IsDir() || !s.shards.isShard(info.Name()) {
+				continue
+			}
+			if more, err := s.walkShard(filename, level+1, filenameOf, fn); err != nil || !more {
+				return more, err
+			}
+			continue
+		}
+		if id, ok := s.itemFileID(info.Name()); ok && info.Mode().IsRegular() && filename == filenameOf(id) {
+			if !fn(id, filename) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+} //store.walkShard()
+
+//Reshard moves the item files, tombstones and history of a store into the layout selected by the options,
+//e.g. from a flat directory into the shards of WithShards(), or back to a flat
+//directory without WithShards(), and returns the number of files moved
+//The store must not be open while it is resharded.
+func Reshard(parentDir string, name string, tmpl items.IItem, opts ...Option) (int, error) {
+	s, err := newStore(parentDir, name, tmpl, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	//find the item files and tombstones in any layout, and the layouts
+	//they are in, so that only their empty shards are removed
+	moves := map[string]string{}
+	oldLayouts := map[shards]bool{s.shards: true}
+	if err := findMoves(s, s.path, s.itemFilename, moves, oldLayouts); err != nil {
+		return 0, err
+	}
+	deletedPath := s.path + "/" + deletedDir
+	deletedMoves := map[string]string{}
+	oldDeletedLayouts := map[shards]bool{s.shards: true}
+	if err := findMoves(s, deletedPath, s.deletedFilename, deletedMoves, oldDeletedLayouts); err != nil {
+		return 0, err
+	}
+
+	//history directories of the items are sharded the same way
+	historyPath := s.path + "/" + historyDir
+	historyMoves := map[string]string{}
+	oldHistoryLayouts := map[shards]bool{s.shards: true}
+	if err := filepath.Walk(historyPath, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || dir == historyPath || !isHistoryDir(dir) {
+			return nil
+		}
+		id := info.Name()
+		if dir != filepath.Clean(s.itemHistoryDir(id)) {
+			historyMoves[dir] = s.itemHistoryDir(id)
+			if rel, err := filepath.Rel(historyPath, filepath.Dir(dir)); err == nil {
+				if l, ok := layoutOf(rel, id); ok {
+					oldHistoryLayouts[l] = true
+				}
+			}
+		}
+		return filepath.SkipDir
+	}); err != nil {
+		return 0, logger.Wrapf(err, "cannot walk %s", historyPath)
+	}
+
+	moved := 0
+	for from, to := range moves {
+		if err := move(from, to); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	for from, to := range deletedMoves {
+		if err := move(from, to); err != nil {
+			return moved, err
+		}
+	}
+	for l := range oldLayouts {
+		removeEmptyShards(s.path, l, 0)
+	}
+	for l := range oldDeletedLayouts {
+		removeEmptyShards(deletedPath, l, 0)
+	}
+	//the last valid versions are written again in the new layout when reload starts
+	if err := os.RemoveAll(s.path + "/" + validDir); err != nil {
+		return moved, logger.Wrapf(err, "cannot remove %s", validDir)
+	}
+
+	//history directories are moved aside first, because their names can be the
+	//same as shards, e.g. .history/ab is in the shard .history/ab/ab with WithShards(1,2)
+	stagePath := historyPath + "/" + reshardDir
+	for from := range historyMoves {
+		if err := move(from, stagePath+"/"+filepath.Base(from)); err != nil {
+			return moved, err
+		}
+	}
+	for l := range oldHistoryLayouts {
+		removeEmptyShards(historyPath, l, 0)
+	}
+	for from, to := range historyMoves {
+		if err := move(stagePath+"/"+filepath.Base(from), to); err != nil {
+			return moved, err
+		}
+	}
+	os.Remove(stagePath)
+	s.log.Debugf("Resharded %d %s files in %s", moved, s.itemName, s.path)
+	return moved, nil
+} //Reshard()
+
+//findMoves adds the files under root that are not named filenameOf(id) to moves,
+//and the layouts that they are in to layouts, skipping hidden directories below root
+func findMoves(s *store, root string, filenameOf func(id string) string, moves map[string]string, layouts map[shards]bool) error {
+	if err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filename == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && filename != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if id, ok := s.itemFileID(info.Name()); ok && info.Mode().IsRegular() && filename != filepath.Clean(filenameOf(id)) {
+			moves[filename] = filenameOf(id)
+			if rel, err := filepath.Rel(root, filepath.Dir(filename)); err == nil {
+				if l, ok := layoutOf(rel, id); ok {
+					layouts[l] = true
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return logger.Wrapf(err, "cannot walk %s", root)
+	}
+	return nil
+}
+
+//move renames a file or directory without replacing an existing one
+func move(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return logger.Wrapf(nil, "cannot move %s to existing %s", from, to)
+	}
+	if err := mkdir(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return logger.Wrapf(err, "cannot move %s to %s", from, to)
+	}
+	return nil
+}
+
+//removeEmptyShards removes the shard directories of layout l under dir that have no files,
+//e.g. after the layout changed, and returns true when dir is empty
+//Other directories are never removed, and neither are shards that contain them.
+func removeEmptyShards(dir string, l shards, level int) bool {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	empty := true
+	for _, info := range infos {
+		if level < l.levels && info.IsDir() && l.isShard(info.Name()) && removeEmptyShards(dir+"/"+info.Name(), l, level+1) {
+			continue
+		}
+		empty = false
+	}
+	if empty && level > 0 {
+		return os.Remove(dir) == nil
+	}
+	return empty
+}
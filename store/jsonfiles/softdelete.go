@@ -0,0 +1,212 @@
+package jsonfiles
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//deletedDir is the sub directory of the store with the tombstone files
+//named the same as the item files they replaced, in the same shards
+const deletedDir = ".deleted"
+
+//EnableSoftDelete makes Del() move the item file to <dir>/.deleted/
+//tombstones older than retention are ignored, and purged every retention period, 0 keeps them
+func (s *store) EnableSoftDelete(retention time.Duration) error {
+	if retention < 0 {
+		return logger.Wrapf(nil, "EnableSoftDelete(%v) negative retention", retention)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	if err := mkdir(s.path + "/" + deletedDir); err != nil {
+		return logger.Wrapf(err, "cannot create %s deleted directory", s.itemName)
+	}
+	s.softDelete = true
+	s.retention = retention
+	s.purgeExpired()
+
+	//restart the purger at the new retention period
+	if s.purgerStop != nil {
+		close(s.purgerStop)
+		s.purgerStop = nil
+	}
+	if retention > 0 {
+		s.purgerStop = make(chan struct{})
+		s.sweeper.Add(1)
+		go s.purge(retention, s.purgerStop)
+	}
+	return nil
+}
+
+func (s *store) purge(interval time.Duration, stop chan struct{}) {
+	defer s.sweeper.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			if !s.closed {
+				s.purgeExpired()
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+//FindDeleted is Find() on the tombstones
+func (s *store) FindDeleted(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+	for _, tombstone := range s.tombstones() {
+		if tombstone.Meta.Expired(s.retention) {
+			continue
+		}
+		if filter != nil {
+			if err := tombstone.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: tombstone.ID, Item: tombstone.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.FindDeleted()
+
+//Restore writes the item file from the tombstone then removes the tombstone
+func (s *store) Restore(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	tombstone, err := s.readFileItem(s.deletedFilename(id), id)
+	if err != nil || tombstone.Meta.Expired(s.retention) {
+		return logger.Wrapf(err, "deleted %s.id=%s does not exist", s.itemName, id)
+	}
+	if _, err := os.Stat(s.itemFilename(id)); err == nil {
+		return logger.Wrapf(nil, "%s.id=%s already exists", s.itemName, id)
+	}
+	if err := s.checkUnique(id, tombstone.Item); err != nil {
+		return logger.Wrapf(err, "cannot restore %s", s.itemName)
+	}
+	if err := s.hooks.CheckAdd(tombstone.Item); err != nil {
+		return logger.Wrapf(err, "cannot restore %s", s.itemName)
+	}
+
+	restored := fileItem{ID: id, Item: tombstone.Item, Meta: tombstone.Meta.Restored("")}
+	if err := s.writeItemFile(restored); err != nil {
+		return logger.Wrapf(err, "failed to restore %s.id=%s", s.itemName, id)
+	}
+	if err := os.Remove(s.deletedFilename(id)); err != nil {
+		s.log.Errorf("Restored %s.id=%s but failed to remove tombstone: %+v", s.itemName, id, err)
+	}
+	s.logChange(items.ChangeAdd, id)
+	s.log.Debugf("RESTORE(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: restored.Item})
+	return nil
+} //store.Restore()
+
+//Purge removes the tombstone file
+//purging an id that does not exist also succeeds
+func (s *store) Purge(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	if _, err := os.Stat(s.itemFilename(id)); err == nil {
+		return logger.Wrapf(nil, "cannot purge %s.id=%s that is not deleted", s.itemName, id)
+	}
+	if err := os.Remove(s.deletedFilename(id)); err != nil && !os.IsNotExist(err) {
+		return logger.Wrapf(err, "cannot purge %s.id=%s", s.itemName, id)
+	}
+	s.log.Debugf("PURGED(%s)", id)
+	return nil
+}
+
+//tombstones reads all tombstone files, ignoring those that cannot be read
+//must be called with the store locked
+func (s *store) tombstones() []fileItem {
+	list := make([]fileItem, 0)
+	dir := s.path + "/" + deletedDir
+	if _, err := os.Stat(dir); err != nil {
+		return list
+	}
+	if _, err := s.walkShard(dir, 0, s.deletedFilename, func(id string, filename string) bool {
+		tombstone, err := s.readFileItem(filename, id)
+		if err != nil {
+			s.log.Errorf("Ignoring tombstone %s: %+v", filename, err)
+			return true
+		}
+		list = append(list, tombstone)
+		return true
+	}); err != nil {
+		s.log.Errorf("Cannot read tombstones: %+v", err)
+	}
+	return list
+} //store.tombstones()
+
+//purgeExpired removes tombstones older than the retention period
+//must be called with the store locked
+func (s *store) purgeExpired() {
+	if s.retention == 0 {
+		return
+	}
+	for _, tombstone := range s.tombstones() {
+		if tombstone.Meta.Expired(s.retention) {
+			if err := os.Remove(s.deletedFilename(tombstone.ID)); err != nil {
+				s.log.Errorf("Failed to purge %s.id=%s: %+v", s.itemName, tombstone.ID, err)
+				continue
+			}
+			s.log.Debugf("PURGED(%s)", tombstone.ID)
+		}
+	}
+} //store.purgeExpired()
+
+//deletedFilename is the tombstone of the item, in the same shard as the item file
+func (s *store) deletedFilename(id string) string {
+	dir := s.path + "/" + deletedDir
+	if shardDir := s.shardDir(id); shardDir != "" {
+		dir += "/" + shardDir
+	}
+	return fmt.Sprintf("%s/%s_%s%s", dir, s.itemName, id, s.codec.Ext())
+}
+
+//expiredTombstone removes the tombstone of id if it is older than the retention period
+//and returns false if a tombstone that did not expire remains
+//must be called with the store locked
+func (s *store) expiredTombstone(id string) bool {
+	fn := s.deletedFilename(id)
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		return true
+	}
+	tombstone, err := s.readFileItem(fn, id)
+	if err != nil || !tombstone.Meta.Expired(s.retention) {
+		return false
+	}
+	if err := os.Remove(fn); err != nil {
+		s.log.Errorf("Failed to purge %s.id=%s: %+v", s.itemName, id, err)
+		return false
+	}
+	s.log.Debugf("PURGED(%s)", id)
+	return true
+}
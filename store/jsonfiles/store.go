@@ -2,18 +2,23 @@
 package jsonfiles
 
 import (
-	"encoding/json"
+	"crypto/md5"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
-	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	items "github.com/jansemmelink/items2"
-	"github.com/satori/uuid"
+	"github.com/jansemmelink/items2/store/changelog"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
 	"github.com/stewelarend/logger"
 )
 
@@ -31,6 +36,26 @@ func MustNew(parentDir string, name string, tmpl items.IItem) items.IStore {
 
 //New makes a new items.IStore using a directory of JSON files
 func New(parentDir string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(parentDir, name, tmpl)
+}
+
+//NewWithOptions makes a new items.IStore using a directory of JSON files,
+//configured with options
+func NewWithOptions(parentDir string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	s, err := newStore(parentDir, name, tmpl, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.reload != nil {
+		if err := s.watchDir(*s.reload); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func newStore(parentDir string, name string, tmpl items.IItem, opts ...Option) (*store, error) {
 	path := parentDir + "/" + name
 	if err := mkdir(path); err != nil {
 		return nil, logger.Wrapf(err, "Cannot create directory \"%s\" for jsonfiles", path)
@@ -43,51 +68,115 @@ func New(parentDir string, name string, tmpl items.IItem) (items.IStore, error)
 	if tmpl == nil {
 		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
 	}
-	//todo:
-	// if idGen == nil {
-	// 	return nil, logger.Wrapf(nil, "New(idGen==nil)")
-	// }
 	if _, ok := tmpl.(items.IItemWithID); ok {
 		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
 	}
 
 	s := &store{
-		path:            path,
-		itemName:        name,
-		itemTmpl:        tmpl,
-		itemType:        reflect.TypeOf(tmpl),
-		filenamePattern: fmt.Sprintf(`%s_(.*)\.json`, name),
+		path:       path,
+		fileMode:   0666,
+		codec:      codec.JSON,
+		itemName:   name,
+		itemTmpl:   tmpl,
+		itemType:   reflect.TypeOf(tmpl),
+		idGen:      idgen.UUIDv4(),
+		uniqueKeys: make(common.KeyFuncs),
+		hooks:      items.NewHooks(),
+		notifier:   items.NewNotifier(items.NotifySync),
+		log:        log,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
 	}
 	if s.itemType.Kind() == reflect.Ptr {
 		s.itemType = s.itemType.Elem()
 	}
+	s.fileItemType = fileItemType(reflect.PtrTo(s.itemType))
+	s.filenamePattern = fmt.Sprintf(`%s_(.*)%s`, name, regexp.QuoteMeta(s.codec.Ext()))
 	s.filenameRegex = regexp.MustCompile(s.filenamePattern)
 
-	//see if has any files in the dir, then see what's the latest existing id
-	// filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-	// 	items := s.filenameRegex.FindStringSubmatch(path)
-	// 	if len(items) >= 2 {
-	// 		id, _ := strconv.Atoi(items[1])
-	// 		if id >= s.nextID {
-	// 			s.nextID = id + 1
-	// 		}
-	// 	}
-	// 	return nil
-	// })
-
-	log.Debugf("Created JSON files store of %s in dir %s", s.itemName, s.path)
+	lock, err := filelock.New(path + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock jsonfiles %s", path)
+	}
+	s.lock = lock
+
+	changes, err := changelog.Open(path+".changes", changelog.DefaultSize)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot open change log for jsonfiles %s", path)
+	}
+	s.changes = changes
+
+	//existing ids, also of deleted items, must not be generated again
+	ids := s.itemFileIDs()
+	idgen.Resume(s.idGen, ids...)
+	s.ids = newCatalogue(ids)
+	s.keyIndex = common.NewIndex(s.itemName)
+	if s.hasKeys() {
+		//the items are read once to index their keys
+		for _, id := range ids {
+			s.readItemFile(id)
+		}
+	}
+	for _, tombstone := range s.tombstones() {
+		idgen.Resume(s.idGen, tombstone.ID)
+	}
+
+	s.log.Debugf("Created JSON files store of %s in dir %s", s.itemName, s.path)
 	return s, nil
-} //New()
+} //newStore()
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids of the existing files
+type IIDGenerator interface {
+	NewID() string
+}
 
 //store implements items.IStore for a directory with one JSON file per item
 type store struct {
 	mutex           sync.Mutex
 	path            string
+	fileMode        os.FileMode
+	codec           codec.ICodec
 	itemName        string
 	itemTmpl        items.IItem
 	itemType        reflect.Type
+	fileItemType    reflect.Type
+	historyItemType reflect.Type //nil when history is not enabled
+	softDelete      bool
+	retention       time.Duration        //of tombstones, 0 to keep them
+	ttl             time.Duration        //of items, 0 when items do not expire
+	expiry          map[string]time.Time //of the items that can expire, nil until the next Sweep()
+	sweeperStop     chan struct{}
+	purgerStop      chan struct{} //of tombstones, nil without retention
+	sweeper         sync.WaitGroup
+	lock            *filelock.Lock
+	closed          bool
+	shards          shards
+
+	//ids and unique keys of the item files and recently used items, updated when files are written
+	ids      *catalogue
+	keyIndex *common.Index
+	cache    *itemCache //nil without WithCacheSize()
+
+	//only used with reload: the checksum of each item file as last written or loaded,
+	//so that external changes can be detected and notified
+	reload          *ReloadOptions
+	known           map[string][md5.Size]byte
+	watcherStop     chan struct{}
+	watching        sync.WaitGroup
 	filenamePattern string
 	filenameRegex   *regexp.Regexp
+	changes         *changelog.Log
+	idGen           IIDGenerator
+	idKey           string //unique key used as id, "" to generate ids
+	uniqueKeys      common.KeyFuncs
+	hooks           *items.Hooks
+	notifier        *items.Notifier
+	log             logger.ILogger
 }
 
 //Name ...
@@ -114,8 +203,33 @@ func (s *store) Tmpl() items.IItem {
 }
 
 func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
 
 	if item == nil {
 		return "", logger.Wrapf(nil, "cannot add nil item")
@@ -123,41 +237,68 @@ func (s *store) Add(item items.IItem) (string, error) {
 	if err := item.Validate(); err != nil {
 		return "", logger.Wrapf(err, "cannot add invalid item")
 	}
-	//todo: add index functions, e.g. check for unique name in the store
-
-	//assign a new ID
-	id := uuid.NewV1().String()
-
-	//make sure it does not exist
-	fn := s.itemFilename(id)
-	if _, err := os.Stat(fn); err == nil {
-		return "", logger.Wrapf(err, "%s.id=%s already exists", s.Name(), id)
+	if err := s.checkUnique("", item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
 	}
 
-	jsonItem, err := json.MarshalIndent(item, "", "  ")
+	//use the id from the item key, which is then also the file name, or assign a new id
+	keyID, err := s.keyID(item)
 	if err != nil {
-		return "", logger.Wrapf(err, "Failed to JSON encode item")
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
 	}
-	f, err := os.Create(fn)
-	if err != nil {
-		return "", logger.Wrapf(err, "Failed to create item file %s", fn)
+	if keyID != "" {
+		if id != "" && id != keyID {
+			return "", logger.Wrapf(nil, "cannot add %s.id=%s with %s=%s", s.itemName, id, s.idKey, keyID)
+		}
+		id = keyID
+	}
+	if id == "" {
+		id = s.idGen.NewID()
 	}
-	defer f.Close()
 
-	_, err = f.Write(jsonItem)
-	if err != nil {
-		return "", logger.Wrapf(err, "Failed to write item to file %s", fn)
+	//make sure it does not exist, an expired item that was not swept yet is removed now
+	fn := s.itemFilename(id)
+	if _, err := os.Stat(fn); err == nil {
+		now := time.Now()
+		old, err := s.readItemFile(id)
+		if err != nil || !s.expired(old, now) {
+			return "", logger.Wrapf(err, "%s.id=%s already exists", s.Name(), id)
+		}
+		if err := s.expireItem(old, now); err != nil {
+			return "", logger.Wrapf(err, "%s.id=%s already exists", s.Name(), id)
+		}
+		notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: old.Item})
 	}
-	log.Debugf("ADD(%s)", id)
-	if addedItem, ok := item.(items.IItemWithNotifyNew); ok {
-		addedItem.NotifyNew()
+	if !s.expiredTombstone(id) {
+		return "", logger.Wrapf(nil, "%s.id=%s already exists as deleted", s.Name(), id)
 	}
+
+	if err := s.writeItemFile(fileItem{ID: id, Item: item, Meta: items.NewMeta(actor)}); err != nil {
+		return "", logger.Wrapf(err, "Failed to add %s.id=%s", s.Name(), id)
+	}
+	s.logChange(items.ChangeAdd, id)
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
 	return id, nil
-} //store.Add()
+} //store.add()
 
 func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
 
 	if item == nil {
 		return logger.Wrapf(nil, "cannot upd nil item")
@@ -171,109 +312,329 @@ func (s *store) Upd(id string, item items.IItem) error {
 		return logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
 	}
 
-	//load old item - needed when calling NotifyUpd
-	oldItem, err := s.Get(id)
-
-	jsonItem, err := json.MarshalIndent(item, "", "  ")
+	//load old item - needed for hooks, meta and when calling NotifyUpd
+	//(an old file that cannot be read can still be replaced)
+	old, err := s.readItemFile(id)
 	if err != nil {
-		return logger.Wrapf(err, "failed to JSON encode item")
+		old = fileItem{ID: id, Item: s.noItem()}
+	} else if s.expired(old, time.Now()) {
+		return logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
 	}
-	f, err := os.Create(fn)
-	if err != nil {
-		return logger.Wrapf(err, "failed to create item file %s", fn)
+	oldItem := old.Item
+	if err := s.checkUnique(id, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
 	}
-	defer f.Close()
-
-	_, err = f.Write(jsonItem)
-	if err != nil {
-		return logger.Wrapf(err, "failed to write item to file %s", fn)
+	if keyID, err := s.keyID(item); err != nil || (keyID != "" && keyID != id) {
+		return logger.Wrapf(err, "cannot upd %s.id=%s to %s=%s", s.itemName, id, s.idKey, keyID)
+	}
+	if err := s.hooks.CheckUpd(id, oldItem, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
 	}
-	log.Debugf("UPD(%s)", id)
-	if updatedItem, ok := item.(items.IItemWithNotifyUpd); ok {
-		updatedItem.NotifyUpd(oldItem)
+	if err := s.keepVersion(historyItem{ID: id, Item: old.Item, Meta: old.Meta, Replaced: time.Now()}); err != nil {
+		return logger.Wrapf(err, "cannot keep history of %s.id=%s", s.itemName, id)
 	}
+
+	if err := s.writeItemFile(fileItem{ID: id, Item: item, Meta: old.Meta.NextRev(actor)}); err != nil {
+		return logger.Wrapf(err, "failed to upd %s.id=%s", s.Name(), id)
+	}
+	s.logChange(items.ChangeUpd, id)
+	s.log.Debugf("UPD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: oldItem})
 	return nil
-} //store.Upd()
+} //store.UpdBy()
 
 func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
 
-	if item, err := s.Get(id); err == nil && item != nil {
-		if deletedItem, ok := item.(items.IItemWithNotifyDel); ok {
-			deletedItem.NotifyDel()
+	//load the item - needed for hooks, history and when calling NotifyDel
+	deleted, err := s.readItemFile(id)
+	item := deleted.Item
+	if err == nil {
+		if err := s.hooks.CheckDel(id, item); err != nil {
+			return logger.Wrapf(err, "cannot del %s", s.itemName)
+		}
+		if err := s.keepVersion(historyItem{ID: id, Item: item, Meta: deleted.Meta, Replaced: time.Now(), Deleted: true}); err != nil {
+			return logger.Wrapf(err, "cannot keep history of %s.id=%s", s.itemName, id)
+		}
+	} else {
+		item = s.noItem()
+	}
+
+	//keep a tombstone before removing the file
+	//(an item file that cannot be read is deleted permanently)
+	if s.softDelete && err == nil {
+		if _, err := s.writeFileItem(s.deletedFilename(id), fileItem{ID: id, Item: item, Meta: deleted.Meta.Tombstone()}); err != nil {
+			return logger.Wrapf(err, "cannot keep deleted %s.id=%s", s.itemName, id)
 		}
 	}
 
 	fn := s.itemFilename(id)
-	err := os.Remove(fn)
+	err = s.removeItemFile(id)
 	if err != nil {
 		return logger.Wrapf(err, "Cannot delete %s file: %s", s.itemName, fn)
 	}
+	s.purgeExpired()
+	s.logChange(items.ChangeDel, id)
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: item})
 	return nil
 }
 
 func (s *store) Get(id string) (items.IItem, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.ErrClosed
+	}
+	return s.get(id)
+}
+
+//get is Get() without locking, for use inside locked operations
+func (s *store) get(id string) (items.IItem, error) {
+	fi, err := s.readItemFile(id)
+	if err != nil {
+		return s.noItem(), err
+	}
+	if s.expired(fi, time.Now()) {
+		return s.noItem(), logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return fi.Item, nil
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+	fi, err := s.readItemFile(id)
+	if err != nil {
+		return s.noItem(), items.Meta{}, err
+	}
+	if s.expired(fi, time.Now()) {
+		return s.noItem(), items.Meta{}, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return fi.Item, fi.Meta, nil
+}
 
+//readItemFile reads and validates the item file, unless it is cached
+//files written before metadata was added contain only the item
+//Files that other programs added or removed are added to or removed from the catalogue when read.
+func (s *store) readItemFile(id string) (fileItem, error) {
 	fn := s.itemFilename(id)
-	jsonFile, err := os.Open(fn)
+	if data, ok := s.cache.get(id); ok {
+		return s.decodeFileItem(fn, id, data)
+	}
+	data, err := ioutil.ReadFile(fn)
+	var fi fileItem
 	if err != nil {
-		return s.noItem(), logger.Wrapf(err, "Cannot open %s file: %s", s.itemName, fn)
+		err = logger.Wrapf(err, "Cannot open %s file: %s", s.itemName, fn)
+	} else {
+		fi, err = s.decodeFileItem(fn, id, data)
 	}
-	defer jsonFile.Close()
+	if err != nil {
+		if _, statErr := os.Stat(fn); os.IsNotExist(statErr) {
+			s.ids.remove(id)
+			s.keyIndex.Remove(id)
+			delete(s.expiry, id)
+		}
+		return fileItem{}, err
+	}
+	s.ids.add(id)
+	s.keyIndex.Put(id, s.keys(fi.Item))
+	s.cache.put(id, data)
+	s.setExpiry(fi)
+	return fi, nil
+}
+
+//readFileItem reads and validates the item file fn
+func (s *store) readFileItem(fn string, id string) (fileItem, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return fileItem{}, logger.Wrapf(err, "Cannot open %s file: %s", s.itemName, fn)
+	}
+	return s.decodeFileItem(fn, id, data)
+}
+
+//decodeFileItem decodes and validates the contents of item file fn
+func (s *store) decodeFileItem(fn string, id string, data []byte) (fileItem, error) {
+	fi := fileItem{ID: id}
+	fileItemPtrValue := reflect.New(s.fileItemType)
+	if err := s.codec.Unmarshal(data, fileItemPtrValue.Interface()); err != nil {
+		return fileItem{}, logger.Wrapf(err, "Failed to decode %s file %s into %s", s.codec.Name(), fn, s.itemName)
+	}
+	fileItemValue := fileItemPtrValue.Elem()
+	switch {
+	case !fileItemValue.Field(1).IsNil():
+		fi.Item = fileItemValue.Field(1).Interface().(items.IItem)
+		fi.Meta = fileItemValue.Field(2).Interface().(items.Meta)
+	case fileItemValue.Field(0).Interface().(string) != "":
+		return fileItem{}, logger.Wrapf(nil, "%s file %s has no item data", s.codec.Name(), fn)
+	default:
+		//file written before metadata was added
+		newItemDataPtr := reflect.New(s.itemType).Interface()
+		if err := s.codec.Unmarshal(data, newItemDataPtr); err != nil {
+			return fileItem{}, logger.Wrapf(err, "Failed to decode %s file %s into %s", s.codec.Name(), fn, s.itemName)
+		}
+		fi.Item = newItemDataPtr.(items.IItem)
+	}
+	if err := fi.Item.Validate(); err != nil {
+		return fileItem{}, logger.Wrapf(err, "Invalid %s in %s file %s", s.itemName, s.codec.Name(), fn)
+	}
+	return fi, nil
+} //store.decodeFileItem()
+
+//writeItemFile creates or replaces the item file
+func (s *store) writeItemFile(fi fileItem) error {
+	data, err := s.writeFileItem(s.itemFilename(fi.ID), fi)
+	if err != nil {
+		return err
+	}
+	s.ids.add(fi.ID)
+	s.keyIndex.Put(fi.ID, s.keys(fi.Item))
+	s.cache.put(fi.ID, data)
+	s.setExpiry(fi)
+	if s.known != nil {
+		s.known[fi.ID] = md5.Sum(data)
+		if err := s.keepValid(fi.ID, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writeFileItem creates or replaces the file fn and returns what was written
+func (s *store) writeFileItem(fn string, fi fileItem) ([]byte, error) {
+	//encode the store's fileItemType, so that codecs that need concrete types (e.g. gob) can encode the item
+	fileItemValue := reflect.New(s.fileItemType).Elem()
+	fileItemValue.Field(0).Set(reflect.ValueOf(fi.ID))
+	if fi.Item != nil {
+		fileItemValue.Field(1).Set(reflect.ValueOf(itemPtr(fi.Item)))
+	}
+	fileItemValue.Field(2).Set(reflect.ValueOf(fi.Meta))
+	data, err := s.codec.Marshal(fileItemValue.Interface())
+	if err != nil {
+		return nil, logger.Wrapf(err, "Failed to %s encode item", s.codec.Name())
+	}
+	if s.shards.levels > 0 {
+		if err := mkdir(path.Dir(fn)); err != nil {
+			return nil, logger.Wrapf(err, "Failed to create shard for item file %s", fn)
+		}
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode)
+	if err != nil {
+		return nil, logger.Wrapf(err, "Failed to create item file %s", fn)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return nil, logger.Wrapf(err, "Failed to write item to file %s", fn)
+	}
+	return data, nil
+} //store.writeFileItem()
+
+//keys returns the unique keys of the item, from items.IItemWithUniqueKeys and WithUniqueKey()
+func (s *store) keys(item items.IItem) map[string]interface{} {
+	//keys are called with pointers, like the items read from files
+	return s.uniqueKeys.Keys(itemPtr(item))
+}
+
+//keyID returns the id derived from the item key, or "" when ids are not derived from keys
+func (s *store) keyID(item items.IItem) (string, error) {
+	if s.idKey == "" {
+		return "", nil
+	}
+	return common.KeyID(s.itemName, s.keys(item), s.idKey)
+}
+
+//itemPtr returns a pointer to the item, like the items read from files
+func itemPtr(item items.IItem) items.IItem {
+	itemValue := reflect.ValueOf(item)
+	if itemValue.Kind() == reflect.Ptr {
+		return item
+	}
+	itemPtrValue := reflect.New(itemValue.Type())
+	itemPtrValue.Elem().Set(itemValue)
+	return itemPtrValue.Interface().(items.IItem)
+}
+
+//hasKeys returns true if items have unique keys, from items.IItemWithUniqueKeys or WithUniqueKey()
+func (s *store) hasKeys() bool {
+	_, ok := itemPtr(s.itemTmpl).(items.IItemWithUniqueKeys)
+	return ok || len(s.uniqueKeys) > 0
+}
+
+//checkUnique fails if another item than id has the same value for one of the unique keys
+//id is "" for a new item
+func (s *store) checkUnique(id string, item items.IItem) error {
+	now := time.Now()
+	for n, v := range s.keys(item) {
+		otherID, ok := s.keyIndex.Get(n, v)
+		if !ok || otherID == id {
+			continue
+		}
+		//an expired item that was not swept yet does not keep its keys
+		other, err := s.readItemFile(otherID)
+		if err != nil || s.expired(other, now) {
+			continue
+		}
+		return common.DuplicateKey(s.itemName, id, n, v, otherID)
+	}
+	return nil
+} //store.checkUnique()
 
-	newItemValue := reflect.New(s.itemType)
-	newItemDataPtr := newItemValue.Interface()
-	if err := json.NewDecoder(jsonFile).Decode(newItemDataPtr); err != nil {
-		return s.noItem(), logger.Wrapf(err, "Failed to decode JSON file %s into %s", fn, s.itemName)
+//removeItemFile removes the item file
+func (s *store) removeItemFile(id string) error {
+	if err := os.Remove(s.itemFilename(id)); err != nil {
+		return err
 	}
-	newItem := newItemDataPtr.(items.IItem)
-	if err := newItem.Validate(); err != nil {
-		return s.noItem(), logger.Wrapf(err, "Invalid %s in JSON file %s", s.itemName, fn)
+	s.ids.remove(id)
+	s.keyIndex.Remove(id)
+	s.cache.remove(id)
+	delete(s.expiry, id)
+	if s.known != nil {
+		delete(s.known, id)
+		os.Remove(s.validFilename(id))
 	}
-	return newItem, nil
+	return nil
 }
 
 func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
 	//do not lock, because we use Get() inside this func...
-	// s.mutex.Lock()
-	// defer s.mutex.Unlock()
+	//(after Close, Get fails so nothing will be listed)
+
+	//list the ids in memory instead of reading the directory or all shards
+	s.mutex.Lock()
+	ids := s.ids.list()
+	s.mutex.Unlock()
 
-	//walk the directory
 	list := make([]items.IDAndItem, 0)
-	filepath.Walk(
-		s.path,
-		func(path string, info os.FileInfo, err error) error {
-			if info.Mode().IsRegular() {
-				parts := s.filenameRegex.FindStringSubmatch(path)
-				log.Debugf("Eval file \"%s\" with %d parts: %v", info.Name(), len(parts), parts)
-				if len(parts) >= 2 {
-					id := parts[1] //parts[0] = full name, parts[1] = sub string match
-
-					item, err := s.Get(id)
-					if err != nil {
-						//log.Errorf("List ignores file %s: %+v", info.Name(), err)
-					} else {
-						if filter != nil {
-							if err := item.Match(filter); err != nil {
-								//log.Errorf("Filter out file %s: %+v", info.Name(), err)
-								item = nil
-							}
-						}
-						if item != nil {
-							list = append(list, items.IDAndItem{ID: id, Item: item})
-							if size > 0 && len(list) >= size {
-								//stop processing
-								return filepath.SkipDir
-							}
-						}
-					}
-				}
-			} //if regular file
-			return nil
-		})
+	for _, id := range ids {
+		item, err := s.Get(id)
+		if err != nil {
+			//log.Errorf("List ignores %s.id=%s: %+v", s.itemName, id, err)
+			continue
+		}
+		if filter != nil {
+			if err := item.Match(filter); err != nil {
+				//log.Errorf("Filter out %s.id=%s: %+v", s.itemName, id, err)
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: id, Item: item})
+		//stop processing when size was reached
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
 	return list
 }
 
@@ -282,7 +643,10 @@ func (s *store) GetBy(map[string]interface{}) (string, items.IItem, error) {
 } //store.GetBy()
 
 func (s *store) itemFilename(id string) string {
-	return fmt.Sprintf("%s/%s_%s.json", s.path, s.itemName, id)
+	if s.shards.levels > 0 {
+		return fmt.Sprintf("%s/%s/%s_%s%s", s.path, s.shardDir(id), s.itemName, id, s.codec.Ext())
+	}
+	return fmt.Sprintf("%s/%s_%s%s", s.path, s.itemName, id, s.codec.Ext())
 }
 
 func (s *store) newItem() items.IItem {
@@ -295,10 +659,92 @@ func (s *store) noItem() items.IItem {
 	return ni.(items.IItem)
 }
 
+//Seq returns the sequence of the last change
+func (s *store) Seq() uint64 {
+	return s.changes.Seq()
+}
+
+//ChangesSince returns the changes made after seq
+func (s *store) ChangesSince(seq uint64) ([]items.Change, error) {
+	return s.changes.Since(seq)
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+//logChange records a change that was already applied
+//failing to log does not undo the change, consumers will see a gap after restart
+func (s *store) logChange(op items.ChangeOp, id string) {
+	if _, err := s.changes.Append(op, id); err != nil {
+		s.log.Errorf("Failed to log %s.%s(%s): %+v", s.itemName, op, id, err)
+	}
+}
+
 func (s *store) Uses(fieldName string, itemStore items.IStore) error {
 	return logger.Wrapf(nil, "Not yet implemented")
 }
 
+//Close stops the TTL sweeper and reload watcher, delivers queued notifications and releases the directory lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.sweeperStop != nil {
+		close(s.sweeperStop)
+	}
+	if s.purgerStop != nil {
+		close(s.purgerStop)
+	}
+	if s.watcherStop != nil {
+		close(s.watcherStop)
+	}
+	s.mutex.Unlock()
+
+	//wait without the lock, because a sweep, purge or reload may be busy
+	s.sweeper.Wait()
+	s.watching.Wait()
+	s.notifier.Close()
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.path)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.path)
+	return nil
+} //store.Close()
+
+//fileItem is what is stored in each file
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta
+type fileItem struct {
+	ID   string      `json:"_id"`
+	Item items.IItem `json:"item"`
+	Meta items.Meta  `json:"_meta"`
+}
+
+//fileItemType is fileItem with the user item type instead of the generic IItem
+//so that the JSON decoder knows what to make
+func fileItemType(itemType reflect.Type) reflect.Type {
+	return withItemType(reflect.TypeOf(fileItem{}), itemType)
+}
+
+//withItemType makes a struct same as t but with field[1] using the user item type
+func withItemType(t reflect.Type, itemType reflect.Type) reflect.Type {
+	structFields := make([]reflect.StructField, 0)
+	for i := 0; i < t.NumField(); i++ {
+		structFields = append(structFields, t.Field(i))
+	}
+	structFields[1].Type = itemType
+	return reflect.StructOf(structFields)
+}
+
 func mkdir(dir string) error {
 	dir = strings.TrimSuffix(dir, "/")
 	info, err := os.Stat(dir)
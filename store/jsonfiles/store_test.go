@@ -1,10 +1,20 @@
 package jsonfiles_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/codec"
+	"github.com/jansemmelink/items2/store/idgen"
 	"github.com/jansemmelink/items2/store/jsonfiles"
+	"github.com/stewelarend/logger"
 )
 
 func Test1(t *testing.T) {
@@ -12,6 +22,7 @@ func Test1(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create store: %+v", err)
 	}
+	defer store.Close()
 	t.Logf("Created store: %s", store.Name())
 }
 
@@ -34,3 +45,938 @@ func (u user) Match(filter items.IItem) error {
 func (u user) MatchKey(key map[string]interface{}) bool {
 	return false
 }
+
+func TestChanges(t *testing.T) {
+	os.RemoveAll("./share/changes")
+	s1, err := jsonfiles.New("./share/changes", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s1.Close()
+	id1, err := s1.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	id2, err := s1.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s1.Upd(id1, user{}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	if err := s1.Del(id2); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	//changes must survive a restart
+	s1.Close()
+	s2, err := jsonfiles.New("./share/changes", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s2.Close()
+	cs := s2.(items.IStoreWithChanges)
+	if cs.Seq() != 4 {
+		t.Fatalf("Seq=%d instead of 4", cs.Seq())
+	}
+	changes, err := cs.ChangesSince(1)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+	expected := []items.Change{
+		{Seq: 2, Op: items.ChangeAdd, ID: id2},
+		{Seq: 3, Op: items.ChangeUpd, ID: id1},
+		{Seq: 4, Op: items.ChangeDel, ID: id2},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Got %d changes instead of %d", len(changes), len(expected))
+	}
+	for i, c := range changes {
+		if c.Seq != expected[i].Seq || c.Op != expected[i].Op || c.ID != expected[i].ID {
+			t.Fatalf("change[%d]=%+v instead of %+v", i, c, expected[i])
+		}
+	}
+	if _, err := cs.ChangesSince(5); err == nil {
+		t.Fatalf("Got changes after last seq")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	os.RemoveAll("./share/hooks")
+	s, err := jsonfiles.New("./share/hooks", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	id, err := s.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	hooks := s.(items.IStoreWithHooks).Hooks()
+	hooks.BeforeAdd(func(item items.IItem) error { return logger.Wrapf(nil, "no more users") })
+	hooks.BeforeDel(func(id string, item items.IItem) error { return logger.Wrapf(nil, "keep users") })
+	if _, err := s.Add(user{}); err == nil {
+		t.Fatalf("Added user rejected by hook")
+	}
+	if err := s.Del(id); err == nil {
+		t.Fatalf("Deleted user rejected by hook")
+	}
+	if _, err := s.Get(id); err != nil {
+		t.Fatalf("User deleted despite hook: %+v", err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	os.RemoveAll("./share/meta")
+	s1, err := jsonfiles.New("./share/meta", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s1.Close()
+	ms := s1.(items.IStoreWithMeta)
+	id, err := ms.AddBy("alice", user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := ms.UpdBy("bob", id, user{}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	_, meta, err := ms.GetWithMeta(id)
+	if err != nil {
+		t.Fatalf("Failed to get: %+v", err)
+	}
+	if meta.Rev != 2 || meta.CreatedBy != "alice" || meta.UpdatedBy != "bob" || meta.Updated.Before(meta.Created) {
+		t.Fatalf("Wrong meta: %+v", meta)
+	}
+
+	//files without metadata can still be read
+	legacyID := "legacy"
+	if err := ioutil.WriteFile("./share/meta/user/user_"+legacyID+".json", []byte(`{}`), 0660); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	if _, meta, err := ms.GetWithMeta(legacyID); err != nil || meta.Rev != 0 {
+		t.Fatalf("Failed to get legacy item: %+v, %+v", meta, err)
+	}
+	if err := ms.UpdBy("carol", legacyID, user{}); err != nil {
+		t.Fatalf("Failed to upd legacy item: %+v", err)
+	}
+	if _, meta, err := ms.GetWithMeta(legacyID); err != nil || meta.Rev != 1 || meta.UpdatedBy != "carol" {
+		t.Fatalf("Wrong meta after legacy upd: %+v, %+v", meta, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	os.RemoveAll("./share/history")
+	s, err := jsonfiles.New("./share/history", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	hs := s.(items.IStoreWithHistory)
+	if err := hs.EnableHistory(); err != nil {
+		t.Fatalf("Failed to enable history: %+v", err)
+	}
+	id, err := s.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	t1 := time.Now()
+	if err := s.Upd(id, user{}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	t2 := time.Now()
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+
+	versions, err := hs.Versions(id)
+	if err != nil || len(versions) != 2 || versions[0].Meta.Rev != 1 || versions[1].Meta.Rev != 2 || !versions[1].Deleted {
+		t.Fatalf("Wrong versions: %+v, %v", versions, err)
+	}
+	if _, meta, err := hs.GetAsOf(id, t1); err != nil || meta.Rev != 1 {
+		t.Fatalf("GetAsOf(t1) -> %+v, %v", meta, err)
+	}
+	if _, meta, err := hs.GetVersion(id, 2); err != nil || meta.Rev != 2 {
+		t.Fatalf("GetVersion(2) -> %+v, %v", meta, err)
+	}
+	if list := hs.FindAsOf(t2, 0, nil); len(list) != 1 || list[0].ID != id {
+		t.Fatalf("FindAsOf(t2) -> %+v", list)
+	}
+	if list := hs.FindAsOf(time.Now(), 0, nil); len(list) != 0 {
+		t.Fatalf("FindAsOf(now) -> %+v", list)
+	}
+	if list := s.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Find() lists history: %+v", list)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	os.RemoveAll("./share/softdelete")
+	s, err := jsonfiles.New("./share/softdelete", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	sd := s.(items.IStoreWithSoftDelete)
+	if err := sd.EnableSoftDelete(0); err != nil {
+		t.Fatalf("Failed to enable soft delete: %+v", err)
+	}
+	id, err := s.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if _, err := s.Get(id); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	if list := s.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Found deleted item: %+v", list)
+	}
+	if list := sd.FindDeleted(0, nil); len(list) != 1 || list[0].ID != id {
+		t.Fatalf("FindDeleted -> %+v", list)
+	}
+	if err := sd.Restore(id); err != nil {
+		t.Fatalf("Failed to restore: %+v", err)
+	}
+	if _, meta, err := s.(items.IStoreWithMeta).GetWithMeta(id); err != nil || meta.Rev != 2 || meta.IsDeleted() {
+		t.Fatalf("Restored -> %+v, %v", meta, err)
+	}
+	if err := sd.Purge(id); err == nil {
+		t.Fatalf("Purged item that is not deleted")
+	}
+
+	//the id of an expired tombstone can be used again, purged or not
+	if err := sd.EnableSoftDelete(time.Millisecond * 50); err != nil {
+		t.Fatalf("Failed to set retention: %+v", err)
+	}
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if err := s.(items.IStoreWithID).AddWithID(id, user{}); err == nil {
+		t.Fatalf("Added id of deleted item")
+	}
+	time.Sleep(time.Millisecond * 60)
+	if err := s.(items.IStoreWithID).AddWithID(id, user{}); err != nil {
+		t.Fatalf("Failed to add id of expired tombstone: %+v", err)
+	}
+
+	//expired tombstones are purged on a timer
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 150)
+	if _, err := os.Stat("./share/softdelete/user/.deleted/user_" + id + ".json"); !os.IsNotExist(err) {
+		t.Fatalf("Expired tombstone was not purged: %v", err)
+	}
+	otherID, _ := s.Add(user{})
+	if err := s.Del(otherID); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if err := sd.Purge(otherID); err != nil {
+		t.Fatalf("Failed to purge: %+v", err)
+	}
+	if list := sd.FindDeleted(0, nil); len(list) != 0 {
+		t.Fatalf("FindDeleted after purge -> %+v", list)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	os.RemoveAll("./share/ttl")
+	s, err := jsonfiles.New("./share/ttl", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	ts := s.(items.IStoreWithTTL)
+	if err := ts.EnableTTL(time.Millisecond*50, 0); err != nil {
+		t.Fatalf("Failed to enable TTL: %+v", err)
+	}
+	expired := []string{}
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		if n.Op == items.ChangeDel {
+			expired = append(expired, n.ID)
+		}
+		return nil
+	})
+	id, _ := s.Add(user{})
+	if _, err := s.Get(id); err != nil {
+		t.Fatalf("Item expired too soon: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if _, err := s.Get(id); err == nil {
+		t.Fatalf("Got expired item")
+	}
+	if list := s.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Found expired item: %+v", list)
+	}
+	if n := ts.Sweep(); n != 1 || len(expired) != 1 || expired[0] != id {
+		t.Fatalf("Sweep -> %d, %+v", n, expired)
+	}
+	if _, err := os.Stat("./share/ttl/user/user_" + id + ".json"); !os.IsNotExist(err) {
+		t.Fatalf("Expired item file not removed: %v", err)
+	}
+
+	//an expired item that was not swept yet does not exist, like in the jsonfile store
+	if err := s.(items.IStoreWithID).AddWithID("x", user{}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := s.(items.IStoreWithID).AddWithID("x", user{}); err != nil {
+		t.Fatalf("Failed to add id of expired item: %+v", err)
+	}
+	if len(expired) != 2 || expired[1] != "x" {
+		t.Fatalf("Expired -> %+v", expired)
+	}
+
+	//nothing expires without TTL, and the expiry times follow changes to the TTL and items
+	if err := ts.EnableTTL(0, 0); err != nil {
+		t.Fatalf("Failed to disable TTL: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if n := ts.Sweep(); n != 0 {
+		t.Fatalf("Sweep without TTL -> %d", n)
+	}
+	if err := ts.EnableTTL(time.Hour, 0); err != nil {
+		t.Fatalf("Failed to enable TTL: %+v", err)
+	}
+	if n := ts.Sweep(); n != 0 {
+		t.Fatalf("Sweep before TTL -> %d", n)
+	}
+	if err := ts.EnableTTL(time.Millisecond*10, 0); err != nil {
+		t.Fatalf("Failed to shorten TTL: %+v", err)
+	}
+	if n := ts.Sweep(); n != 1 || expired[2] != "x" {
+		t.Fatalf("Sweep after shorter TTL -> %d, %+v", n, expired)
+	}
+	if err := ts.EnableTTL(time.Millisecond*100, 0); err != nil {
+		t.Fatalf("Failed to set TTL: %+v", err)
+	}
+	id, _ = s.Add(user{})
+	time.Sleep(time.Millisecond * 60)
+	if err := s.Upd(id, user{}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if n := ts.Sweep(); n != 0 {
+		t.Fatalf("Sweep after upd -> %d", n)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if n := ts.Sweep(); n != 1 || expired[3] != id {
+		t.Fatalf("Sweep -> %d, %+v", n, expired)
+	}
+}
+
+func TestClose(t *testing.T) {
+	os.RemoveAll("./share/close")
+	s1, err := jsonfiles.New("./share/close", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, err := s1.Add(user{})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := jsonfiles.New("./share/close", "user", user{}); err == nil {
+		t.Fatalf("Opened store twice")
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+	if _, err := s1.Get(id); err != items.ErrClosed {
+		t.Fatalf("Get after close -> %v", err)
+	}
+	if err := s1.Upd(id, user{}); err != items.ErrClosed {
+		t.Fatalf("Upd after close -> %v", err)
+	}
+	if list := s1.Find(0, nil); len(list) != 0 {
+		t.Fatalf("Find after close -> %+v", list)
+	}
+	s2, err := jsonfiles.New("./share/close", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %+v", err)
+	}
+	defer s2.Close()
+	if _, err := s2.Get(id); err != nil {
+		t.Fatalf("Failed to get after reopen: %+v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defaultDebounce := jsonfiles.DefaultReloadDebounce
+	jsonfiles.DefaultReloadDebounce = time.Millisecond * 100
+	defer func() { jsonfiles.DefaultReloadDebounce = defaultDebounce }()
+
+	os.RemoveAll("./share/reload")
+	os.MkdirAll("./share/reload/user", 0770)
+	ioutil.WriteFile("./share/reload/user/user_1.json", []byte(`{}`), 0660)
+	s, err := jsonfiles.NewWithReload("./share/reload", "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	var notifiedMutex sync.Mutex
+	notified := []string{}
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		notifiedMutex.Lock()
+		defer notifiedMutex.Unlock()
+		notified = append(notified, fmt.Sprintf("%s(%s)", n.Op, n.ID))
+		return nil
+	})
+	s.(items.IStoreWithHooks).Hooks().BeforeDel(func(id string, item items.IItem) error {
+		if id == "1" {
+			return fmt.Errorf("may not delete 1")
+		}
+		return nil
+	})
+
+	//changes made through the store are not reloaded
+	id, _ := s.Add(user{})
+	if err := s.Upd(id, user{}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+
+	//external changes are notified
+	ioutil.WriteFile("./share/reload/user/user_2.json", []byte(`{}`), 0660)
+	ioutil.WriteFile("./share/reload/user/user_3.json", []byte(`{"bad`), 0660)
+	os.Remove("./share/reload/user/user_" + id + ".json")
+	os.Remove("./share/reload/user/user_1.json")
+	time.Sleep(time.Millisecond * 500)
+
+	notifiedMutex.Lock()
+	expected := []string{"add(" + id + ")", "upd(" + id + ")", "add(2)", "del(" + id + ")"}
+	sort.Strings(notified)
+	sort.Strings(expected)
+	if strings.Join(notified, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Wrong notifications: %v", notified)
+	}
+	notifiedMutex.Unlock()
+	if _, meta, err := s.(items.IStoreWithMeta).GetWithMeta("2"); err != nil || meta.Rev != 1 {
+		t.Fatalf("Get(2) -> %+v, %v", meta, err)
+	}
+	if _, err := os.Stat("./share/reload/user/user_3.err"); err != nil {
+		t.Fatalf("No error file for invalid file: %v", err)
+	}
+	if _, err := s.Get("1"); err != nil {
+		t.Fatalf("Rejected delete did not restore the file: %v", err)
+	}
+	if _, err := os.Stat("./share/reload/user/user_1.err"); err != nil {
+		t.Fatalf("No error file for rejected delete: %v", err)
+	}
+}
+
+//TestReloadRejected checks that rejected external changes are not returned by Get()
+func TestReloadRejected(t *testing.T) {
+	os.RemoveAll("./share/rejected")
+	hooks := items.NewHooks()
+	hooks.BeforeUpd(func(id string, old items.IItem, new items.IItem) error {
+		if new.(*country).Code == "XX" {
+			return logger.Wrapf(nil, "XX is not a country")
+		}
+		return nil
+	})
+	seq, _ := idgen.Sequential("")
+	s, err := jsonfiles.NewWithOptions("./share/rejected", "country", country{},
+		jsonfiles.WithIDGenerator(seq),
+		jsonfiles.WithHooks(hooks),
+		jsonfiles.WithReload(jsonfiles.ReloadOptions{Debounce: time.Millisecond * 100}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	if _, err := s.Add(country{Code: "ZA"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+
+	//a vetoed update is kept aside and replaced by the last valid version
+	ioutil.WriteFile("./share/rejected/country/country_1.json", []byte(`{"item":{"code":"XX"}}`), 0660)
+	//an invalid new file is moved aside
+	ioutil.WriteFile("./share/rejected/country/country_2.json", []byte(`{"item":{"code":"ZAF"}}`), 0660)
+	time.Sleep(time.Millisecond * 400)
+
+	if item, err := s.Get("1"); err != nil || item.(*country).Code != "ZA" {
+		t.Fatalf("Get(1) after vetoed update -> %+v, %v", item, err)
+	}
+	if _, err := os.Stat("./share/rejected/country/country_1.err"); err != nil {
+		t.Fatalf("Vetoed update not reported: %v", err)
+	}
+	if data, err := ioutil.ReadFile("./share/rejected/country/country_1.json.rejected"); err != nil || string(data) != `{"item":{"code":"XX"}}` {
+		t.Fatalf("Vetoed update not kept: %s %v", data, err)
+	}
+	if item, err := s.Get("2"); err == nil {
+		t.Fatalf("Get(2) returned invalid item %+v", item)
+	}
+	if _, err := os.Stat("./share/rejected/country/country_2.json.rejected"); err != nil {
+		t.Fatalf("Invalid file not moved aside: %v", err)
+	}
+	if _, err := os.Stat("./share/rejected/country/country_2.err"); err != nil {
+		t.Fatalf("Invalid file not reported: %v", err)
+	}
+	if list := s.Find(0, nil); len(list) != 1 {
+		t.Fatalf("Find -> %+v", list)
+	}
+}
+
+type country struct {
+	Code string `json:"code"`
+}
+
+func (c country) Validate() error {
+	if len(c.Code) != 2 {
+		return logger.Wrapf(nil, "country.code=\"%s\" must have 2 letters", c.Code)
+	}
+	return nil
+}
+
+func (c country) Match(filter items.IItem) error {
+	return nil
+}
+
+func (c country) MatchKey(key map[string]interface{}) bool {
+	return key["code"] == c.Code
+}
+
+func TestOptions(t *testing.T) {
+	os.RemoveAll("./share/options")
+	hooks := items.NewHooks()
+	hooks.BeforeDel(func(id string, item items.IItem) error { return logger.Wrapf(nil, "keep countries") })
+	s, err := jsonfiles.NewWithOptions("./share/options", "country", country{},
+		jsonfiles.WithFileMode(0600),
+		jsonfiles.WithLogger(logger.New()),
+		jsonfiles.WithHooks(hooks),
+		jsonfiles.WithUniqueKey("code", func(item items.IItem) interface{} { return item.(*country).Code }),
+		jsonfiles.WithReload(jsonfiles.ReloadOptions{Debounce: time.Millisecond * 100}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+
+	id, err := s.Add(country{Code: "ZA"})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(country{Code: "ZA"}); err == nil {
+		t.Fatalf("Added duplicate code")
+	}
+	if err := s.Upd(id, country{Code: "ZA"}); err != nil {
+		t.Fatalf("Failed to upd with own code: %+v", err)
+	}
+	if err := s.Del(id); err == nil {
+		t.Fatalf("Deleted country rejected by hook")
+	}
+	info, err := os.Stat(fmt.Sprintf("./share/options/country/country_%s.json", id))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Wrong file mode: %+v %v", info, err)
+	}
+
+	//reloaded files are also checked
+	ioutil.WriteFile("./share/options/country/country_dup.json", []byte(`{"item":{"code":"ZA"}}`), 0660)
+	time.Sleep(time.Millisecond * 400)
+	if _, err := s.Get("dup"); err != nil {
+		t.Logf("Not loaded as expected: %v", err)
+	}
+	if _, err := os.Stat("./share/options/country/country_dup.err"); err != nil {
+		t.Fatalf("Duplicate not reported: %v", err)
+	}
+}
+
+type team struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func (tm team) Validate() error {
+	return nil
+}
+
+func (tm team) Match(filter items.IItem) error {
+	return nil
+}
+
+func (tm team) MatchKey(key map[string]interface{}) bool {
+	return key["name"] == tm.Name
+}
+
+func (tm team) Keys() map[string]interface{} {
+	return map[string]interface{}{"name": tm.Name, "members": tm.Members}
+}
+
+func TestUniqueKeys(t *testing.T) {
+	os.RemoveAll("./share/teams")
+	//keys from items.IItemWithUniqueKeys, also values that cannot be compared with ==
+	s, err := jsonfiles.New("./share/teams", "team", team{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	id, err := s.Add(team{Name: "a", Members: []string{"x", "y"}})
+	if err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if _, err := s.Add(team{Name: "a"}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate name: %v", err)
+	}
+	if _, err := s.Add(team{Name: "b", Members: []string{"x", "y"}}); err == nil || !strings.Contains(fmt.Sprintf("%v", err), "duplicate key") {
+		t.Fatalf("Added duplicate members: %v", err)
+	}
+	if err := s.Upd(id, team{Name: "a", Members: []string{"x"}}); err != nil {
+		t.Fatalf("Failed to upd own keys: %+v", err)
+	}
+	s.Close()
+
+	//the index is built from the files when the store is opened
+	s, err = jsonfiles.New("./share/teams", "team", team{})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %+v", err)
+	}
+	defer s.Close()
+	if _, err := s.Add(team{Name: "b", Members: []string{"x"}}); err == nil {
+		t.Fatalf("Added duplicate members after reopen")
+	}
+	if _, err := s.Add(team{Name: "b", Members: []string{"x", "y"}}); err != nil {
+		t.Fatalf("Failed to add old members of updated team: %+v", err)
+	}
+	if err := s.Del(id); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if _, err := s.Add(team{Name: "a", Members: []string{"x"}}); err != nil {
+		t.Fatalf("Failed to add keys of deleted team: %+v", err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	os.RemoveAll("./share/idgen")
+	os.MkdirAll("./share/idgen/user", 0770)
+	ioutil.WriteFile("./share/idgen/user/user_usr_7.json", []byte(`{}`), 0660)
+	seq, _ := idgen.Sequential("")
+	s, err := jsonfiles.NewWithOptions("./share/idgen", "user", user{}, jsonfiles.WithIDGenerator(idgen.Prefixed("usr_", seq)))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	if id, err := s.Add(user{}); err != nil || id != "usr_8" {
+		t.Fatalf("Added id=%s instead of usr_8: %v", id, err)
+	}
+}
+
+func TestIDFromKey(t *testing.T) {
+	os.RemoveAll("./share/idfromkey")
+	s, err := jsonfiles.NewWithOptions("./share/idfromkey", "country", country{},
+		jsonfiles.WithUniqueKey("code", func(item items.IItem) interface{} { return item.(*country).Code }),
+		jsonfiles.WithIDFromKey("code"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	if id, err := s.Add(country{Code: "ZA"}); err != nil || id != "ZA" {
+		t.Fatalf("Added id=%s instead of ZA: %v", id, err)
+	}
+	if _, err := os.Stat("./share/idfromkey/country/country_ZA.json"); err != nil {
+		t.Fatalf("File not named by key: %v", err)
+	}
+	if err := s.Upd("ZA", country{Code: "ZW"}); err == nil {
+		t.Fatalf("Updated key used as id")
+	}
+	if err := s.(items.IStoreWithID).AddWithID("US", country{Code: "UK"}); err == nil {
+		t.Fatalf("Added with id different from key")
+	}
+	if err := s.(items.IStoreWithID).AddWithID("ZA", country{Code: "ZA"}); err == nil {
+		t.Fatalf("Added existing id")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []codec.ICodec{codec.CompactJSON, codec.Gob, codec.YAML, codec.TOML} {
+		dir := "./share/codec-" + c.Name()
+		os.RemoveAll(dir)
+		s, err := jsonfiles.NewWithOptions(dir, "country", country{}, jsonfiles.WithCodec(c))
+		if err != nil {
+			t.Fatalf("%s: failed to create store: %+v", c.Name(), err)
+		}
+		id, err := s.Add(country{Code: "ZA"})
+		if err == nil {
+			err = s.Upd(id, country{Code: "ZW"})
+		}
+		s.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to add and update: %+v", c.Name(), err)
+		}
+		if _, err := os.Stat(dir + "/country/country_" + id + c.Ext()); err != nil {
+			t.Fatalf("%s: file not named with codec extension: %v", c.Name(), err)
+		}
+
+		s, err = jsonfiles.NewWithOptions(dir, "country", country{}, jsonfiles.WithCodec(c))
+		if err != nil {
+			t.Fatalf("%s: failed to open store: %+v", c.Name(), err)
+		}
+		item, err := s.Get(id)
+		s.Close()
+		if err != nil || item.(*country).Code != "ZW" {
+			t.Fatalf("%s: Get -> %+v, %v", c.Name(), item, err)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	os.RemoveAll("./share/shards")
+	s, err := jsonfiles.NewWithOptions("./share/shards", "country", country{},
+		jsonfiles.WithUniqueKey("code", func(item items.IItem) interface{} { return item.(*country).Code }),
+		jsonfiles.WithIDFromKey("code"),
+		jsonfiles.WithShards(2, 1),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	for _, code := range []string{"ZA", "ZW", "US", "UK", "NA"} {
+		if _, err := s.Add(country{Code: code}); err != nil {
+			t.Fatalf("Failed to add %s: %+v", code, err)
+		}
+	}
+	if _, err := os.Stat("./share/shards/country/Z/A/country_ZA.json"); err != nil {
+		t.Fatalf("File not in shard: %v", err)
+	}
+	if item, err := s.Get("UK"); err != nil || item.(*country).Code != "UK" {
+		t.Fatalf("Get -> %+v, %v", item, err)
+	}
+	if list := s.Find(0, nil); len(list) != 5 || list[0].ID != "NA" || list[4].ID != "ZW" {
+		t.Fatalf("Find -> %+v", list)
+	}
+	if list := s.Find(3, nil); len(list) != 3 || list[2].ID != "US" {
+		t.Fatalf("Find(3) -> %+v", list)
+	}
+	//tombstones are kept in the same shards
+	if err := s.(items.IStoreWithSoftDelete).EnableSoftDelete(0); err != nil {
+		t.Fatalf("Failed to enable soft delete: %+v", err)
+	}
+	if err := s.Del("NA"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	if _, err := os.Stat("./share/shards/country/.deleted/N/A/country_NA.json"); err != nil {
+		t.Fatalf("Tombstone not in shard: %v", err)
+	}
+	if list := s.(items.IStoreWithSoftDelete).FindDeleted(0, nil); len(list) != 1 || list[0].ID != "NA" {
+		t.Fatalf("FindDeleted -> %+v", list)
+	}
+	//history is kept in the same shards
+	if err := s.(items.IStoreWithHistory).EnableHistory(); err != nil {
+		t.Fatalf("Failed to enable history: %+v", err)
+	}
+	if err := s.Upd("ZA", country{Code: "ZA"}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	if infos, err := ioutil.ReadDir("./share/shards/country/.history/Z/A/ZA"); err != nil || len(infos) != 1 {
+		t.Fatalf("History not in shard: %v", err)
+	}
+	s.Close()
+
+	//directories that are not shards are kept
+	os.MkdirAll("./share/shards/country/docs", 0770)
+	os.MkdirAll("./share/shards/country/Z/docs", 0770)
+
+	if _, err := jsonfiles.NewWithOptions("./share/shards", "country", country{}, jsonfiles.WithShards(2, 5)); err == nil {
+		t.Fatalf("Created store with shards wider than allowed")
+	}
+
+	//back to a flat directory
+	if moved, err := jsonfiles.Reshard("./share/shards", "country", country{}); err != nil || moved != 4 {
+		t.Fatalf("Reshard -> %d, %+v", moved, err)
+	}
+	if _, err := os.Stat("./share/shards/country/U"); !os.IsNotExist(err) {
+		t.Fatalf("Empty shard not removed: %v", err)
+	}
+	if _, err := os.Stat("./share/shards/country/Z/A"); !os.IsNotExist(err) {
+		t.Fatalf("Empty shard not removed: %v", err)
+	}
+	for _, dir := range []string{"./share/shards/country/docs", "./share/shards/country/Z/docs", "./share/shards/country/.history/ZA"} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatalf("Removed or did not move %s: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat("./share/shards/country/.history/Z"); !os.IsNotExist(err) {
+		t.Fatalf("Empty history shard not removed: %v", err)
+	}
+	if _, err := os.Stat("./share/shards/country/.deleted/country_NA.json"); err != nil {
+		t.Fatalf("Tombstone not moved: %v", err)
+	}
+	if _, err := os.Stat("./share/shards/country/.deleted/N"); !os.IsNotExist(err) {
+		t.Fatalf("Empty tombstone shard not removed: %v", err)
+	}
+	s, err = jsonfiles.New("./share/shards", "country", country{})
+	if err != nil {
+		t.Fatalf("Failed to open flat store: %+v", err)
+	}
+	if list := s.Find(0, nil); len(list) != 4 {
+		t.Fatalf("Find after reshard -> %+v", list)
+	}
+	s.Close()
+
+	//into shards of 2 characters
+	if moved, err := jsonfiles.Reshard("./share/shards", "country", country{}, jsonfiles.WithShards(1, 2)); err != nil || moved != 4 {
+		t.Fatalf("Reshard -> %d, %+v", moved, err)
+	}
+	if _, err := os.Stat("./share/shards/country/UK/country_UK.json"); err != nil {
+		t.Fatalf("File not in new shard: %v", err)
+	}
+	if _, err := os.Stat("./share/shards/country/.deleted/NA/country_NA.json"); err != nil {
+		t.Fatalf("Tombstone not in new shard: %v", err)
+	}
+	s, err = jsonfiles.NewWithOptions("./share/shards", "country", country{}, jsonfiles.WithShards(1, 2))
+	if err != nil {
+		t.Fatalf("Failed to open resharded store: %+v", err)
+	}
+	defer s.Close()
+	if item, err := s.Get("ZW"); err != nil || item.(*country).Code != "ZW" {
+		t.Fatalf("Get after reshard -> %+v, %v", item, err)
+	}
+	hs := s.(items.IStoreWithHistory)
+	if err := hs.EnableHistory(); err != nil {
+		t.Fatalf("Failed to enable history: %+v", err)
+	}
+	if versions, err := hs.Versions("ZA"); err != nil || len(versions) != 2 {
+		t.Fatalf("Versions after reshard -> %+v, %v", versions, err)
+	}
+	if s.Del("ZA") != nil || len(hs.FindAsOf(time.Now().Add(-time.Hour), 0, nil)) != 0 || len(hs.FindAsOf(time.Now(), 0, nil)) != 3 {
+		t.Fatalf("FindAsOf after reshard")
+	}
+}
+
+//TestShardsReload checks that files changed in shards are reloaded after they stopped changing
+func TestShardsReload(t *testing.T) {
+	os.RemoveAll("./share/shardsreload")
+	s, err := jsonfiles.NewWithOptions("./share/shardsreload", "country", country{},
+		jsonfiles.WithIDFromKey("code"),
+		jsonfiles.WithUniqueKey("code", func(item items.IItem) interface{} { return item.(*country).Code }),
+		jsonfiles.WithShards(1, 1),
+		jsonfiles.WithReload(jsonfiles.ReloadOptions{Debounce: time.Millisecond * 300, PollInterval: time.Millisecond * 20}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	var notifiedMutex sync.Mutex
+	notified := 0
+	s.(items.IStoreWithNotifier).Notifier().Handle(func(n items.Notification) error {
+		notifiedMutex.Lock()
+		defer notifiedMutex.Unlock()
+		notified++
+		return nil
+	})
+
+	//a file that is still being written is not loaded
+	os.MkdirAll("./share/shardsreload/country/Z", 0770)
+	ioutil.WriteFile("./share/shardsreload/country/Z/country_ZA.json", []byte(`{"item":{"code":"Z`), 0660)
+	time.Sleep(time.Millisecond * 150)
+	ioutil.WriteFile("./share/shardsreload/country/Z/country_ZA.json", []byte(`{"item":{"code":"ZA"}}`), 0660)
+	time.Sleep(time.Millisecond * 150)
+	if _, err := os.Stat("./share/shardsreload/country/Z/country_ZA.err"); err == nil {
+		t.Fatalf("Loaded a file that was still changing")
+	}
+	time.Sleep(time.Millisecond * 400)
+	if item, err := s.Get("ZA"); err != nil || item.(*country).Code != "ZA" {
+		t.Fatalf("Get -> %+v, %v", item, err)
+	}
+	//the last valid version is kept on disk in the same shard
+	if _, err := os.Stat("./share/shardsreload/country/.valid/Z/country_ZA.json"); err != nil {
+		t.Fatalf("Valid version not kept: %v", err)
+	}
+
+	//a rejected change in an existing shard is restored, and a removed file is deleted
+	ioutil.WriteFile("./share/shardsreload/country/Z/country_ZA.json", []byte(`{"item":{"code":"ZW"}}`), 0660)
+	time.Sleep(time.Millisecond * 500)
+	if item, err := s.Get("ZA"); err != nil || item.(*country).Code != "ZA" {
+		t.Fatalf("Get after rejected change -> %+v, %v", item, err)
+	}
+	os.Remove("./share/shardsreload/country/Z/country_ZA.json")
+	time.Sleep(time.Millisecond * 500)
+	if item, err := s.Get("ZA"); err == nil {
+		t.Fatalf("Get after remove -> %+v", item)
+	}
+	notifiedMutex.Lock()
+	defer notifiedMutex.Unlock()
+	if notified != 2 {
+		t.Fatalf("Notified %d times", notified)
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := "./share/cache/country"
+	os.RemoveAll("./share/cache")
+	seq, _ := idgen.Sequential("")
+	if _, err := jsonfiles.NewWithOptions("./share/cache", "country", country{}, jsonfiles.WithCacheSize(-1)); err == nil {
+		t.Fatalf("Created store with negative cache size")
+	}
+	s, err := jsonfiles.NewWithOptions("./share/cache", "country", country{}, jsonfiles.WithIDGenerator(seq), jsonfiles.WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer s.Close()
+	for _, code := range []string{"ZA", "ZW", "US"} {
+		if _, err := s.Add(country{Code: code}); err != nil {
+			t.Fatalf("Failed to add %s: %+v", code, err)
+		}
+	}
+
+	//the last two items are served from memory, the first was dropped from the cache
+	os.Remove(dir + "/country_1.json")
+	os.Remove(dir + "/country_3.json")
+	if item, err := s.Get("3"); err != nil || item.(*country).Code != "US" {
+		t.Fatalf("Get cached -> %+v, %v", item, err)
+	}
+	if _, err := s.Get("1"); err == nil {
+		t.Fatalf("Got item that was not cached after its file was removed")
+	}
+	if list := s.Find(1, nil); len(list) != 1 || list[0].ID != "2" {
+		t.Fatalf("Find(1) -> %+v", list)
+	}
+
+	//changing a returned item does not change the cache
+	item, _ := s.Get("2")
+	item.(*country).Code = "XX"
+	if item, err := s.Get("2"); err != nil || item.(*country).Code != "ZW" {
+		t.Fatalf("Get after change -> %+v, %v", item, err)
+	}
+	teams, err := jsonfiles.NewWithOptions("./share/cache", "team", team{}, jsonfiles.WithCacheSize(2))
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	defer teams.Close()
+	members := []string{"A", "B"}
+	teamID, _ := teams.Add(team{Name: "T", Members: members})
+	members[0] = "X"
+	teamItem, _ := teams.Get(teamID)
+	teamItem.(*team).Members[1] = "Y"
+	if teamItem, err := teams.Get(teamID); err != nil || strings.Join(teamItem.(*team).Members, ",") != "A,B" {
+		t.Fatalf("Get after changing slice -> %+v, %v", teamItem, err)
+	}
+
+	//writes through the store update the cache and the catalogue
+	if err := s.Upd("2", country{Code: "UK"}); err != nil {
+		t.Fatalf("Failed to upd: %+v", err)
+	}
+	if item, err := s.Get("2"); err != nil || item.(*country).Code != "UK" {
+		t.Fatalf("Get after upd -> %+v, %v", item, err)
+	}
+	if err := s.Del("2"); err != nil {
+		t.Fatalf("Failed to del: %+v", err)
+	}
+	if _, err := s.Get("2"); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	id, _ := s.Add(country{Code: "NA"})
+	if list := s.Find(0, nil); len(list) != 2 || list[0].ID != "3" || list[1].ID != id {
+		t.Fatalf("Find -> %+v", list)
+	}
+
+	//files added by other programs are seen when asked for
+	ioutil.WriteFile(dir+"/country_BW.json", []byte(`{"code":"BW"}`), 0660)
+	if item, err := s.Get("BW"); err != nil || item.(*country).Code != "BW" {
+		t.Fatalf("Get external file -> %+v, %v", item, err)
+	}
+	//and items that were dropped from the cache are removed when their file is gone
+	if list := s.Find(0, nil); len(list) != 2 || list[0].ID != id || list[1].ID != "BW" {
+		t.Fatalf("Find after external file -> %+v", list)
+	}
+}
@@ -0,0 +1,132 @@
+package jsonfiles
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/stewelarend/logger"
+)
+
+//EnableTTL sets the store TTL and starts the sweeper when sweepInterval > 0
+func (s *store) EnableTTL(ttl time.Duration, sweepInterval time.Duration) error {
+	if ttl < 0 || sweepInterval < 0 {
+		return logger.Wrapf(nil, "EnableTTL(%v,%v) negative duration", ttl, sweepInterval)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+	s.ttl = ttl
+	s.expiry = nil //rebuilt with the new TTL on the next sweep
+	if sweepInterval > 0 && s.sweeperStop == nil {
+		s.sweeperStop = make(chan struct{})
+		s.sweeper.Add(1)
+		go s.sweep(sweepInterval, s.sweeperStop)
+	}
+	return nil
+}
+
+func (s *store) sweep(interval time.Duration, stop chan struct{}) {
+	defer s.sweeper.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Sweep()
+		}
+	}
+}
+
+//Sweep removes the files of expired items now, returning the number of items removed
+//expiry cannot be vetoed by hooks and does not leave tombstones
+//The expiry times are kept in memory, so only the files of items that are due are read,
+//after all files were read once on the first sweep after EnableTTL().
+func (s *store) Sweep() int {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0
+	}
+
+	if !s.canExpire() {
+		return 0
+	}
+	if s.expiry == nil {
+		s.expiry = make(map[string]time.Time)
+		for _, id := range s.ids.list() {
+			s.readItemFile(id) //sets the expiry of valid items
+		}
+	}
+
+	now := time.Now()
+	due := make([]string, 0)
+	for id, expiry := range s.expiry {
+		if now.After(expiry) {
+			due = append(due, id)
+		}
+	}
+	sort.Strings(due)
+	for _, id := range due {
+		fi, err := s.readItemFile(id)
+		if err != nil || !s.expired(fi, now) {
+			continue
+		}
+		if err := s.expireItem(fi, now); err != nil {
+			s.log.Errorf("%+v", err)
+			continue
+		}
+		notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: fi.Item})
+	}
+	return len(notifications)
+} //store.Sweep()
+
+//expireItem removes the file of an expired item, keeping its history
+//must be called with the store locked
+func (s *store) expireItem(fi fileItem, now time.Time) error {
+	if err := s.keepVersion(historyItem{ID: fi.ID, Item: fi.Item, Meta: fi.Meta, Replaced: now, Deleted: true}); err != nil {
+		return logger.Wrapf(err, "cannot keep history of expired %s.id=%s", s.itemName, fi.ID)
+	}
+	if err := s.removeItemFile(fi.ID); err != nil {
+		return logger.Wrapf(err, "failed to remove expired %s.id=%s", s.itemName, fi.ID)
+	}
+	s.logChange(items.ChangeDel, fi.ID)
+	s.log.Debugf("EXPIRED(%s)", fi.ID)
+	return nil
+}
+
+//canExpire is false when there is no store TTL and the items do not implement items.IItemWithTTL
+func (s *store) canExpire() bool {
+	if s.ttl > 0 {
+		return true
+	}
+	ttlType := reflect.TypeOf((*items.IItemWithTTL)(nil)).Elem()
+	return s.itemType.Implements(ttlType) || reflect.PtrTo(s.itemType).Implements(ttlType)
+}
+
+//setExpiry updates the expiry time of the item while Sweep() keeps them
+//must be called with the store locked
+func (s *store) setExpiry(fi fileItem) {
+	if s.expiry == nil {
+		return
+	}
+	ttl := items.TTL(fi.Item, s.ttl)
+	if ttl <= 0 || fi.Meta.Updated.IsZero() {
+		delete(s.expiry, fi.ID)
+		return
+	}
+	s.expiry[fi.ID] = fi.Meta.Updated.Add(ttl)
+}
+
+//expired is true when the item's TTL passed
+func (s *store) expired(fi fileItem, now time.Time) bool {
+	return items.IsExpired(fi.Item, fi.Meta, s.ttl, now)
+}
@@ -0,0 +1,468 @@
+package jsonfiles
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/stewelarend/logger"
+)
+
+//DefaultReloadDebounce is how long an item file must be unchanged
+//before it is reloaded, so that a file is not loaded while being written
+var DefaultReloadDebounce = time.Second
+
+//defaultPollInterval is used to scan the item files when they cannot be watched with fsnotify
+const defaultPollInterval = time.Second
+
+//validDir keeps the last valid version of each item file when reload is enabled,
+//so that a rejected external change can be restored without keeping all items in memory
+const validDir = ".valid"
+
+//NewWithReload is same as New() then watching the directory for item files
+//that are created, changed or removed by other programs
+//Changed files are validated and must pass the hooks, then they are notified
+//like changes made through the store. A changed or new file that fails is kept as
+//<file>.rejected, then a changed file is restored to its last valid version,
+//with the reason written to a .err file next to them.
+func NewWithReload(parentDir string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(parentDir, name, tmpl, WithReload(ReloadOptions{}))
+}
+
+//watchDir loads all item files then starts watching the directory and its shards
+//when fsnotify cannot be used, the files are scanned at intervals instead
+func (s *store) watchDir(opts ReloadOptions) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.watcherStop != nil {
+		return logger.Wrapf(nil, "cannot watch %s", s.path)
+	}
+
+	//load what is there now, without notifying
+	s.known = make(map[string][md5.Size]byte)
+	states := make(map[string]fileState)
+	for _, id := range s.itemFileIDs() {
+		fn := s.itemFilename(id)
+		if info, err := os.Stat(fn); err == nil {
+			states[id] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+		jsonData, err := ioutil.ReadFile(fn)
+		if err == nil {
+			if _, err = s.decodeFileItem(fn, id, jsonData); err == nil {
+				s.known[id] = md5.Sum(jsonData)
+				err = s.keepValid(id, jsonData)
+			}
+		}
+		s.reportFile(fn, err)
+	}
+
+	s.watcherStop = make(chan struct{})
+	s.watching.Add(1)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = s.watchShards(watcher, s.path, 0); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		s.log.Errorf("Cannot watch %s with fsnotify, scanning instead: %v", s.path, err)
+		go s.pollDir(states, opts.Debounce, opts.PollInterval, s.watcherStop)
+		return nil
+	}
+	go s.watchEvents(watcher, opts.Debounce, s.watcherStop)
+	s.log.Debugf("Watching %s with %d %ss...", s.path, len(s.known), s.itemName)
+	return nil
+} //store.watchDir()
+
+//watchShards adds dir at the shard level to the watcher, and all shard directories under it,
+//because fsnotify does not watch subdirectories
+func (s *store) watchShards(watcher *fsnotify.Watcher, dir string, level int) error {
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	if level >= s.shards.levels {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() && s.shards.isShard(info.Name()) {
+			if err := s.watchShards(watcher, dir+"/"+info.Name(), level+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//shardLevel returns the level of a shard directory below the store, e.g. 1 for ab in ab/cd
+func (s *store) shardLevel(dir string) (int, bool) {
+	rel, err := filepath.Rel(s.path, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return 0, false
+	}
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	if len(names) > s.shards.levels {
+		return 0, false
+	}
+	for _, name := range names {
+		if !s.shards.isShard(name) {
+			return 0, false
+		}
+	}
+	return len(names), true
+}
+
+//watchEvents reloads changed files after no events were received for the debounce time
+func (s *store) watchEvents(watcher *fsnotify.Watcher, debounce time.Duration, stop chan struct{}) {
+	defer s.watching.Done()
+	defer watcher.Close()
+
+	//timer runs only while files are changing
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	pending := make(map[string]bool)
+	changed := func(id string) {
+		pending[id] = true
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(debounce)
+	}
+	for {
+		select {
+		case <-stop:
+			s.log.Debugf("Stopped watching %s", s.path)
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			//a new shard is watched, and files written before that are loaded
+			if level, ok := s.shardLevel(event.Name); ok && event.Op&fsnotify.Create != 0 {
+				if err := s.watchShards(watcher, event.Name, level); err != nil {
+					s.log.Errorf("Cannot watch %s: %v", event.Name, err)
+				}
+				if _, err := s.walkShard(event.Name, level, s.itemFilename, func(id string, filename string) bool {
+					changed(id)
+					return true
+				}); err != nil {
+					s.log.Errorf("Cannot read %s: %v", event.Name, err)
+				}
+				continue
+			}
+			id, ok := s.itemFileID(event.Name)
+			if !ok || filepath.Clean(event.Name) != filepath.Clean(s.itemFilename(id)) {
+				continue
+			}
+			s.log.Debugf("CHANGING  %s (%s)...", event.Name, event.Op)
+			changed(id)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.log.Errorf("Error watching %s: %v", s.path, err)
+		case <-timer.C:
+			ids := make([]string, 0, len(pending))
+			for id := range pending {
+				ids = append(ids, id)
+			}
+			pending = make(map[string]bool)
+			s.reloadItems(ids)
+		}
+	}
+} //store.watchEvents()
+
+//fileState is what pollDir compares to see that a file changed
+type fileState struct {
+	modTime time.Time
+	size    int64 //-1 when the file does not exist
+}
+
+//pollDir checks all files at the poll interval and reloads each changed file
+//after its modification time and size did not change for the debounce time
+//The files are listed and checked without locking the store, starting from
+//the states of the files loaded by watchDir().
+func (s *store) pollDir(states map[string]fileState, debounce time.Duration, interval time.Duration, stop chan struct{}) {
+	defer s.watching.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	changing := make(map[string]time.Time) //when each changing file was last seen to change
+	for {
+		select {
+		case <-stop:
+			s.log.Debugf("Stopped scanning %s", s.path)
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		settled := make([]string, 0)
+		newStates := make(map[string]fileState, len(states))
+		check := func(id string, state fileState) {
+			newStates[id] = state
+			if old, ok := states[id]; !ok || old.size != state.size || !old.modTime.Equal(state.modTime) {
+				s.log.Debugf("CHANGING  %s...", s.itemFilename(id))
+				changing[id] = now
+				return
+			}
+			if since, ok := changing[id]; ok && now.Sub(since) >= debounce {
+				settled = append(settled, id)
+				delete(changing, id)
+			}
+		}
+		if err := s.walkItemFiles(func(id string, filename string) bool {
+			state := fileState{size: -1}
+			if info, err := os.Stat(filename); err == nil {
+				state = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+			check(id, state)
+			return true
+		}); err != nil {
+			s.log.Errorf("Cannot read %s: %+v", s.path, err)
+			continue
+		}
+		//files that were removed are checked until they are reloaded
+		for id, old := range states {
+			_, exists := newStates[id]
+			_, isChanging := changing[id]
+			if !exists && (old.size >= 0 || isChanging) {
+				check(id, fileState{size: -1})
+			}
+		}
+		for id := range changing {
+			if _, ok := newStates[id]; !ok {
+				delete(changing, id)
+			}
+		}
+		states = newStates
+		if len(settled) > 0 {
+			s.reloadItems(settled)
+		}
+	}
+} //store.pollDir()
+
+//validFilename is the last valid version of the item file, in the same shard as the item
+func (s *store) validFilename(id string) string {
+	dir := s.path + "/" + validDir
+	if shardDir := s.shardDir(id); shardDir != "" {
+		dir += "/" + shardDir
+	}
+	return dir + "/" + filepath.Base(s.itemFilename(id))
+}
+
+//keepValid writes the last valid version of the item file
+func (s *store) keepValid(id string, data []byte) error {
+	fn := s.validFilename(id)
+	if err := mkdir(filepath.Dir(fn)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fn, data, s.fileMode); err != nil {
+		return logger.Wrapf(err, "cannot keep %s", fn)
+	}
+	return nil
+}
+
+//reloadItems applies external changes to the item files
+func (s *store) reloadItems(ids []string) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+
+	done := make(map[string]bool)
+	for _, id := range ids {
+		if done[id] {
+			continue
+		}
+		done[id] = true
+		//files written by the store are not reported, so that
+		//restoring a file does not remove its error report
+		n, err := s.reloadItem(id)
+		if err != nil || n != nil {
+			s.reportFile(s.itemFilename(id), err)
+		}
+		if n != nil {
+			notifications = append(notifications, *n)
+		}
+	}
+} //store.reloadItems()
+
+//reloadItem compares the item file with what is known and applies the change
+//must be called with the store locked
+func (s *store) reloadItem(id string) (*items.Notification, error) {
+	fn := s.itemFilename(id)
+	sum, isKnown := s.known[id]
+	jsonData, err := ioutil.ReadFile(fn)
+	removed := os.IsNotExist(err)
+	if err != nil && !removed {
+		return nil, logger.Wrapf(err, "cannot read file")
+	}
+	if !removed && isKnown && md5.Sum(jsonData) == sum {
+		return nil, nil //written by the store
+	}
+	if removed && !isKnown {
+		return nil, nil //deleted through the store
+	}
+	var old fileItem
+	if isKnown {
+		validData, err := ioutil.ReadFile(s.validFilename(id))
+		if err == nil {
+			old, err = s.decodeFileItem(s.validFilename(id), id, validData)
+		}
+		if err != nil {
+			return nil, logger.Wrapf(err, "cannot read last valid version")
+		}
+	}
+	if removed {
+		if err := s.hooks.CheckDel(id, old.Item); err != nil {
+			//the file is already gone, so put it back
+			if werr := s.writeItemFile(old); werr != nil {
+				return nil, logger.Wrapf(werr, "cannot restore file after del rejected: %v", err)
+			}
+			return nil, logger.Wrapf(err, "del rejected, restored the file")
+		}
+		if err := s.keepVersion(historyItem{ID: id, Item: old.Item, Meta: old.Meta, Replaced: time.Now(), Deleted: true}); err != nil {
+			s.log.Errorf("Cannot keep history of %s.id=%s: %+v", s.itemName, id, err)
+		}
+		delete(s.known, id)
+		os.Remove(s.validFilename(id))
+		s.ids.remove(id)
+		s.keyIndex.Remove(id)
+		s.cache.remove(id)
+		delete(s.expiry, id)
+		s.logChange(items.ChangeDel, id)
+		s.log.Debugf("RELOAD DEL(%s)", id)
+		return &items.Notification{Op: items.ChangeDel, ID: id, Item: old.Item}, nil
+	}
+
+	n, err := s.applyItemFile(fn, id, jsonData, old, isKnown)
+	if err == nil {
+		return n, nil
+	}
+
+	//a rejected file must not be returned by Get(), so it is kept under a name
+	//that is not loaded, then the last valid version of a changed file is restored
+	rejectedFilename := fn + ".rejected"
+	if isKnown {
+		if werr := ioutil.WriteFile(rejectedFilename, jsonData, s.fileMode); werr != nil {
+			return nil, logger.Wrapf(werr, "cannot keep rejected file after: %v", err)
+		}
+		if werr := s.writeItemFile(old); werr != nil {
+			return nil, logger.Wrapf(werr, "cannot restore file after: %v", err)
+		}
+		return nil, logger.Wrapf(err, "kept the file as %s and restored the last valid version", filepath.Base(rejectedFilename))
+	}
+	if rerr := os.Rename(fn, rejectedFilename); rerr != nil {
+		return nil, logger.Wrapf(rerr, "cannot move file aside after: %v", err)
+	}
+	s.ids.remove(id)
+	s.keyIndex.Remove(id)
+	s.cache.remove(id)
+	delete(s.expiry, id)
+	return nil, logger.Wrapf(err, "moved the file to %s", filepath.Base(rejectedFilename))
+} //store.reloadItem()
+
+//applyItemFile validates the changed contents of an item file and applies it to the store
+//must be called with the store locked
+func (s *store) applyItemFile(fn string, id string, jsonData []byte, old fileItem, isKnown bool) (*items.Notification, error) {
+	fi, err := s.decodeFileItem(fn, id, jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkUnique(id, fi.Item); err != nil {
+		return nil, err
+	}
+	if keyID, err := s.keyID(fi.Item); err != nil {
+		return nil, err
+	} else if keyID != "" && keyID != id {
+		return nil, logger.Wrapf(nil, "file name does not match %s=%s", s.idKey, keyID)
+	}
+
+	//metadata is managed by the store, so the file is rewritten with it
+	if !isKnown {
+		if err := s.hooks.CheckAdd(fi.Item); err != nil {
+			return nil, logger.Wrapf(err, "add rejected")
+		}
+		fi.Meta = items.NewMeta("")
+		if err := s.writeItemFile(fi); err != nil {
+			return nil, err
+		}
+		idgen.Resume(s.idGen, id)
+		s.logChange(items.ChangeAdd, id)
+		s.log.Debugf("RELOAD ADD(%s)", id)
+		return &items.Notification{Op: items.ChangeAdd, ID: id, Item: fi.Item}, nil
+	}
+	if reflect.DeepEqual(old.Item, fi.Item) {
+		s.reportFile(fn, nil)
+		return nil, s.writeItemFile(old)
+	}
+	if err := s.hooks.CheckUpd(id, old.Item, fi.Item); err != nil {
+		return nil, logger.Wrapf(err, "upd rejected")
+	}
+	if err := s.keepVersion(historyItem{ID: id, Item: old.Item, Meta: old.Meta, Replaced: time.Now()}); err != nil {
+		return nil, logger.Wrapf(err, "cannot keep history")
+	}
+	fi.Meta = old.Meta.NextRev("")
+	if err := s.writeItemFile(fi); err != nil {
+		return nil, err
+	}
+	s.logChange(items.ChangeUpd, id)
+	s.log.Debugf("RELOAD UPD(%s)", id)
+	return &items.Notification{Op: items.ChangeUpd, ID: id, Item: fi.Item, Old: old.Item}, nil
+} //store.applyItemFile()
+
+//reportFile writes the error to <file>.err or removes an old .err file on success
+func (s *store) reportFile(fn string, err error) {
+	errorFilename := strings.TrimSuffix(fn, s.codec.Ext()) + ".err"
+	if err == nil {
+		os.Remove(errorFilename)
+		return
+	}
+	s.log.Errorf("Reload %s failed: %v", fn, err)
+	if werr := ioutil.WriteFile(errorFilename, []byte(fmt.Sprintf("Reload failed: %+v", err)), 0660); werr != nil {
+		s.log.Errorf("Failed to create %s: %+v", errorFilename, werr)
+	}
+}
+
+//itemFileIDs lists the ids of all item files in the directory, or in all shards
+func (s *store) itemFileIDs() []string {
+	ids := make([]string, 0)
+	if err := s.walkItemFiles(func(id string, filename string) bool {
+		ids = append(ids, id)
+		return true
+	}); err != nil {
+		s.log.Errorf("Cannot read %s: %+v", s.path, err)
+	}
+	return ids
+}
+
+//itemFileID returns the id from an item file name, ignoring other files, e.g. <name>_<id>.json.tmp
+func (s *store) itemFileID(fn string) (string, bool) {
+	parts := s.filenameRegex.FindStringSubmatch(filepath.Base(fn))
+	if len(parts) < 2 || filepath.Base(fn) != filepath.Base(s.itemFilename(parts[1])) {
+		return "", false
+	}
+	return parts[1], true
+}
@@ -0,0 +1,390 @@
+//Package memory implements a IItem store that keeps the items in memory only
+//It behaves like the jsonfile store without the file, for tests and caches.
+package memory
+
+import (
+	"reflect"
+	"regexp"
+	"sync"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/changelog"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+var (
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-_]*[a-zA-Z0-9]$`)
+)
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+type IIDGenerator interface {
+	NewID() string
+}
+
+//New makes a new items.IStore in memory
+func New(name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(name, tmpl)
+}
+
+//NewWithOptions makes a new items.IStore in memory, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	if len(name) == 0 || !validName.MatchString(name) {
+		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
+	}
+	if tmpl == nil {
+		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
+	}
+	if _, ok := tmpl.(items.IItemWithID); ok {
+		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
+	}
+	s := &store{
+		itemName:   name,
+		itemTmpl:   tmpl,
+		itemType:   reflect.TypeOf(tmpl),
+		idGen:      idgen.UUIDv4(),
+		itemList:   make([]memItem, 0),
+		itemByID:   make(map[string]memItem),
+		uniqueKeys: make(common.KeyFuncs),
+		hooks:      items.NewHooks(),
+		notifier:   items.NewNotifier(items.NotifySync),
+		log:        log,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+	s.keyIndex = common.NewIndex(s.itemName)
+	s.changes, _ = changelog.Open("", changelog.DefaultSize) //cannot fail without a file
+	s.log.Debugf("Created memory store of %ss", s.itemName)
+	return s, nil
+} //NewWithOptions()
+
+//store implements items.IStore in memory
+type store struct {
+	mutex      sync.Mutex
+	itemName   string
+	itemTmpl   items.IItem
+	itemType   reflect.Type
+	idGen      IIDGenerator
+	itemList   []memItem          //in the order added
+	itemByID   map[string]memItem //same items as itemList
+	keyIndex   *common.Index
+	uniqueKeys common.KeyFuncs //in addition to IItemWithUniqueKeys
+	idKey      string          //unique key used as id, "" to generate ids
+	changes    *changelog.Log
+	hooks      *items.Hooks
+	notifier   *items.Notifier
+	log        logger.ILogger
+	closed     bool
+}
+
+//memItem is an item with its id and metadata
+type memItem struct {
+	ID   string
+	Item items.IItem
+	Meta items.Meta
+}
+
+//Name ...
+func (s *store) Name() string {
+	return s.itemName
+}
+
+//Type ...
+func (s *store) Type() reflect.Type {
+	return s.itemType
+}
+
+//StructType ...
+func (s *store) StructType() reflect.Type {
+	if s.itemType.Kind() == reflect.Ptr {
+		return s.itemType.Elem()
+	}
+	return s.itemType
+}
+
+//Tmpl ...
+func (s *store) Tmpl() items.IItem {
+	return s.itemTmpl
+}
+
+func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	if item == nil {
+		return "", logger.Wrapf(nil, "cannot add nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return "", logger.Wrapf(err, "cannot add invalid item")
+	}
+
+	if err := s.keyIndex.Check("", s.uniqueKeys.Keys(item)); err != nil {
+		return "", logger.Wrapf(err, "cannot add duplicate")
+	}
+
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+
+	//use the id from the item key, or assign a new unique id
+	keyID, err := s.keyID(item)
+	if err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if keyID != "" {
+		if id != "" && id != keyID {
+			return "", logger.Wrapf(nil, "cannot add %s.id=%s with %s=%s", s.itemName, id, s.idKey, keyID)
+		}
+		id = keyID
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
+	if _, ok := s.itemByID[id]; ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
+	}
+
+	newItem := memItem{ID: id, Item: item, Meta: items.NewMeta(actor)}
+	s.itemList = append(s.itemList, newItem)
+	s.itemByID[id] = newItem
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.logChange(items.ChangeAdd, id)
+
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
+	return id, nil
+} //store.add()
+
+func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if item == nil {
+		return logger.Wrapf(nil, "cannot upd nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "cannot upd invalid item")
+	}
+
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
+		return logger.Wrapf(err, "upd will make a duplicate")
+	}
+	if keyID, err := s.keyID(item); err != nil || (keyID != "" && keyID != id) {
+		return logger.Wrapf(err, "cannot upd %s.id=%s to %s=%s", s.itemName, id, s.idKey, keyID)
+	}
+
+	updIndex := -1
+	for index, memItem := range s.itemList {
+		if memItem.ID == id {
+			updIndex = index
+			break
+		}
+	}
+	if updIndex < 0 {
+		return logger.Wrapf(nil, "id=%s does not exist", id)
+	}
+	old := s.itemList[updIndex]
+	if err := s.hooks.CheckUpd(id, old.Item, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(old.Item))
+	updated := memItem{ID: id, Item: item, Meta: old.Meta.NextRev(actor)}
+	s.itemList[updIndex] = updated
+	s.itemByID[id] = updated
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.logChange(items.ChangeUpd, id)
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: old.Item})
+	return nil
+} //store.UpdBy()
+
+func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	deleted, ok := s.itemByID[id]
+	if !ok {
+		return nil //not found also return success
+	}
+	if err := s.hooks.CheckDel(id, deleted.Item); err != nil {
+		return logger.Wrapf(err, "cannot del %s", s.itemName)
+	}
+
+	updatedList := make([]memItem, 0, len(s.itemList))
+	for _, memItem := range s.itemList {
+		if memItem.ID != id {
+			updatedList = append(updatedList, memItem)
+		}
+	}
+	s.itemList = updatedList
+	delete(s.itemByID, id)
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(deleted.Item))
+	s.logChange(items.ChangeDel, id)
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deleted.Item})
+	return nil
+} //store.Del()
+
+func (s *store) Get(id string) (items.IItem, error) {
+	item, _, err := s.GetWithMeta(id)
+	return item, err
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+
+	existing, ok := s.itemByID[id]
+	if !ok {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return existing.Item, existing.Meta, nil
+}
+
+func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	//walk the items in the order added, like the jsonfile store walks its file
+	for _, memItem := range s.itemList {
+		if filter != nil {
+			if err := memItem.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: memItem.ID, Item: memItem.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.Find()
+
+func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
+	//walk the items to return first match
+	s.log.Debugf("%s.GetBy(%+v)", s.Name(), key)
+	for _, memItem := range s.itemList {
+		if memItem.Item.MatchKey(key) {
+			return memItem.ID, memItem.Item, nil
+		}
+	}
+	return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+} //store.GetBy()
+
+//keyID returns the id derived from the item key, or "" when ids are not derived from keys
+func (s *store) keyID(item items.IItem) (string, error) {
+	if s.idKey == "" {
+		return "", nil
+	}
+	return common.KeyID(s.itemName, s.uniqueKeys.Keys(item), s.idKey)
+}
+
+//Seq returns the sequence of the last change
+func (s *store) Seq() uint64 {
+	return s.changes.Seq()
+}
+
+//ChangesSince returns the changes made after seq
+func (s *store) ChangesSince(seq uint64) ([]items.Change, error) {
+	return s.changes.Since(seq)
+}
+
+//logChange records a change that was already applied
+func (s *store) logChange(op items.ChangeOp, id string) {
+	if _, err := s.changes.Append(op, id); err != nil {
+		s.log.Errorf("Failed to log %s.%s(%s): %+v", s.itemName, op, id, err)
+	}
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+func (s *store) Uses(fieldName string, itemStore items.IStore) error {
+	return logger.Wrapf(nil, "Not yet implemented")
+}
+
+//Close delivers queued notifications, after which the items are no longer accessible
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.notifier.Close()
+	s.log.Debugf("Closed %s memory store", s.itemName)
+	return nil
+} //store.Close()
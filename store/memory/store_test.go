@@ -0,0 +1,70 @@
+package memory_test
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/storetest"
+	"github.com/jansemmelink/items2/store/jsonfile"
+	"github.com/jansemmelink/items2/store/memory"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func() (items.IStore, error) {
+		return memory.New("user", storetest.User{})
+	})
+}
+
+//TestSameAsJSONFile makes the same changes to a jsonfile and a memory store
+func TestSameAsJSONFile(t *testing.T) {
+	os.MkdirAll("./share", 0770)
+	filename := "./share/same.json"
+	os.Remove(filename)
+	seq, _ := idgen.Sequential("")
+	fileStore, err := jsonfile.NewWithOptions(filename, "user", storetest.User{}, jsonfile.WithIDGenerator(seq))
+	if err != nil {
+		t.Fatalf("Failed to create jsonfile store: %+v", err)
+	}
+	defer fileStore.Close()
+	seq, _ = idgen.Sequential("")
+	memStore, err := memory.NewWithOptions("user", storetest.User{}, memory.WithIDGenerator(seq))
+	if err != nil {
+		t.Fatalf("Failed to create memory store: %+v", err)
+	}
+	defer memStore.Close()
+
+	results := map[string][]string{}
+	for _, s := range []items.IStore{fileStore, memStore} {
+		result := func(format string, args ...interface{}) {
+			results[fmt.Sprintf("%T", s)] = append(results[fmt.Sprintf("%T", s)], fmt.Sprintf(format, args...))
+		}
+		for _, name := range []string{"C", "A", "B", "A", ""} {
+			id, err := s.Add(storetest.User{Name: name, Rev: 1})
+			result("add %s -> %s %v", name, id, err != nil)
+		}
+		result("upd 1 -> %v", s.Upd("1", storetest.User{Name: "A"}) != nil)
+		result("upd 1 -> %v", s.Upd("1", storetest.User{Name: "D", Rev: 2}) != nil)
+		result("upd 9 -> %v", s.Upd("9", storetest.User{Name: "E"}) != nil)
+		result("del 2 -> %v", s.Del("2"))
+		result("del 9 -> %v", s.Del("9"))
+		id, item, err := s.GetBy(map[string]interface{}{"name": "B"})
+		result("getby B -> %s %+v %v", id, item, err != nil)
+		result("find -> %+v", s.Find(0, nil))
+		result("find 1 rev 2 -> %+v", s.Find(1, storetest.User{Rev: 2}))
+	}
+	if len(results) != 2 {
+		t.Fatalf("Results %+v", results)
+	}
+	var expected []string
+	for _, result := range results {
+		if expected == nil {
+			expected = result
+		} else if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Results differ:\n%v\n%v", expected, result)
+		}
+	}
+}
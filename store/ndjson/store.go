@@ -0,0 +1,524 @@
+//Package ndjson implements a IItem store using a single file with one JSON object per line
+//New items are appended to the file, so it can be followed with tail and searched with grep,
+//while updates and deletes rewrite the file.
+package ndjson
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/filelock"
+	"github.com/jansemmelink/items2/store/idgen"
+	"github.com/jansemmelink/items2/store/internal/common"
+	"github.com/stewelarend/logger"
+)
+
+var log = logger.New()
+
+var (
+	validName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-_]*[a-zA-Z0-9]$`)
+)
+
+//IIDGenerator generates unique ids, see package idgen for implementations
+//generators that implement idgen.IResumable are told the ids loaded from the file
+type IIDGenerator interface {
+	NewID() string
+}
+
+//New makes a new items.IStore using a single NDJSON file
+func New(filename string, name string, tmpl items.IItem) (items.IStore, error) {
+	return NewWithOptions(filename, name, tmpl)
+}
+
+//NewWithOptions makes a new items.IStore using a single NDJSON file, configured with options
+//ids are random UUIDs unless WithIDGenerator() is used
+func NewWithOptions(filename string, name string, tmpl items.IItem, opts ...Option) (items.IStore, error) {
+	filename = path.Clean(filename)
+	if len(name) == 0 || !validName.MatchString(name) {
+		return nil, logger.Wrapf(nil, "New(name==%s) invalid identifier", name)
+	}
+	if tmpl == nil {
+		return nil, logger.Wrapf(nil, "New(tmpl==nil)")
+	}
+	if _, ok := tmpl.(items.IItemWithID); ok {
+		return nil, logger.Wrapf(nil, "%T may not have ID() method.", tmpl)
+	}
+	s := &store{
+		filename:     filename,
+		fileMode:     0666,
+		itemName:     name,
+		itemTmpl:     tmpl,
+		itemType:     reflect.TypeOf(tmpl),
+		fileItemType: fileItemType(reflect.TypeOf(tmpl)),
+		idGen:        idgen.UUIDv4(),
+		indexOfID:    make(map[string]int),
+		uniqueKeys:   make(common.KeyFuncs),
+		hooks:        items.NewHooks(),
+		notifier:     items.NewNotifier(items.NotifySync),
+		log:          log,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, logger.Wrapf(err, "invalid option for %s store", name)
+		}
+	}
+
+	//lock before reading so that no other store writes the file
+	lock, err := filelock.New(strings.TrimSuffix(filename, path.Ext(filename)) + ".lock")
+	if err != nil {
+		return nil, logger.Wrapf(err, "cannot lock NDJSON file %s", filename)
+	}
+	s.lock = lock
+
+	if err := s.readFile(); err != nil {
+		s.lock.Unlock()
+		return nil, logger.Wrapf(err, "cannot access items in NDJSON file %s", filename)
+	}
+
+	//ids loaded from the file must not be generated again
+	for _, fileItem := range s.fileItems {
+		idgen.Resume(s.idGen, fileItem.ID)
+	}
+	s.log.Debugf("Created NDJSON file store of %d %ss from file %s", len(s.fileItems), s.itemName, s.filename)
+	return s, nil
+} //NewWithOptions()
+
+//store implements items.IStore for a file with one JSON object per line
+type store struct {
+	mutex        sync.Mutex
+	filename     string
+	fileMode     os.FileMode
+	itemName     string
+	itemTmpl     items.IItem
+	itemType     reflect.Type
+	fileItemType reflect.Type
+	idGen        IIDGenerator
+	fileItems    []fileItem      //in the order of the lines in the file
+	indexOfID    map[string]int  //in fileItems
+	uniqueKeys   common.KeyFuncs //in addition to IItemWithUniqueKeys
+	keyIndex     *common.Index   //id of each key value
+	hooks        *items.Hooks
+	notifier     *items.Notifier
+	log          logger.ILogger
+	lock         *filelock.Lock
+	closed       bool
+}
+
+//Name ...
+func (s *store) Name() string {
+	return s.itemName
+}
+
+//Type ...
+func (s *store) Type() reflect.Type {
+	return s.itemType
+}
+
+//StructType ...
+func (s *store) StructType() reflect.Type {
+	if s.itemType.Kind() == reflect.Ptr {
+		return s.itemType.Elem()
+	}
+	return s.itemType
+}
+
+//Tmpl ...
+func (s *store) Tmpl() items.IItem {
+	return s.itemTmpl
+}
+
+func (s *store) Add(item items.IItem) (string, error) {
+	return s.AddBy("", item)
+}
+
+//AddBy is Add() recording the actor in the item metadata
+func (s *store) AddBy(actor string, item items.IItem) (string, error) {
+	return s.add(actor, "", item)
+}
+
+//AddWithID is Add() using the id instead of generating one
+func (s *store) AddWithID(id string, item items.IItem) error {
+	if err := items.ValidateID(id); err != nil {
+		return logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	_, err := s.add("", id, item)
+	return err
+}
+
+//add the item with the id, or with a new id when id is ""
+//the item is appended to the file without rewriting the other lines
+func (s *store) add(actor string, id string, item items.IItem) (string, error) {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", items.ErrClosed
+	}
+
+	if item == nil {
+		return "", logger.Wrapf(nil, "cannot add nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return "", logger.Wrapf(err, "cannot add invalid item")
+	}
+	if err := s.keyIndex.Check("", s.uniqueKeys.Keys(item)); err != nil {
+		return "", logger.Wrapf(err, "cannot add duplicate")
+	}
+	if err := s.hooks.CheckAdd(item); err != nil {
+		return "", logger.Wrapf(err, "cannot add %s", s.itemName)
+	}
+	if id == "" {
+		id = s.idGen.NewID()
+	}
+	if _, ok := s.indexOfID[id]; ok {
+		return "", logger.Wrapf(nil, "New %s.id=%s already exists", s.Name(), id)
+	}
+
+	newFileItem := fileItem{ID: id, Item: item, Meta: items.NewMeta(actor)}
+	if err := s.appendLine(newFileItem); err != nil {
+		return "", logger.Wrapf(err, "failed to append to NDJSON file")
+	}
+	s.indexOfID[id] = len(s.fileItems)
+	s.fileItems = append(s.fileItems, newFileItem)
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+
+	s.log.Debugf("ADD(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeAdd, ID: id, Item: item})
+	return id, nil
+} //store.add()
+
+func (s *store) Upd(id string, item items.IItem) error {
+	return s.UpdBy("", id, item)
+}
+
+//UpdBy is Upd() recording the actor in the item metadata
+func (s *store) UpdBy(actor string, id string, item items.IItem) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	if item == nil {
+		return logger.Wrapf(nil, "cannot upd nil item")
+	}
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "cannot upd invalid item")
+	}
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return logger.Wrapf(nil, "id=%s does not exist", id)
+	}
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
+		return logger.Wrapf(err, "upd will make a duplicate")
+	}
+	old := s.fileItems[index]
+	if err := s.hooks.CheckUpd(id, old.Item, item); err != nil {
+		return logger.Wrapf(err, "cannot upd %s", s.itemName)
+	}
+
+	updatedFileItems := append([]fileItem{}, s.fileItems...)
+	updatedFileItems[index] = fileItem{ID: id, Item: item, Meta: old.Meta.NextRev(actor)}
+	if err := s.writeFile(updatedFileItems); err != nil {
+		return logger.Wrapf(err, "failed to update NDJSON file")
+	}
+	s.fileItems = updatedFileItems
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(old.Item))
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	s.log.Debugf("UPD(%s) -> %+v", id, item)
+	notifications = append(notifications, items.Notification{Op: items.ChangeUpd, ID: id, Item: item, Old: old.Item})
+	return nil
+} //store.UpdBy()
+
+func (s *store) Del(id string) error {
+	//deferred first to notify after the lock is released
+	var notifications []items.Notification
+	defer func() { s.notifier.Notify(notifications...) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return items.ErrClosed
+	}
+
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return nil //not found also return success
+	}
+	deleted := s.fileItems[index]
+	if err := s.hooks.CheckDel(id, deleted.Item); err != nil {
+		return logger.Wrapf(err, "cannot del %s", s.itemName)
+	}
+
+	updatedFileItems := append(append([]fileItem{}, s.fileItems[:index]...), s.fileItems[index+1:]...)
+	if err := s.writeFile(updatedFileItems); err != nil {
+		return logger.Wrapf(err, "failed to update NDJSON file")
+	}
+	s.fileItems = updatedFileItems
+	delete(s.indexOfID, id)
+	for i := index; i < len(s.fileItems); i++ {
+		s.indexOfID[s.fileItems[i].ID] = i
+	}
+	s.keyIndex.Del(id, s.uniqueKeys.Keys(deleted.Item))
+	s.log.Debugf("DEL(%s)", id)
+	notifications = append(notifications, items.Notification{Op: items.ChangeDel, ID: id, Item: deleted.Item})
+	return nil
+} //store.Del()
+
+func (s *store) Get(id string) (items.IItem, error) {
+	item, _, err := s.GetWithMeta(id)
+	return item, err
+}
+
+//GetWithMeta returns the item and its store-managed metadata
+func (s *store) GetWithMeta(id string) (items.IItem, items.Meta, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, items.Meta{}, items.ErrClosed
+	}
+
+	index, ok := s.indexOfID[id]
+	if !ok {
+		return nil, items.Meta{}, logger.Wrapf(nil, "%s.id=%s does not exist", s.Name(), id)
+	}
+	return s.fileItems[index].Item, s.fileItems[index].Meta, nil
+}
+
+func (s *store) Find(size int, filter items.IItem) []items.IDAndItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]items.IDAndItem, 0)
+	if s.closed {
+		return list
+	}
+
+	//walk the items to return in the order of the file
+	for _, fileItem := range s.fileItems {
+		if filter != nil {
+			if err := fileItem.Item.Match(filter); err != nil {
+				continue
+			}
+		}
+		list = append(list, items.IDAndItem{ID: fileItem.ID, Item: fileItem.Item})
+		if size > 0 && len(list) >= size {
+			break
+		}
+	}
+	return list
+} //store.Find()
+
+func (s *store) GetBy(key map[string]interface{}) (string, items.IItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return "", nil, items.ErrClosed
+	}
+
+	for _, fileItem := range s.fileItems {
+		if fileItem.Item.MatchKey(key) {
+			return fileItem.ID, fileItem.Item, nil
+		}
+	}
+	return "", nil, logger.Wrapf(nil, "%s{%v} not found", s.itemName, key)
+} //store.GetBy()
+
+func (s *store) Uses(fieldName string, itemStore items.IStore) error {
+	return logger.Wrapf(nil, "Not yet implemented")
+}
+
+//Notifier returns the notifier used to deliver item notifications
+func (s *store) Notifier() *items.Notifier {
+	return s.notifier
+}
+
+//Hooks returns the hooks evaluated before changes are made
+func (s *store) Hooks() *items.Hooks {
+	return s.hooks
+}
+
+//Close delivers queued notifications and releases the file lock
+func (s *store) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.notifier.Close()
+	if err := s.lock.Unlock(); err != nil {
+		return logger.Wrapf(err, "cannot unlock %s", s.filename)
+	}
+	s.log.Debugf("Closed %s store %s", s.itemName, s.filename)
+	return nil
+} //store.Close()
+
+//readFile loads the file one line at a time, creating it if it does not exist
+//all invalid lines are reported with their line numbers
+func (s *store) readFile() error {
+	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_RDONLY, s.fileMode)
+	if err != nil {
+		return logger.Wrapf(err, "cannot open file %s", s.filename)
+	}
+	defer f.Close()
+
+	s.fileItems = nil
+	s.indexOfID = make(map[string]int)
+	s.keyIndex = common.NewIndex(s.itemName)
+	problems := []string{}
+	reader := bufio.NewReader(f)
+	for lineNr := 1; ; lineNr++ {
+		//ReadBytes rather than a Scanner, which limits the length of a line
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return logger.Wrapf(readErr, "cannot read line %d of %s", lineNr, s.filename)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err := s.loadLine(line); err != nil {
+				problems = append(problems, fmt.Sprintf("%s:%d: %v", s.filename, lineNr, err))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if len(problems) > 0 {
+		return logger.Wrapf(nil, "%d invalid lines:\n%s", len(problems), strings.Join(problems, "\n"))
+	}
+	return nil
+} //store.readFile()
+
+//loadLine decodes and validates one line of the file and adds its item to the store
+func (s *store) loadLine(line []byte) error {
+	//using the store's fileItemType (including _id)
+	fileItemPtrValue := reflect.New(s.fileItemType)
+	if err := json.Unmarshal(line, fileItemPtrValue.Interface()); err != nil {
+		return logger.Wrapf(err, "cannot decode %s", s.itemName)
+	}
+	fileItemValue := fileItemPtrValue.Elem()
+	id := fileItemValue.Field(0).Interface().(string)
+	if len(id) == 0 {
+		return logger.Wrapf(nil, "missing id")
+	}
+	if _, ok := s.indexOfID[id]; ok {
+		return logger.Wrapf(nil, "duplicate id=%s", id)
+	}
+	if itemValue := fileItemValue.Field(1); itemValue.Kind() == reflect.Ptr && itemValue.IsNil() {
+		return logger.Wrapf(nil, "id=%s has no item data", id)
+	}
+	item := fileItemValue.Field(1).Interface().(items.IItem)
+	if err := item.Validate(); err != nil {
+		return logger.Wrapf(err, "invalid %s.id=%s", s.itemName, id)
+	}
+	if err := s.keyIndex.Check(id, s.uniqueKeys.Keys(item)); err != nil {
+		return logger.Wrapf(err, "%s.id=%s", s.itemName, id)
+	}
+	meta := fileItemValue.Field(2).Interface().(items.Meta)
+	s.indexOfID[id] = len(s.fileItems)
+	s.fileItems = append(s.fileItems, fileItem{ID: id, Item: item, Meta: meta})
+	s.keyIndex.Add(id, s.uniqueKeys.Keys(item))
+	return nil
+} //store.loadLine()
+
+//appendLine writes the item as a new line at the end of the file
+//a partly written line is removed again, so that the file stays readable
+func (s *store) appendLine(fi fileItem) error {
+	line, err := json.Marshal(fi)
+	if err != nil {
+		return logger.Wrapf(err, "failed to JSON encode %s", s.itemName)
+	}
+	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, s.fileMode)
+	if err != nil {
+		return logger.Wrapf(err, "cannot open file %s", s.filename)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return logger.Wrapf(err, "cannot stat file %s", s.filename)
+	}
+
+	//start on a new line if the file was edited without a final newline
+	if size := info.Size(); size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err != nil {
+			return logger.Wrapf(err, "cannot read file %s", s.filename)
+		}
+		if last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Truncate(info.Size())
+		return logger.Wrapf(err, "failed to write to file %s", s.filename)
+	}
+	return nil
+} //store.appendLine()
+
+//writeFile replaces the file with all the items, one per line
+//the items are written to a temporary file that is then renamed, so that
+//readers never see a partly written file
+func (s *store) writeFile(fileItems []fileItem) error {
+	tmpFilename := s.filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode)
+	if err != nil {
+		return logger.Wrapf(err, "failed to create file %s", tmpFilename)
+	}
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer) //Encode() ends each item with a newline
+	for _, fi := range fileItems {
+		if err = encoder.Encode(fi); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return logger.Wrapf(err, "failed to write file %s", tmpFilename)
+	}
+	if err := os.Rename(tmpFilename, s.filename); err != nil {
+		os.Remove(tmpFilename)
+		return logger.Wrapf(err, "failed to replace file %s", s.filename)
+	}
+	return nil
+} //store.writeFile()
+
+//fileItem is one line in the file
+//the field order is used when reading: 0=ID, 1=Item, 2=Meta
+type fileItem struct {
+	ID   string      `json:"_id"`
+	Item items.IItem `json:"item"`
+	Meta items.Meta  `json:"_meta"`
+}
+
+//fileItemType is fileItem with the user item type instead of the IItem interface,
+//so that lines can be decoded into the user item type
+func fileItemType(itemType reflect.Type) reflect.Type {
+	structFields := make([]reflect.StructField, 0)
+	t := reflect.TypeOf(fileItem{})
+	for i := 0; i < t.NumField(); i++ {
+		structFields = append(structFields, t.Field(i))
+	}
+	structFields[1].Type = itemType
+	return reflect.StructOf(structFields)
+}
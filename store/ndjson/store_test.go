@@ -0,0 +1,166 @@
+package ndjson_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	items "github.com/jansemmelink/items2"
+	"github.com/jansemmelink/items2/store/ndjson"
+	"github.com/stewelarend/logger"
+)
+
+func TestMain(m *testing.M) {
+	os.MkdirAll("./share", 0770)
+	os.Exit(m.Run())
+}
+
+type user struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (u user) Validate() error {
+	if len(u.Name) == 0 {
+		return logger.Wrapf(nil, "user.name not specified")
+	}
+	return nil
+}
+
+func (u user) Match(filter items.IItem) error {
+	if f, ok := filter.(user); ok && f.Name != "" && f.Name != u.Name {
+		return logger.Wrapf(nil, "name does not match")
+	}
+	return nil
+}
+
+func (u user) MatchKey(key map[string]interface{}) bool {
+	name, ok := key["name"]
+	return ok && name == u.Name
+}
+
+//lines returns the non-empty lines of the file
+func lines(t *testing.T, filename string) []string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Cannot read %s: %v", filename, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestStore(t *testing.T) {
+	filename := "./share/users.ndjson"
+	os.Remove(filename)
+	s, err := ndjson.NewWithOptions(filename, "user", user{},
+		ndjson.WithUniqueKey("name", func(item items.IItem) interface{} { return item.(user).Name }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create store: %+v", err)
+	}
+	ids := []string{}
+	for _, name := range []string{"A", "B", "C"} {
+		id, err := s.Add(user{Name: name})
+		if err != nil {
+			t.Fatalf("Failed to add %s: %+v", name, err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := s.Add(user{Name: "B"}); err == nil {
+		t.Fatalf("Added duplicate name")
+	}
+
+	//one object per line, in the order added
+	fileLines := lines(t, filename)
+	if len(fileLines) != 3 {
+		t.Fatalf("File has %d lines instead of 3", len(fileLines))
+	}
+	var line struct {
+		ID   string `json:"_id"`
+		Item user   `json:"item"`
+	}
+	if err := json.Unmarshal([]byte(fileLines[1]), &line); err != nil || line.ID != ids[1] || line.Item.Name != "B" {
+		t.Fatalf("Line 2 is %s: %v", fileLines[1], err)
+	}
+
+	if err := s.Upd(ids[1], user{Name: "A"}); err == nil {
+		t.Fatalf("Updated to duplicate name")
+	}
+	if err := s.Upd(ids[1], user{Name: "B", Age: 2}); err != nil {
+		t.Fatalf("Failed to update: %+v", err)
+	}
+	if err := s.Del(ids[0]); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	if _, err := s.Add(user{Name: "A"}); err != nil {
+		t.Fatalf("Failed to add deleted name again: %+v", err)
+	}
+	if id, item, err := s.GetBy(map[string]interface{}{"name": "C"}); err != nil || id != ids[2] || item.(user).Name != "C" {
+		t.Fatalf("GetBy -> %s %+v %v", id, item, err)
+	}
+	s.Close()
+
+	//reopen to load the file
+	s, err = ndjson.New(filename, "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	list := s.Find(0, nil)
+	if len(list) != 3 || list[0].ID != ids[1] || list[0].Item.(user).Age != 2 || list[2].Item.(user).Name != "A" {
+		t.Fatalf("Find -> %+v", list)
+	}
+	if _, err := s.Get(ids[0]); err == nil {
+		t.Fatalf("Got deleted item")
+	}
+	if list := s.Find(0, user{Name: "C"}); len(list) != 1 || list[0].ID != ids[2] {
+		t.Fatalf("Find(C) -> %+v", list)
+	}
+}
+
+func TestInvalidLines(t *testing.T) {
+	filename := "./share/invalid.ndjson"
+	ioutil.WriteFile(filename, []byte(`{"_id":"1","item":{"name":"A"}}
+
+{"_id":"2","item":{"name":""}}
+{"_id":"1","item":{"name":"B"}}
+{"_id":"3","item":{"name":"C","age":"x"}}
+not json
+{"_id":"4","item":{"name":"D"}}
+`), 0666)
+	_, err := ndjson.New(filename, "user", user{})
+	if err == nil {
+		t.Fatalf("Opened file with invalid lines")
+	}
+	msg := fmt.Sprintf("%v", err)
+	for _, expected := range []string{"invalid.ndjson:3:", "invalid.ndjson:4: duplicate id=1", "invalid.ndjson:5:", "invalid.ndjson:6:"} {
+		if !strings.Contains(msg, expected) {
+			t.Fatalf("Error does not contain \"%s\": %s", expected, msg)
+		}
+	}
+	if strings.Contains(msg, "invalid.ndjson:7:") {
+		t.Fatalf("Error reports a valid line: %v", err)
+	}
+}
+
+func TestAppendAfterEdit(t *testing.T) {
+	//an edited file without a final newline
+	filename := "./share/edited.ndjson"
+	ioutil.WriteFile(filename, []byte(`{"_id":"1","item":{"name":"A"}}`), 0666)
+	s, err := ndjson.New(filename, "user", user{})
+	if err != nil {
+		t.Fatalf("Failed to open store: %+v", err)
+	}
+	defer s.Close()
+	if _, err := s.Add(user{Name: "B"}); err != nil {
+		t.Fatalf("Failed to add: %+v", err)
+	}
+	if fileLines := lines(t, filename); len(fileLines) != 2 || !strings.HasPrefix(fileLines[1], "{") {
+		t.Fatalf("File has lines %+v", fileLines)
+	}
+	if err := s.(items.IStoreWithID).AddWithID("1", user{Name: "C"}); err == nil {
+		t.Fatalf("Added existing id")
+	}
+}
@@ -0,0 +1,22 @@
+package items
+
+import "time"
+
+//TTL returns the time to live of the item, which is its own TTL() if
+//it implements IItemWithTTL, else the store TTL, 0 meaning no expiry
+func TTL(item IItem, storeTTL time.Duration) time.Duration {
+	if itemWithTTL, ok := item.(IItemWithTTL); ok {
+		return itemWithTTL.TTL()
+	}
+	return storeTTL
+}
+
+//IsExpired is true when the item was last added or updated more than its TTL before now
+//items without an update time in their metadata do not expire
+func IsExpired(item IItem, meta Meta, storeTTL time.Duration, now time.Time) bool {
+	ttl := TTL(item, storeTTL)
+	if ttl <= 0 || meta.Updated.IsZero() {
+		return false
+	}
+	return now.After(meta.Updated.Add(ttl))
+}
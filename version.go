@@ -0,0 +1,30 @@
+package items
+
+import "time"
+
+//Version is one version of an item kept by a store with history
+type Version struct {
+	Item     IItem
+	Meta     Meta
+	Replaced time.Time //when this version was replaced or deleted, zero for the current version
+	Deleted  bool      //true when the version was deleted rather than replaced
+}
+
+//ValidAt is true when this was the version of the item at time t
+func (v Version) ValidAt(t time.Time) bool {
+	if v.Meta.Updated.After(t) {
+		return false
+	}
+	return v.Replaced.IsZero() || t.Before(v.Replaced)
+}
+
+//VersionAt returns the version valid at time t from a list of versions
+//ordered oldest first, or false if the item did not exist at that time
+func VersionAt(versions []Version, t time.Time) (Version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].ValidAt(t) {
+			return versions[i], true
+		}
+	}
+	return Version{}, false
+}